@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const peersFile = "./tmp/peers_%s.dat"
+
+// The address book keeps addresses we have only heard about in "new" buckets
+// and addresses we have successfully connected to in "tried" buckets, as in
+// Bitcoin Core's addrman. Bucket placement is keyed by a secret per-book key
+// so a peer cannot predict which entries its addresses would evict.
+const (
+	newBucketCount   = 256
+	triedBucketCount = 64
+	bucketSize       = 64
+
+	maxAddrFailures   = 10
+	addrHorizon       = 30 * 24 * time.Hour
+	baseRetryInterval = time.Second
+	maxRetryInterval  = 10 * time.Minute
+)
+
+// KnownAddress is an address book entry.
+type KnownAddress struct {
+	Addr        *NetAddress
+	Source      string // address of the peer that told us about Addr
+	Attempts    int    // failed connection attempts since the last success
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Tried       bool
+}
+
+// retryBackoff is how long to wait before the next connection attempt after
+// attempts consecutive failures.
+func retryBackoff(attempts int) time.Duration {
+	if attempts > 20 {
+		return maxRetryInterval
+	}
+	d := baseRetryInterval << attempts
+	if d > maxRetryInterval {
+		return maxRetryInterval
+	}
+	return d
+}
+
+// ready reports whether enough time has passed since the last failed attempt.
+func (ka *KnownAddress) ready(now time.Time) bool {
+	if ka.Attempts == 0 {
+		return true
+	}
+	return now.After(ka.LastAttempt.Add(retryBackoff(ka.Attempts)))
+}
+
+// terrible reports whether the entry is not worth keeping: it is old, or we
+// keep failing to connect to it.
+func (ka *KnownAddress) terrible(now time.Time) bool {
+	if now.Sub(time.Unix(int64(ka.Addr.Timestamp), 0)) > addrHorizon {
+		return true
+	}
+	return ka.Attempts >= maxAddrFailures && now.Sub(ka.LastSuccess) > 7*24*time.Hour
+}
+
+type AddrBook struct {
+	path string // empty for a book that is never saved
+
+	mu         sync.Mutex
+	key        [32]byte
+	addrs      map[string]*KnownAddress
+	newTable   [newBucketCount]map[string]*KnownAddress
+	triedTable [triedBucketCount]map[string]*KnownAddress
+}
+
+// NewAddrBook returns an empty address book that is saved to path, or kept in
+// memory only if path is empty.
+func NewAddrBook(path string) *AddrBook {
+	book := &AddrBook{
+		path:  path,
+		addrs: make(map[string]*KnownAddress),
+	}
+	for i := range book.newTable {
+		book.newTable[i] = make(map[string]*KnownAddress)
+	}
+	for i := range book.triedTable {
+		book.triedTable[i] = make(map[string]*KnownAddress)
+	}
+	if _, err := rand.Read(book.key[:]); err != nil {
+		log.Panic(err)
+	}
+
+	return book
+}
+
+// addrBookFile is the on-disk form of an address book. Buckets are not
+// stored; they are recomputed from the key when the book is loaded.
+type addrBookFile struct {
+	Key   [32]byte
+	Addrs []*KnownAddress
+}
+
+// LoadAddrBook opens nodeID's address book, which lives next to its chain
+// database. A missing file yields an empty book.
+func LoadAddrBook(nodeID string) (*AddrBook, error) {
+	path := fmt.Sprintf(peersFile, nodeID)
+	book := NewAddrBook(path)
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file addrBookFile
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&file); err != nil {
+		return nil, fmt.Errorf("corrupt address book %s: %w", path, err)
+	}
+
+	book.key = file.Key
+	for _, ka := range file.Addrs {
+		if ka.Tried {
+			book.addTried(ka)
+		} else {
+			book.addNew(ka)
+		}
+	}
+
+	return book, nil
+}
+
+// Save writes the address book to its file.
+func (book *AddrBook) Save() error {
+	if book.path == "" {
+		return nil
+	}
+
+	book.mu.Lock()
+	file := addrBookFile{Key: book.key}
+	for _, ka := range book.addrs {
+		file.Addrs = append(file.Addrs, ka)
+	}
+
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(file)
+	book.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := book.path + ".new"
+	if err := os.WriteFile(tmp, content.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, book.path)
+}
+
+// addrGroup is the network group an address belongs to: the /16 for IPv4 and
+// the /32 for IPv6. Buckets are chosen by group so that one operator with many
+// addresses in the same range can only fill a few of them.
+func addrGroup(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[:2]
+	}
+	return ip.To16()[:4]
+}
+
+func (book *AddrBook) bucket(count int, parts ...[]byte) int {
+	h := sha256.New()
+	h.Write(book.key[:])
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return int(binary.LittleEndian.Uint64(h.Sum(nil)) % uint64(count))
+}
+
+func (book *AddrBook) newBucket(ka *KnownAddress) int {
+	source := []byte(ka.Source)
+	if host, _, err := net.SplitHostPort(ka.Source); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			source = addrGroup(ip)
+		}
+	}
+	return book.bucket(newBucketCount, []byte("new"), addrGroup(ka.Addr.IP), source)
+}
+
+func (book *AddrBook) triedBucket(ka *KnownAddress) int {
+	return book.bucket(triedBucketCount, []byte("tried"), []byte(ka.Addr.String()))
+}
+
+// addNew places ka in its new bucket, making room by evicting a terrible
+// entry or else the one seen longest ago.
+func (book *AddrBook) addNew(ka *KnownAddress) {
+	key := ka.Addr.String()
+	bucket := book.newTable[book.newBucket(ka)]
+
+	if len(bucket) >= bucketSize {
+		var victim *KnownAddress
+		now := time.Now()
+		for _, other := range bucket {
+			if other.terrible(now) {
+				victim = other
+				break
+			}
+			if victim == nil || other.Addr.Timestamp < victim.Addr.Timestamp {
+				victim = other
+			}
+		}
+		victimKey := victim.Addr.String()
+		delete(bucket, victimKey)
+		delete(book.addrs, victimKey)
+	}
+
+	ka.Tried = false
+	bucket[key] = ka
+	book.addrs[key] = ka
+}
+
+// addTried places ka in its tried bucket. If the bucket is full, the entry
+// with the oldest successful connection moves back to the new table.
+func (book *AddrBook) addTried(ka *KnownAddress) {
+	key := ka.Addr.String()
+	bucket := book.triedTable[book.triedBucket(ka)]
+
+	if len(bucket) >= bucketSize {
+		var victim *KnownAddress
+		for _, other := range bucket {
+			if victim == nil || other.LastSuccess.Before(victim.LastSuccess) {
+				victim = other
+			}
+		}
+		delete(bucket, victim.Addr.String())
+		book.addNew(victim)
+	}
+
+	ka.Tried = true
+	bucket[key] = ka
+	book.addrs[key] = ka
+}
+
+// AddAddress records na, learned from the peer at source. Known addresses
+// only have their timestamp refreshed.
+func (book *AddrBook) AddAddress(na *NetAddress, source string) {
+	if na.Port == 0 || na.IP == nil || na.IP.IsUnspecified() {
+		return
+	}
+
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	key := na.String()
+	if ka, ok := book.addrs[key]; ok {
+		if na.Timestamp > ka.Addr.Timestamp {
+			ka.Addr.Timestamp = na.Timestamp
+		}
+		ka.Addr.Services |= na.Services
+		return
+	}
+
+	addr := *na
+	book.addNew(&KnownAddress{Addr: &addr, Source: source})
+}
+
+// Attempt records a connection attempt to addr.
+func (book *AddrBook) Attempt(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if ka, ok := book.addrs[addr]; ok {
+		ka.Attempts++
+		ka.LastAttempt = time.Now()
+	}
+}
+
+// Good records a successful connection to addr and moves it to the tried
+// table.
+func (book *AddrBook) Good(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	ka, ok := book.addrs[addr]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	ka.Attempts = 0
+	ka.LastSuccess = now
+	ka.Addr.Timestamp = uint32(now.Unix())
+
+	if ka.Tried {
+		return
+	}
+	delete(book.newTable[book.newBucket(ka)], addr)
+	book.addTried(ka)
+}
+
+// Select picks an address to connect to, choosing between the tried and new
+// tables with equal probability. Addresses for which skip returns true and
+// addresses still backing off after failed attempts are never returned.
+func (book *AddrBook) Select(skip func(addr string) bool) *KnownAddress {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	now := time.Now()
+	var tried, fresh []*KnownAddress
+	for key, ka := range book.addrs {
+		if skip(key) || !ka.ready(now) {
+			continue
+		}
+		if ka.Tried {
+			tried = append(tried, ka)
+		} else {
+			fresh = append(fresh, ka)
+		}
+	}
+
+	candidates := fresh
+	if len(tried) > 0 && (len(fresh) == 0 || mrand.IntN(2) == 0) {
+		candidates = tried
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	ka := *candidates[mrand.IntN(len(candidates))]
+	return &ka
+}
+
+// Sample returns up to max random addresses to share with a peer.
+func (book *AddrBook) Sample(max int) []*NetAddress {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	now := time.Now()
+	var result []*NetAddress
+	for _, ka := range book.addrs {
+		if ka.terrible(now) {
+			continue
+		}
+		addr := *ka.Addr
+		result = append(result, &addr)
+	}
+
+	mrand.Shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+	if len(result) > max {
+		result = result[:max]
+	}
+	return result
+}
+
+// Size returns the number of addresses in the new and tried tables.
+func (book *AddrBook) Size() (fresh, tried int) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	for _, ka := range book.addrs {
+		if ka.Tried {
+			tried++
+		} else {
+			fresh++
+		}
+	}
+	return fresh, tried
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	banListFile        = "./tmp/banlist_%s.dat"
+	defaultBanDuration = 24 * time.Hour
+)
+
+var ErrBanned = errors.New("address is banned")
+
+// BanEntry bans every address in Subnet until Until.
+type BanEntry struct {
+	Subnet  string
+	Created time.Time
+	Until   time.Time
+	Reason  string
+}
+
+// BanList is the set of banned subnets, kept next to the chain database so
+// bans survive restarts.
+type BanList struct {
+	path string // empty for a list that is never saved
+
+	mu      sync.Mutex
+	entries map[string]*BanEntry
+}
+
+func NewBanList(path string) *BanList {
+	return &BanList{path: path, entries: make(map[string]*BanEntry)}
+}
+
+// LoadBanList opens nodeID's ban list. A missing file yields an empty list.
+func LoadBanList(nodeID string) (*BanList, error) {
+	path := fmt.Sprintf(banListFile, nodeID)
+	bl := NewBanList(path)
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*BanEntry
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("corrupt ban list %s: %w", path, err)
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.Until.After(now) {
+			bl.entries[entry.Subnet] = entry
+		}
+	}
+
+	return bl, nil
+}
+
+// save writes the list to its file. The caller must hold bl.mu.
+func (bl *BanList) save() error {
+	if bl.path == "" {
+		return nil
+	}
+
+	entries := make([]*BanEntry, 0, len(bl.entries))
+	for _, entry := range bl.entries {
+		entries = append(entries, entry)
+	}
+
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(entries); err != nil {
+		return err
+	}
+
+	tmp := bl.path + ".new"
+	if err := os.WriteFile(tmp, content.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bl.path)
+}
+
+// ParseSubnet parses a CIDR subnet or a single IP address, which becomes a
+// /32 (or /128 for IPv6) subnet.
+func ParseSubnet(s string) (*net.IPNet, error) {
+	if _, subnet, err := net.ParseCIDR(s); err == nil {
+		return subnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address or subnet %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Ban bans subnet until until, replacing any existing ban of it.
+func (bl *BanList) Ban(subnet *net.IPNet, until time.Time, reason string) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	key := subnet.String()
+	bl.entries[key] = &BanEntry{Subnet: key, Created: time.Now(), Until: until, Reason: reason}
+	return bl.save()
+}
+
+// Unban lifts the ban of subnet.
+func (bl *BanList) Unban(subnet *net.IPNet) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	key := subnet.String()
+	if _, ok := bl.entries[key]; !ok {
+		return fmt.Errorf("%s is not banned", key)
+	}
+	delete(bl.entries, key)
+	return bl.save()
+}
+
+// Clear lifts every ban.
+func (bl *BanList) Clear() error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.entries = make(map[string]*BanEntry)
+	return bl.save()
+}
+
+// sweep forgets expired bans. The caller must hold bl.mu.
+func (bl *BanList) sweep() {
+	now := time.Now()
+	for key, entry := range bl.entries {
+		if !entry.Until.After(now) {
+			delete(bl.entries, key)
+		}
+	}
+}
+
+// IsBanned reports whether ip falls in a banned subnet.
+func (bl *BanList) IsBanned(ip net.IP) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.sweep()
+	for key := range bl.entries {
+		if _, subnet, err := net.ParseCIDR(key); err == nil && subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBannedAddr is IsBanned for a host:port address.
+func (bl *BanList) IsBannedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && bl.IsBanned(ip)
+}
+
+// List returns the current bans, soonest to expire first.
+func (bl *BanList) List() []BanEntry {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.sweep()
+	entries := make([]BanEntry, 0, len(bl.entries))
+	for _, entry := range bl.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Until.Before(entries[j].Until) })
+	return entries
+}
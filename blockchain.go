@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 
 	"github.com/dgraph-io/badger/v4"
 )
@@ -13,9 +18,51 @@ const (
 	genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 )
 
+// blockBits is the compact difficulty target every block is mined at. Tests
+// lower it to the regtest limit (0x207fffff) so mining finishes instantly.
+var blockBits uint32 = 0x1d00ffff
+
+// dbVersion is the layout of the blocks database, stored under dbVersionKey.
+// It goes up whenever older databases can no longer be read; those have to be
+// deleted and synced again. Databases without the key predate it.
+const (
+	dbVersionKey = "dbversion"
+	dbVersion    = 3
+)
+
+var (
+	ErrTxNotFound      = errors.New("transaction not found")
+	ErrReindexRequired = errors.New("blocks database must be rebuilt")
+)
+
 type Blockchain struct {
 	LastHash []byte
 	Database *badger.DB
+
+	// mu serializes everything that moves the tip, so a running node can
+	// accept blocks from several peers at once. tipMu guards LastHash for
+	// readers that do not hold mu.
+	mu    sync.Mutex
+	tipMu sync.RWMutex
+	prune PruneConfig
+
+	// bestHeader caches the valid header with the most work, which may be
+	// ahead of the tip while block bodies are downloaded. Guarded by tipMu.
+	bestHeader *BlockIndexEntry
+
+	// candidates holds the stored blocks that may have more work than the
+	// tip, so activation need not scan the whole block index. It is
+	// loaded on first use. Guarded by mu.
+	candidates map[string]*BlockIndexEntry
+
+	// events gets the chain's events; eventTip is the tip they last
+	// reported. Guarded by mu.
+	events   *EventBus
+	eventTip []byte
+}
+
+func newBlockchain(db *badger.DB, lastHash []byte) *Blockchain {
+	return &Blockchain{LastHash: lastHash, Database: db, events: NewEventBus(), eventTip: lastHash}
 }
 
 func DBExists(path string) bool {
@@ -26,7 +73,7 @@ func DBExists(path string) bool {
 }
 
 func InitBlockchain(address, nodeId string) *Blockchain {
-	path := fmt.Sprintf("./tmp/blocks_%s", nodeId)
+	path := fmt.Sprintf(dbPath, nodeId)
 	if DBExists(path) {
 		log.Panic("blockchain already exists")
 	}
@@ -40,17 +87,21 @@ func InitBlockchain(address, nodeId string) *Blockchain {
 	}
 
 	err = db.Update(func(txn *badger.Txn) error {
+		if err := setDBVersion(txn); err != nil {
+			return err
+		}
+
 		cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
-		genesisBlock := NewGenesisBlock(cbtx, 0x1d00ffff)
+		genesisBlock := NewGenesisBlock(cbtx, blockBits)
 
 		fmt.Println("Genesis Block created")
 
-		err = txn.Set(genesisBlock.Header.Hash(), genesisBlock.Serialize())
+		_, err = storeBlock(txn, genesisBlock)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		err = txn.Set([]byte("l"), genesisBlock.Header.Hash())
+		err = connectTip(txn, genesisBlock)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -62,7 +113,7 @@ func InitBlockchain(address, nodeId string) *Blockchain {
 		log.Panic(err)
 	}
 
-	return &Blockchain{lastHash, db}
+	return newBlockchain(db, lastHash)
 }
 
 func ContinueBlockchain(nodeId string) *Blockchain {
@@ -80,6 +131,10 @@ func ContinueBlockchain(nodeId string) *Blockchain {
 	if err != nil {
 		log.Panic(err)
 	}
+	if err := checkDBVersion(db, path); err != nil {
+		db.Close()
+		log.Panic(err)
+	}
 
 	err = db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("l"))
@@ -96,55 +151,182 @@ func ContinueBlockchain(nodeId string) *Blockchain {
 		log.Panic(err)
 	}
 
-	return &Blockchain{lastHash, db}
+	chain := newBlockchain(db, lastHash)
+	chain.prune = chain.loadPruneConfig()
+
+	return chain
 }
 
+func setDBVersion(txn *badger.Txn) error {
+	return txn.Set([]byte(dbVersionKey), binary.LittleEndian.AppendUint32(nil, dbVersion))
+}
+
+// checkDBVersion returns ErrReindexRequired if the database at path was
+// written with another layout than this node's.
+func checkDBVersion(db *badger.DB, path string) error {
+	version := uint32(0)
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(dbVersionKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			version = binary.LittleEndian.Uint32(val)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if version != dbVersion {
+		return fmt.Errorf("%w: %s has version %d, this node needs %d; delete it and sync again", ErrReindexRequired, path, version, dbVersion)
+	}
+	return nil
+}
+
+// OpenBlockchain opens the chain for nodeId, creating an empty database if
+// there is none yet. A running node fills an empty chain from its peers,
+// starting with their genesis block.
+func OpenBlockchain(nodeId string) *Blockchain {
+	path := fmt.Sprintf(dbPath, nodeId)
+	if DBExists(path) {
+		return ContinueBlockchain(nodeId)
+	}
+
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := db.Update(setDBVersion); err != nil {
+		log.Panic(err)
+	}
+
+	return newBlockchain(db, nil)
+}
+
+// NewMemoryBlockchain returns an empty chain kept in memory only, for
+// simulations running many nodes in one process.
+func NewMemoryBlockchain() *Blockchain {
+	opts := badger.DefaultOptions("").WithInMemory(true)
+	opts.Logger = nil
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return newBlockchain(db, nil)
+}
+
+// Tip returns the hash of the main chain tip, or nil for an empty chain.
+func (chain *Blockchain) Tip() []byte {
+	chain.tipMu.RLock()
+	defer chain.tipMu.RUnlock()
+
+	return chain.LastHash
+}
+
+func (chain *Blockchain) setTip(hash []byte) {
+	chain.tipMu.Lock()
+	defer chain.tipMu.Unlock()
+
+	chain.LastHash = hash
+}
+
+// AddBlock mines a block of transactions on the tip and connects it.
 func (chain *Blockchain) AddBlock(transactions []*Transaction) *Block {
+	block, err := chain.MineBlock(func(int) []*Transaction { return transactions })
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
+}
+
+// MineBlock mines a block on the tip out of the transactions build returns
+// for the block's height, and connects it. The chain stays locked from the
+// call to build until the block is connected, so build picks transactions
+// against the tip the block extends.
+func (chain *Blockchain) MineBlock(build func(height int) []*Transaction) (*Block, error) {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
 	var lastHash []byte
 	var lastHeight int
 
 	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(chain.LastHash)
+		lastEntry, err := getBlockIndex(txn, chain.LastHash)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		var blockData []byte
-		err = item.Value(func(val []byte) error {
-			blockData = append([]byte{}, val...)
-			return nil
-		})
-
-		lastBlock := DeserializeBlock(blockData)
-		lastHash = lastBlock.Header.Hash()
-		lastHeight = lastBlock.Height
+		lastHash = lastEntry.Hash()
+		lastHeight = lastEntry.Height
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight+1, 0x1d00ffff)
+	newBlock := NewBlock(build(lastHeight+1), lastHash, lastHeight+1, blockBits)
+	hash := newBlock.Header.Hash()
 
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Header.Hash(), newBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
+	ctx, span := startBlockSpan(context.Background(), "chain.addblock", hash, newBlock.Height)
+	defer span.End()
 
-		err = txn.Set([]byte("l"), newBlock.Header.Hash())
+	err = chain.update(ctx, func(txn *badger.Txn) error {
+		_, err := storeBlock(txn, newBlock)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		chain.LastHash = newBlock.Header.Hash()
-		return nil
+		_, connectSpan := startBlockSpan(ctx, "chain.connect", hash, newBlock.Height)
+		err = connectTip(txn, newBlock)
+		endSpan(connectSpan, err)
+		return err
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+	chain.setTip(hash)
+	chain.publishTipChanges()
+
+	if chain.prune.Target > 0 {
+		chain.pruneBlocks()
 	}
 
-	return newBlock
+	return newBlock, nil
+}
+
+// FindTransaction returns the main chain transaction txid and the block it
+// is in. There is no transaction index, so blocks are read from the tip down
+// until it turns up; pruned blocks are skipped.
+func (chain *Blockchain) FindTransaction(txid []byte) (*Transaction, *Block, error) {
+	tip := chain.Tip()
+	if tip == nil {
+		return nil, nil, ErrTxNotFound
+	}
+
+	iter := &BlockchainIterator{tip, chain.Database}
+	for {
+		block, err := iter.Next()
+		if err == nil {
+			for _, tx := range block.Transactions {
+				if bytes.Equal(tx.ID(), txid) {
+					return tx, block, nil
+				}
+			}
+		}
+
+		if block.Height == 0 {
+			return nil, nil, ErrTxNotFound
+		}
+	}
 }
 
 func (chain *Blockchain) Close() {
@@ -164,10 +346,19 @@ func NewCoinbaseTX(to, data string) *Transaction {
 	}
 
 	txout := TxOut{
-		Value:        10,
+		Value:        blockSubsidy,
 		ScriptPubKey: []byte(to),
 	}
 
 	tx := Transaction{Version: 1, Vin: []TxIn{txin}, Vout: []TxOut{txout}, LockTime: 0}
 	return &tx
 }
+
+// NewHeightCoinbaseTX is NewCoinbaseTX for a block at height. The height is
+// committed to in the coinbase, as BIP34 does, so blocks carrying the same
+// data still get coinbases with different txids.
+func NewHeightCoinbaseTX(to, data string, height int) *Transaction {
+	tx := NewCoinbaseTX(to, data)
+	tx.Vin[0].ScriptSig = fmt.Appendf(tx.Vin[0].ScriptSig, " at height %d", height)
+	return tx
+}
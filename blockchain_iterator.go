@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 
 	"github.com/dgraph-io/badger/v4"
@@ -15,22 +16,23 @@ func (chain *Blockchain) Iterator() *BlockchainIterator {
 	return &BlockchainIterator{chain.LastHash, chain.Database}
 }
 
-func (i *BlockchainIterator) Next() *Block {
+// Next returns the current block and steps to its parent. For blocks whose
+// body is not on disk only the header and height are available, and
+// ErrBlockPruned or ErrBlockNoData is returned alongside them.
+func (i *BlockchainIterator) Next() (*Block, error) {
 	var block *Block
+	var readErr error
 
 	err := i.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(i.CurrentHash)
+		entry, err := getBlockIndex(txn, i.CurrentHash)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		var encodedBlock []byte
-		err = item.Value(func(val []byte) error {
-			encodedBlock = append([]byte{}, val...)
-			return nil
-		})
-
-		block = DeserializeBlock(encodedBlock)
+		block, readErr = readBlock(txn, entry)
+		if readErr != nil && !errors.Is(readErr, ErrBlockPruned) && !errors.Is(readErr, ErrBlockNoData) {
+			log.Panic(readErr)
+		}
 		return nil
 	})
 
@@ -40,5 +42,5 @@ func (i *BlockchainIterator) Next() *Block {
 
 	i.CurrentHash = block.Header.PrevBlockHash
 
-	return block
+	return block, readErr
 }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/big"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Block bodies live under their raw 32-byte hash. Everything else the node
+// keeps about a block is stored under a one byte prefix, so prefix scans must
+// also check the key length to skip bodies whose hash happens to start with
+// the same byte.
+const (
+	blockIndexPrefix  = "b"
+	heightIndexPrefix = "h"
+)
+
+// Block status flags persisted in the block index.
+const (
+	blockHaveData    uint32 = 1 << iota // body is stored under the block hash
+	blockPruned                         // body was deleted by prune mode
+	blockFailedValid                    // block itself is invalid (or was invalidated)
+	blockFailedChild                    // block descends from an invalid block
+
+	blockFailedMask = blockFailedValid | blockFailedChild
+)
+
+var (
+	ErrBlockNotFound = errors.New("block not found")
+	ErrBlockPruned   = errors.New("block data pruned")
+	ErrBlockNoData   = errors.New("block data not available")
+)
+
+// BlockIndexEntry is the per-block metadata kept for every known block, even
+// after its body has been pruned.
+type BlockIndexEntry struct {
+	Header    BlockHeader
+	Height    int
+	Status    uint32
+	Size      uint32   // serialized body size in bytes
+	ChainWork *big.Int // total work of the chain ending at this block
+}
+
+func (e *BlockIndexEntry) Hash() []byte {
+	return e.Header.Hash()
+}
+
+func (e *BlockIndexEntry) HaveData() bool {
+	return e.Status&blockHaveData != 0
+}
+
+func (e *BlockIndexEntry) Failed() bool {
+	return e.Status&blockFailedMask != 0
+}
+
+func (e *BlockIndexEntry) Serialize() []byte {
+	buf := make([]byte, 0, 124)
+	buf = append(buf, e.Header.Serialize()...)
+
+	tmp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(tmp, uint32(e.Height))
+	buf = append(buf, tmp...)
+
+	binary.LittleEndian.PutUint32(tmp, e.Status)
+	buf = append(buf, tmp...)
+
+	binary.LittleEndian.PutUint32(tmp, e.Size)
+	buf = append(buf, tmp...)
+
+	return append(buf, e.ChainWork.FillBytes(make([]byte, 32))...)
+}
+
+func DeserializeBlockIndexEntry(data []byte) (*BlockIndexEntry, error) {
+	if len(data) < 124 {
+		return nil, errors.New("invalid block index entry length")
+	}
+
+	header, err := DeserializeBlockHeader(data[:80])
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockIndexEntry{
+		Header:    *header,
+		Height:    int(binary.LittleEndian.Uint32(data[80:])),
+		Status:    binary.LittleEndian.Uint32(data[84:]),
+		Size:      binary.LittleEndian.Uint32(data[88:]),
+		ChainWork: new(big.Int).SetBytes(data[92:124]),
+	}, nil
+}
+
+func blockIndexKey(hash []byte) []byte {
+	return append([]byte(blockIndexPrefix), hash...)
+}
+
+func isBlockIndexKey(key []byte) bool {
+	return len(key) == 33 && bytes.HasPrefix(key, []byte(blockIndexPrefix))
+}
+
+func heightKey(height int) []byte {
+	key := []byte(heightIndexPrefix)
+	return binary.BigEndian.AppendUint32(key, uint32(height))
+}
+
+func getBlockIndex(txn *badger.Txn, hash []byte) (*BlockIndexEntry, error) {
+	item, err := txn.Get(blockIndexKey(hash))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entry *BlockIndexEntry
+	err = item.Value(func(val []byte) error {
+		entry, err = DeserializeBlockIndexEntry(val)
+		return err
+	})
+
+	return entry, err
+}
+
+func putBlockIndex(txn *badger.Txn, entry *BlockIndexEntry) error {
+	return txn.Set(blockIndexKey(entry.Hash()), entry.Serialize())
+}
+
+// getMainChainHash returns the hash of the main chain block at height.
+func getMainChainHash(txn *badger.Txn, height int) ([]byte, error) {
+	item, err := txn.Get(heightKey(height))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrBlockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+// readBlock loads the body for entry. Blocks without a body come back as a
+// header-only block together with ErrBlockPruned, or ErrBlockNoData if the
+// body was never stored (headers loaded from a UTXO snapshot).
+func readBlock(txn *badger.Txn, entry *BlockIndexEntry) (*Block, error) {
+	if entry.Status&blockPruned != 0 {
+		return &Block{Header: entry.Header, Height: entry.Height}, ErrBlockPruned
+	}
+	if !entry.HaveData() {
+		return &Block{Header: entry.Header, Height: entry.Height}, ErrBlockNoData
+	}
+
+	item, err := txn.Get(entry.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	var block *Block
+	err = item.Value(func(val []byte) error {
+		block, err = DeserializeBlock(val)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	block.Height = entry.Height
+	return block, nil
+}
+
+// storeBlock writes the body and the index entry for block. The parent must
+// already be indexed unless block is a genesis block. Whether the block joins
+// the main chain is decided separately by connectTip.
+func storeBlock(txn *badger.Txn, block *Block) (*BlockIndexEntry, error) {
+	hash := block.Header.Hash()
+	body := block.Serialize()
+
+	chainWork := CalcWork(block.Header.Bits)
+	if !bytes.Equal(block.Header.PrevBlockHash, make([]byte, 32)) {
+		parent, err := getBlockIndex(txn, block.Header.PrevBlockHash)
+		if err != nil {
+			return nil, err
+		}
+		chainWork.Add(chainWork, parent.ChainWork)
+	}
+
+	if err := txn.Set(hash, body); err != nil {
+		return nil, err
+	}
+
+	entry := &BlockIndexEntry{
+		Header:    block.Header,
+		Height:    block.Height,
+		Status:    blockHaveData,
+		Size:      uint32(len(body)),
+		ChainWork: chainWork,
+	}
+
+	return entry, putBlockIndex(txn, entry)
+}
+
+func (chain *Blockchain) GetBlockIndex(hash []byte) (*BlockIndexEntry, error) {
+	var entry *BlockIndexEntry
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		entry, err = getBlockIndex(txn, hash)
+		return err
+	})
+
+	return entry, err
+}
+
+// GetBlock returns the block with the given hash. If the body is not on
+// disk the header-only block is returned along with ErrBlockPruned or
+// ErrBlockNoData.
+func (chain *Blockchain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		entry, err := getBlockIndex(txn, hash)
+		if err != nil {
+			return err
+		}
+		block, err = readBlock(txn, entry)
+		return err
+	})
+
+	return block, err
+}
+
+// GetBlockHash returns the hash of the main chain block at height.
+func (chain *Blockchain) GetBlockHash(height int) ([]byte, error) {
+	var hash []byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		hash, err = getMainChainHash(txn, height)
+		return err
+	})
+
+	return hash, err
+}
+
+// Height returns the height of the main chain tip, or -1 for an empty chain.
+func (chain *Blockchain) Height() int {
+	tip := chain.Tip()
+	if tip == nil {
+		return -1
+	}
+
+	entry, err := chain.GetBlockIndex(tip)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return entry.Height
+}
+
+// LocateBlocks returns up to max main chain hashes following the first
+// locator hash that is on our main chain (or starting at genesis if none is),
+// stopping after hashStop.
+func (chain *Blockchain) LocateBlocks(locator [][]byte, hashStop []byte, max int) [][]byte {
+	var hashes [][]byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		start := 0
+		for _, hash := range locator {
+			entry, err := getBlockIndex(txn, hash)
+			if errors.Is(err, ErrBlockNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			onMain, err := isMainChain(txn, entry)
+			if err != nil {
+				return err
+			}
+			if onMain {
+				start = entry.Height + 1
+				break
+			}
+		}
+
+		for height := start; len(hashes) < max; height++ {
+			hash, err := getMainChainHash(txn, height)
+			if errors.Is(err, ErrBlockNotFound) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			hashes = append(hashes, hash)
+			if bytes.Equal(hash, hashStop) {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return hashes
+}
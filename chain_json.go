@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// The JSON encodings of blocks, headers and transactions served over RPC and
+// REST. They are shaped like Bitcoin Core's, with hashes in the byte order
+// the rest of the node prints them in.
+
+type blockResult struct {
+	Hash              string  `json:"hash"`
+	Confirmations     int     `json:"confirmations"`
+	Size              int     `json:"size"`
+	Height            int     `json:"height"`
+	Version           uint32  `json:"version"`
+	MerkleRoot        string  `json:"merkleroot"`
+	Time              uint32  `json:"time"`
+	Nonce             uint32  `json:"nonce"`
+	Bits              string  `json:"bits"`
+	Difficulty        float64 `json:"difficulty"`
+	ChainWork         string  `json:"chainwork"`
+	NTx               int     `json:"nTx"`
+	PreviousBlockHash string  `json:"previousblockhash,omitempty"`
+	NextBlockHash     string  `json:"nextblockhash,omitempty"`
+	Tx                []any   `json:"tx"`
+}
+
+type txResult struct {
+	TxID          string        `json:"txid"`
+	Hex           string        `json:"hex"`
+	Version       int32         `json:"version"`
+	Size          int           `json:"size"`
+	LockTime      uint32        `json:"locktime"`
+	Vin           []txInResult  `json:"vin"`
+	Vout          []txOutResult `json:"vout"`
+	BlockHash     string        `json:"blockhash,omitempty"`
+	Confirmations int           `json:"confirmations,omitempty"`
+}
+
+type txInResult struct {
+	Coinbase  string `json:"coinbase,omitempty"`
+	TxID      string `json:"txid,omitempty"`
+	Vout      uint32 `json:"vout"`
+	ScriptSig string `json:"scriptSig,omitempty"`
+	Sequence  uint32 `json:"sequence"`
+}
+
+type txOutResult struct {
+	Value        int64  `json:"value"`
+	N            int    `json:"n"`
+	ScriptPubKey string `json:"scriptPubKey"`
+	Address      string `json:"address,omitempty"`
+}
+
+// scriptAddress returns the address an output script pays to, or "" for
+// scripts that are not an address.
+func scriptAddress(script []byte) string {
+	if !ValidateAddress(string(script)) {
+		return ""
+	}
+	return string(script)
+}
+
+func newTxResult(tx *Transaction) txResult {
+	serialized := tx.Serialize()
+	res := txResult{
+		TxID:     hex.EncodeToString(tx.ID()),
+		Hex:      hex.EncodeToString(serialized),
+		Version:  tx.Version,
+		Size:     len(serialized),
+		LockTime: tx.LockTime,
+		Vin:      []txInResult{},
+		Vout:     []txOutResult{},
+	}
+
+	for _, vin := range tx.Vin {
+		in := txInResult{Vout: vin.Vout, Sequence: vin.Sequence}
+		if tx.IsCoinbase() {
+			in.Coinbase = hex.EncodeToString(vin.ScriptSig)
+		} else {
+			in.TxID = hex.EncodeToString(vin.PrevTxID)
+			in.ScriptSig = hex.EncodeToString(vin.ScriptSig)
+		}
+		res.Vin = append(res.Vin, in)
+	}
+	for i, out := range tx.Vout {
+		res.Vout = append(res.Vout, txOutResult{
+			Value:        out.Value,
+			N:            i,
+			ScriptPubKey: hex.EncodeToString(out.ScriptPubKey),
+			Address:      scriptAddress(out.ScriptPubKey),
+		})
+	}
+	return res
+}
+
+// newBlockTxResult is newTxResult with the block holding tx, if any.
+func newBlockTxResult(chain *Blockchain, tx *Transaction, block *Block) txResult {
+	res := newTxResult(tx)
+	if block != nil {
+		res.BlockHash = hex.EncodeToString(block.Header.Hash())
+		if entry, err := chain.GetBlockIndex(block.Header.Hash()); err == nil {
+			res.Confirmations = confirmations(chain, entry)
+		}
+	}
+	return res
+}
+
+// confirmations returns how deep entry is in the main chain, or -1 if it is
+// not in it.
+func confirmations(chain *Blockchain, entry *BlockIndexEntry) int {
+	hash, err := chain.GetBlockHash(entry.Height)
+	if err != nil || !bytes.Equal(hash, entry.Hash()) {
+		return -1
+	}
+	return chain.Height() - entry.Height + 1
+}
+
+type blockHeaderResult struct {
+	Hash              string  `json:"hash"`
+	Confirmations     int     `json:"confirmations"`
+	Height            int     `json:"height"`
+	Version           uint32  `json:"version"`
+	MerkleRoot        string  `json:"merkleroot"`
+	Time              uint32  `json:"time"`
+	Nonce             uint32  `json:"nonce"`
+	Bits              string  `json:"bits"`
+	Difficulty        float64 `json:"difficulty"`
+	ChainWork         string  `json:"chainwork"`
+	PreviousBlockHash string  `json:"previousblockhash,omitempty"`
+	HaveData          bool    `json:"have_data"`
+}
+
+type blockchainInfoResult struct {
+	Blocks          int     `json:"blocks"`
+	Headers         int     `json:"headers"`
+	BestBlockHash   string  `json:"bestblockhash"`
+	Difficulty      float64 `json:"difficulty"`
+	ChainWork       string  `json:"chainwork"`
+	Pruned          bool    `json:"pruned"`
+	PruneHeight     int     `json:"pruneheight,omitempty"`
+	PruneTargetSize uint64  `json:"prune_target_size,omitempty"`
+}
+
+// newBlockResult encodes block, whose index entry is entry, with its txids
+// or, with txDetails, with its transactions decoded.
+func newBlockResult(chain *Blockchain, entry *BlockIndexEntry, block *Block, txDetails bool) blockResult {
+	res := blockResult{
+		Hash:          hex.EncodeToString(entry.Hash()),
+		Confirmations: confirmations(chain, entry),
+		Size:          len(block.Serialize()),
+		Height:        entry.Height,
+		Version:       block.Header.Version,
+		MerkleRoot:    hex.EncodeToString(block.Header.MerkleRoot),
+		Time:          block.Header.Timestamp,
+		Nonce:         block.Header.Nonce,
+		Bits:          fmt.Sprintf("%08x", block.Header.Bits),
+		Difficulty:    Difficulty(block.Header.Bits),
+		ChainWork:     fmt.Sprintf("%064x", entry.ChainWork),
+		NTx:           len(block.Transactions),
+		Tx:            []any{},
+	}
+	if entry.Height > 0 {
+		res.PreviousBlockHash = hex.EncodeToString(block.Header.PrevBlockHash)
+	}
+	if res.Confirmations > 1 {
+		if next, err := chain.GetBlockHash(entry.Height + 1); err == nil {
+			res.NextBlockHash = hex.EncodeToString(next)
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		if txDetails {
+			res.Tx = append(res.Tx, newTxResult(tx))
+		} else {
+			res.Tx = append(res.Tx, hex.EncodeToString(tx.ID()))
+		}
+	}
+	return res
+}
+
+func newBlockHeaderResult(chain *Blockchain, entry *BlockIndexEntry) blockHeaderResult {
+	res := blockHeaderResult{
+		Hash:          hex.EncodeToString(entry.Hash()),
+		Confirmations: confirmations(chain, entry),
+		Height:        entry.Height,
+		Version:       entry.Header.Version,
+		MerkleRoot:    hex.EncodeToString(entry.Header.MerkleRoot),
+		Time:          entry.Header.Timestamp,
+		Nonce:         entry.Header.Nonce,
+		Bits:          fmt.Sprintf("%08x", entry.Header.Bits),
+		Difficulty:    Difficulty(entry.Header.Bits),
+		ChainWork:     fmt.Sprintf("%064x", entry.ChainWork),
+		HaveData:      entry.HaveData(),
+	}
+	if entry.Height > 0 {
+		res.PreviousBlockHash = hex.EncodeToString(entry.Header.PrevBlockHash)
+	}
+	return res
+}
+
+func newBlockchainInfoResult(chain *Blockchain) (blockchainInfoResult, error) {
+	res := blockchainInfoResult{Blocks: -1, Headers: -1}
+	if tip := chain.Tip(); tip != nil {
+		entry, err := chain.GetBlockIndex(tip)
+		if err != nil {
+			return res, err
+		}
+		res.Blocks = entry.Height
+		res.BestBlockHash = hex.EncodeToString(tip)
+		res.Difficulty = Difficulty(entry.Header.Bits)
+		res.ChainWork = fmt.Sprintf("%064x", entry.ChainWork)
+	}
+	if best := chain.BestHeader(); best != nil {
+		res.Headers = best.Height
+	}
+	if cfg := chain.PruneConfig(); cfg.Target > 0 {
+		res.Pruned = true
+		res.PruneHeight = chain.PruneHeight()
+		res.PruneTargetSize = cfg.Target
+	}
+	return res, nil
+}
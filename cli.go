@@ -1,21 +1,138 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type CLI struct{}
 
+const defaultNodeID = "node_1"
+
+// nodeID selects the node whose data directory and wallet file are used. It
+// is read from the NODE_ID environment variable.
+func (cli *CLI) nodeID() string {
+	if nodeID := os.Getenv("NODE_ID"); nodeID != "" {
+		return nodeID
+	}
+	return defaultNodeID
+}
+
+// rpcClient returns a client for the node of this node ID if it is running,
+// or nil to work on the chain database directly. A running node holds the
+// database lock, so commands must go through it. It exits with a one-line
+// message if it cannot tell whether the node is running.
+func (cli *CLI) rpcClient() *RPCClient {
+	client, err := cli.findNode()
+	if err != nil {
+		fmt.Printf("Cannot reach the node: %v\n", err)
+		os.Exit(1)
+	}
+	return client
+}
+
+// findNode looks for the running node with its cookie file, or RPC_USER and
+// RPC_PASSWORD for a node started with -rpcuser, at its default RPC port
+// unless RPC_ADDR is set. A missing cookie, or a stale one left behind by a
+// node that crashed, means no node is running and gives a nil client.
+func (cli *CLI) findNode() (*RPCClient, error) {
+	nodeID := cli.nodeID()
+
+	user, password := os.Getenv("RPC_USER"), os.Getenv("RPC_PASSWORD")
+	fromCookie := password == ""
+	if fromCookie {
+		var err error
+		user, password, err = ReadRPCCookie(nodeID)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading RPC cookie: %w", err)
+		}
+	}
+
+	addr := os.Getenv("RPC_ADDR")
+	if addr == "" {
+		addr = fmt.Sprintf("127.0.0.1:%d", DefaultRPCPort(nodeID))
+	}
+	client := NewRPCClient(addr, user, password)
+
+	err := client.Call("getblockcount", nil)
+	switch {
+	case err == nil:
+		return client, nil
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return nil, nil
+	case fromCookie && errors.Is(err, ErrRPCUnauthorized):
+		// Another node now listens on the port with its own cookie.
+		return nil, nil
+	}
+	return nil, err
+}
+
+// requireNode returns the client of the running node, or exits for commands
+// that only make sense while it runs.
+func (cli *CLI) requireNode(command string) *RPCClient {
+	client := cli.rpcClient()
+	if client == nil {
+		fmt.Printf("%s needs the node running\n", command)
+		os.Exit(1)
+	}
+	return client
+}
+
+// requireOffline exits if the node is running, for commands that replace or
+// read the chain database of a stopped node.
+func (cli *CLI) requireOffline(command string) {
+	if cli.rpcClient() != nil {
+		fmt.Printf("%s needs the node to be stopped first\n", command)
+		os.Exit(1)
+	}
+}
+
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
-	fmt.Println("  addblock -data DATA - Add a block to the blockchain")
+	fmt.Println("  addblock -data DATA - Mine a block with DATA in its coinbase, taking in the running node's mempool")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
-	fmt.Println("  createwallet - Create a new wallet")
+	fmt.Println("  createwallet [-curve secp256k1|p256] - Create a new wallet address, on CURVE if the wallet has no seed yet (default secp256k1)")
+	fmt.Println("  getbalance [-address ADDRESS] - Print the spendable balance of ADDRESS, or of the whole wallet")
+	fmt.Println("  listunspent [-address ADDRESS] - List the unspent coins of ADDRESS, or of the whole wallet")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT [-fee FEE] - Pay AMOUNT from the wallet address FROM, through the running node's mempool (confirmed by its next addblock) or else in a block mined here")
+	fmt.Println("  dumpmnemonic - Print the recovery phrase of the wallet's seed")
+	fmt.Println("  restorewallet -mnemonic WORDS [-seedpassphrase PASS] [-curve secp256k1|p256|legacy] - Recreate the wallet of a recovery phrase and the addresses it used")
+	fmt.Println("  encryptwallet [-passphrase PASS] - Encrypt the wallet's private keys (prompts for PASS if not given)")
+	fmt.Println("  walletpassphrase [-passphrase PASS] -timeout SECONDS - Unlock the running node's encrypted wallet for SECONDS")
+	fmt.Println("  walletlock - Lock the running node's encrypted wallet")
+	fmt.Println("  walletpassphrasechange [-old PASS] [-new PASS] - Change the wallet passphrase")
+	fmt.Println("  setprune -target BYTES [-depth N] - Enable prune mode, keeping block bodies under BYTES (0 disables)")
+	fmt.Println("  dumptxoutset -file FILE [-hash HASH] - Write the UTXO set as of block HASH (default tip) to FILE")
+	fmt.Println("  loadtxoutset -file FILE [-sha256 HASH] [-from NODE] - Create this node's chain from a UTXO snapshot, validating history from NODE")
+	fmt.Println("  invalidateblock -hash HASH - Mark a block and its descendants invalid and reorg to the best remaining chain")
+	fmt.Println("  reconsiderblock -hash HASH - Undo invalidateblock for a block and its descendants")
+	fmt.Println("  getpeerinfo - List the running node's peers")
+	fmt.Println("  addnode -addr ADDR [-command add|remove|onetry] - Keep the running node connected to ADDR, stop doing so, or connect once")
+	fmt.Println("  disconnectnode -addr ADDR - Disconnect the running node from the peer at ADDR")
+	fmt.Println("  setban -subnet SUBNET [-command add|remove] [-bantime SECONDS] - Ban an address or subnet on the running node (default 24 hours), or lift the ban")
+	fmt.Println("  listbanned - List the running node's banned addresses and subnets")
+	fmt.Println("  clearbanned - Lift all of the running node's bans")
+	fmt.Println("  startnode [-port PORT] [-connect ADDR,...] [-whitelist SUBNET,...] [-maxoutbound N] [-maxinbound N] [-v2transport=false] [-dandelion=false] [-rpcport PORT] [-rpcuser USER -rpcpassword PASS] [-rest] [-explorer] [-metrics] [-trace stdout|FILE] - Run a P2P node, syncing blocks with the given peers")
+	fmt.Println("  gettxoutsetinfo - Print statistics and the MuHash of the UTXO set")
+	fmt.Println("  validatesnapshot -from NODE - Resume background validation of a loaded snapshot using NODE's blocks")
 }
 
 func (cli *CLI) validateArgs() {
@@ -32,9 +149,77 @@ func (cli *CLI) Run() {
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	listUnspentCmd := flag.NewFlagSet("listunspent", flag.ExitOnError)
+	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	dumpMnemonicCmd := flag.NewFlagSet("dumpmnemonic", flag.ExitOnError)
+	restoreWalletCmd := flag.NewFlagSet("restorewallet", flag.ExitOnError)
+	encryptWalletCmd := flag.NewFlagSet("encryptwallet", flag.ExitOnError)
+	walletPassphraseCmd := flag.NewFlagSet("walletpassphrase", flag.ExitOnError)
+	walletLockCmd := flag.NewFlagSet("walletlock", flag.ExitOnError)
+	walletPassphraseChangeCmd := flag.NewFlagSet("walletpassphrasechange", flag.ExitOnError)
+	setPruneCmd := flag.NewFlagSet("setprune", flag.ExitOnError)
+	dumpTxOutSetCmd := flag.NewFlagSet("dumptxoutset", flag.ExitOnError)
+	loadTxOutSetCmd := flag.NewFlagSet("loadtxoutset", flag.ExitOnError)
+	validateSnapshotCmd := flag.NewFlagSet("validatesnapshot", flag.ExitOnError)
+	getTxOutSetInfoCmd := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ExitOnError)
+	reconsiderBlockCmd := flag.NewFlagSet("reconsiderblock", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
+	addNodeCmd := flag.NewFlagSet("addnode", flag.ExitOnError)
+	disconnectNodeCmd := flag.NewFlagSet("disconnectnode", flag.ExitOnError)
+	setBanCmd := flag.NewFlagSet("setban", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
 	addBlockData := addBlockCmd.String("data", "", "Block data")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createWalletCurve := createWalletCmd.String("curve", "", "Curve of a new wallet seed's keys: secp256k1 or p256 (default secp256k1)")
+	getBalanceAddress := getBalanceCmd.String("address", "", "Address to get the balance of (default the whole wallet)")
+	listUnspentAddress := listUnspentCmd.String("address", "", "Address to list the coins of (default the whole wallet)")
+	sendFrom := sendCmd.String("from", "", "Wallet address to pay from")
+	sendTo := sendCmd.String("to", "", "Address to pay")
+	sendAmount := sendCmd.Int64("amount", 0, "Amount to pay")
+	sendFee := sendCmd.Int64("fee", 0, "Fee to leave to the miner")
+	restoreWalletMnemonic := restoreWalletCmd.String("mnemonic", "", "Recovery phrase")
+	restoreWalletSeedPassphrase := restoreWalletCmd.String("seedpassphrase", "", "BIP39 passphrase the seed was created with")
+	restoreWalletCurve := restoreWalletCmd.String("curve", "secp256k1", "Curve the seed's keys are on: secp256k1, p256, or legacy for P-256 seeds created before secp256k1")
+	encryptWalletPassphrase := encryptWalletCmd.String("passphrase", "", "New wallet passphrase (default read from standard input)")
+	walletPassphrasePassphrase := walletPassphraseCmd.String("passphrase", "", "Wallet passphrase (default read from standard input)")
+	walletPassphraseTimeout := walletPassphraseCmd.Int64("timeout", 0, "Seconds to keep the wallet unlocked")
+	walletPassphraseChangeOld := walletPassphraseChangeCmd.String("old", "", "Current wallet passphrase (default read from standard input)")
+	walletPassphraseChangeNew := walletPassphraseChangeCmd.String("new", "", "New wallet passphrase (default read from standard input)")
+	setPruneTarget := setPruneCmd.Uint64("target", 0, "Target size in bytes for stored block bodies")
+	setPruneDepth := setPruneCmd.Int("depth", defaultPruneDepth, "Number of blocks below the tip that are never pruned")
+	dumpTxOutSetFile := dumpTxOutSetCmd.String("file", "", "Snapshot file to write")
+	dumpTxOutSetHash := dumpTxOutSetCmd.String("hash", "", "Block hash to snapshot (default tip)")
+	loadTxOutSetFile := loadTxOutSetCmd.String("file", "", "Snapshot file to load")
+	loadTxOutSetSHA := loadTxOutSetCmd.String("sha256", "", "Expected snapshot content hash")
+	loadTxOutSetFrom := loadTxOutSetCmd.String("from", "", "Node ID whose blocks are used to validate history")
+	validateSnapshotFrom := validateSnapshotCmd.String("from", "", "Node ID whose blocks are used to validate history")
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "Hash of the block to invalidate")
+	reconsiderBlockHash := reconsiderBlockCmd.String("hash", "", "Hash of the block to reconsider")
+	addNodeAddr := addNodeCmd.String("addr", "", "Peer address")
+	addNodeCommand := addNodeCmd.String("command", "add", "add, remove or onetry")
+	disconnectNodeAddr := disconnectNodeCmd.String("addr", "", "Address of the peer to disconnect")
+	setBanSubnet := setBanCmd.String("subnet", "", "Address or subnet (CIDR) to ban")
+	setBanCommand := setBanCmd.String("command", "add", "add or remove")
+	setBanTime := setBanCmd.Int64("bantime", 0, "Seconds to ban for (default 24 hours)")
+	startNodePort := startNodeCmd.Int("port", 0, "TCP port to listen on (default derived from NODE_ID)")
+	startNodeConnect := startNodeCmd.String("connect", "", "Comma separated peer addresses to stay connected to")
+	startNodeWhitelist := startNodeCmd.String("whitelist", "", "Comma separated addresses or subnets whose peers are never banned (loopback never is)")
+	startNodeMaxOutbound := startNodeCmd.Int("maxoutbound", defaultMaxOutbound, "Maximum number of automatic outbound connections")
+	startNodeMaxInbound := startNodeCmd.Int("maxinbound", defaultMaxInbound, "Maximum number of inbound connections")
+	startNodeV2Transport := startNodeCmd.Bool("v2transport", true, "Encrypt connections to peers that support it")
+	startNodeDandelion := startNodeCmd.Bool("dandelion", true, "Relay new transactions along a Dandelion stem first")
+	startNodeRPCPort := startNodeCmd.Int("rpcport", 0, "Port for JSON-RPC on 127.0.0.1 (default derived from NODE_ID)")
+	startNodeRPCUser := startNodeCmd.String("rpcuser", "", "JSON-RPC user (default cookie authentication)")
+	startNodeRPCPassword := startNodeCmd.String("rpcpassword", "", "JSON-RPC password")
+	startNodeREST := startNodeCmd.Bool("rest", false, "Serve the read-only REST interface on the RPC port")
+	startNodeExplorer := startNodeCmd.Bool("explorer", false, "Serve the block explorer on the RPC port")
+	startNodeMetrics := startNodeCmd.Bool("metrics", false, "Serve Prometheus metrics at /metrics on the RPC port")
+	startNodeTrace := startNodeCmd.String("trace", "", "Export OpenTelemetry spans to stdout or to a file")
 
 	switch os.Args[1] {
 	case "addblock":
@@ -57,13 +242,176 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getbalance":
+		err := getBalanceCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listunspent":
+		err := listUnspentCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "send":
+		err := sendCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumpmnemonic":
+		err := dumpMnemonicCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "restorewallet":
+		err := restoreWalletCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "encryptwallet":
+		err := encryptWalletCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "walletpassphrase":
+		err := walletPassphraseCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "walletlock":
+		err := walletLockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "walletpassphrasechange":
+		err := walletPassphraseChangeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "setprune":
+		err := setPruneCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "dumptxoutset":
+		err := dumpTxOutSetCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "loadtxoutset":
+		err := loadTxOutSetCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "validatesnapshot":
+		err := validateSnapshotCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettxoutsetinfo":
+		err := getTxOutSetInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "invalidateblock":
+		err := invalidateBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reconsiderblock":
+		err := reconsiderBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "addnode":
+		err := addNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "disconnectnode":
+		err := disconnectNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "setban":
+		err := setBanCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "clearbanned":
+		err := clearBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "startnode":
+		err := startNodeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet("node_1")
+		cli.createWallet(cli.nodeID(), *createWalletCurve)
+	}
+
+	if getBalanceCmd.Parsed() {
+		cli.getBalance(*getBalanceAddress)
+	}
+
+	if listUnspentCmd.Parsed() {
+		cli.listUnspent(*listUnspentAddress)
+	}
+
+	if sendCmd.Parsed() {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+			sendCmd.Usage()
+			os.Exit(1)
+		}
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee)
+	}
+
+	if dumpMnemonicCmd.Parsed() {
+		cli.dumpMnemonic()
+	}
+
+	if restoreWalletCmd.Parsed() {
+		if *restoreWalletMnemonic == "" {
+			restoreWalletCmd.Usage()
+			os.Exit(1)
+		}
+		cli.restoreWallet(*restoreWalletMnemonic, *restoreWalletSeedPassphrase, curveFlag(*restoreWalletCurve, true))
+	}
+
+	if encryptWalletCmd.Parsed() {
+		cli.encryptWallet(*encryptWalletPassphrase)
+	}
+
+	if walletPassphraseCmd.Parsed() {
+		if *walletPassphraseTimeout <= 0 {
+			walletPassphraseCmd.Usage()
+			os.Exit(1)
+		}
+		cli.walletPassphrase(*walletPassphrasePassphrase, *walletPassphraseTimeout)
+	}
+
+	if walletLockCmd.Parsed() {
+		cli.walletLock()
+	}
+
+	if walletPassphraseChangeCmd.Parsed() {
+		cli.walletPassphraseChange(*walletPassphraseChangeOld, *walletPassphraseChangeNew)
 	}
 
 	if addBlockCmd.Parsed() {
@@ -85,58 +433,1084 @@ func (cli *CLI) Run() {
 		}
 		cli.createBlockchain(*createBlockchainAddress)
 	}
+
+	if setPruneCmd.Parsed() {
+		cli.setPrune(*setPruneTarget, *setPruneDepth)
+	}
+
+	if dumpTxOutSetCmd.Parsed() {
+		if *dumpTxOutSetFile == "" {
+			dumpTxOutSetCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpTxOutSet(*dumpTxOutSetFile, *dumpTxOutSetHash)
+	}
+
+	if loadTxOutSetCmd.Parsed() {
+		if *loadTxOutSetFile == "" {
+			loadTxOutSetCmd.Usage()
+			os.Exit(1)
+		}
+		cli.loadTxOutSet(*loadTxOutSetFile, *loadTxOutSetSHA, *loadTxOutSetFrom)
+	}
+
+	if validateSnapshotCmd.Parsed() {
+		if *validateSnapshotFrom == "" {
+			validateSnapshotCmd.Usage()
+			os.Exit(1)
+		}
+		cli.validateSnapshot(*validateSnapshotFrom)
+	}
+
+	if getTxOutSetInfoCmd.Parsed() {
+		cli.getTxOutSetInfo()
+	}
+
+	if invalidateBlockCmd.Parsed() {
+		if *invalidateBlockHash == "" {
+			invalidateBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.invalidateBlock(*invalidateBlockHash)
+	}
+
+	if reconsiderBlockCmd.Parsed() {
+		if *reconsiderBlockHash == "" {
+			reconsiderBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.reconsiderBlock(*reconsiderBlockHash)
+	}
+
+	if getPeerInfoCmd.Parsed() {
+		cli.getPeerInfo()
+	}
+
+	if addNodeCmd.Parsed() {
+		if *addNodeAddr == "" {
+			addNodeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.addNode(*addNodeAddr, *addNodeCommand)
+	}
+
+	if disconnectNodeCmd.Parsed() {
+		if *disconnectNodeAddr == "" {
+			disconnectNodeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.disconnectNode(*disconnectNodeAddr)
+	}
+
+	if setBanCmd.Parsed() {
+		if *setBanSubnet == "" {
+			setBanCmd.Usage()
+			os.Exit(1)
+		}
+		cli.setBan(*setBanSubnet, *setBanCommand, *setBanTime)
+	}
+
+	if listBannedCmd.Parsed() {
+		cli.listBanned()
+	}
+
+	if clearBannedCmd.Parsed() {
+		cli.clearBanned()
+	}
+
+	if startNodeCmd.Parsed() {
+		if (*startNodeRPCUser == "") != (*startNodeRPCPassword == "") {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.startNode(*startNodePort, *startNodeConnect, *startNodeWhitelist, *startNodeMaxOutbound, *startNodeMaxInbound, *startNodeV2Transport, *startNodeDandelion,
+			*startNodeRPCPort, *startNodeRPCUser, *startNodeRPCPassword, *startNodeREST, *startNodeExplorer, *startNodeMetrics, *startNodeTrace)
+	}
 }
 
 func (cli *CLI) createBlockchain(address string) {
+	cli.requireOffline("createblockchain")
 
-	chain := InitBlockchain(address, "node_1")
+	chain := InitBlockchain(address, cli.nodeID())
 	chain.Close()
 	fmt.Println("Done!")
 }
 
 func (cli *CLI) addBlock(data string) {
+	if client := cli.rpcClient(); client != nil {
+		if err := client.Call("addblock", nil, data); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("Success!")
+		return
+	}
 
-	chain := ContinueBlockchain("node_1")
+	chain := ContinueBlockchain(cli.nodeID())
 	defer chain.Close()
 
-	tx := NewCoinbaseTX("legacy_user", data)
+	tx := NewHeightCoinbaseTX("legacy_user", data, chain.Height()+1)
 
 	chain.AddBlock([]*Transaction{tx})
 	fmt.Println("Success!")
 }
 
 func (cli *CLI) printChain() {
-	chain := ContinueBlockchain("node_1")
+	if client := cli.rpcClient(); client != nil {
+		printChainRPC(client)
+		return
+	}
+
+	chain := ContinueBlockchain(cli.nodeID())
 	defer chain.Close()
 
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		printBlock(block, err)
+
+		if block.Height == 0 {
+			break
+		}
+	}
+
+	printPruneHeight(chain.PruneHeight())
+}
 
-		fmt.Printf("============ Block %x ============\n", block.Header.Hash())
-		fmt.Printf("Height: %d\n", block.Height)
-		fmt.Printf("Prev. block: %x\n", block.Header.PrevBlockHash)
+func printChainRPC(client *RPCClient) {
+	var hash string
+	if err := client.Call("getbestblockhash", &hash); err != nil {
+		log.Panic(err)
+	}
+	var tip blockHeaderResult
+	if err := client.Call("getblockheader", &tip, hash); err != nil {
+		log.Panic(err)
+	}
 
-		for _, tx := range block.Transactions {
+	for height := tip.Height; height >= 0; height-- {
+		var headerHex string
+		if err := client.Call("getblockheader", &headerHex, hash, false); err != nil {
+			log.Panic(err)
+		}
+		header, err := DeserializeBlockHeader(mustDecodeHex(headerHex))
+		if err != nil {
+			log.Panic(err)
+		}
+		block := &Block{Header: *header, Height: height}
 
-			fmt.Printf("Tx: %x\n", tx.Serialize())
+		// Blocks without a body on disk come back as an error named after
+		// ErrBlockPruned or ErrBlockNoData.
+		var blockHex string
+		var readErr error
+		var rpcErr *RPCError
+		err = client.Call("getblock", &blockHex, hash, 0)
+		switch {
+		case err == nil:
+			full, err := DeserializeBlock(mustDecodeHex(blockHex))
+			if err != nil {
+				log.Panic(err)
+			}
+			block.Transactions = full.Transactions
+		case errors.As(err, &rpcErr) && rpcErr.Message == ErrBlockPruned.Error():
+			readErr = ErrBlockPruned
+		case errors.As(err, &rpcErr) && rpcErr.Message == ErrBlockNoData.Error():
+			readErr = ErrBlockNoData
+		default:
+			log.Panic(err)
 		}
 
-		pow := NewProofOfWork(&block.Header)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-		fmt.Println()
+		printBlock(block, readErr)
+		hash = hex.EncodeToString(header.PrevBlockHash)
+	}
 
-		if len(block.Header.PrevBlockHash) == 0 {
-			break
+	var info blockchainInfoResult
+	if err := client.Call("getblockchaininfo", &info); err != nil {
+		log.Panic(err)
+	}
+	if info.Pruned {
+		printPruneHeight(info.PruneHeight)
+	}
+}
+
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		log.Panic(err)
+	}
+	return data
+}
+
+// printBlock prints a block for printchain. err is ErrBlockPruned or
+// ErrBlockNoData for blocks whose body is not on disk.
+func printBlock(block *Block, err error) {
+	fmt.Printf("============ Block %x ============\n", block.Header.Hash())
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Prev. block: %x\n", block.Header.PrevBlockHash)
+
+	if errors.Is(err, ErrBlockPruned) {
+		fmt.Println("Tx: <pruned>")
+	}
+	if errors.Is(err, ErrBlockNoData) {
+		fmt.Println("Tx: <not downloaded>")
+	}
+
+	for _, tx := range block.Transactions {
+
+		fmt.Printf("Tx: %x\n", tx.Serialize())
+	}
+
+	pow := NewProofOfWork(&block.Header)
+	fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+	fmt.Println()
+}
+
+func printPruneHeight(pruneHeight int) {
+	if pruneHeight >= 0 {
+		fmt.Printf("Block bodies up to height %d have been pruned\n", pruneHeight)
+	}
+}
+
+func (cli *CLI) setPrune(target uint64, depth int) {
+	var cfg PruneConfig
+	var pruneHeight int
+	if client := cli.rpcClient(); client != nil {
+		var res struct {
+			Target      uint64
+			Depth       int
+			PruneHeight int
+		}
+		if err := client.Call("setprune", &res, target, depth); err != nil {
+			log.Panic(err)
 		}
+		cfg, pruneHeight = PruneConfig{Target: res.Target, Depth: res.Depth}, res.PruneHeight
+	} else {
+		chain := ContinueBlockchain(cli.nodeID())
+		defer chain.Close()
+
+		chain.SetPruneConfig(PruneConfig{Target: target, Depth: depth})
+		cfg, pruneHeight = chain.PruneConfig(), chain.PruneHeight()
+	}
+
+	if target == 0 {
+		fmt.Println("Prune mode disabled")
+		return
+	}
+
+	fmt.Printf("Prune mode enabled: target %d bytes, keeping the last %d blocks\n", cfg.Target, cfg.Depth)
+	if pruneHeight >= 0 {
+		fmt.Printf("Pruned block bodies up to height %d\n", pruneHeight)
 	}
 }
 
-func (cli *CLI) createWallet(nodeID string) {
+func (cli *CLI) createWallet(nodeID, curve string) {
+	if curve != "" {
+		cli.requireOffline("createwallet -curve")
+	}
+	if client := cli.rpcClient(); client != nil {
+		var address string
+		if err := client.Call("getnewaddress", &address); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Your new address: %s\n", address)
+		return
+	}
+
 	wallets, _ := NewWallets(nodeID)
-	address := wallets.CreateWallet()
+	masterKey := unlockOffline(wallets)
+	newSeed := !wallets.IsHD()
+	if curve != "" {
+		name := curveFlag(curve, false)
+		if !newSeed && wallets.HD.Curve != name {
+			fmt.Println("The wallet's seed is on another curve; -curve only applies to a new seed")
+			os.Exit(1)
+		}
+		if newSeed {
+			if err := wallets.NewSeed(name, masterKey); err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+	address, err := wallets.CreateWallet(masterKey)
+	if err != nil {
+		log.Panic(err)
+	}
 	wallets.SaveToFile(nodeID)
 
+	if newSeed {
+		mnemonic, _, err := wallets.Mnemonic(masterKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("New wallet seed. Write down this recovery phrase; restorewallet recreates every address from it:\n%s\n", mnemonic)
+	}
 	fmt.Printf("Your new address: %s\n", address)
 }
+
+// unlockOffline asks for the passphrase of an encrypted wallet and returns
+// its master key, or nil for an unencrypted wallet.
+func unlockOffline(wallets *Wallets) []byte {
+	if !wallets.IsEncrypted() {
+		return nil
+	}
+	masterKey, err := wallets.Unlock(readPassphrase("Wallet passphrase: ", ""))
+	if err != nil {
+		log.Panic(err)
+	}
+	return masterKey
+}
+
+// walletCoins returns the coins paying to address, or to every address of
+// the node's wallet.
+func (cli *CLI) walletCoins(chain *Blockchain, address string) []UnspentOutput {
+	var scripts [][]byte
+	if address != "" {
+		if !ValidateAddress(address) {
+			log.Panic("ERROR: Address is not valid")
+		}
+		scripts = append(scripts, []byte(address))
+	} else {
+		wallets, _ := NewWallets(cli.nodeID())
+		for address := range wallets.Wallets {
+			scripts = append(scripts, []byte(address))
+		}
+	}
+
+	coins, err := chain.FindCoins(scripts)
+	if err != nil {
+		log.Panic(err)
+	}
+	return coins
+}
+
+func (cli *CLI) getBalance(address string) {
+	var balance int64
+	if client := cli.rpcClient(); client != nil {
+		var params []any
+		if address != "" {
+			params = append(params, address)
+		}
+		if err := client.Call("getbalance", &balance, params...); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		chain := ContinueBlockchain(cli.nodeID())
+		defer chain.Close()
+		for _, coin := range cli.walletCoins(chain, address) {
+			if coin.Coin.Mature(chain.Height() + 1) {
+				balance += coin.Coin.Out.Value
+			}
+		}
+	}
+
+	if address == "" {
+		fmt.Printf("Balance of the wallet: %d\n", balance)
+	} else {
+		fmt.Printf("Balance of '%s': %d\n", address, balance)
+	}
+}
+
+func (cli *CLI) listUnspent(address string) {
+	var unspent []unspentResult
+	if client := cli.rpcClient(); client != nil {
+		var params []any
+		if address != "" {
+			params = append(params, address)
+		}
+		if err := client.Call("listunspent", &unspent, params...); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		chain := ContinueBlockchain(cli.nodeID())
+		defer chain.Close()
+		height := chain.Height()
+		for _, coin := range cli.walletCoins(chain, address) {
+			if coin.Coin.Mature(height + 1) {
+				unspent = append(unspent, newUnspentResult(coin, height))
+			}
+		}
+	}
+
+	for _, coin := range unspent {
+		fmt.Printf("%s:%d %s %d (%d confirmations)\n", coin.TxID, coin.Vout, coin.Address, coin.Amount, coin.Confirmations)
+	}
+}
+
+// send pays amount from the wallet address from. A running node puts the
+// payment in its mempool; otherwise it is mined here, in a block whose
+// reward goes to from.
+func (cli *CLI) send(from, to string, amount, fee int64) {
+	if client := cli.rpcClient(); client != nil {
+		var res sendFromResult
+		if err := client.Call("sendfrom", &res, from, to, amount, fee); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Sent %s\n", res.TxID)
+		printDroppedChange(res.DroppedChange)
+		return
+	}
+
+	nodeID := cli.nodeID()
+	wallets, _ := NewWallets(nodeID)
+	if _, ok := wallets.Wallets[from]; !ok {
+		log.Panic(fmt.Errorf("%w: %s", ErrWalletNotFound, from))
+	}
+	masterKey := unlockOffline(wallets)
+
+	chain := ContinueBlockchain(nodeID)
+	defer chain.Close()
+
+	var coins []UnspentOutput
+	for _, coin := range cli.walletCoins(chain, from) {
+		if coin.Coin.Mature(chain.Height() + 1) {
+			coins = append(coins, coin)
+		}
+	}
+	tx, dropped, err := wallets.CreateTransaction(coins, to, amount, fee, from, masterKey)
+	if err != nil {
+		log.Panic(err)
+	}
+	coinbase := NewHeightCoinbaseTX(from, "", chain.Height()+1)
+	block := chain.AddBlock([]*Transaction{coinbase, tx})
+	fmt.Printf("Sent %x in block %x\n", tx.ID(), block.Header.Hash())
+	printDroppedChange(dropped)
+}
+
+func printDroppedChange(dropped int64) {
+	if dropped > 0 {
+		fmt.Printf("Change of %d is below the dust threshold of %d and goes to the miner\n", dropped, dustThreshold)
+	}
+}
+
+func (cli *CLI) dumpMnemonic() {
+	if client := cli.rpcClient(); client != nil {
+		var res mnemonicResult
+		if err := client.Call("dumpmnemonic", &res); err != nil {
+			log.Panic(err)
+		}
+		printMnemonic(res.Mnemonic, res.Passphrase, res.AccountPath)
+		return
+	}
+
+	wallets, err := NewWallets(cli.nodeID())
+	if err != nil || !wallets.IsHD() {
+		fmt.Println("The wallet has no seed yet; createwallet creates one")
+		os.Exit(1)
+	}
+	mnemonic, passphrase, err := wallets.Mnemonic(unlockOffline(wallets))
+	if err != nil {
+		log.Panic(err)
+	}
+	printMnemonic(mnemonic, passphrase, hdAccountPath(wallets.HD.Account))
+}
+
+func printMnemonic(mnemonic, passphrase, accountPath string) {
+	fmt.Printf("Recovery phrase: %s\n", mnemonic)
+	if passphrase != "" {
+		fmt.Printf("Seed passphrase: %s\n", passphrase)
+	}
+	fmt.Printf("Account: %s\n", accountPath)
+}
+
+// curveFlag returns the curve name of a -curve flag; legacy, the encoding of
+// P-256 keys from before secp256k1, is only for restoring old seeds.
+func curveFlag(flag string, legacy bool) string {
+	switch {
+	case flag == "secp256k1":
+		return secp256k1.name
+	case flag == "p256":
+		return p256.name
+	case flag == "legacy" && legacy:
+		return legacyCurve
+	}
+	fmt.Printf("Unknown curve %q\n", flag)
+	os.Exit(1)
+	return ""
+}
+
+// restoreWallet recreates the wallet of mnemonic, scanning the main chain,
+// if the node has one, for the addresses it used.
+func (cli *CLI) restoreWallet(mnemonic, seedPassphrase, curve string) {
+	cli.requireOffline("restorewallet")
+
+	nodeID := cli.nodeID()
+	if _, err := os.Stat(fmt.Sprintf(walletFile, nodeID)); err == nil {
+		fmt.Printf("%s exists; move it away before restoring over it\n", fmt.Sprintf(walletFile, nodeID))
+		os.Exit(1)
+	}
+
+	used := make(map[string]bool)
+	if DBExists(fmt.Sprintf(dbPath, nodeID)) {
+		chain := ContinueBlockchain(nodeID)
+		var missing int
+		used, missing = usedAddresses(chain)
+		chain.Close()
+		if missing > 0 {
+			fmt.Printf("Warning: %d blocks are pruned or not downloaded, so addresses used only in them were not found and the restore is incomplete; restore on a node with the full chain to find them\n", missing)
+		}
+	}
+
+	wallets, _ := NewWallets(nodeID)
+	restored, err := wallets.Restore(mnemonic, seedPassphrase, curve, func(address string) bool { return used[address] })
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets.SaveToFile(nodeID)
+	fmt.Printf("Restored %d used addresses\n", restored)
+}
+
+// usedAddresses returns the addresses paid on the main chain, and how many
+// of its blocks have no body to look in.
+func usedAddresses(chain *Blockchain) (map[string]bool, int) {
+	used := make(map[string]bool)
+	var missing int
+	for iter := chain.Iterator(); ; {
+		block, err := iter.Next()
+		if err != nil {
+			missing++
+		} else {
+			for _, tx := range block.Transactions {
+				for _, out := range tx.Vout {
+					used[string(out.ScriptPubKey)] = true
+				}
+			}
+		}
+		if block.Height == 0 {
+			return used, missing
+		}
+	}
+}
+
+// stdin is shared by every read of standard input, so that buffering by
+// one does not swallow the lines meant for the next.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassphrase returns given, or else a line read from standard input
+// after prompting for it, so the passphrase need not be on the command line.
+func readPassphrase(prompt, given string) []byte {
+	if given != "" {
+		return []byte(given)
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		log.Panic(err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
+
+func (cli *CLI) encryptWallet(passphrase string) {
+	phrase := readPassphrase("New wallet passphrase: ", passphrase)
+
+	if client := cli.rpcClient(); client != nil {
+		if err := client.Call("encryptwallet", nil, string(phrase)); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("Wallet encrypted")
+		return
+	}
+
+	nodeID := cli.nodeID()
+	wallets, _ := NewWallets(nodeID)
+	if err := wallets.Encrypt(phrase); err != nil {
+		log.Panic(err)
+	}
+	wallets.SaveToFile(nodeID)
+	fmt.Println("Wallet encrypted")
+}
+
+func (cli *CLI) walletPassphrase(passphrase string, timeout int64) {
+	client := cli.rpcClient()
+	if client == nil {
+		fmt.Println("walletpassphrase needs the node running, as the node keeps the wallet unlocked")
+		os.Exit(1)
+	}
+
+	phrase := readPassphrase("Wallet passphrase: ", passphrase)
+	if err := client.Call("walletpassphrase", nil, string(phrase), timeout); err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Wallet unlocked for %d seconds\n", timeout)
+}
+
+func (cli *CLI) walletLock() {
+	client := cli.rpcClient()
+	if client == nil {
+		fmt.Println("walletlock needs the node running; a stopped node's wallet is always locked")
+		os.Exit(1)
+	}
+
+	if err := client.Call("walletlock", nil); err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("Wallet locked")
+}
+
+func (cli *CLI) walletPassphraseChange(oldPassphrase, newPassphrase string) {
+	oldPhrase := readPassphrase("Old wallet passphrase: ", oldPassphrase)
+	newPhrase := readPassphrase("New wallet passphrase: ", newPassphrase)
+
+	if client := cli.rpcClient(); client != nil {
+		if err := client.Call("walletpassphrasechange", nil, string(oldPhrase), string(newPhrase)); err != nil {
+			log.Panic(err)
+		}
+		fmt.Println("Passphrase changed")
+		return
+	}
+
+	nodeID := cli.nodeID()
+	wallets, _ := NewWallets(nodeID)
+	if err := wallets.ChangePassphrase(oldPhrase, newPhrase); err != nil {
+		log.Panic(err)
+	}
+	wallets.SaveToFile(nodeID)
+	fmt.Println("Passphrase changed")
+}
+
+func (cli *CLI) dumpTxOutSet(file, hash string) {
+	if client := cli.rpcClient(); client != nil {
+		// The node resolves relative paths against its own directory.
+		path, err := filepath.Abs(file)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		var res struct {
+			Height      int
+			BaseHash    string `json:"base_hash"`
+			ContentHash string `json:"content_hash"`
+		}
+		if err := client.Call("dumptxoutset", &res, path, hash); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Wrote UTXO set at height %d (block %s)\n", res.Height, res.BaseHash)
+		fmt.Printf("Content hash: %s\n", res.ContentHash)
+		return
+	}
+
+	chain := ContinueBlockchain(cli.nodeID())
+	defer chain.Close()
+
+	baseHash := chain.LastHash
+	if hash != "" {
+		var err error
+		baseHash, err = hex.DecodeString(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	contentHash, height, err := chain.DumpUTXOSet(f, baseHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Wrote UTXO set at height %d (block %x)\n", height, baseHash)
+	fmt.Printf("Content hash: %x\n", contentHash)
+}
+
+func (cli *CLI) loadTxOutSet(file, sha, from string) {
+	cli.requireOffline("loadtxoutset")
+
+	var expected []byte
+	if sha != "" {
+		var err error
+		expected, err = hex.DecodeString(sha)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer f.Close()
+
+	chain, err := LoadUTXOSnapshot(cli.nodeID(), f, expected)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer chain.Close()
+
+	info := chain.SnapshotInfo()
+	fmt.Printf("Loaded UTXO snapshot at height %d, tip %x\n", info.Height, info.BaseHash)
+	fmt.Printf("Content hash: %x\n", info.ContentHash)
+	fmt.Printf("MuHash: %x\n", chain.UTXOStats().Hash.Digest())
+
+	if from == "" {
+		fmt.Println("History not validated yet; run validatesnapshot -from NODE to validate it")
+		return
+	}
+
+	runSnapshotValidation(chain, from)
+}
+
+func (cli *CLI) validateSnapshot(from string) {
+	cli.requireOffline("validatesnapshot")
+
+	chain := ContinueBlockchain(cli.nodeID())
+	defer chain.Close()
+
+	if chain.SnapshotInfo() == nil {
+		fmt.Println("Chain was not loaded from a snapshot")
+		return
+	}
+
+	runSnapshotValidation(chain, from)
+}
+
+func runSnapshotValidation(chain *Blockchain, from string) {
+	source := ContinueBlockchain(from)
+	defer source.Close()
+
+	done := chain.StartSnapshotValidation(source, func(height, target int) {
+		fmt.Printf("Background validation: %d/%d\n", height, target)
+	})
+	if err := <-done; err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println("Background chain reached the snapshot height; snapshot validated")
+}
+
+func (cli *CLI) getTxOutSetInfo() {
+	if client := cli.rpcClient(); client != nil {
+		var res txOutSetInfoResult
+		if err := client.Call("gettxoutsetinfo", &res); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Height: %d\n", res.Height)
+		fmt.Printf("Best block: %s\n", res.BestBlock)
+		fmt.Printf("Txouts: %d\n", res.TxOuts)
+		fmt.Printf("Total amount: %d\n", res.TotalAmount)
+		fmt.Printf("Serialized size: %d\n", res.SerializedSize)
+		fmt.Printf("MuHash: %s\n", res.MuHash)
+		return
+	}
+
+	chain := ContinueBlockchain(cli.nodeID())
+	defer chain.Close()
+
+	stats := chain.UTXOStats()
+
+	fmt.Printf("Height: %d\n", chain.Height())
+	fmt.Printf("Best block: %x\n", chain.LastHash)
+	fmt.Printf("Txouts: %d\n", stats.Count)
+	fmt.Printf("Total amount: %d\n", stats.TotalAmount)
+	fmt.Printf("Serialized size: %d\n", stats.Size)
+	fmt.Printf("MuHash: %x\n", stats.Hash.Digest())
+}
+
+func (cli *CLI) invalidateBlock(hash string) {
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if client := cli.rpcClient(); client != nil {
+		if err := client.Call("invalidateblock", nil, hash); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Block %x invalidated\n", blockHash)
+		printTipRPC(client)
+		return
+	}
+
+	chain := ContinueBlockchain(cli.nodeID())
+	defer chain.Close()
+
+	if err := chain.InvalidateBlock(blockHash); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block %x invalidated\n", blockHash)
+	fmt.Printf("New tip: %x (height %d)\n", chain.LastHash, chain.Height())
+}
+
+func (cli *CLI) reconsiderBlock(hash string) {
+	blockHash, err := hex.DecodeString(hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if client := cli.rpcClient(); client != nil {
+		if err := client.Call("reconsiderblock", nil, hash); err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Block %x reconsidered\n", blockHash)
+		printTipRPC(client)
+		return
+	}
+
+	chain := ContinueBlockchain(cli.nodeID())
+	defer chain.Close()
+
+	if err := chain.ReconsiderBlock(blockHash); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block %x reconsidered\n", blockHash)
+	fmt.Printf("New tip: %x (height %d)\n", chain.LastHash, chain.Height())
+}
+
+func printTipRPC(client *RPCClient) {
+	var info blockchainInfoResult
+	if err := client.Call("getblockchaininfo", &info); err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("New tip: %s (height %d)\n", info.BestBlockHash, info.Blocks)
+}
+
+func (cli *CLI) getPeerInfo() {
+	var peers []peerInfoResult
+	if err := cli.requireNode("getpeerinfo").Call("getpeerinfo", &peers); err != nil {
+		log.Panic(err)
+	}
+
+	for _, p := range peers {
+		direction := "outbound"
+		if p.Inbound {
+			direction = "inbound"
+		}
+		fmt.Printf("%d %s %s %s height %d ping %.3fs banscore %d\n", p.ID, p.Addr, direction, p.Transport, p.StartingHeight, p.PingTime, p.BanScore)
+	}
+	fmt.Printf("%d peers\n", len(peers))
+}
+
+func (cli *CLI) addNode(addr, command string) {
+	if err := cli.requireNode("addnode").Call("addnode", nil, addr, command); err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("addnode %s %s done\n", addr, command)
+}
+
+func (cli *CLI) disconnectNode(addr string) {
+	if err := cli.requireNode("disconnectnode").Call("disconnectnode", nil, addr); err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Disconnected %s\n", addr)
+}
+
+func (cli *CLI) setBan(subnet, command string, seconds int64) {
+	if err := cli.requireNode("setban").Call("setban", nil, subnet, command, seconds); err != nil {
+		log.Panic(err)
+	}
+	if command == "remove" {
+		fmt.Printf("Unbanned %s\n", subnet)
+		return
+	}
+	fmt.Printf("Banned %s\n", subnet)
+}
+
+func (cli *CLI) listBanned() {
+	var bans []banResult
+	if err := cli.requireNode("listbanned").Call("listbanned", &bans); err != nil {
+		log.Panic(err)
+	}
+
+	for _, ban := range bans {
+		fmt.Printf("%s until %s (%s)\n", ban.Address, time.Unix(ban.BannedUntil, 0).Format(time.RFC3339), ban.BanReason)
+	}
+	fmt.Printf("%d bans\n", len(bans))
+}
+
+func (cli *CLI) clearBanned() {
+	if err := cli.requireNode("clearbanned").Call("clearbanned", nil); err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("All bans lifted")
+}
+
+func (cli *CLI) startNode(port int, connect, whitelist string, maxOutbound, maxInbound int, v2Transport, dandelion bool, rpcPort int, rpcUser, rpcPassword string, rest, explorer, metrics bool, trace string) {
+	nodeID := cli.nodeID()
+	if port == 0 {
+		port = DefaultPort(nodeID)
+	}
+	if rpcPort == 0 {
+		rpcPort = DefaultRPCPort(nodeID)
+	}
+
+	if trace != "" {
+		shutdown, err := setupTracing(trace)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				log.Printf("tracing: %v", err)
+			}
+		}()
+	}
+
+	chain := OpenBlockchain(nodeID)
+	defer chain.Close()
+
+	addrBook, err := LoadAddrBook(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	banList, err := LoadBanList(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	server := NewServer(chain, fmt.Sprintf(":%d", port), addrBook, banList)
+	server.MaxOutbound = maxOutbound
+	server.MaxInbound = maxInbound
+	server.V2Transport = v2Transport
+	server.Dandelion = dandelion
+	for _, subnet := range strings.Split(whitelist, ",") {
+		if subnet == "" {
+			continue
+		}
+		ipNet, err := ParseSubnet(subnet)
+		if err != nil {
+			log.Panic(err)
+		}
+		server.Whitelist = append(server.Whitelist, ipNet)
+	}
+	if err := server.Start(); err != nil {
+		log.Panic(err)
+	}
+	defer server.Stop()
+
+	rpc := NewRPCServer(server, nodeID, fmt.Sprintf("127.0.0.1:%d", rpcPort), rpcUser, rpcPassword)
+	rpc.REST = rest
+	rpc.Explorer = explorer
+	rpc.Metrics = metrics
+	if err := rpc.Start(); err != nil {
+		log.Panic(err)
+	}
+	defer rpc.Stop()
+
+	fresh, tried := addrBook.Size()
+	fmt.Printf("Node %s listening on port %d, height %d\n", nodeID, port, chain.Height())
+	fmt.Printf("JSON-RPC on %s\n", rpc.Addr())
+	if rest {
+		fmt.Printf("REST on http://%s/rest/\n", rpc.Addr())
+	}
+	if explorer {
+		fmt.Printf("Block explorer on http://%s/explorer/\n", rpc.Addr())
+	}
+	if metrics {
+		fmt.Printf("Metrics on http://%s/metrics\n", rpc.Addr())
+	}
+	if trace != "" {
+		fmt.Printf("Tracing to %s\n", trace)
+	}
+	fmt.Printf("Address book: %d new, %d tried\n", fresh, tried)
+	if banned := len(banList.List()); banned > 0 {
+		fmt.Printf("Ban list: %d banned subnets\n", banned)
+	}
+
+	for _, addr := range strings.Split(connect, ",") {
+		if addr == "" {
+			continue
+		}
+		if err := server.AddNode(addr); err != nil {
+			fmt.Printf("Could not add %s: %v\n", addr, err)
+		}
+	}
+
+	go runConsole(server, os.Stdin)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-interrupt:
+	case <-rpc.ShutdownRequested():
+	}
+
+	fmt.Println("Shutting down")
+}
+
+// runConsole reads peer management commands for a running node, one per
+// line, until r is exhausted.
+func runConsole(server *Server, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var err error
+		switch {
+		case fields[0] == "addnode" && len(fields) == 2:
+			err = server.AddNode(fields[1])
+		case fields[0] == "addnode" && len(fields) == 3 && fields[2] == "remove":
+			err = server.RemoveNode(fields[1])
+		case fields[0] == "addnode" && len(fields) == 3 && fields[2] == "onetry":
+			_, err = server.Connect(fields[1])
+		case fields[0] == "disconnectnode" && len(fields) == 2:
+			err = server.DisconnectNode(fields[1])
+		case fields[0] == "getpeerinfo":
+			printPeerInfo(server.PeerInfo())
+		case fields[0] == "setban" && len(fields) >= 3 && fields[2] == "add":
+			var seconds int
+			if len(fields) == 4 {
+				if seconds, err = strconv.Atoi(fields[3]); err != nil {
+					break
+				}
+			}
+			err = server.SetBan(fields[1], time.Duration(seconds)*time.Second)
+		case fields[0] == "setban" && len(fields) == 3 && fields[2] == "remove":
+			err = server.Unban(fields[1])
+		case fields[0] == "listbanned":
+			printBanList(server.ListBanned())
+		case fields[0] == "clearbanned":
+			err = server.ClearBanned()
+		default:
+			fmt.Println("Commands: addnode ADDR [remove|onetry], disconnectnode ADDR, getpeerinfo,")
+			fmt.Println("          setban SUBNET add [SECONDS], setban SUBNET remove, listbanned, clearbanned")
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+}
+
+func printPeerInfo(peers []PeerInfo) {
+	for _, p := range peers {
+		direction := "outbound"
+		if p.Inbound {
+			direction = "inbound"
+		}
+		if p.Added {
+			direction += ", added"
+		}
+
+		fmt.Printf("Peer %d: %s (%s)\n", p.ID, p.Addr, direction)
+		fmt.Printf("  Version: %d %s, services %d\n", p.Version, p.UserAgent, p.Services)
+		fmt.Printf("  Start height: %d\n", p.StartHeight)
+		fmt.Printf("  Connected: %s ago, ping %s\n", time.Since(p.ConnTime).Round(time.Second), p.PingTime)
+		fmt.Printf("  Ban score: %d\n", p.BanScore)
+		if p.SessionID != nil {
+			fmt.Printf("  Transport: v2, session %x\n", p.SessionID)
+		} else {
+			fmt.Println("  Transport: v1")
+		}
+	}
+	if len(peers) == 0 {
+		fmt.Println("No peers connected")
+	}
+}
+
+func printBanList(bans []BanEntry) {
+	for _, ban := range bans {
+		fmt.Printf("%s until %s (%s)\n", ban.Subnet, ban.Until.Format(time.RFC3339), ban.Reason)
+	}
+	if len(bans) == 0 {
+		fmt.Println("No banned subnets")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+)
+
+// Coins are selected as Bitcoin Core selects them. Branch and bound looks
+// for a set of coins that pays the target without change, overshooting by
+// no more than change would cost; failing that, the knapsack solver looks
+// for the set that comes closest to paying the target plus some change.
+const (
+	bnbMaxTries        = 100_000
+	knapsackIterations = 1000
+)
+
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// selectCoins picks coins worth at least target. costOfChange is what a
+// change output is worth to the wallet at most; paying up to that much over
+// the target is better than making change.
+func selectCoins(coins []UnspentOutput, target, costOfChange int64) ([]UnspentOutput, error) {
+	var total int64
+	for _, coin := range coins {
+		total += coin.Coin.Out.Value
+	}
+	if total < target {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, total, target)
+	}
+
+	if selected := selectCoinsBnB(coins, target, costOfChange); selected != nil {
+		return selected, nil
+	}
+	return selectCoinsKnapsack(coins, target, costOfChange+1), nil
+}
+
+// selectCoinsBnB searches depth first, largest coins first, for the coins
+// paying between target and target+costOfChange that overshoot the least,
+// giving up after bnbMaxTries steps. It returns nil if there are none.
+func selectCoinsBnB(coins []UnspentOutput, target, costOfChange int64) []UnspentOutput {
+	pool := slices.Clone(coins)
+	slices.SortFunc(pool, func(a, b UnspentOutput) int { return compareValues(b, a) })
+
+	var available int64
+	for _, coin := range pool {
+		available += coin.Coin.Out.Value
+	}
+
+	var selection, best []int
+	var value, bestExcess int64
+	for try, i := 0, 0; try < bnbMaxTries; try, i = try+1, i+1 {
+		backtrack := false
+		if value+available < target || value > target+costOfChange {
+			backtrack = true
+		} else if value >= target {
+			if excess := value - target; best == nil || excess < bestExcess {
+				best, bestExcess = slices.Clone(selection), excess
+				if excess == 0 {
+					break
+				}
+			}
+			backtrack = true
+		}
+
+		if backtrack {
+			if len(selection) == 0 {
+				break
+			}
+			// Coins left out of the last one included go back to what is
+			// available, and the branch leaving that one out comes next.
+			last := selection[len(selection)-1]
+			for i--; i > last; i-- {
+				available += pool[i].Coin.Out.Value
+			}
+			value -= pool[last].Coin.Out.Value
+			selection = selection[:len(selection)-1]
+			continue
+		}
+
+		available -= pool[i].Coin.Out.Value
+		// Leaving a coin out and then taking one of the same value is the
+		// branch already searched with the first taken instead.
+		if len(selection) == 0 || selection[len(selection)-1] == i-1 || pool[i].Coin.Out.Value != pool[i-1].Coin.Out.Value {
+			selection = append(selection, i)
+			value += pool[i].Coin.Out.Value
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	selected := make([]UnspentOutput, len(best))
+	for j, i := range best {
+		selected[j] = pool[i]
+	}
+	return selected
+}
+
+// selectCoinsKnapsack picks a single coin paying target exactly, or else
+// either the smallest coin paying target+minChange or the set of smaller
+// coins closest to paying it, whichever overshoots less. The coins must be
+// worth target in total.
+func selectCoinsKnapsack(coins []UnspentOutput, target, minChange int64) []UnspentOutput {
+	pool := slices.Clone(coins)
+	rand.Shuffle(len(pool), func(i, j int) { pool[i], pool[j] = pool[j], pool[i] })
+
+	var smaller []UnspentOutput
+	var lowestLarger *UnspentOutput
+	var totalSmaller int64
+	for i, coin := range pool {
+		switch value := coin.Coin.Out.Value; {
+		case value == target:
+			return []UnspentOutput{coin}
+		case value < target+minChange:
+			smaller = append(smaller, coin)
+			totalSmaller += value
+		case lowestLarger == nil || value < lowestLarger.Coin.Out.Value:
+			lowestLarger = &pool[i]
+		}
+	}
+
+	if totalSmaller == target {
+		return smaller
+	}
+	if totalSmaller < target {
+		return []UnspentOutput{*lowestLarger}
+	}
+
+	slices.SortFunc(smaller, func(a, b UnspentOutput) int { return compareValues(b, a) })
+	best, bestValue := approximateBestSubset(smaller, totalSmaller, target)
+	if bestValue != target && totalSmaller >= target+minChange {
+		best, bestValue = approximateBestSubset(smaller, totalSmaller, target+minChange)
+	}
+
+	if lowestLarger != nil && (bestValue != target && bestValue < target+minChange || lowestLarger.Coin.Out.Value <= bestValue) {
+		return []UnspentOutput{*lowestLarger}
+	}
+	var selected []UnspentOutput
+	for i, coin := range smaller {
+		if best[i] {
+			selected = append(selected, coin)
+		}
+	}
+	return selected
+}
+
+// approximateBestSubset tries random subsets of coins, worth total together,
+// for the one worth the least that is still worth target.
+func approximateBestSubset(coins []UnspentOutput, total, target int64) ([]bool, int64) {
+	best := make([]bool, len(coins))
+	for i := range best {
+		best[i] = true
+	}
+	bestValue := total
+
+	for range knapsackIterations {
+		if bestValue == target {
+			break
+		}
+		included := make([]bool, len(coins))
+		var value int64
+		reached := false
+		// The first pass takes each coin at random; the second takes the
+		// rest in order until the target is reached.
+		for pass := 0; pass < 2 && !reached; pass++ {
+			for i, coin := range coins {
+				if pass == 0 && rand.IntN(2) == 0 || pass == 1 && included[i] {
+					continue
+				}
+				value += coin.Coin.Out.Value
+				included[i] = true
+				if value >= target {
+					reached = true
+					if value < bestValue {
+						bestValue = value
+						copy(best, included)
+					}
+					value -= coin.Coin.Out.Value
+					included[i] = false
+				}
+			}
+		}
+	}
+	return best, bestValue
+}
+
+func compareValues(a, b UnspentOutput) int {
+	return cmp.Compare(a.Coin.Out.Value, b.Coin.Out.Value)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// Compact block relay, after BIP152: instead of a full block, peers that ask
+// for it with sendcmpct are sent the header and a 6-byte short ID for every
+// transaction, which they look up in their mempool. Only the coinbase, which
+// no mempool can have, is sent in full. Transactions that can't be found are
+// fetched with getblocktxn, and if the block still doesn't add up (a short
+// ID collision) the full block is requested.
+const compactBlockVersion = 1
+
+var errShortIDCollision = errors.New("short ID collision")
+
+// sipHash24 is SipHash-2-4 of data keyed with k0 and k1.
+func sipHash24(k0, k1 uint64, data []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	length := len(data)
+	for ; len(data) >= 8; data = data[8:] {
+		m := binary.LittleEndian.Uint64(data)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	var last [8]byte
+	copy(last[:], data)
+	last[7] = byte(length)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// shortIDKeys derives the SipHash key for a compact block from its header and
+// nonce, so short IDs differ between blocks and peers.
+func shortIDKeys(header *BlockHeader, nonce uint64) (k0, k1 uint64) {
+	h := sha256.Sum256(binary.LittleEndian.AppendUint64(header.Serialize(), nonce))
+	return binary.LittleEndian.Uint64(h[0:8]), binary.LittleEndian.Uint64(h[8:16])
+}
+
+func shortTxID(k0, k1 uint64, txid []byte) uint64 {
+	return sipHash24(k0, k1, txid) & 0xffffffffffff
+}
+
+// NewCompactBlock returns block as a compact block with a random nonce.
+func NewCompactBlock(block *Block) *MsgCmpctBlock {
+	m := &MsgCmpctBlock{Header: block.Header, Nonce: rand.Uint64()}
+	k0, k1 := shortIDKeys(&m.Header, m.Nonce)
+
+	for i, tx := range block.Transactions {
+		if i == 0 {
+			m.Prefilled = append(m.Prefilled, PrefilledTx{Index: 0, Tx: tx})
+			continue
+		}
+		m.ShortIDs = append(m.ShortIDs, shortTxID(k0, k1, tx.ID()))
+	}
+	return m
+}
+
+// partialBlock is a compact block being reconstructed.
+type partialBlock struct {
+	header  BlockHeader
+	txs     []*Transaction
+	missing []int // indexes of txs still nil
+}
+
+// reconstruct fills in what it can of m from the prefilled transactions and
+// the mempool. Malformed compact blocks are reported as ErrInvalidBlock, and
+// short IDs that are not unique within the block as errShortIDCollision.
+func (m *MsgCmpctBlock) reconstruct(mempool *TxPool) (*partialBlock, error) {
+	total := len(m.ShortIDs) + len(m.Prefilled)
+	if total == 0 {
+		return nil, fmt.Errorf("%w: no transactions", ErrInvalidBlock)
+	}
+
+	pb := &partialBlock{header: m.Header, txs: make([]*Transaction, total)}
+	for _, ptx := range m.Prefilled {
+		if ptx.Index >= total {
+			return nil, fmt.Errorf("%w: prefilled index %d out of range", ErrInvalidBlock, ptx.Index)
+		}
+		pb.txs[ptx.Index] = ptx.Tx
+	}
+
+	slots := make(map[uint64]int, len(m.ShortIDs))
+	next := 0
+	for _, id := range m.ShortIDs {
+		for pb.txs[next] != nil {
+			next++
+		}
+		if _, ok := slots[id]; ok {
+			return nil, errShortIDCollision
+		}
+		slots[id] = next
+		next++
+	}
+
+	// Two mempool transactions matching one short ID leave the slot empty;
+	// the right one is fetched from the peer.
+	k0, k1 := shortIDKeys(&m.Header, m.Nonce)
+	ambiguous := make(map[int]bool)
+	for _, desc := range mempool.Descs() {
+		i, ok := slots[shortTxID(k0, k1, desc.Tx.ID())]
+		if !ok {
+			continue
+		}
+		if pb.txs[i] != nil {
+			ambiguous[i] = true
+			continue
+		}
+		pb.txs[i] = desc.Tx
+	}
+	for i := range ambiguous {
+		pb.txs[i] = nil
+	}
+
+	for i, tx := range pb.txs {
+		if tx == nil {
+			pb.missing = append(pb.missing, i)
+		}
+	}
+	return pb, nil
+}
+
+// fill puts the transactions of a blocktxn answer into the missing slots.
+func (pb *partialBlock) fill(txs []*Transaction) error {
+	if len(txs) != len(pb.missing) {
+		return fmt.Errorf("%w: %d transactions for %d missing", ErrInvalidBlock, len(txs), len(pb.missing))
+	}
+	for i, index := range pb.missing {
+		pb.txs[index] = txs[i]
+	}
+	pb.missing = nil
+	return nil
+}
+
+func (pb *partialBlock) block() *Block {
+	return &Block{Header: pb.header, Transactions: pb.txs}
+}
+
+func (s *Server) handleSendCmpct(p *Peer, msg *MsgSendCmpct) {
+	if msg.Version != compactBlockVersion {
+		return
+	}
+
+	p.mu.Lock()
+	p.sendCompact = msg.Announce
+	p.mu.Unlock()
+}
+
+func (s *Server) handleCmpctBlock(p *Peer, msg *MsgCmpctBlock) {
+	hash := msg.Header.Hash()
+	p.AddKnownInventory(hash)
+
+	if err := CheckBlockHeader(&msg.Header); err != nil {
+		s.Misbehaving(p, 100, err.Error())
+		return
+	}
+	if entry, err := s.chain.GetBlockIndex(hash); err == nil && (entry.HaveData() || entry.Failed()) {
+		return
+	}
+
+	// Only blocks on top of ones we have are worth reconstructing; anything
+	// else goes through header sync.
+	parent, err := s.chain.GetBlockIndex(msg.Header.PrevBlockHash)
+	if err != nil || !parent.HaveData() {
+		s.sync.handleHeaders(p, &MsgHeaders{Headers: []BlockHeader{msg.Header}})
+		return
+	}
+
+	pb, err := msg.reconstruct(s.mempool)
+	if errors.Is(err, errShortIDCollision) {
+		s.requestFullBlock(p, hash)
+		return
+	}
+	if err != nil {
+		s.Misbehaving(p, 100, err.Error())
+		return
+	}
+
+	if len(pb.missing) > 0 {
+		p.mu.Lock()
+		p.partialBlock = pb
+		p.mu.Unlock()
+
+		p.QueueMessage(&MsgGetBlockTxn{BlockHash: hash, Indexes: pb.missing})
+		return
+	}
+
+	s.acceptCompactBlock(p, pb.block())
+}
+
+func (s *Server) handleGetBlockTxn(p *Peer, msg *MsgGetBlockTxn) {
+	block, err := s.chain.GetBlock(msg.BlockHash)
+	if err != nil {
+		p.QueueMessage(&MsgNotFound{Inv: []InvVect{{Type: InvTypeBlock, Hash: msg.BlockHash}}})
+		return
+	}
+
+	txs := make([]*Transaction, 0, len(msg.Indexes))
+	for _, index := range msg.Indexes {
+		if index >= len(block.Transactions) {
+			s.Misbehaving(p, 100, fmt.Sprintf("getblocktxn index %d out of range", index))
+			return
+		}
+		txs = append(txs, block.Transactions[index])
+	}
+
+	p.QueueMessage(&MsgBlockTxn{BlockHash: msg.BlockHash, Txs: txs})
+}
+
+func (s *Server) handleBlockTxn(p *Peer, msg *MsgBlockTxn) {
+	p.mu.Lock()
+	pb := p.partialBlock
+	if pb != nil && bytes.Equal(pb.header.Hash(), msg.BlockHash) {
+		p.partialBlock = nil
+	} else {
+		pb = nil
+	}
+	p.mu.Unlock()
+
+	if pb == nil {
+		s.Misbehaving(p, 10, "unsolicited blocktxn")
+		return
+	}
+
+	if err := pb.fill(msg.Txs); err != nil {
+		s.Misbehaving(p, 100, err.Error())
+		return
+	}
+	s.acceptCompactBlock(p, pb.block())
+}
+
+// acceptCompactBlock processes a reconstructed block. A block that fails the
+// context-free checks may just have been put together from the wrong
+// mempool transactions, so the full block is fetched instead of blaming the
+// peer.
+func (s *Server) acceptCompactBlock(p *Peer, block *Block) {
+	if err := CheckBlock(block); err != nil {
+		log.Printf("compact block %x from %s did not reconstruct: %v", block.Header.Hash(), p, err)
+		s.requestFullBlock(p, block.Header.Hash())
+		return
+	}
+
+	s.processBlock(p, block)
+}
+
+func (s *Server) requestFullBlock(p *Peer, hash []byte) {
+	s.sync.markRequested(p, hash)
+	p.QueueMessage(&MsgGetData{Inv: []InvVect{{Type: InvTypeBlock, Hash: hash}}})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	basePort             = 3000
+	connectInterval      = time.Second
+	addrBookSaveInterval = 10 * time.Minute
+)
+
+var ErrPeerNotFound = errors.New("peer not found")
+
+// DefaultPort is the port the node with nodeID listens on unless told
+// otherwise. node_1 listens on 3000, node_2 on 3001 and so on; other IDs are
+// hashed into the range 4000-4999, so each node on a host gets its own port
+// the same way it gets its own chain database.
+func DefaultPort(nodeID string) int {
+	if suffix, ok := strings.CutPrefix(nodeID, "node_"); ok {
+		if n, err := strconv.Atoi(suffix); err == nil && n >= 1 && n <= 1000 {
+			return basePort + n - 1
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(nodeID))
+	return basePort + 1000 + int(h.Sum32()%1000)
+}
+
+// addedNode is a peer added with AddNode. The server keeps reconnecting to
+// it, backing off after each failure, until it is removed.
+type addedNode struct {
+	peer     *Peer
+	attempts int
+	retryAt  time.Time
+}
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	ID          int
+	Addr        string
+	Inbound     bool
+	Added       bool
+	Services    uint64
+	Version     int32
+	UserAgent   string
+	StartHeight int
+	ConnTime    time.Time
+	PingTime    time.Duration
+	BanScore    int
+	SessionID   []byte // v2 transport session ID, nil for v1
+}
+
+func resolveAddr(addr string) (string, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	return tcpAddr.String(), nil
+}
+
+// AddNode adds addr to the peers the server stays connected to.
+func (s *Server) AddNode(addr string) error {
+	addr, err := resolveAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if _, ok := s.added[addr]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("node %s already added", addr)
+	}
+	s.added[addr] = &addedNode{}
+	for p := range s.peers {
+		if !p.inbound && p.addr == addr {
+			s.added[addr].peer = p
+		}
+	}
+	s.mu.Unlock()
+
+	s.connectPeers()
+	return nil
+}
+
+// RemoveNode stops reconnecting to a node added with AddNode. An existing
+// connection to it is kept.
+func (s *Server) RemoveNode(addr string) error {
+	addr, err := resolveAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.added[addr]; !ok {
+		return fmt.Errorf("node %s has not been added", addr)
+	}
+	delete(s.added, addr)
+	return nil
+}
+
+// DisconnectNode drops the connection to the peer at addr. Added nodes are
+// reconnected after a backoff.
+func (s *Server) DisconnectNode(addr string) error {
+	if resolved, err := resolveAddr(addr); err == nil {
+		addr = resolved
+	}
+
+	for _, p := range s.Peers() {
+		if p.addr == addr {
+			p.Disconnect()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrPeerNotFound, addr)
+}
+
+// PeerInfo returns the connected peers, ordered by connection ID.
+func (s *Server) PeerInfo() []PeerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]PeerInfo, 0, len(s.peers))
+	for p := range s.peers {
+		_, added := s.added[p.addr]
+
+		p.mu.Lock()
+		info := PeerInfo{
+			ID:          p.id,
+			Addr:        p.addr,
+			Inbound:     p.inbound,
+			Added:       added && !p.inbound,
+			StartHeight: -1,
+			ConnTime:    p.connectedAt,
+			PingTime:    p.pingLatency,
+			BanScore:    p.banScore,
+			SessionID:   p.sessionID,
+		}
+		if p.version != nil {
+			info.Services = p.version.Services
+			info.Version = p.version.Version
+			info.UserAgent = p.version.UserAgent
+			info.StartHeight = int(p.version.StartHeight)
+		}
+		p.mu.Unlock()
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// connectionCounts returns the number of outbound connections, not counting
+// added nodes, and of inbound connections.
+func (s *Server) connectionCounts() (outbound, inbound int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for p := range s.peers {
+		switch {
+		case p.inbound:
+			inbound++
+		case s.added[p.addr] == nil:
+			outbound++
+		}
+	}
+	for addr := range s.dialing {
+		if s.added[addr] == nil {
+			outbound++
+		}
+	}
+	return outbound, inbound
+}
+
+func (s *Server) markAddedConnected(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if node, ok := s.added[p.addr]; ok {
+		node.peer = p
+		node.attempts = 0
+	}
+}
+
+// connectionLoop keeps added nodes connected and fills the free outbound
+// slots with addresses from the address book.
+func (s *Server) connectionLoop() {
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+	saveTicker := time.NewTicker(addrBookSaveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.connectPeers()
+		case <-saveTicker.C:
+			if err := s.addrBook.Save(); err != nil {
+				log.Printf("saving address book: %v", err)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Server) connectPeers() {
+	now := time.Now()
+	self := s.advertisedAddr()
+
+	s.mu.Lock()
+	var retry []string
+	for addr, node := range s.added {
+		if node.peer == nil && !s.dialing[addr] && !now.Before(node.retryAt) {
+			s.dialing[addr] = true
+			retry = append(retry, addr)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, addr := range retry {
+		go s.dialAdded(addr)
+	}
+
+	for {
+		if outbound, _ := s.connectionCounts(); outbound >= s.MaxOutbound {
+			return
+		}
+
+		busy := make(map[string]bool)
+		s.mu.Lock()
+		for p := range s.peers {
+			busy[p.addr] = true
+		}
+		for addr := range s.dialing {
+			busy[addr] = true
+		}
+		s.mu.Unlock()
+
+		ka := s.addrBook.Select(func(addr string) bool {
+			return busy[addr] || addr == self || s.banList.IsBannedAddr(addr)
+		})
+		if ka == nil {
+			return
+		}
+
+		addr := ka.Addr.String()
+		s.mu.Lock()
+		s.dialing[addr] = true
+		s.mu.Unlock()
+
+		s.addrBook.Attempt(addr)
+		go s.dial(addr)
+	}
+}
+
+func (s *Server) dial(addr string) {
+	_, err := s.Connect(addr)
+
+	s.mu.Lock()
+	delete(s.dialing, addr)
+	s.mu.Unlock()
+
+	if err != nil {
+		log.Printf("connect to %s: %v", addr, err)
+	}
+}
+
+func (s *Server) dialAdded(addr string) {
+	p, err := s.Connect(addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.dialing, addr)
+	node, ok := s.added[addr]
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		node.retryAt = time.Now().Add(retryBackoff(node.attempts))
+		node.attempts++
+		log.Printf("connect to added node %s: %v (retrying in %s)", addr, err, retryBackoff(node.attempts-1))
+		return
+	}
+	if p.Connected() {
+		node.peer = p
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Dandelion relay, after Dandelion++ (BIP156): a new transaction is first
+// passed along a stem, one randomly chosen outbound peer per hop, before one
+// node on the way "fluffs" it and it is announced to everyone as usual. A
+// node watching announcements then learns which node fluffed it, not which
+// created it. Each node picks its stem peer and whether it fluffs every
+// transaction it is handed for an epoch at a time. Every node a transaction
+// passes sets an embargo timer and fluffs it itself if the transaction
+// hasn't been announced to it by then, so a stem peer that drops
+// transactions can't stop them.
+//
+// Tests shorten the timers.
+var (
+	dandelionEpoch       = 10 * time.Minute
+	dandelionFluffRate   = 0.1
+	embargoMin           = 10 * time.Second
+	embargoMean          = 20 * time.Second // mean of the random part
+	embargoCheckInterval = time.Second
+)
+
+type stemState struct {
+	mu        sync.Mutex
+	epochEnd  time.Time
+	diffuser  bool  // fluff every transaction received this epoch
+	peer      *Peer // stem successor this epoch
+	embargoes map[string]time.Time
+}
+
+// stemSuccessor returns the peer to pass a stem transaction from from (nil
+// for our own) to, or nil if it should be fluffed here.
+func (s *Server) stemSuccessor(from *Peer) *Peer {
+	var candidates []*Peer
+	for _, p := range s.Peers() {
+		if !p.inbound && p != from && p.HandshakeDone() && p.Services()&serviceDandelion != 0 {
+			candidates = append(candidates, p)
+		}
+	}
+
+	st := &s.stem
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if time.Now().After(st.epochEnd) {
+		st.epochEnd = time.Now().Add(dandelionEpoch)
+		st.diffuser = rand.Float64() < dandelionFluffRate
+		st.peer = nil
+	}
+	if from != nil && st.diffuser {
+		return nil
+	}
+
+	if st.peer == nil || !st.peer.Connected() || st.peer == from {
+		st.peer = nil
+		if len(candidates) > 0 {
+			st.peer = candidates[rand.IntN(len(candidates))]
+		}
+	}
+	return st.peer
+}
+
+// stemTransaction passes tx, which is in the mempool in the stem phase, on to
+// the stem successor, or fluffs it.
+func (s *Server) stemTransaction(tx *Transaction, from *Peer) {
+	txid := tx.ID()
+
+	next := s.stemSuccessor(from)
+	if next == nil {
+		s.fluffTransaction(txid)
+		return
+	}
+
+	embargo := embargoMin + time.Duration(rand.ExpFloat64()*float64(embargoMean))
+	s.stem.mu.Lock()
+	s.stem.embargoes[string(txid)] = time.Now().Add(embargo)
+	s.stem.mu.Unlock()
+
+	next.QueueMessage(&MsgDandelionTx{Tx: tx})
+}
+
+// fluffTransaction ends the stem phase of txid and announces it.
+func (s *Server) fluffTransaction(txid []byte) {
+	s.stem.mu.Lock()
+	delete(s.stem.embargoes, string(txid))
+	s.stem.mu.Unlock()
+
+	if s.mempool.Fluff(txid) {
+		s.relayTransaction(txid)
+	}
+}
+
+func (s *Server) handleDandelionTx(p *Peer, msg *MsgDandelionTx) {
+	tx := msg.Tx
+	txid := tx.ID()
+
+	if !s.Dandelion {
+		s.acceptTransaction(p, tx)
+		return
+	}
+
+	_, err := s.mempool.MaybeAcceptStemTransaction(tx)
+	switch {
+	case errors.Is(err, ErrTxAlreadyKnown):
+		return
+	case errors.Is(err, ErrMissingInput):
+		log.Printf("stem tx %x from %s has missing inputs", txid, p)
+		return
+	case err != nil:
+		log.Printf("rejected stem tx %x from %s: %v", txid, p, err)
+		if errors.Is(err, ErrInvalidTx) {
+			s.Misbehaving(p, 10, "invalid transaction")
+		}
+		return
+	}
+
+	s.stemTransaction(tx, p)
+}
+
+// dandelionLoop fluffs transactions whose embargo ran out.
+func (s *Server) dandelionLoop() {
+	ticker := time.NewTicker(embargoCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			var expired [][]byte
+			s.stem.mu.Lock()
+			for txid, embargo := range s.stem.embargoes {
+				if now.After(embargo) {
+					expired = append(expired, []byte(txid))
+				}
+			}
+			s.stem.mu.Unlock()
+
+			for _, txid := range expired {
+				if s.mempool.IsStem(txid) {
+					log.Printf("embargo of tx %x expired, fluffing it", txid)
+				}
+				s.fluffTransaction(txid)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
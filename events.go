@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+)
+
+// Event is something that happened to the chain or the mempool.
+type Event interface {
+	isEvent()
+}
+
+// BlockConnected is published for each block that joins the main chain,
+// oldest first.
+type BlockConnected struct {
+	Entry *BlockIndexEntry
+	Block *Block
+}
+
+// BlockDisconnected is published for each block that leaves the main chain
+// in a reorganization, tip first, before the blocks replacing them connect.
+type BlockDisconnected struct {
+	Entry *BlockIndexEntry
+	Block *Block
+}
+
+// TipChanged follows the BlockConnected and BlockDisconnected events of one
+// tip change. Old is nil if the chain was empty.
+type TipChanged struct {
+	Old, New []byte
+	Height   int
+}
+
+// TxAcceptedToMempool is published when a transaction enters the mempool,
+// or, for a Dandelion stem transaction, when it is announced.
+type TxAcceptedToMempool struct {
+	Desc *TxDesc
+}
+
+func (BlockConnected) isEvent()      {}
+func (BlockDisconnected) isEvent()   {}
+func (TipChanged) isEvent()          {}
+func (TxAcceptedToMempool) isEvent() {}
+
+// EventHandler is called with each event published to a subscription.
+type EventHandler func(Event)
+
+// Handle returns a handler that calls fn for events of type E only.
+func Handle[E Event](fn func(E)) EventHandler {
+	return func(e Event) {
+		if e, ok := e.(E); ok {
+			fn(e)
+		}
+	}
+}
+
+// EventBus delivers events to subscribers, each of which sees every event in
+// the order it was published. Synchronous subscribers run inside Publish;
+// asynchronous ones get their own goroutine and a buffer, and when that is
+// full Publish waits, so a slow subscriber holds back the publisher rather
+// than miss events.
+//
+// Chain events are published with the chain locked, so handlers may read it
+// but must not change it, publish events themselves or, if synchronous,
+// block for long.
+type EventBus struct {
+	publishMu sync.Mutex // one event at a time, so every subscriber sees the same order
+
+	mu   sync.Mutex
+	subs []*Subscription // replaced, not modified, so Publish can use a copy
+}
+
+// Subscription is a subscriber's registration with an EventBus.
+type Subscription struct {
+	bus     *EventBus
+	handler EventHandler
+	queue   chan Event // nil for a synchronous subscriber
+	done    chan struct{}
+	once    sync.Once
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe calls handler with every event, on the publishing goroutine.
+func (b *EventBus) Subscribe(handler EventHandler) *Subscription {
+	s := &Subscription{bus: b, handler: handler, done: make(chan struct{})}
+	b.add(s)
+	return s
+}
+
+// SubscribeAsync calls handler with every event on a goroutine of its own,
+// queueing up to buffer events.
+func (b *EventBus) SubscribeAsync(buffer int, handler EventHandler) *Subscription {
+	s := &Subscription{bus: b, handler: handler, queue: make(chan Event, buffer), done: make(chan struct{})}
+	b.add(s)
+	go s.loop()
+	return s
+}
+
+func (b *EventBus) add(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs = append(b.subs[:len(b.subs):len(b.subs)], s)
+}
+
+func (b *EventBus) subscribers() []*Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.subs
+}
+
+// Publish hands e to every subscriber.
+func (b *EventBus) Publish(e Event) {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	for _, s := range b.subscribers() {
+		if s.queue == nil {
+			select {
+			case <-s.done:
+			default:
+				s.handler(e)
+			}
+			continue
+		}
+
+		select {
+		case s.queue <- e:
+		case <-s.done:
+		}
+	}
+}
+
+func (s *Subscription) loop() {
+	for {
+		select {
+		case e := <-s.queue:
+			s.handler(e)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Unsubscribe stops delivery to the subscriber. Events still queued for an
+// asynchronous subscriber are dropped.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		close(s.done)
+
+		b := s.bus
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		subs := make([]*Subscription, 0, len(b.subs))
+		for _, other := range b.subs {
+			if other != s {
+				subs = append(subs, other)
+			}
+		}
+		b.subs = subs
+	})
+}
+
+// Events returns the bus the chain and its mempool publish to.
+func (chain *Blockchain) Events() *EventBus {
+	return chain.events
+}
+
+// publishTipChanges publishes the blocks that left and joined the main chain
+// since the last call, then the new tip. The caller must hold chain.mu.
+func (chain *Blockchain) publishTipChanges() {
+	tip := chain.Tip()
+	old := chain.eventTip
+	if bytes.Equal(tip, old) {
+		return
+	}
+	chain.eventTip = tip
+	if len(chain.events.subscribers()) == 0 {
+		return
+	}
+
+	disconnected, connected, err := tipDiff(chain, old, tip)
+	if err != nil {
+		log.Printf("events: %v", err)
+		return
+	}
+
+	for _, entry := range disconnected {
+		block, err := chain.GetBlock(entry.Hash())
+		if err != nil {
+			log.Printf("events: block %x: %v", entry.Hash(), err)
+			continue
+		}
+		chain.events.Publish(BlockDisconnected{Entry: entry, Block: block})
+	}
+	for _, entry := range connected {
+		block, err := chain.GetBlock(entry.Hash())
+		if err != nil {
+			log.Printf("events: block %x: %v", entry.Hash(), err)
+			continue
+		}
+		chain.events.Publish(BlockConnected{Entry: entry, Block: block})
+	}
+	chain.events.Publish(TipChanged{Old: old, New: tip, Height: chain.Height()})
+}
+
+// tipDiff returns the blocks between the fork point of the chains ending in
+// oldTip and newTip and those tips: the ones only on the old chain, tip
+// first, and the ones only on the new chain, oldest first. oldTip is nil for
+// an empty chain.
+func tipDiff(chain *Blockchain, oldTip, newTip []byte) (disconnected, connected []*BlockIndexEntry, err error) {
+	entry := func(hash []byte) (*BlockIndexEntry, error) {
+		if hash == nil {
+			return nil, nil
+		}
+		return chain.GetBlockIndex(hash)
+	}
+	parent := func(e *BlockIndexEntry) (*BlockIndexEntry, error) {
+		if e.Height == 0 {
+			return nil, nil
+		}
+		return chain.GetBlockIndex(e.Header.PrevBlockHash)
+	}
+
+	old, err := entry(oldTip)
+	if err != nil {
+		return nil, nil, err
+	}
+	cur, err := entry(newTip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for old != nil || cur != nil {
+		if old != nil && cur != nil && bytes.Equal(old.Hash(), cur.Hash()) {
+			break
+		}
+		if cur == nil || (old != nil && old.Height >= cur.Height) {
+			disconnected = append(disconnected, old)
+			old, err = parent(old)
+		} else {
+			connected = append(connected, cur)
+			cur, err = parent(cur)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for i, j := 0, len(connected)-1; i < j; i, j = i+1, j-1 {
+		connected[i], connected[j] = connected[j], connected[i]
+	}
+	return disconnected, connected, nil
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The block explorer is a handful of server-rendered pages under /explorer/,
+// templates and stylesheet compiled into the binary. Like REST it is
+// read-only and sits behind the RPC credentials.
+const (
+	explorerLatestBlocks = 20
+	explorerTimeWindow   = 100 // blocks averaged over for the block interval
+)
+
+//go:embed explorer
+var explorerFiles embed.FS
+
+var explorerTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"short": func(s string) string {
+		if len(s) <= 16 {
+			return s
+		}
+		return s[:8] + "…" + s[len(s)-8:]
+	},
+	"time": func(ts uint32) string {
+		return time.Unix(int64(ts), 0).UTC().Format("2006-01-02 15:04:05 UTC")
+	},
+}).ParseFS(explorerFiles, "explorer/*.html"))
+
+type explorerHandler struct {
+	server *Server
+	chain  *Blockchain
+	mux    *http.ServeMux
+}
+
+func newExplorerHandler(server *Server) *explorerHandler {
+	h := &explorerHandler{server: server, chain: server.chain, mux: http.NewServeMux()}
+
+	static, err := fs.Sub(explorerFiles, "explorer")
+	if err != nil {
+		log.Panic(err)
+	}
+	h.mux.Handle("GET /explorer/style.css", http.StripPrefix("/explorer/", http.FileServerFS(static)))
+	h.mux.HandleFunc("GET /explorer/{$}", h.handleIndex)
+	h.mux.HandleFunc("GET /explorer/block/{id}", h.handleBlock)
+	h.mux.HandleFunc("GET /explorer/tx/{txid}", h.handleTx)
+	h.mux.HandleFunc("GET /explorer/address/{address}", h.handleAddress)
+	h.mux.HandleFunc("GET /explorer/search", h.handleSearch)
+	return h
+}
+
+func (h *explorerHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(w, req)
+}
+
+func (h *explorerHandler) render(w http.ResponseWriter, status int, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := explorerTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("explorer: %s: %v", name, err)
+	}
+}
+
+func (h *explorerHandler) fail(w http.ResponseWriter, status int, format string, args ...any) {
+	h.render(w, status, "error.html", fmt.Sprintf(format, args...))
+}
+
+type explorerBlockSummary struct {
+	Hash       string
+	Height     int
+	Time       uint32
+	NTx        int // -1 if the body is not on disk
+	Size       uint32
+	Difficulty float64
+}
+
+type explorerPoW struct {
+	Bits       string
+	Target     string
+	Difficulty float64
+	ChainWork  string
+	Interval   time.Duration // average over recent blocks, 0 if unknown
+	HashRate   float64       // hashes per second implied by Interval
+}
+
+type explorerIndexPage struct {
+	Height  int
+	Tip     string
+	Headers int
+	Mempool int
+	PoW     explorerPoW
+	Blocks  []explorerBlockSummary
+}
+
+// newExplorerPoW describes the proof of work of entry, averaging the block
+// interval over the explorerTimeWindow blocks before it.
+func (h *explorerHandler) newExplorerPoW(entry *BlockIndexEntry) explorerPoW {
+	pow := explorerPoW{
+		Bits:       fmt.Sprintf("%08x", entry.Header.Bits),
+		Target:     fmt.Sprintf("%064x", BitsToTarget(entry.Header.Bits)),
+		Difficulty: Difficulty(entry.Header.Bits),
+		ChainWork:  fmt.Sprintf("%064x", entry.ChainWork),
+	}
+
+	window := min(explorerTimeWindow, entry.Height)
+	if window == 0 {
+		return pow
+	}
+	hash, err := h.chain.GetBlockHash(entry.Height - window)
+	if err != nil {
+		return pow
+	}
+	first, err := h.chain.GetBlockIndex(hash)
+	if err != nil || entry.Header.Timestamp <= first.Header.Timestamp {
+		return pow
+	}
+
+	pow.Interval = time.Duration(entry.Header.Timestamp-first.Header.Timestamp) * time.Second / time.Duration(window)
+	work, _ := new(big.Float).SetInt(CalcWork(entry.Header.Bits)).Float64()
+	pow.HashRate = work / pow.Interval.Seconds()
+	return pow
+}
+
+func (h *explorerHandler) handleIndex(w http.ResponseWriter, req *http.Request) {
+	tip := h.chain.Tip()
+	if tip == nil {
+		h.fail(w, http.StatusNotFound, "The chain is empty.")
+		return
+	}
+	entry, err := h.chain.GetBlockIndex(tip)
+	if err != nil {
+		h.fail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	_, headers := h.server.SyncProgress()
+	page := explorerIndexPage{
+		Height:  entry.Height,
+		Tip:     hex.EncodeToString(tip),
+		Headers: headers,
+		Mempool: h.server.Mempool().Count(),
+		PoW:     h.newExplorerPoW(entry),
+	}
+
+	for height := entry.Height; height >= 0 && len(page.Blocks) < explorerLatestBlocks; height-- {
+		hash, err := h.chain.GetBlockHash(height)
+		if err != nil {
+			break
+		}
+		e, err := h.chain.GetBlockIndex(hash)
+		if err != nil {
+			break
+		}
+
+		summary := explorerBlockSummary{
+			Hash:       hex.EncodeToString(hash),
+			Height:     height,
+			Time:       e.Header.Timestamp,
+			NTx:        -1,
+			Size:       e.Size,
+			Difficulty: Difficulty(e.Header.Bits),
+		}
+		if block, err := h.chain.GetBlock(hash); err == nil {
+			summary.NTx = len(block.Transactions)
+		}
+		page.Blocks = append(page.Blocks, summary)
+	}
+
+	h.render(w, http.StatusOK, "index.html", page)
+}
+
+type explorerInput struct {
+	TxID    string
+	Vout    uint32
+	Value   int64
+	Address string
+	Known   bool // whether the funding output was found
+}
+
+type explorerOutput struct {
+	N       int
+	Value   int64
+	Address string
+	Script  string
+	Status  string
+}
+
+type explorerTx struct {
+	TxID          string
+	Size          int
+	LockTime      uint32
+	Coinbase      string // hex coinbase data, for coinbase transactions
+	Inputs        []explorerInput
+	Outputs       []explorerOutput
+	In, Out       int64
+	Fee           int64 // -1 if an input is unknown
+	BlockHash     string
+	Height        int
+	Time          uint32
+	Confirmations int
+}
+
+// newExplorerTx describes tx, found in block or else the mempool. spent are
+// the coins its inputs spend, nil if not known.
+func (h *explorerHandler) newExplorerTx(tx *Transaction, block *Block, spent []*Coin) explorerTx {
+	res := newBlockTxResult(h.chain, tx, block)
+	etx := explorerTx{
+		TxID:          res.TxID,
+		Size:          res.Size,
+		LockTime:      res.LockTime,
+		BlockHash:     res.BlockHash,
+		Confirmations: res.Confirmations,
+	}
+	if block != nil {
+		etx.Height = block.Height
+		etx.Time = block.Header.Timestamp
+	}
+
+	mempool := h.server.Mempool()
+	known := true
+	for i, vin := range tx.Vin {
+		if tx.IsCoinbase() {
+			etx.Coinbase = res.Vin[i].Coinbase
+			continue
+		}
+
+		in := explorerInput{TxID: res.Vin[i].TxID, Vout: vin.Vout}
+		var coin *Coin
+		if spent != nil {
+			coin = spent[i]
+		} else if parent := mempool.Get(vin.PrevTxID); parent != nil && int(vin.Vout) < len(parent.Vout) {
+			coin = &Coin{Out: parent.Vout[vin.Vout]}
+		} else if c, err := h.chain.GetCoin(vin.PrevTxID, vin.Vout); err == nil {
+			coin = c
+		}
+		if coin != nil {
+			in.Known = true
+			in.Value = coin.Out.Value
+			in.Address = scriptAddress(coin.Out.ScriptPubKey)
+			etx.In += in.Value
+		} else {
+			known = false
+		}
+		etx.Inputs = append(etx.Inputs, in)
+	}
+
+	txid := tx.ID()
+	for i, out := range res.Vout {
+		status := "unconfirmed"
+		if block != nil && etx.Confirmations < 0 {
+			status = "not on the main chain"
+		} else if block != nil {
+			status = "spent"
+			if _, err := h.chain.GetCoin(txid, uint32(i)); err == nil {
+				status = "unspent"
+			}
+		}
+		if mempool.IsSpent(txid, uint32(i)) {
+			status = "spent by an unconfirmed transaction"
+		}
+
+		etx.Outputs = append(etx.Outputs, explorerOutput{
+			N:       i,
+			Value:   out.Value,
+			Address: out.Address,
+			Script:  out.ScriptPubKey,
+			Status:  status,
+		})
+		etx.Out += out.Value
+	}
+
+	etx.Fee = -1
+	if known && !tx.IsCoinbase() {
+		etx.Fee = etx.In - etx.Out
+	}
+	return etx
+}
+
+// blockTxs describes the transactions of a main chain block, with the
+// coins they spend taken from its undo data.
+func (h *explorerHandler) blockTxs(block *Block) []explorerTx {
+	spent, err := h.chain.GetSpentCoins(block.Header.Hash())
+	if err != nil {
+		spent = nil
+	}
+
+	var txs []explorerTx
+	next := 0
+	for _, tx := range block.Transactions {
+		var txSpent []*Coin
+		if !tx.IsCoinbase() && spent != nil && next+len(tx.Vin) <= len(spent) {
+			txSpent = spent[next : next+len(tx.Vin)]
+			next += len(tx.Vin)
+		}
+		txs = append(txs, h.newExplorerTx(tx, block, txSpent))
+	}
+	return txs
+}
+
+type explorerBlockPage struct {
+	Block  blockResult
+	PoW    explorerPoW
+	Pruned string
+	Txs    []explorerTx
+}
+
+func (h *explorerHandler) handleBlock(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+
+	var hash []byte
+	if height, err := strconv.Atoi(id); err == nil && len(id) < 64 {
+		if hash, err = h.chain.GetBlockHash(height); err != nil {
+			h.fail(w, http.StatusNotFound, "There is no block at height %d.", height)
+			return
+		}
+	} else if hash, err = hex.DecodeString(id); err != nil || len(hash) != 32 {
+		h.fail(w, http.StatusBadRequest, "%q is neither a block hash nor a height.", id)
+		return
+	}
+
+	entry, err := h.chain.GetBlockIndex(hash)
+	if errors.Is(err, ErrBlockNotFound) {
+		h.fail(w, http.StatusNotFound, "Block %s not found.", id)
+		return
+	}
+	if err != nil {
+		h.fail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	page := explorerBlockPage{PoW: h.newExplorerPoW(entry)}
+	block, err := h.chain.GetBlock(hash)
+	switch {
+	case errors.Is(err, ErrBlockPruned) || errors.Is(err, ErrBlockNoData):
+		page.Pruned = err.Error()
+	case err != nil:
+		h.fail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	page.Block = newBlockResult(h.chain, entry, block, false)
+	if page.Pruned == "" {
+		page.Txs = h.blockTxs(block)
+	}
+
+	h.render(w, http.StatusOK, "block.html", page)
+}
+
+func (h *explorerHandler) handleTx(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("txid")
+	txid, err := hex.DecodeString(id)
+	if err != nil || len(txid) != 32 {
+		h.fail(w, http.StatusBadRequest, "%q is not a transaction id.", id)
+		return
+	}
+
+	if tx := h.server.Mempool().Get(txid); tx != nil {
+		h.render(w, http.StatusOK, "tx.html", h.newExplorerTx(tx, nil, nil))
+		return
+	}
+
+	_, block, err := h.chain.FindTransaction(txid)
+	if errors.Is(err, ErrTxNotFound) {
+		h.fail(w, http.StatusNotFound, "Transaction %s not found in the mempool or the main chain.", id)
+		return
+	}
+	if err != nil {
+		h.fail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	for _, etx := range h.blockTxs(block) {
+		if etx.TxID == id {
+			h.render(w, http.StatusOK, "tx.html", etx)
+			return
+		}
+	}
+	h.fail(w, http.StatusInternalServerError, "Transaction %s vanished from its block.", id)
+}
+
+type explorerUTXO struct {
+	TxID   string
+	Vout   uint32
+	Value  int64
+	Height int
+}
+
+type explorerAddressPage struct {
+	Address     string
+	Balance     int64
+	UTXOs       []explorerUTXO
+	Unconfirmed []explorerTx
+}
+
+// handleAddress shows what an address holds. There is no address index, so
+// instead of a full history it lists the address's unspent outputs and the
+// mempool transactions paying or spending from it.
+func (h *explorerHandler) handleAddress(w http.ResponseWriter, req *http.Request) {
+	address := req.PathValue("address")
+	if !ValidateAddress(address) {
+		h.fail(w, http.StatusBadRequest, "%q is not a valid address.", address)
+		return
+	}
+
+	coins, err := h.chain.FindCoins([][]byte{[]byte(address)})
+	if err != nil {
+		h.fail(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	page := explorerAddressPage{Address: address}
+	for _, c := range coins {
+		page.Balance += c.Coin.Out.Value
+		page.UTXOs = append(page.UTXOs, explorerUTXO{
+			TxID:   hex.EncodeToString(c.TxID),
+			Vout:   c.Vout,
+			Value:  c.Coin.Out.Value,
+			Height: c.Coin.Height,
+		})
+	}
+
+	for _, desc := range h.server.Mempool().Descs() {
+		etx := h.newExplorerTx(desc.Tx, nil, nil)
+		involved := false
+		for _, in := range etx.Inputs {
+			involved = involved || in.Address == address
+		}
+		for _, out := range etx.Outputs {
+			involved = involved || out.Address == address
+		}
+		if involved {
+			page.Unconfirmed = append(page.Unconfirmed, etx)
+		}
+	}
+
+	h.render(w, http.StatusOK, "address.html", page)
+}
+
+// handleSearch sends a height, block hash, txid or address to its page.
+func (h *explorerHandler) handleSearch(w http.ResponseWriter, req *http.Request) {
+	q := strings.TrimSpace(req.URL.Query().Get("q"))
+
+	target := ""
+	if _, err := strconv.ParseUint(q, 10, 31); err == nil {
+		target = "/explorer/block/" + q
+	} else if hash, err := hex.DecodeString(q); err == nil && len(hash) == 32 {
+		if _, err := h.chain.GetBlockIndex(hash); err == nil {
+			target = "/explorer/block/" + q
+		} else if h.server.Mempool().Have(hash) {
+			target = "/explorer/tx/" + q
+		} else if _, _, err := h.chain.FindTransaction(hash); err == nil {
+			target = "/explorer/tx/" + q
+		}
+	} else if ValidateAddress(q) {
+		target = "/explorer/address/" + q
+	}
+
+	if target == "" {
+		h.fail(w, http.StatusNotFound, "Nothing found for %q.", q)
+		return
+	}
+	http.Redirect(w, req, target, http.StatusFound)
+}
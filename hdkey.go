@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Wallet keys are derived from the seed as in BIP32. Seeds of P-256 wallets
+// use the seed key "Nist256p1 seed" and retry out of range keys as SLIP-0010
+// specifies for that curve; on secp256k1 this is plain BIP32, where such a
+// child index is skipped and such a seed is unusable.
+const (
+	hardenedKey  = 0x80000000
+	maxHDDepth   = 255
+	hdPathPrefix = "m"
+)
+
+var (
+	ErrInvalidPath  = errors.New("invalid derivation path")
+	ErrInvalidChild = errors.New("child key out of range")
+)
+
+// ExtendedKey is a private key together with the chain code its children
+// are derived with.
+type ExtendedKey struct {
+	Curve     *keyCurve
+	Key       []byte // 32-byte private scalar
+	ChainCode []byte
+	Depth     int
+	Index     uint32 // of this key among its parent's children
+}
+
+// NewMasterKey derives the root key of seed on curve.
+func NewMasterKey(curve *keyCurve, seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, fmt.Errorf("seed of %d bytes is not 16 to 64 bytes", len(seed))
+	}
+
+	mac := hmac.New(sha512.New, []byte(curve.seedKey))
+	mac.Write(seed)
+	I := mac.Sum(nil)
+	for !curve.validScalar(I[:32]) {
+		if !curve.retryKeys {
+			return nil, errors.New("seed gives an invalid master key")
+		}
+		mac.Reset()
+		mac.Write(I)
+		I = mac.Sum(nil)
+	}
+	return &ExtendedKey{Curve: curve, Key: I[:32], ChainCode: I[32:]}, nil
+}
+
+// Child derives child index of k; indexes from hardenedKey up are hardened.
+// On curves that follow BIP32 an index whose key is out of range returns
+// ErrInvalidChild, and callers move on to the next index.
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	if k.Depth == maxHDDepth {
+		return nil, errors.New("derivation path too deep")
+	}
+
+	var data []byte
+	if index >= hardenedKey {
+		data = append([]byte{0}, k.Key...)
+	} else {
+		public, err := k.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		data = public
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	n := k.Curve.n
+	for {
+		mac := hmac.New(sha512.New, k.ChainCode)
+		mac.Write(data)
+		I := mac.Sum(nil)
+
+		child := new(big.Int).SetBytes(I[:32])
+		if child.Cmp(n) < 0 {
+			child.Add(child, new(big.Int).SetBytes(k.Key))
+			child.Mod(child, n)
+			if child.Sign() != 0 {
+				return &ExtendedKey{
+					Curve:     k.Curve,
+					Key:       child.FillBytes(make([]byte, 32)),
+					ChainCode: I[32:],
+					Depth:     k.Depth + 1,
+					Index:     index,
+				}, nil
+			}
+		}
+		if !k.Curve.retryKeys {
+			return nil, fmt.Errorf("%w: index %d", ErrInvalidChild, index)
+		}
+		data = append([]byte{1}, I[32:]...)
+		data = binary.BigEndian.AppendUint32(data, index)
+	}
+}
+
+// Derive follows path, such as m/44'/1'/0'/0/7, from k. Hardened indexes
+// are marked with ' or h.
+func (k *ExtendedKey) Derive(path string) (*ExtendedKey, error) {
+	indexes, err := ParseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if k, err = k.Child(index); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// PublicKey returns k's public key in SEC1 compressed form.
+func (k *ExtendedKey) PublicKey() ([]byte, error) {
+	x, y, err := k.Curve.publicPoint(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	return k.Curve.marshalCompressed(x, y), nil
+}
+
+// ParseDerivationPath returns the child indexes path goes through.
+func ParseDerivationPath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if parts[0] != hdPathPrefix {
+		return nil, fmt.Errorf("%w %q: must start with %s", ErrInvalidPath, path, hdPathPrefix)
+	}
+
+	indexes := make([]uint32, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		var hardened uint32
+		if trimmed, ok := strings.CutSuffix(part, "'"); ok {
+			part, hardened = trimmed, hardenedKey
+		} else if trimmed, ok := strings.CutSuffix(part, "h"); ok {
+			part, hardened = trimmed, hardenedKey
+		}
+		index, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q", ErrInvalidPath, path)
+		}
+		indexes = append(indexes, uint32(index)|hardened)
+	}
+	return indexes, nil
+}
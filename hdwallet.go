@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Keys handed out by the wallet are derived from its seed along BIP44 paths,
+// m/44'/1'/account'/chain/index, with chain 0 for receiving addresses and 1
+// for change, so the mnemonic alone restores them. Coin type 1 is the one
+// every test network shares.
+const (
+	bip44Purpose  = 44
+	bip44CoinType = 1
+	hdExternal    = 0
+	hdChange      = 1
+	hdGapLimit    = 20
+	hdSecretAAD   = "wallet seed"
+)
+
+var ErrWalletHasSeed = errors.New("wallet already has a seed")
+
+// HDChain is the seed of a wallet, as its mnemonic and BIP39 passphrase,
+// and how far along each chain keys have been handed out.
+type HDChain struct {
+	Mnemonic   string // empty once the wallet is encrypted
+	Passphrase string
+
+	// Curve is the curve keys are derived on, named as in Wallet.Curve.
+	// Seeds from before secp256k1 have legacyCurve, and keep deriving
+	// legacy keys so that their addresses stay the same.
+	Curve string
+
+	// EncryptedSecret is the mnemonic and passphrase, sealed with the
+	// master key, in an encrypted wallet.
+	EncryptedSecret []byte
+
+	Account uint32
+	Next    [2]uint32 // next index on the receiving and change chains
+}
+
+func (hd *HDChain) secret() []byte {
+	return []byte(hd.Mnemonic + "\n" + hd.Passphrase)
+}
+
+func hdAccountPath(account uint32) string {
+	return fmt.Sprintf("m/%d'/%d'/%d'", bip44Purpose, bip44CoinType, account)
+}
+
+// IsHD reports whether the wallet has a seed.
+func (ws *Wallets) IsHD() bool {
+	return ws.HD != nil
+}
+
+// NewSeed gives the wallet a new seed for keys on curve.
+func (ws *Wallets) NewSeed(curve string, masterKey []byte) error {
+	mnemonic, err := NewMnemonic(defaultMnemonicBits)
+	if err != nil {
+		return err
+	}
+	return ws.SetMnemonic(mnemonic, "", curve, masterKey)
+}
+
+// SetMnemonic gives the wallet the seed of mnemonic and passphrase, for
+// keys on curve.
+func (ws *Wallets) SetMnemonic(mnemonic, passphrase, curve string, masterKey []byte) error {
+	if ws.IsHD() {
+		return ErrWalletHasSeed
+	}
+	if _, err := MnemonicToEntropy(mnemonic); err != nil {
+		return err
+	}
+	if _, err := lookupCurve(curve); err != nil {
+		return err
+	}
+
+	hd := &HDChain{Mnemonic: strings.Join(strings.Fields(mnemonic), " "), Passphrase: passphrase, Curve: curve}
+	if ws.IsEncrypted() {
+		if masterKey == nil {
+			return ErrWalletLocked
+		}
+		sealed, err := seal(masterKey, hd.secret(), []byte(hdSecretAAD))
+		if err != nil {
+			return err
+		}
+		hd.Mnemonic, hd.Passphrase, hd.EncryptedSecret = "", "", sealed
+	}
+	ws.HD = hd
+	return nil
+}
+
+// Mnemonic returns the mnemonic and BIP39 passphrase of the wallet's seed.
+func (ws *Wallets) Mnemonic(masterKey []byte) (string, string, error) {
+	if !ws.IsHD() {
+		return "", "", errors.New("wallet has no seed")
+	}
+	if !ws.IsEncrypted() {
+		return ws.HD.Mnemonic, ws.HD.Passphrase, nil
+	}
+	if masterKey == nil {
+		return "", "", ErrWalletLocked
+	}
+
+	secret, err := unseal(masterKey, ws.HD.EncryptedSecret, []byte(hdSecretAAD))
+	if err != nil {
+		return "", "", errWalletKeyCorruption
+	}
+	mnemonic, passphrase, _ := strings.Cut(string(secret), "\n")
+	return mnemonic, passphrase, nil
+}
+
+// accountKey derives the key of the wallet's BIP44 account.
+func (ws *Wallets) accountKey(masterKey []byte) (*ExtendedKey, error) {
+	mnemonic, passphrase, err := ws.Mnemonic(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := MnemonicToSeed(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	curve, err := lookupCurve(ws.HD.Curve)
+	if err != nil {
+		return nil, err
+	}
+	root, err := NewMasterKey(curve, seed)
+	if err != nil {
+		return nil, err
+	}
+	return root.Derive(hdAccountPath(ws.HD.Account))
+}
+
+// deriveWallet returns the key at index on chain below account. It returns
+// ErrInvalidChild if BIP32 skips index.
+func (ws *Wallets) deriveWallet(account *ExtendedKey, chain, index uint32) (*Wallet, error) {
+	chainKey, err := account.Child(chain)
+	if err != nil {
+		return nil, fmt.Errorf("chain %d: %v", chain, err)
+	}
+	key, err := chainKey.Child(index)
+	if err != nil {
+		return nil, err
+	}
+
+	private, public, err := encodeKeyPair(ws.HD.Curve, key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Wallet{
+		PrivKey: private,
+		PubKey:  public,
+		Curve:   ws.HD.Curve,
+		Path:    fmt.Sprintf("%s/%d/%d", hdAccountPath(ws.HD.Account), chain, index),
+	}, nil
+}
+
+// deriveNext adds the next key on chain and returns its address.
+func (ws *Wallets) deriveNext(chain uint32, masterKey []byte) (string, error) {
+	account, err := ws.accountKey(masterKey)
+	if err != nil {
+		return "", err
+	}
+	wallet, err := ws.deriveWallet(account, chain, ws.HD.Next[chain])
+	for errors.Is(err, ErrInvalidChild) {
+		ws.HD.Next[chain]++
+		wallet, err = ws.deriveWallet(account, chain, ws.HD.Next[chain])
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ws.HD.Next[chain]++
+	return ws.addWallet(wallet, masterKey)
+}
+
+// Restore gives an empty wallet the seed of mnemonic and passphrase, for
+// keys on curve, and adds its keys up to the last one used; used reports
+// whether an address has ever been paid. As in BIP44, the search along each
+// chain gives up after hdGapLimit unused addresses in a row.
+func (ws *Wallets) Restore(mnemonic, passphrase, curve string, used func(address string) bool) (int, error) {
+	if len(ws.Wallets) > 0 || ws.IsEncrypted() {
+		return 0, errors.New("wallets can only be restored into a new wallet file")
+	}
+	if err := ws.SetMnemonic(mnemonic, passphrase, curve, nil); err != nil {
+		return 0, err
+	}
+	account, err := ws.accountKey(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	for _, chain := range []uint32{hdExternal, hdChange} {
+		var derived []*Wallet
+		next, kept := 0, 0
+		for index := 0; index < next+hdGapLimit; index++ {
+			wallet, err := ws.deriveWallet(account, chain, uint32(index))
+			if errors.Is(err, ErrInvalidChild) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			derived = append(derived, wallet)
+			if used(string(wallet.GetAddress())) {
+				next, kept = index+1, len(derived)
+			}
+		}
+
+		for _, wallet := range derived[:kept] {
+			if _, err := ws.addWallet(wallet, nil); err != nil {
+				return 0, err
+			}
+		}
+		ws.HD.Next[chain] = uint32(next)
+		restored += kept
+	}
+	return restored, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// CheckBlockHeader runs the checks that need nothing but the header itself.
+func CheckBlockHeader(header *BlockHeader) error {
+	if err := header.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+	}
+	if header.Bits != blockBits {
+		return fmt.Errorf("%w: unexpected difficulty bits %08x", ErrInvalidBlock, header.Bits)
+	}
+	if !NewProofOfWork(header).Validate() {
+		return fmt.Errorf("%w: proof of work does not meet target", ErrInvalidBlock)
+	}
+
+	return nil
+}
+
+// ProcessHeaders adds a run of consecutive headers to the block index without
+// their bodies, so the chain with the most work is known before any of its
+// blocks are downloaded. The first header must build on an indexed block (or
+// be the genesis header of an empty chain). It returns the entry of the last
+// header.
+func (chain *Blockchain) ProcessHeaders(headers []BlockHeader) (*BlockIndexEntry, error) {
+	for i := range headers {
+		if err := CheckBlockHeader(&headers[i]); err != nil {
+			return nil, err
+		}
+		if i > 0 && !bytes.Equal(headers[i].PrevBlockHash, headers[i-1].Hash()) {
+			return nil, fmt.Errorf("%w: headers are not continuous", ErrInvalidBlock)
+		}
+	}
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	haveGenesis := chain.BestHeader() != nil
+
+	var last *BlockIndexEntry
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		for _, header := range headers {
+			entry, err := getBlockIndex(txn, header.Hash())
+			if err == nil {
+				if entry.Failed() {
+					return fmt.Errorf("%w: header %x", ErrKnownInvalid, entry.Hash())
+				}
+				last = entry
+				continue
+			}
+			if !errors.Is(err, ErrBlockNotFound) {
+				return err
+			}
+
+			entry = &BlockIndexEntry{Header: header, ChainWork: CalcWork(header.Bits)}
+
+			if bytes.Equal(header.PrevBlockHash, make([]byte, 32)) {
+				if haveGenesis {
+					return fmt.Errorf("%w: unexpected genesis header", ErrInvalidBlock)
+				}
+			} else {
+				parent, err := getBlockIndex(txn, header.PrevBlockHash)
+				if errors.Is(err, ErrBlockNotFound) {
+					return ErrOrphanBlock
+				}
+				if err != nil {
+					return err
+				}
+				if parent.Failed() {
+					return fmt.Errorf("%w: parent of header %x", ErrKnownInvalid, header.Hash())
+				}
+
+				entry.Height = parent.Height + 1
+				entry.ChainWork.Add(entry.ChainWork, parent.ChainWork)
+			}
+
+			if err := putBlockIndex(txn, entry); err != nil {
+				return err
+			}
+			last = entry
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chain.noteHeader(last)
+	return last, nil
+}
+
+// BestHeader returns the valid header with the most work, or nil for a chain
+// that has no blocks.
+func (chain *Blockchain) BestHeader() *BlockIndexEntry {
+	chain.tipMu.RLock()
+	best := chain.bestHeader
+	tip := chain.LastHash
+	chain.tipMu.RUnlock()
+
+	if best == nil {
+		best = chain.findBestHeader()
+	}
+
+	// Blocks mined locally extend the tip without passing through here.
+	if tip != nil && (best == nil || !bytes.Equal(best.Hash(), tip)) {
+		entry, err := chain.GetBlockIndex(tip)
+		if err != nil {
+			log.Panic(err)
+		}
+		if best == nil || entry.ChainWork.Cmp(best.ChainWork) > 0 {
+			best = entry
+		}
+	}
+
+	chain.noteHeader(best)
+	return best
+}
+
+// noteHeader records entry as the best header if it has more work.
+func (chain *Blockchain) noteHeader(entry *BlockIndexEntry) {
+	if entry == nil {
+		return
+	}
+
+	chain.tipMu.Lock()
+	defer chain.tipMu.Unlock()
+
+	if chain.bestHeader == nil || entry.ChainWork.Cmp(chain.bestHeader.ChainWork) > 0 {
+		chain.bestHeader = entry
+	}
+}
+
+// resetBestHeader drops the cached best header after blocks were marked
+// valid or invalid.
+func (chain *Blockchain) resetBestHeader() {
+	chain.tipMu.Lock()
+	defer chain.tipMu.Unlock()
+
+	chain.bestHeader = nil
+}
+
+func (chain *Blockchain) findBestHeader() *BlockIndexEntry {
+	var best *BlockIndexEntry
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		return forEachBlockIndex(txn, func(entry *BlockIndexEntry) error {
+			if !entry.Failed() && (best == nil || entry.ChainWork.Cmp(best.ChainWork) > 0) {
+				best = entry
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return best
+}
+
+// HeaderLocator returns hashes from the best header back to genesis, dense
+// near the top and exponentially sparser further down, for getheaders.
+func (chain *Blockchain) HeaderLocator() [][]byte {
+	best := chain.BestHeader()
+	if best == nil {
+		return nil
+	}
+
+	var locator [][]byte
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		entry := best
+		step := 1
+		for {
+			locator = append(locator, entry.Hash())
+			if entry.Height == 0 {
+				return nil
+			}
+
+			if len(locator) >= 10 {
+				step *= 2
+			}
+			target := max(entry.Height-step, 0)
+
+			var err error
+			entry, err = ancestor(txn, entry, target)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return locator
+}
+
+// ancestor returns the block at height on the chain ending at entry. Once
+// the walk reaches the main chain it jumps straight to height.
+func ancestor(txn *badger.Txn, entry *BlockIndexEntry, height int) (*BlockIndexEntry, error) {
+	for entry.Height > height {
+		onMain, err := isMainChain(txn, entry)
+		if err != nil {
+			return nil, err
+		}
+		if onMain {
+			hash, err := getMainChainHash(txn, height)
+			if err != nil {
+				return nil, err
+			}
+			return getBlockIndex(txn, hash)
+		}
+
+		entry, err = getBlockIndex(txn, entry.Header.PrevBlockHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entry, nil
+}
+
+// LocateHeaders is LocateBlocks for getheaders: it returns the headers of up
+// to max main chain blocks following the locator.
+func (chain *Blockchain) LocateHeaders(locator [][]byte, hashStop []byte, max int) []BlockHeader {
+	hashes := chain.LocateBlocks(locator, hashStop, max)
+
+	headers := make([]BlockHeader, 0, len(hashes))
+	for _, hash := range hashes {
+		entry, err := chain.GetBlockIndex(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		headers = append(headers, entry.Header)
+	}
+
+	return headers
+}
+
+// HeaderPath returns the blocks from the fork point with the main chain up to
+// the best header, lowest first. These are the blocks a syncing node still
+// has to download and connect.
+func (chain *Blockchain) HeaderPath() []*BlockIndexEntry {
+	best := chain.BestHeader()
+	if best == nil {
+		return nil
+	}
+
+	var path []*BlockIndexEntry
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		// Re-read the entry: the cached one does not see bodies stored since.
+		entry, err := getBlockIndex(txn, best.Hash())
+		if err != nil {
+			return err
+		}
+
+		for {
+			onMain, err := isMainChain(txn, entry)
+			if err != nil {
+				return err
+			}
+			if onMain {
+				return nil
+			}
+
+			path = append(path, entry)
+			if entry.Height == 0 {
+				return nil
+			}
+
+			entry, err = getBlockIndex(txn, entry.Header.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	maxKnownInventory = 50000
+	maxRecentRejects  = 50000
+	txRequestTimeout  = time.Minute
+)
+
+// Transactions are announced in batches after a random delay drawn per peer
+// from an exponential distribution, so the first peer to hear about a
+// transaction says little about who created it. Inbound peers, which an
+// attacker can open many of, wait longer on average. Tests shorten these.
+var (
+	inboundTrickleInterval  = 5 * time.Second
+	outboundTrickleInterval = 2 * time.Second
+)
+
+// inventorySet is a bounded set of inventory hashes that forgets the oldest
+// entries first.
+type inventorySet struct {
+	limit int
+	items map[string]struct{}
+	order []string
+}
+
+func newInventorySet(limit int) *inventorySet {
+	return &inventorySet{limit: limit, items: make(map[string]struct{})}
+}
+
+func (s *inventorySet) Add(hash []byte) {
+	key := string(hash)
+	if _, ok := s.items[key]; ok {
+		return
+	}
+
+	if len(s.order) >= s.limit {
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.items[key] = struct{}{}
+	s.order = append(s.order, key)
+}
+
+func (s *inventorySet) Has(hash []byte) bool {
+	_, ok := s.items[string(hash)]
+	return ok
+}
+
+func (s *inventorySet) Reset() {
+	s.items = make(map[string]struct{})
+	s.order = nil
+}
+
+// nextTrickle returns the delay before the peer's next transaction inv batch.
+func (p *Peer) nextTrickle() time.Duration {
+	mean := outboundTrickleInterval
+	if p.inbound {
+		mean = inboundTrickleInterval
+	}
+	return time.Duration(rand.ExpFloat64() * float64(mean))
+}
+
+// AddKnownInventory records that the peer has hash, so it is never announced
+// back to it.
+func (p *Peer) AddKnownInventory(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.knownInventory.Add(hash)
+}
+
+// QueueTxInventory schedules an announcement of txid for the next trickle,
+// unless the peer already knows it.
+func (p *Peer) QueueTxInventory(txid []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.knownInventory.Has(txid) {
+		return
+	}
+	p.knownInventory.Add(txid)
+	p.txInvQueue = append(p.txInvQueue, InvVect{Type: InvTypeTx, Hash: txid})
+}
+
+// trickleLoop sends queued transaction announcements in shuffled batches
+// at random intervals.
+func (p *Peer) trickleLoop() {
+	timer := time.NewTimer(p.nextTrickle())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			p.mu.Lock()
+			inv := p.txInvQueue
+			p.txInvQueue = nil
+			p.mu.Unlock()
+
+			rand.Shuffle(len(inv), func(i, j int) { inv[i], inv[j] = inv[j], inv[i] })
+			for len(inv) > 0 {
+				n := min(len(inv), maxInvPerMessage)
+				p.QueueMessage(&MsgInv{Inv: inv[:n]})
+				inv = inv[n:]
+			}
+
+			timer.Reset(p.nextTrickle())
+		case <-p.quit:
+			return
+		}
+	}
+}
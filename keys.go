@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Wallet keys are on secp256k1, like Bitcoin's, or on P-256 for those who
+// ask for it. Private keys are stored as their 32-byte scalar and public
+// keys in SEC1 form, compressed unless said otherwise, and addresses hash
+// the compressed form. Keys from before secp256k1 have an empty curve name:
+// they are P-256 keys whose private key is SEC1 DER and whose public key is
+// the coordinates without leading zeros, and keep the addresses hashed from
+// that.
+type keyCurve struct {
+	name       string
+	p, n, a, b *big.Int
+	seedKey    string // HMAC key of BIP32 master keys, after SLIP-0010
+	retryKeys  bool   // rehash out of range keys as SLIP-0010 does, not skip them
+
+	scalarBaseMult func(k []byte) (*big.Int, *big.Int)
+	signHash       func(k, hash []byte) (r, s *big.Int, err error)
+	verifyHash     func(x, y *big.Int, hash []byte, r, s *big.Int) bool
+}
+
+var (
+	secp256k1 = &keyCurve{
+		name:           "secp256k1",
+		p:              secp256k1P,
+		n:              secp256k1N,
+		a:              new(big.Int),
+		b:              secp256k1B,
+		seedKey:        "Bitcoin seed",
+		scalarBaseMult: secp256k1ScalarBaseMult,
+		signHash:       secp256k1Sign,
+		verifyHash:     secp256k1Verify,
+	}
+	p256 = &keyCurve{
+		name:           "P-256",
+		p:              elliptic.P256().Params().P,
+		n:              elliptic.P256().Params().N,
+		a:              big.NewInt(-3),
+		b:              elliptic.P256().Params().B,
+		seedKey:        "Nist256p1 seed",
+		retryKeys:      true,
+		scalarBaseMult: p256ScalarBaseMult,
+		signHash:       p256Sign,
+		verifyHash:     p256Verify,
+	}
+
+	defaultCurve = secp256k1
+)
+
+// legacyCurve names the curve and encodings of keys from before secp256k1.
+const legacyCurve = ""
+
+var ErrInvalidPublicKey = errors.New("invalid public key")
+
+// lookupCurve returns the curve a wallet key or seed names.
+func lookupCurve(name string) (*keyCurve, error) {
+	switch name {
+	case secp256k1.name:
+		return secp256k1, nil
+	case p256.name, legacyCurve:
+		return p256, nil
+	}
+	return nil, fmt.Errorf("unknown curve %q", name)
+}
+
+func p256ScalarBaseMult(k []byte) (*big.Int, *big.Int) {
+	private, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), k)
+	if err != nil {
+		return nil, nil
+	}
+	public, err := private.PublicKey.Bytes()
+	if err != nil {
+		return nil, nil
+	}
+	return new(big.Int).SetBytes(public[1:33]), new(big.Int).SetBytes(public[33:])
+}
+
+func (c *keyCurve) validScalar(k []byte) bool {
+	s := new(big.Int).SetBytes(k)
+	return len(k) == 32 && s.Sign() != 0 && s.Cmp(c.n) < 0
+}
+
+// newPrivateKey returns a random scalar.
+func (c *keyCurve) newPrivateKey() ([]byte, error) {
+	k := make([]byte, 32)
+	for {
+		if _, err := rand.Read(k); err != nil {
+			return nil, err
+		}
+		if c.validScalar(k) {
+			return k, nil
+		}
+	}
+}
+
+// publicPoint returns the public key of the private key k.
+func (c *keyCurve) publicPoint(k []byte) (*big.Int, *big.Int, error) {
+	if !c.validScalar(k) {
+		return nil, nil, errors.New("invalid private key")
+	}
+	x, y := c.scalarBaseMult(k)
+	return x, y, nil
+}
+
+// marshalCompressed encodes a point as 0x02 or 0x03, for even or odd y,
+// and x.
+func (c *keyCurve) marshalCompressed(x, y *big.Int) []byte {
+	b := make([]byte, 33)
+	b[0] = byte(2 + y.Bit(0))
+	x.FillBytes(b[1:])
+	return b
+}
+
+// marshalUncompressed encodes a point as 0x04, x and y.
+func (c *keyCurve) marshalUncompressed(x, y *big.Int) []byte {
+	b := make([]byte, 65)
+	b[0] = 4
+	x.FillBytes(b[1:33])
+	y.FillBytes(b[33:])
+	return b
+}
+
+// parsePublicKey decodes a compressed or uncompressed SEC1 public key.
+func (c *keyCurve) parsePublicKey(b []byte) (*big.Int, *big.Int, error) {
+	switch {
+	case len(b) == 33 && (b[0] == 2 || b[0] == 3):
+		x := new(big.Int).SetBytes(b[1:])
+		if x.Cmp(c.p) >= 0 {
+			return nil, nil, ErrInvalidPublicKey
+		}
+		y := new(big.Int).ModSqrt(c.curveRHS(x), c.p)
+		if y == nil {
+			return nil, nil, ErrInvalidPublicKey
+		}
+		if y.Bit(0) != uint(b[0]&1) {
+			y.Sub(c.p, y)
+		}
+		return x, y, nil
+
+	case len(b) == 65 && b[0] == 4:
+		x, y := new(big.Int).SetBytes(b[1:33]), new(big.Int).SetBytes(b[33:])
+		if x.Cmp(c.p) >= 0 || y.Cmp(c.p) >= 0 {
+			return nil, nil, ErrInvalidPublicKey
+		}
+		y2 := new(big.Int).Mul(y, y)
+		if y2.Mod(y2, c.p).Cmp(c.curveRHS(x)) != 0 {
+			return nil, nil, ErrInvalidPublicKey
+		}
+		return x, y, nil
+	}
+	return nil, nil, ErrInvalidPublicKey
+}
+
+// curveRHS returns x³ + ax + b.
+func (c *keyCurve) curveRHS(x *big.Int) *big.Int {
+	r := new(big.Int).Mul(x, x)
+	r.Add(r, c.a)
+	r.Mul(r, x)
+	r.Add(r, c.b)
+	return r.Mod(r, c.p)
+}
+
+// encodeKeyPair returns the private key k and its public key as a wallet
+// with keys on the named curve stores them.
+func encodeKeyPair(curveName string, k []byte) (privKey, pubKey []byte, err error) {
+	curve, err := lookupCurve(curveName)
+	if err != nil {
+		return nil, nil, err
+	}
+	x, y, err := curve.publicPoint(k)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if curveName == legacyCurve {
+		private, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), k)
+		if err != nil {
+			return nil, nil, err
+		}
+		privateBytes, err := x509.MarshalECPrivateKey(private)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateBytes, append(x.Bytes(), y.Bytes()...), nil
+	}
+
+	return append([]byte(nil), k...), curve.marshalCompressed(x, y), nil
+}
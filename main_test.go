@@ -84,11 +84,85 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/net/websocket"
 )
 
+func TestMain(m *testing.M) {
+	// Mine at the regtest limit so blocks are found in a handful of hashes.
+	blockBits = 0x207fffff
+	// Announce transactions without the privacy delay.
+	inboundTrickleInterval = 20 * time.Millisecond
+	outboundTrickleInterval = 20 * time.Millisecond
+	// Fluff stem transactions that go missing quickly.
+	embargoMin = 200 * time.Millisecond
+	embargoMean = 100 * time.Millisecond
+	embargoCheckInterval = 20 * time.Millisecond
+	// Derive wallet keys cheaply.
+	walletKDFCost = 1 << 10
+	// Let tests spend coinbases in the next block.
+	coinbaseMaturity = 1
+	os.Exit(m.Run())
+}
+
+// testAddress returns the address of a secp256k1 key derived from name, so
+// tests can pay coins to it that signTestTx can later spend.
+func testAddress(name string) string {
+	address, _, _ := testKey(name)
+	return address
+}
+
+func testKey(name string) (address string, privKey, pubKey []byte) {
+	k := sha256.Sum256([]byte("test key " + name))
+	privKey, pubKey, err := encodeKeyPair(secp256k1.name, k[:])
+	if err != nil {
+		panic(err)
+	}
+	address = string(Wallet{PubKey: pubKey}.GetAddress())
+	testKeyNames[address] = name
+	return address, privKey, pubKey
+}
+
+var testKeyNames = make(map[string]string)
+
+// signTestTx signs every input of tx, which spends prevOuts, with the key
+// testAddress gave out for the address each pays.
+func signTestTx(t *testing.T, tx *Transaction, prevOuts ...TxOut) *Transaction {
+	t.Helper()
+	for i, prevOut := range prevOuts {
+		name, ok := testKeyNames[string(prevOut.ScriptPubKey)]
+		if !ok {
+			t.Fatalf("no test key for %q", prevOut.ScriptPubKey)
+		}
+		_, privKey, pubKey := testKey(name)
+		if err := signInput(tx, i, prevOut, secp256k1.name, privKey, pubKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tx
+}
+
 func TestBlockchainPersistence(t *testing.T) {
 	nodeID := "test_node"
 	os.RemoveAll("./tmp/blocks_" + nodeID) // Clean up
@@ -119,3 +193,2976 @@ func TestBlockchainPersistence(t *testing.T) {
 	os.RemoveAll("./tmp/blocks_" + nodeID)
 	fmt.Println("Persistence Test Passed!")
 }
+
+func TestOldDatabaseNeedsReindex(t *testing.T) {
+	nodeID := "test_dbversion"
+	path := "./tmp/blocks_" + nodeID
+	os.RemoveAll(path)
+	defer os.RemoveAll(path)
+
+	bc := InitBlockchain("test_address", nodeID)
+	if err := checkDBVersion(bc.Database, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A database from before the version key is refused, not misread.
+	if err := bc.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(dbVersionKey))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkDBVersion(bc.Database, path); !errors.Is(err, ErrReindexRequired) {
+		t.Fatalf("expected ErrReindexRequired, got %v", err)
+	}
+	bc.Close()
+}
+
+func TestPruneKeepsHeaders(t *testing.T) {
+	nodeID := "test_prune"
+	os.RemoveAll("./tmp/blocks_" + nodeID)
+	defer os.RemoveAll("./tmp/blocks_" + nodeID)
+
+	bc := InitBlockchain("test_address", nodeID)
+	defer bc.Close()
+
+	for i := 0; i < defaultPruneDepth+10; i++ {
+		bc.AddBlock([]*Transaction{NewCoinbaseTX("test_address", fmt.Sprintf("Block %d", i))})
+	}
+
+	bc.SetPruneConfig(PruneConfig{Target: 1, Depth: defaultPruneDepth})
+
+	pruneHeight := bc.PruneHeight()
+	if pruneHeight != bc.Height()-defaultPruneDepth {
+		t.Fatalf("expected prune height %d, got %d", bc.Height()-defaultPruneDepth, pruneHeight)
+	}
+
+	hash, err := bc.GetBlockHash(pruneHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := bc.GetBlock(hash)
+	if !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("expected ErrBlockPruned, got %v", err)
+	}
+	if block.Height != pruneHeight || block.Transactions != nil {
+		t.Fatal("pruned block should only carry its header and height")
+	}
+
+	hash, _ = bc.GetBlockHash(pruneHeight + 1)
+	if _, err := bc.GetBlock(hash); err != nil {
+		t.Fatalf("block above the prune height should keep its body: %v", err)
+	}
+
+	// A wallet restore scanning the chain learns what it could not see.
+	if _, missing := usedAddresses(bc); missing != pruneHeight+1 {
+		t.Fatalf("expected %d blocks without bodies, got %d", pruneHeight+1, missing)
+	}
+}
+
+func TestUTXOSnapshotRoundTrip(t *testing.T) {
+	srcID, dstID := "test_snapshot_src", "test_snapshot_dst"
+	os.RemoveAll("./tmp/blocks_" + srcID)
+	os.RemoveAll("./tmp/blocks_" + dstID)
+	defer os.RemoveAll("./tmp/blocks_" + srcID)
+	defer os.RemoveAll("./tmp/blocks_" + dstID)
+
+	src := InitBlockchain("test_address", srcID)
+	defer src.Close()
+	for i := 0; i < 5; i++ {
+		src.AddBlock([]*Transaction{NewCoinbaseTX("test_address", fmt.Sprintf("Block %d", i))})
+	}
+
+	baseHash, _ := src.GetBlockHash(3)
+	var buf bytes.Buffer
+	contentHash, height, err := src.DumpUTXOSet(&buf, baseHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 3 {
+		t.Fatalf("expected snapshot height 3, got %d", height)
+	}
+
+	dst, err := LoadUTXOSnapshot(dstID, &buf, contentHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if !bytes.Equal(dst.LastHash, baseHash) || dst.Height() != 3 {
+		t.Fatal("loaded chain should start at the snapshot base")
+	}
+	if _, err := dst.GetBlock(baseHash); !errors.Is(err, ErrBlockNoData) {
+		t.Fatalf("expected ErrBlockNoData before validation, got %v", err)
+	}
+
+	dst.AddBlock([]*Transaction{NewCoinbaseTX("test_address", "after snapshot")})
+
+	// The chain keeps growing while history is validated.
+	done := dst.StartSnapshotValidation(src, nil)
+	for i := 0; i < 3; i++ {
+		dst.AddBlock([]*Transaction{NewCoinbaseTX("test_address", fmt.Sprintf("during validation %d", i))})
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if dst.SnapshotInfo().Status != snapshotValidated {
+		t.Fatal("snapshot should be validated")
+	}
+	var background int
+	dst.Database.View(func(txn *badger.Txn) error {
+		return forEachCoin(txn, backgroundUTXOPrefix, func([]byte, *Coin) error {
+			background++
+			return nil
+		})
+	})
+	if background != 0 || dst.backgroundHeight() != -1 {
+		t.Fatalf("%d background coins left after validation", background)
+	}
+	if _, err := dst.GetBlock(baseHash); err != nil {
+		t.Fatalf("validated history should have block bodies: %v", err)
+	}
+}
+
+func TestUTXOStatsTrackUTXOSet(t *testing.T) {
+	nodeID := "test_utxostats"
+	os.RemoveAll("./tmp/blocks_" + nodeID)
+	defer os.RemoveAll("./tmp/blocks_" + nodeID)
+
+	bc := InitBlockchain("test_address", nodeID)
+	defer bc.Close()
+	for i := 0; i < 3; i++ {
+		bc.AddBlock([]*Transaction{NewCoinbaseTX("test_address", fmt.Sprintf("Block %d", i))})
+	}
+
+	stats := bc.UTXOStats()
+	if stats.Count != 4 || stats.TotalAmount != 40 {
+		t.Fatalf("expected 4 coins worth 40, got %d worth %d", stats.Count, stats.TotalAmount)
+	}
+
+	var recomputed *UTXOStats
+	bc.Database.View(func(txn *badger.Txn) error {
+		var err error
+		recomputed, err = computeUTXOStats(txn, utxoPrefix)
+		return err
+	})
+	if !bytes.Equal(stats.Hash.Digest(), recomputed.Hash.Digest()) || stats.Size != recomputed.Size {
+		t.Fatal("incremental stats differ from a full rescan")
+	}
+
+	empty := NewMuHash()
+	m := NewMuHash()
+	m.Insert([]byte("a"))
+	m.Insert([]byte("b"))
+	m.Remove([]byte("a"))
+	m.Remove([]byte("b"))
+	if !bytes.Equal(m.Digest(), empty.Digest()) {
+		t.Fatal("removing every element should give the empty set hash")
+	}
+}
+
+func TestInvalidateAndReconsiderBlock(t *testing.T) {
+	nodeID := "test_invalidate"
+	os.RemoveAll("./tmp/blocks_" + nodeID)
+	defer os.RemoveAll("./tmp/blocks_" + nodeID)
+
+	bc := InitBlockchain("test_address", nodeID)
+	defer bc.Close()
+
+	var chainA [][]byte
+	for i := 0; i < 3; i++ {
+		block := bc.AddBlock([]*Transaction{NewCoinbaseTX("test_address", fmt.Sprintf("A%d", i))})
+		chainA = append(chainA, block.Header.Hash())
+	}
+	statsA := bc.UTXOStats().Hash.Digest()
+
+	if err := bc.InvalidateBlock(chainA[1]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.LastHash, chainA[0]) {
+		t.Fatalf("expected tip %x after invalidation, got %x", chainA[0], bc.LastHash)
+	}
+
+	var chainB [][]byte
+	for i := 0; i < 3; i++ {
+		block := bc.AddBlock([]*Transaction{NewCoinbaseTX("test_address", fmt.Sprintf("B%d", i))})
+		chainB = append(chainB, block.Header.Hash())
+	}
+
+	// Chain A is shorter than chain B once reconsidered, so the tip stays.
+	if err := bc.ReconsiderBlock(chainA[1]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.LastHash, chainB[2]) {
+		t.Fatal("reconsidering a chain with less work should not reorg")
+	}
+
+	if err := bc.InvalidateBlock(chainB[0]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bc.LastHash, chainA[2]) {
+		t.Fatalf("expected reorg back to %x, got %x", chainA[2], bc.LastHash)
+	}
+	if !bytes.Equal(bc.UTXOStats().Hash.Digest(), statsA) {
+		t.Fatal("UTXO set after the reorg should match the original chain")
+	}
+}
+
+func TestBlockValueRules(t *testing.T) {
+	nodeID := "test_value_rules"
+	os.RemoveAll("./tmp/blocks_" + nodeID)
+	defer os.RemoveAll("./tmp/blocks_" + nodeID)
+
+	chain := OpenBlockchain(nodeID)
+	defer chain.Close()
+	genesis := NewGenesisBlock(NewCoinbaseTX(testAddress("alice"), genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	spend := func(coinbase *Transaction, value int64) *Transaction {
+		tx := &Transaction{
+			Version: 1,
+			Vin:     []TxIn{{PrevTxID: coinbase.ID(), Vout: 0, Sequence: 0xffffffff}},
+			Vout:    []TxOut{{Value: value, ScriptPubKey: []byte("bob")}},
+		}
+		return signTestTx(t, tx, coinbase.Vout[0])
+	}
+	block := func(reward int64, txs ...*Transaction) *Block {
+		coinbase := NewCoinbaseTX(testAddress("miner"), fmt.Sprintf("height %d", chain.Height()+1))
+		coinbase.Vout[0].Value = reward
+		return NewBlock(append([]*Transaction{coinbase}, txs...), chain.Tip(), chain.Height()+1, blockBits)
+	}
+	expectInvalid := func(b *Block, what string) {
+		t.Helper()
+		tip := chain.Tip()
+		if err := chain.ProcessBlock(b); !errors.Is(err, ErrInvalidBlock) {
+			t.Fatalf("expected a block %s to be invalid, got %v", what, err)
+		}
+		if !bytes.Equal(chain.Tip(), tip) {
+			t.Fatalf("a block %s was connected", what)
+		}
+	}
+
+	forged := spend(genesis.Transactions[0], blockSubsidy)
+	forged.Vout[0].Value--
+	if _, err := NewTxPool(chain).MaybeAcceptTransaction(forged); !errors.Is(err, ErrInvalidTx) {
+		t.Fatalf("expected the mempool to reject a bad signature, got %v", err)
+	}
+	expectInvalid(block(blockSubsidy, forged), "with a bad signature")
+	expectInvalid(block(blockSubsidy, spend(genesis.Transactions[0], blockSubsidy+1)), "spending more than its inputs")
+	expectInvalid(block(blockSubsidy+1), "whose coinbase pays more than the subsidy")
+	expectInvalid(block(blockSubsidy+3, spend(genesis.Transactions[0], blockSubsidy-2)), "whose coinbase pays more than the subsidy and fees")
+
+	// The coinbase may claim the fees.
+	b1 := block(blockSubsidy+2, spend(genesis.Transactions[0], blockSubsidy-2))
+	if err := chain.ProcessBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+
+	coinbaseMaturity = 3
+	defer func() { coinbaseMaturity = 1 }()
+
+	pool := NewTxPool(chain)
+	if _, err := pool.MaybeAcceptTransaction(spend(b1.Transactions[0], 1)); !errors.Is(err, ErrPrematureSpend) {
+		t.Fatalf("expected the mempool to reject an immature spend, got %v", err)
+	}
+	expectInvalid(block(blockSubsidy, spend(b1.Transactions[0], 1)), "spending an immature coinbase")
+
+	var unspent *Transaction
+	for range 2 {
+		b := block(blockSubsidy)
+		if err := chain.ProcessBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		unspent = b.Transactions[0]
+	}
+	expectInvalid(NewBlock([]*Transaction{unspent}, chain.Tip(), chain.Height()+1, blockBits), "repeating an unspent coinbase")
+	if err := chain.ProcessBlock(block(blockSubsidy, spend(b1.Transactions[0], 1))); err != nil {
+		t.Fatalf("a coinbase %d blocks deep should be spendable: %v", coinbaseMaturity, err)
+	}
+}
+
+func TestMessageFraming(t *testing.T) {
+	block := NewBlock([]*Transaction{NewCoinbaseTX("test_address", "framing")}, make([]byte, 32), 0, blockBits)
+	msgs := []Message{
+		&MsgPing{Nonce: 42},
+		&MsgInv{Inv: []InvVect{{Type: InvTypeBlock, Hash: block.Header.Hash()}}},
+		&MsgBlock{Block: block},
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		if err := WriteMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range msgs {
+		got, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Command() != want.Command() || !bytes.Equal(got.Encode(), want.Encode()) {
+			t.Fatalf("%s message did not round trip", want.Command())
+		}
+	}
+
+	corrupt := new(bytes.Buffer)
+	WriteMessage(corrupt, &MsgPing{Nonce: 1})
+	raw := corrupt.Bytes()
+	raw[len(raw)-1] ^= 0xff
+	if _, err := ReadMessage(bytes.NewReader(raw)); !errors.Is(err, ErrBadChecksum) {
+		t.Fatalf("expected ErrBadChecksum, got %v", err)
+	}
+}
+
+func TestNodesSyncOverTCP(t *testing.T) {
+	idA, idB := "test_p2p_a", "test_p2p_b"
+	os.RemoveAll("./tmp/blocks_" + idA)
+	os.RemoveAll("./tmp/blocks_" + idB)
+	defer os.RemoveAll("./tmp/blocks_" + idA)
+	defer os.RemoveAll("./tmp/blocks_" + idB)
+
+	chainA := InitBlockchain("test_address", idA)
+	defer chainA.Close()
+	for i := 0; i < 3; i++ {
+		chainA.AddBlock([]*Transaction{NewCoinbaseTX("test_address", fmt.Sprintf("Block %d", i))})
+	}
+	chainB := OpenBlockchain(idB)
+	defer chainB.Close()
+
+	serverA := NewServer(chainA, "127.0.0.1:0", nil, nil)
+	serverB := NewServer(chainB, "127.0.0.1:0", nil, nil)
+	for _, s := range []*Server{serverA, serverB} {
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+	}
+
+	if _, err := serverB.Connect(serverA.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("initial sync", func() bool { return bytes.Equal(chainB.Tip(), chainA.Tip()) })
+
+	block := chainA.AddBlock([]*Transaction{NewCoinbaseTX("test_address", "relayed")})
+	serverA.BroadcastBlock(block)
+
+	waitFor("block relay", func() bool { return bytes.Equal(chainB.Tip(), block.Header.Hash()) })
+
+	// A third node downloads blocks from both of the others in parallel.
+	idC := "test_p2p_c"
+	os.RemoveAll("./tmp/blocks_" + idC)
+	defer os.RemoveAll("./tmp/blocks_" + idC)
+
+	chainC := OpenBlockchain(idC)
+	defer chainC.Close()
+	serverC := NewServer(chainC, "127.0.0.1:0", nil, nil)
+	if err := serverC.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer serverC.Stop()
+
+	for _, s := range []*Server{serverA, serverB} {
+		if _, err := serverC.Connect(s.Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor("parallel sync", func() bool { return bytes.Equal(chainC.Tip(), chainA.Tip()) })
+	if height, headers := serverC.SyncProgress(); height != headers {
+		t.Fatalf("expected sync to be complete, got height %d of %d", height, headers)
+	}
+}
+
+func TestAddrBookPersistence(t *testing.T) {
+	nodeID := "test_addrbook"
+	path := fmt.Sprintf(peersFile, nodeID)
+	os.MkdirAll("./tmp", 0755)
+	os.Remove(path)
+	defer os.Remove(path)
+
+	book, err := LoadAddrBook(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		na, _ := NewNetAddress(fmt.Sprintf("10.0.%d.1:8333", i), serviceNodeNetwork)
+		book.AddAddress(na, "10.1.0.1:8333")
+	}
+	book.Good("10.0.2.1:8333")
+	book.Attempt("10.0.3.1:8333")
+	if err := book.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadAddrBook(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh, tried := loaded.Size(); fresh != 2 || tried != 1 {
+		t.Fatalf("expected 2 new and 1 tried address, got %d and %d", fresh, tried)
+	}
+
+	// The failed address is backing off and the others are excluded, so
+	// nothing is left to select.
+	ka := loaded.Select(func(addr string) bool { return addr != "10.0.3.1:8333" })
+	if ka != nil {
+		t.Fatalf("selected %s while it is backing off", ka.Addr)
+	}
+
+	if DefaultPort("node_1") != 3000 || DefaultPort("node_3") != 3002 {
+		t.Fatal("node IDs do not map to consecutive ports")
+	}
+}
+
+func TestInboundConnectionLimit(t *testing.T) {
+	id := "test_inbound_limit"
+	os.RemoveAll("./tmp/blocks_" + id)
+	defer os.RemoveAll("./tmp/blocks_" + id)
+
+	chain := InitBlockchain("test_address", id)
+	defer chain.Close()
+
+	server := NewServer(chain, "127.0.0.1:0", nil, nil)
+	server.MaxInbound = 1
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	first, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.PeerInfo()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("first inbound connection was not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the second connection to be closed, got %v", err)
+	}
+	if peers := server.PeerInfo(); len(peers) != 1 || !peers[0].Inbound {
+		t.Fatalf("expected one inbound peer, got %+v", peers)
+	}
+}
+
+func TestHeadersFirstOutOfOrderBlocks(t *testing.T) {
+	idA, idB := "test_headers_a", "test_headers_b"
+	os.RemoveAll("./tmp/blocks_" + idA)
+	os.RemoveAll("./tmp/blocks_" + idB)
+	defer os.RemoveAll("./tmp/blocks_" + idA)
+	defer os.RemoveAll("./tmp/blocks_" + idB)
+
+	chainA := InitBlockchain("test_address", idA)
+	defer chainA.Close()
+	for i := 0; i < 5; i++ {
+		chainA.AddBlock([]*Transaction{NewCoinbaseTX("test_address", fmt.Sprintf("Block %d", i))})
+	}
+
+	chainB := OpenBlockchain(idB)
+	defer chainB.Close()
+
+	headers := chainA.LocateHeaders(chainB.HeaderLocator(), nil, maxHeadersPerMsg)
+	if len(headers) != 6 {
+		t.Fatalf("expected 6 headers, got %d", len(headers))
+	}
+	last, err := chainB.ProcessHeaders(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Height != 5 || chainB.Height() != -1 {
+		t.Fatalf("expected headers to height 5 and no blocks, got %d and %d", last.Height, chainB.Height())
+	}
+	if path := chainB.HeaderPath(); len(path) != 6 || path[0].Height != 0 {
+		t.Fatalf("expected all 6 blocks to download, got %d", len(path))
+	}
+
+	// Bodies arrive newest first; nothing connects until genesis does.
+	for i := len(headers) - 1; i >= 0; i-- {
+		block, err := chainA.GetBlock(headers[i].Hash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := chainB.ProcessBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && chainB.Height() != -1 {
+			t.Fatalf("block %d connected before its ancestors arrived", i)
+		}
+	}
+
+	if !bytes.Equal(chainB.Tip(), chainA.Tip()) || len(chainB.HeaderPath()) != 0 {
+		t.Fatalf("expected B at A's tip %x, got %x", chainA.Tip(), chainB.Tip())
+	}
+	if !bytes.Equal(chainB.UTXOStats().Hash.Digest(), chainA.UTXOStats().Hash.Digest()) {
+		t.Fatal("UTXO set differs after out of order download")
+	}
+}
+
+func TestInvalidBlockResetsBestHeader(t *testing.T) {
+	nodeID := "test_best_header"
+	os.RemoveAll("./tmp/blocks_" + nodeID)
+	defer os.RemoveAll("./tmp/blocks_" + nodeID)
+
+	chain := OpenBlockchain(nodeID)
+	defer chain.Close()
+	genesis := NewGenesisBlock(NewCoinbaseTX(testAddress("alice"), genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	valid := chain.AddBlock([]*Transaction{NewCoinbaseTX(testAddress("alice"), "valid")})
+
+	// A peer announces a longer fork whose first block overpays itself.
+	var fork []*Block
+	prev := genesis.Header.Hash()
+	for height := 1; height <= 3; height++ {
+		coinbase := NewCoinbaseTX(testAddress("mallory"), fmt.Sprintf("fork %d", height))
+		if height == 1 {
+			coinbase.Vout[0].Value = blockSubsidy + 1
+		}
+		block := NewBlock([]*Transaction{coinbase}, prev, height, blockBits)
+		fork = append(fork, block)
+		prev = block.Header.Hash()
+	}
+	if _, err := chain.ProcessHeaders([]BlockHeader{fork[0].Header, fork[1].Header, fork[2].Header}); err != nil {
+		t.Fatal(err)
+	}
+	if best := chain.BestHeader(); !bytes.Equal(best.Hash(), fork[2].Header.Hash()) {
+		t.Fatalf("expected the fork's header to be best, got height %d", best.Height)
+	}
+
+	if err := chain.ProcessBlock(fork[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ProcessBlock(fork[0]); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("expected the overpaying block to be invalid, got %v", err)
+	}
+	if !bytes.Equal(chain.Tip(), valid.Header.Hash()) {
+		t.Fatalf("expected the chain back at the valid block, got %x", chain.Tip())
+	}
+	if best := chain.BestHeader(); !bytes.Equal(best.Hash(), valid.Header.Hash()) {
+		t.Fatalf("expected the best header to fall back to the valid chain, got height %d", best.Height)
+	}
+	if path := chain.HeaderPath(); len(path) != 0 {
+		t.Fatalf("expected nothing left to download, got %d blocks", len(path))
+	}
+}
+
+func TestTransactionRelay(t *testing.T) {
+	ids := []string{"test_relay_a", "test_relay_b", "test_relay_c"}
+	for _, id := range ids {
+		os.RemoveAll("./tmp/blocks_" + id)
+		defer os.RemoveAll("./tmp/blocks_" + id)
+	}
+
+	chainA := InitBlockchain(testAddress("test_address"), ids[0])
+	defer chainA.Close()
+	genesis, err := chainA.GetBlock(chainA.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var servers []*Server
+	for i, id := range ids {
+		chain := chainA
+		if i > 0 {
+			chain = OpenBlockchain(id)
+			defer chain.Close()
+		}
+
+		s := NewServer(chain, "127.0.0.1:0", nil, nil)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+		servers = append(servers, s)
+	}
+
+	// A line topology: C only hears about transactions through B.
+	if _, err := servers[1].Connect(servers[0].Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := servers[2].Connect(servers[1].Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("initial sync", func() bool {
+		return bytes.Equal(servers[2].chain.Tip(), chainA.Tip())
+	})
+
+	spend := func(value int64) *Transaction {
+		tx := &Transaction{
+			Version: 1,
+			Vin:     []TxIn{{PrevTxID: genesis.Transactions[0].ID(), Vout: 0, Sequence: 0xffffffff}},
+			Vout:    []TxOut{{Value: value, ScriptPubKey: []byte("bob")}},
+		}
+		return signTestTx(t, tx, genesis.Transactions[0].Vout[0])
+	}
+
+	if _, err := servers[0].SubmitTransaction(spend(11)); !errors.Is(err, ErrInvalidTx) {
+		t.Fatalf("expected overspend to be rejected as invalid, got %v", err)
+	}
+
+	tx := spend(9)
+	desc, err := servers[0].SubmitTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Fee != 1 {
+		t.Fatalf("expected a fee of 1, got %d", desc.Fee)
+	}
+	if _, err := servers[0].SubmitTransaction(spend(8)); !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("expected double spend to be rejected, got %v", err)
+	}
+	if _, err := servers[0].SubmitTransaction(tx); !errors.Is(err, ErrTxAlreadyKnown) {
+		t.Fatalf("expected resubmission to be rejected, got %v", err)
+	}
+
+	waitFor("tx relay", func() bool { return servers[2].Mempool().Have(tx.ID()) })
+
+	block := chainA.AddBlock([]*Transaction{NewCoinbaseTX("test_address", "confirm"), tx})
+	servers[0].BroadcastBlock(block)
+
+	waitFor("mempools to drop the confirmed tx", func() bool {
+		for _, s := range servers {
+			if s.Mempool().Count() != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestMempoolRevalidationAndLimits(t *testing.T) {
+	nodeID := "test_mempool_limits"
+	os.RemoveAll("./tmp/blocks_" + nodeID)
+	defer os.RemoveAll("./tmp/blocks_" + nodeID)
+
+	chain := OpenBlockchain(nodeID)
+	defer chain.Close()
+	alice := testAddress("alice")
+	genesis := NewGenesisBlock(NewCoinbaseTX(alice, genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	var coinbases []*Transaction
+	for height := 1; height <= 4; height++ {
+		block := chain.AddBlock([]*Transaction{NewHeightCoinbaseTX(alice, "", height)})
+		coinbases = append(coinbases, block.Transactions[0])
+	}
+	spend := func(coinbase *Transaction, fee int64) *Transaction {
+		tx := &Transaction{
+			Version: 1,
+			Vin:     []TxIn{{PrevTxID: coinbase.ID(), Vout: 0, Sequence: 0xffffffff}},
+			Vout:    []TxOut{{Value: blockSubsidy - fee, ScriptPubKey: []byte(alice)}},
+		}
+		return signTestTx(t, tx, coinbase.Vout[0])
+	}
+
+	// A reorg that makes a spent coinbase immature again takes the spend
+	// out of the pool.
+	coinbaseMaturity = 2
+	defer func() { coinbaseMaturity = 1 }()
+	pool := NewTxPool(chain)
+	if _, err := pool.MaybeAcceptTransaction(spend(coinbases[2], 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.InvalidateBlock(chain.Tip()); err != nil {
+		t.Fatal(err)
+	}
+	if removed := pool.Revalidate(); removed != 1 || pool.Count() != 0 {
+		t.Fatalf("expected the immature spend to be dropped, %d removed and %d left", removed, pool.Count())
+	}
+	coinbaseMaturity = 1
+
+	// A full pool evicts the lowest fee rate, even if that is the newcomer.
+	size := len(spend(coinbases[0], 1).Serialize())
+	defer func(max int) { maxMempoolSize = max }(maxMempoolSize)
+	maxMempoolSize = 2*size + size/2
+	if _, err := pool.MaybeAcceptTransaction(spend(coinbases[0], 2)); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := pool.MaybeAcceptTransaction(spend(coinbases[1], 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.MaybeAcceptTransaction(spend(genesis.Transactions[0], 1)); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("expected the cheapest transaction to be turned away, got %v", err)
+	}
+	if _, err := pool.MaybeAcceptTransaction(spend(coinbases[2], 4)); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Count() != 2 || pool.Have(spend(coinbases[0], 2).ID()) {
+		t.Fatalf("expected the fee 2 transaction to be evicted, %d left", pool.Count())
+	}
+
+	// Transactions nobody mined expire.
+	desc.Added = desc.Added.Add(-mempoolExpiry - time.Minute)
+	if removed := pool.Revalidate(); removed != 1 || pool.Have(desc.Tx.ID()) {
+		t.Fatalf("expected the old transaction to expire, %d removed", removed)
+	}
+}
+
+func TestBanListPersistence(t *testing.T) {
+	nodeID := "test_banlist"
+	path := fmt.Sprintf(banListFile, nodeID)
+	os.MkdirAll("./tmp", 0755)
+	os.Remove(path)
+	defer os.Remove(path)
+
+	bans, err := LoadBanList(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subnet, _ := ParseSubnet("10.1.0.0/16")
+	if err := bans.Ban(subnet, time.Now().Add(time.Hour), "test"); err != nil {
+		t.Fatal(err)
+	}
+	single, _ := ParseSubnet("192.168.1.5")
+	if err := bans.Ban(single, time.Now().Add(-time.Second), "expired"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadBanList(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := loaded.List(); len(list) != 1 || list[0].Subnet != "10.1.0.0/16" {
+		t.Fatalf("expected only the unexpired ban to load, got %+v", list)
+	}
+	if !loaded.IsBannedAddr("10.1.200.3:8333") || loaded.IsBannedAddr("10.2.0.1:8333") {
+		t.Fatal("ban does not cover exactly its subnet")
+	}
+	if loaded.IsBannedAddr("192.168.1.5:8333") {
+		t.Fatal("expired ban is still in force")
+	}
+}
+
+func TestDeserializeRejectsMalformedData(t *testing.T) {
+	tx := NewCoinbaseTX("test_address", "malformed")
+	data := tx.Serialize()
+
+	if _, err := DeserializeTransaction(data); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]byte{data[:len(data)-1], append(data[:len(data):len(data)], 0), nil} {
+		if _, err := DeserializeTransaction(bad); !errors.Is(err, ErrMalformedData) {
+			t.Fatalf("expected ErrMalformedData for %d bytes, got %v", len(bad), err)
+		}
+	}
+
+	// A huge input count must fail before anything is allocated for it.
+	huge := append([]byte{1, 0, 0, 0, 0xff}, bytes.Repeat([]byte{0xff}, 8)...)
+	if _, err := DeserializeTransaction(huge); !errors.Is(err, ErrMalformedData) {
+		t.Fatalf("expected ErrMalformedData for a huge input count, got %v", err)
+	}
+
+	block := NewGenesisBlock(tx, blockBits)
+	data = block.Serialize()
+	if _, err := DeserializeBlock(data[:len(data)-2]); !errors.Is(err, ErrMalformedData) {
+		t.Fatalf("expected ErrMalformedData for a truncated block, got %v", err)
+	}
+	if _, err := decodeMessage("block", append(data, 0)); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("expected ErrMalformedMessage for trailing data, got %v", err)
+	}
+}
+
+func TestMisbehavingPeerIsBanned(t *testing.T) {
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	if err := chain.ProcessBlock(NewGenesisBlock(NewCoinbaseTX("test_address", genesisCoinbaseData), blockBits)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peers on loopback are never banned, so this runs on a memory network.
+	network := NewMemoryNetwork()
+	server := NewServer(chain, "", nil, nil)
+	server.Transport = network.Host()
+	server.MaxOutbound = 0
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	expectClosed := func(conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, err := conn.Read(make([]byte, 1024)); err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Fatal("connection was not closed")
+				}
+				return
+			}
+		}
+	}
+
+	host := network.Host()
+	conn, err := host.Dial(server.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A correctly framed ping whose payload is too short to decode.
+	if err := WriteMessage(conn, &MsgUnknown{"ping", []byte{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(conn)
+
+	if !server.banList.IsBannedAddr(conn.LocalAddr().String()) {
+		t.Fatalf("expected %s to be banned, got %+v", conn.LocalAddr(), server.ListBanned())
+	}
+
+	again, err := host.Dial(server.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	expectClosed(again)
+	if len(server.PeerInfo()) != 0 {
+		t.Fatal("banned address was accepted again")
+	}
+	if _, err := server.Connect(conn.LocalAddr().String()); !errors.Is(err, ErrBanned) {
+		t.Fatalf("expected dialing a banned address to fail, got %v", err)
+	}
+
+	if err := server.ClearBanned(); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.ListBanned()) != 0 {
+		t.Fatal("bans were not cleared")
+	}
+
+	// A whitelisted peer is only disconnected.
+	ip, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	whitelisted, err := ParseSubnet(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Whitelist = []*net.IPNet{whitelisted}
+	conn, err = host.Dial(server.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := WriteMessage(conn, &MsgUnknown{"ping", []byte{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(conn)
+	if len(server.ListBanned()) != 0 {
+		t.Fatalf("a whitelisted peer was banned: %+v", server.ListBanned())
+	}
+}
+
+func TestLocalPeersAreNotBanned(t *testing.T) {
+	id := "test_local_peers"
+	os.RemoveAll("./tmp/blocks_" + id)
+	defer os.RemoveAll("./tmp/blocks_" + id)
+
+	chain := InitBlockchain("test_address", id)
+	defer chain.Close()
+
+	server := NewServer(chain, "127.0.0.1:0", nil, nil)
+	server.MaxOutbound = 0
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Two nodes on the same host; the first misbehaves.
+	bad, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	good, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+	waitFor("both peers", func() bool { return len(server.PeerInfo()) == 2 })
+
+	if err := WriteMessage(bad, &MsgUnknown{"ping", []byte{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the misbehaving peer to be dropped", func() bool { return len(server.PeerInfo()) == 1 })
+
+	if peers := server.PeerInfo(); peers[0].Addr != good.LocalAddr().String() {
+		t.Fatalf("expected %s to stay connected, got %+v", good.LocalAddr(), peers)
+	}
+	if len(server.ListBanned()) != 0 {
+		t.Fatalf("a loopback peer was banned: %+v", server.ListBanned())
+	}
+
+	again, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	waitFor("the local node to reconnect", func() bool { return len(server.PeerInfo()) == 2 })
+}
+
+// simNetwork runs nodes with in-memory chains in this process, connected
+// over a MemoryNetwork.
+type simNetwork struct {
+	t       *testing.T
+	net     *MemoryNetwork
+	genesis *Block
+	chains  []*Blockchain
+	servers []*Server
+}
+
+func newSimNetwork(t *testing.T, nodes int) *simNetwork {
+	sim := &simNetwork{
+		t:       t,
+		net:     NewMemoryNetwork(),
+		genesis: NewGenesisBlock(NewCoinbaseTX(testAddress("sim"), genesisCoinbaseData), blockBits),
+	}
+
+	for i := 0; i < nodes; i++ {
+		chain := NewMemoryBlockchain()
+		if err := chain.ProcessBlock(sim.genesis); err != nil {
+			t.Fatal(err)
+		}
+
+		s := NewServer(chain, "", nil, nil)
+		s.Transport = sim.net.Host()
+		s.MaxOutbound = 0 // only the connections the test asks for
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		sim.chains = append(sim.chains, chain)
+		sim.servers = append(sim.servers, s)
+	}
+
+	t.Cleanup(func() {
+		for i := range sim.servers {
+			sim.servers[i].Stop()
+			sim.chains[i].Close()
+		}
+	})
+	return sim
+}
+
+// connect keeps node i connected to node j, reconnecting after partitions.
+func (sim *simNetwork) connect(i, j int) {
+	if err := sim.servers[i].AddNode(sim.servers[j].Addr()); err != nil {
+		sim.t.Fatal(err)
+	}
+}
+
+// mine has node i mine n blocks and announce them.
+func (sim *simNetwork) mine(i, n int) *Block {
+	var block *Block
+	for k := 0; k < n; k++ {
+		data := fmt.Sprintf("node %d height %d", i, sim.chains[i].Height()+1)
+		block = sim.chains[i].AddBlock([]*Transaction{NewCoinbaseTX("sim", data)})
+		sim.servers[i].BroadcastBlock(block)
+	}
+	return block
+}
+
+// partition splits the network into the given groups of node indexes.
+func (sim *simNetwork) partition(groups ...[]int) {
+	var addrs [][]string
+	for _, group := range groups {
+		var g []string
+		for _, i := range group {
+			g = append(g, sim.servers[i].Addr())
+		}
+		addrs = append(addrs, g)
+	}
+	sim.net.Partition(addrs...)
+}
+
+// waitConverged waits until the given nodes, or all of them, share a tip and
+// returns it.
+func (sim *simNetwork) waitConverged(nodes ...int) []byte {
+	if len(nodes) == 0 {
+		for i := range sim.chains {
+			nodes = append(nodes, i)
+		}
+	}
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		tip := sim.chains[nodes[0]].Tip()
+		converged := true
+		for _, i := range nodes[1:] {
+			if !bytes.Equal(sim.chains[i].Tip(), tip) {
+				converged = false
+			}
+		}
+		if converged {
+			return tip
+		}
+
+		if time.Now().After(deadline) {
+			for _, i := range nodes {
+				sim.t.Logf("node %d: height %d, tip %x", i, sim.chains[i].Height(), sim.chains[i].Tip())
+			}
+			sim.t.Fatalf("nodes %v did not converge", nodes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSimulatedForkConvergence(t *testing.T) {
+	sim := newSimNetwork(t, 4)
+	sim.net.SetLatency(5*time.Millisecond, 5*time.Millisecond)
+
+	// A ring, so every node has two paths to every other.
+	for i := range 4 {
+		sim.connect(i, (i+1)%4)
+	}
+
+	block := sim.mine(0, 3)
+	if tip := sim.waitConverged(); !bytes.Equal(tip, block.Header.Hash()) {
+		t.Fatalf("expected the network at node 0's tip %x, got %x", block.Header.Hash(), tip)
+	}
+
+	// Both halves extend the chain on their own; the second mines more.
+	sim.partition([]int{0, 1}, []int{2, 3})
+	short := sim.mine(0, 2)
+	long := sim.mine(2, 4)
+	if tip := sim.waitConverged(0, 1); !bytes.Equal(tip, short.Header.Hash()) {
+		t.Fatalf("expected nodes 0 and 1 at %x, got %x", short.Header.Hash(), tip)
+	}
+	if tip := sim.waitConverged(2, 3); !bytes.Equal(tip, long.Header.Hash()) {
+		t.Fatalf("expected nodes 2 and 3 at %x, got %x", long.Header.Hash(), tip)
+	}
+
+	// Once the partition heals the nodes reconnect and the short side
+	// reorganises onto the chain with more work.
+	sim.net.Heal()
+	if tip := sim.waitConverged(); !bytes.Equal(tip, long.Header.Hash()) {
+		t.Fatalf("expected the network at the longer fork %x, got %x", long.Header.Hash(), tip)
+	}
+	for i, chain := range sim.chains {
+		if chain.Height() != 7 {
+			t.Fatalf("node %d at height %d, expected 7", i, chain.Height())
+		}
+		if !bytes.Equal(chain.UTXOStats().Hash.Digest(), sim.chains[0].UTXOStats().Hash.Digest()) {
+			t.Fatalf("node %d has a different UTXO set", i)
+		}
+	}
+}
+
+func TestMemoryNetworkConditions(t *testing.T) {
+	network := NewMemoryNetwork()
+	a, b := network.Host(), network.Host()
+
+	l, err := b.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	network.SetLatency(50*time.Millisecond, 0)
+	client, err := a.Dial(l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+
+	start := time.Now()
+	if err := WriteMessage(client, &MsgPing{Nonce: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMessage(server); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("message arrived after %s, before the latency", elapsed)
+	}
+
+	// With total loss nothing gets through, but the connection stays up.
+	network.SetLatency(0, 0)
+	network.SetLoss(1)
+	WriteMessage(client, &MsgPing{Nonce: 2})
+	network.SetLoss(0)
+	WriteMessage(client, &MsgPing{Nonce: 3})
+	if msg, err := ReadMessage(server); err != nil || msg.(*MsgPing).Nonce != 3 {
+		t.Fatalf("expected only the second ping, got %v, %v", msg, err)
+	}
+
+	network.Partition([]string{client.LocalAddr().String()})
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the partition to close the connection, got %v", err)
+	}
+	if _, err := a.Dial(l.Addr().String(), time.Second); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("expected dialing across the partition to fail, got %v", err)
+	}
+
+	network.Heal()
+	conn, err := a.Dial(l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestCompactBlockReconstruction(t *testing.T) {
+	// SipHash-2-4 test vectors from the reference implementation.
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	if h := sipHash24(k0, k1, nil); h != 0x726fdb47dd0e0e31 {
+		t.Fatalf("SipHash of the empty message is %x", h)
+	}
+	if h := sipHash24(k0, k1, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14}); h != 0xa129ca6149be45e5 {
+		t.Fatalf("SipHash of 15 bytes is %x", h)
+	}
+
+	id := "test_compact"
+	os.RemoveAll("./tmp/blocks_" + id)
+	defer os.RemoveAll("./tmp/blocks_" + id)
+
+	chain := InitBlockchain(testAddress("test_address"), id)
+	defer chain.Close()
+	genesis, err := chain.GetBlock(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: genesis.Transactions[0].ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 5, ScriptPubKey: []byte("bob")}, {Value: 4, ScriptPubKey: []byte(testAddress("carol"))}},
+	}, genesis.Transactions[0].Vout[0])
+	child := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: parent.ID(), Vout: 1, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 3, ScriptPubKey: []byte("dave")}},
+	}, parent.Vout[1])
+	block := NewBlock([]*Transaction{NewCoinbaseTX("test_address", "compact"), parent, child}, chain.Tip(), 1, blockBits)
+
+	encoded := NewCompactBlock(block)
+	decoded, err := decodeMessage("cmpctblock", encoded.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := decoded.(*MsgCmpctBlock)
+	if len(compact.ShortIDs) != 2 || len(compact.Prefilled) != 1 || compact.Prefilled[0].Index != 0 {
+		t.Fatalf("expected 2 short IDs and a prefilled coinbase, got %+v", compact)
+	}
+
+	// Only the parent is in the mempool, so the child must be fetched.
+	pool := NewTxPool(chain)
+	if _, err := pool.MaybeAcceptTransaction(parent); err != nil {
+		t.Fatal(err)
+	}
+	pb, err := compact.reconstruct(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pb.missing) != 1 || pb.missing[0] != 2 {
+		t.Fatalf("expected transaction 2 to be missing, got %v", pb.missing)
+	}
+
+	req, err := decodeMessage("getblocktxn", (&MsgGetBlockTxn{BlockHash: block.Header.Hash(), Indexes: pb.missing}).Encode())
+	if err != nil || req.(*MsgGetBlockTxn).Indexes[0] != 2 {
+		t.Fatalf("getblocktxn did not round trip: %v", err)
+	}
+	if err := pb.fill([]*Transaction{child}); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt := pb.block(); !bytes.Equal(rebuilt.BuildMerkleRoot(), block.Header.MerkleRoot) {
+		t.Fatal("reconstructed block has the wrong transactions")
+	}
+}
+
+func TestCompactBlockRelay(t *testing.T) {
+	sim := newSimNetwork(t, 2)
+	sim.connect(1, 0)
+	sim.waitConverged()
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("compact block negotiation", func() bool {
+		for _, s := range sim.servers {
+			peers := s.Peers()
+			if len(peers) != 1 {
+				return false
+			}
+			peers[0].mu.Lock()
+			sendCompact := peers[0].sendCompact
+			peers[0].mu.Unlock()
+			if !sendCompact {
+				return false
+			}
+		}
+		return true
+	})
+
+	parent := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: sim.genesis.Transactions[0].ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 9, ScriptPubKey: []byte(testAddress("bob"))}},
+	}, sim.genesis.Transactions[0].Vout[0])
+	if _, err := sim.servers[0].SubmitTransaction(parent); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("tx relay", func() bool { return sim.servers[1].Mempool().Have(parent.ID()) })
+
+	// The child is never relayed, so node 1 has to ask for it.
+	child := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: parent.ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 8, ScriptPubKey: []byte("carol")}},
+	}, parent.Vout[0])
+	if _, err := sim.servers[0].Mempool().MaybeAcceptTransaction(child); err != nil {
+		t.Fatal(err)
+	}
+
+	block := sim.chains[0].AddBlock([]*Transaction{NewCoinbaseTX("sim", "compact"), parent, child})
+	sim.servers[0].BroadcastBlock(block)
+
+	if tip := sim.waitConverged(); !bytes.Equal(tip, block.Header.Hash()) {
+		t.Fatalf("expected both nodes at %x, got %x", block.Header.Hash(), tip)
+	}
+	waitFor("mempool cleanup", func() bool { return sim.servers[1].Mempool().Count() == 0 })
+}
+
+func TestV2TransportHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	responded := make(chan net.Conn, 1)
+	go func() {
+		conn, err := v2Respond(b)
+		if err != nil {
+			t.Error(err)
+		}
+		responded <- conn
+	}()
+
+	initiator, err := v2Initiate(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, ok := (<-responded).(*v2Conn)
+	if !ok {
+		t.Fatal("responder did not detect the v2 transport")
+	}
+	if !bytes.Equal(initiator.sessionID, responder.sessionID) {
+		t.Fatal("the two sides derived different session IDs")
+	}
+
+	go WriteMessage(initiator, &MsgPing{Nonce: 42})
+	msg, err := ReadMessage(responder)
+	if err != nil || msg.(*MsgPing).Nonce != 42 {
+		t.Fatalf("expected ping 42, got %v, %v", msg, err)
+	}
+	go WriteMessage(responder, &MsgPong{Nonce: 42})
+	if msg, err := ReadMessage(initiator); err != nil || msg.(*MsgPong).Nonce != 42 {
+		t.Fatalf("expected pong 42, got %v, %v", msg, err)
+	}
+
+	// A packet modified in transit fails authentication.
+	packet := binary.LittleEndian.AppendUint32(nil, uint32(3+chacha20poly1305.Overhead))
+	packet = initiator.sendCipher.Seal(packet, packetNonce(initiator.sendCount), []byte("abc"), packet[:4])
+	packet[5] ^= 1
+	go a.Write(packet)
+	if _, err := responder.Read(make([]byte, 16)); !errors.Is(err, ErrV2Decrypt) {
+		t.Fatalf("expected a tampered packet to be rejected, got %v", err)
+	}
+}
+
+func TestV2TransportFallback(t *testing.T) {
+	ids := []string{"test_v2_a", "test_v2_b", "test_v2_old"}
+	var servers []*Server
+	for _, id := range ids {
+		os.RemoveAll("./tmp/blocks_" + id)
+		defer os.RemoveAll("./tmp/blocks_" + id)
+
+		chain := OpenBlockchain(id)
+		defer chain.Close()
+		s := NewServer(chain, "127.0.0.1:0", nil, nil)
+		s.V2Transport = id != "test_v2_old"
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop()
+		servers = append(servers, s)
+	}
+	a, b, old := servers[0], servers[1], servers[2]
+
+	for _, c := range [][2]*Server{{a, b}, {b, old}, {old, a}} {
+		if _, err := c[0].Connect(c[1].Addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions := func(s *Server) map[string][]byte {
+		ids := make(map[string][]byte)
+		for _, info := range s.PeerInfo() {
+			if info.Version == 0 {
+				return nil
+			}
+			ids[info.Addr] = info.SessionID
+		}
+		return ids
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(sessions(a)) != 2 || len(sessions(b)) != 2 || len(sessions(old)) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("handshakes did not complete: %v %v %v", a.PeerInfo(), b.PeerInfo(), old.PeerInfo())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the connection between the two v2 nodes is encrypted.
+	var encrypted int
+	for _, s := range servers {
+		for _, id := range sessions(s) {
+			if id != nil {
+				encrypted++
+			}
+		}
+	}
+	if encrypted != 2 {
+		t.Fatalf("expected one v2 connection seen from both ends, got %d ends", encrypted)
+	}
+	if !b.v1Only[old.Addr()] {
+		t.Fatal("the node without v2 support was not remembered")
+	}
+}
+
+func TestDandelionStemAndEmbargo(t *testing.T) {
+	oldRate := dandelionFluffRate
+	dandelionFluffRate = 0 // only the end of the line fluffs
+	defer func() { dandelionFluffRate = oldRate }()
+
+	// A line of outbound connections 0 -> 1 -> 2, so node 0's stem peer is
+	// node 1 and node 1's is node 2, which has no outbound peers.
+	sim := newSimNetwork(t, 3)
+	sim.connect(0, 1)
+	sim.connect(1, 2)
+
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor("handshakes", func() bool {
+		return len(sim.servers[1].PeerInfo()) == 2 && sim.servers[0].stemSuccessor(nil) != nil &&
+			sim.servers[1].stemSuccessor(nil) != nil
+	})
+
+	spend := func(vout uint32, value int64) *Transaction {
+		tx := &Transaction{
+			Version: 1,
+			Vin:     []TxIn{{PrevTxID: sim.genesis.Transactions[0].ID(), Vout: vout, Sequence: 0xffffffff}},
+			Vout:    []TxOut{{Value: value, ScriptPubKey: []byte("bob")}},
+		}
+		return signTestTx(t, tx, sim.genesis.Transactions[0].Vout[vout])
+	}
+
+	tx := spend(0, 9)
+	if _, err := sim.servers[0].SubmitTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	if !sim.servers[0].Mempool().IsStem(tx.ID()) {
+		t.Fatal("a local transaction was announced without a stem phase")
+	}
+	waitFor("the stem to reach the end of the line and fluff", func() bool {
+		for _, s := range sim.servers {
+			if !s.Mempool().Have(tx.ID()) || s.Mempool().IsStem(tx.ID()) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// A stem peer that drops the transaction can't stop it: the embargo
+	// runs out and node 0 fluffs it itself.
+	sim.net.SetLoss(1)
+	block := sim.chains[0].AddBlock([]*Transaction{NewCoinbaseTX(testAddress("sim"), "dandelion")})
+	sim.servers[0].tipChanged()
+	dropped := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: block.Transactions[0].ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 7, ScriptPubKey: []byte("carol")}},
+	}, block.Transactions[0].Vout[0])
+	start := time.Now()
+	if _, err := sim.servers[0].SubmitTransaction(dropped); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the embargo to expire", func() bool { return !sim.servers[0].Mempool().IsStem(dropped.ID()) })
+	if elapsed := time.Since(start); elapsed < embargoMin {
+		t.Fatalf("fluffed after %s, before the embargo", elapsed)
+	}
+	if sim.servers[1].Mempool().Have(dropped.ID()) {
+		t.Fatal("the dropped stem transaction arrived anyway")
+	}
+}
+
+func TestRPCServer(t *testing.T) {
+	const nodeID = "test_rpc"
+	os.Remove(fmt.Sprintf(walletFile, nodeID))
+	defer os.Remove(fmt.Sprintf(walletFile, nodeID))
+
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	server := NewServer(chain, "127.0.0.1:0", nil, nil)
+
+	rpc := NewRPCServer(server, nodeID, "127.0.0.1:0", "", "")
+	if err := rpc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Stop()
+
+	user, password, err := ReadRPCCookie(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(fmt.Sprintf(rpcCookieFile, nodeID)); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("cookie file not private: %v %v", info.Mode(), err)
+	}
+	client := NewRPCClient(rpc.Addr(), user, password)
+
+	if err := NewRPCClient(rpc.Addr(), user, "wrong").Call("getblockcount", nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected a wrong password to be refused, got %v", err)
+	}
+
+	var address string
+	if err := client.Call("getnewaddress", &address); err != nil {
+		t.Fatal(err)
+	}
+	if !ValidateAddress(address) {
+		t.Fatalf("getnewaddress returned invalid address %q", address)
+	}
+
+	genesis := NewGenesisBlock(NewCoinbaseTX(address, genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	block := chain.AddBlock([]*Transaction{NewCoinbaseTX(address, "")})
+
+	var count int
+	var best string
+	if err := client.Call("getblockcount", &count); err != nil || count != 1 {
+		t.Fatalf("getblockcount: %d, %v", count, err)
+	}
+	if err := client.Call("getbestblockhash", &best); err != nil || best != hex.EncodeToString(block.Header.Hash()) {
+		t.Fatalf("getbestblockhash: %s, %v", best, err)
+	}
+
+	var verbose struct {
+		Height        int
+		Confirmations int
+		PreviousHash  string `json:"previousblockhash"`
+		Tx            []string
+	}
+	if err := client.Call("getblock", &verbose, best); err != nil {
+		t.Fatal(err)
+	}
+	if verbose.Height != 1 || verbose.Confirmations != 1 || verbose.PreviousHash != hex.EncodeToString(genesis.Header.Hash()) ||
+		len(verbose.Tx) != 1 || verbose.Tx[0] != hex.EncodeToString(block.Transactions[0].ID()) {
+		t.Fatalf("unexpected getblock result %+v", verbose)
+	}
+	var raw string
+	if err := client.Call("getblock", &raw, best, 0); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := hex.DecodeString(raw); !bytes.Equal(data, block.Serialize()) {
+		t.Fatal("getblock with verbosity 0 did not return the serialized block")
+	}
+
+	var balance int64
+	if err := client.Call("getbalance", &balance); err != nil || balance != 20 {
+		t.Fatalf("getbalance: %d, %v", balance, err)
+	}
+
+	// A payment leaves the confirmed balance alone until it is mined, and
+	// the next one must not pick the coin it spends.
+	other := NewWallet().GetAddress()
+	var txid string
+	if err := client.Call("sendtoaddress", &txid, string(other), 7); err != nil {
+		t.Fatal(err)
+	}
+	var tx struct {
+		Vout []struct {
+			Value   int64
+			Address string
+		}
+	}
+	if err := client.Call("getrawtransaction", &tx, txid, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Vout) != 2 || tx.Vout[0].Value != 7 || tx.Vout[0].Address != string(other) ||
+		tx.Vout[1].Value != 3 || tx.Vout[1].Address != address {
+		t.Fatalf("unexpected payment %+v", tx)
+	}
+	if err := client.Call("sendtoaddress", &txid, string(other), 9); err != nil {
+		t.Fatal(err)
+	}
+	var rpcErr *RPCError
+	if err := client.Call("sendtoaddress", nil, string(other), 1); !errors.As(err, &rpcErr) || rpcErr.Code != rpcWalletInsufficient {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if err := client.Call("getbalance", &balance, string(other)); err != nil || balance != 0 {
+		t.Fatalf("getbalance of an address: %d, %v", balance, err)
+	}
+
+	// Confirmed transactions are found by scanning the chain.
+	if err := client.Call("getrawtransaction", &raw, hex.EncodeToString(genesis.Transactions[0].ID())); err != nil {
+		t.Fatal(err)
+	}
+	if raw != hex.EncodeToString(genesis.Transactions[0].Serialize()) {
+		t.Fatal("getrawtransaction returned the wrong transaction")
+	}
+
+	if err := client.Call("sendrawtransaction", nil, "00ff"); !errors.As(err, &rpcErr) || rpcErr.Code != rpcDeserializationError {
+		t.Fatalf("expected a decode error, got %v", err)
+	}
+	if err := client.Call("getbestblockhash", nil, 1); !errors.As(err, &rpcErr) || rpcErr.Code != rpcInvalidParams {
+		t.Fatalf("expected invalid params, got %v", err)
+	}
+	if err := client.Call("nosuchmethod", nil); !errors.As(err, &rpcErr) || rpcErr.Code != rpcMethodNotFound {
+		t.Fatalf("expected method not found, got %v", err)
+	}
+
+	// Batches are answered in one response, leaving out notifications.
+	batch := `[{"jsonrpc":"2.0","method":"getblockcount","id":1},
+		{"jsonrpc":"2.0","method":"getblockcount"},
+		{"jsonrpc":"2.0","method":"getrawmempool","id":"b"}]`
+	req, _ := http.NewRequest(http.MethodPost, "http://"+rpc.Addr(), strings.NewReader(batch))
+	req.SetBasicAuth(user, password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var replies []struct {
+		Result json.RawMessage
+		ID     json.RawMessage
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&replies); err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || string(replies[0].Result) != "1" || string(replies[1].ID) != `"b"` {
+		t.Fatalf("unexpected batch replies %s", replies)
+	}
+	var mempool []string
+	if err := json.Unmarshal(replies[1].Result, &mempool); err != nil || len(mempool) != 2 {
+		t.Fatalf("getrawmempool: %s, %v", replies[1].Result, err)
+	}
+
+	rpc.Stop()
+	if _, err := os.Stat(fmt.Sprintf(rpcCookieFile, nodeID)); !os.IsNotExist(err) {
+		t.Fatal("cookie file left behind after stop")
+	}
+}
+
+func TestCLIUsesRunningNode(t *testing.T) {
+	const nodeID = "test_cli_rpc"
+	os.RemoveAll("./tmp/blocks_" + nodeID)
+	defer os.RemoveAll("./tmp/blocks_" + nodeID)
+	t.Setenv("NODE_ID", nodeID)
+
+	// The running node holds the database lock, so everything below only
+	// works over RPC.
+	chain := InitBlockchain("test_address", nodeID)
+	defer chain.Close()
+	server := NewServer(chain, "127.0.0.1:0", nil, nil)
+	rpc := NewRPCServer(server, nodeID, "127.0.0.1:0", "", "")
+	if err := rpc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Stop()
+	t.Setenv("RPC_ADDR", rpc.Addr())
+
+	cli := &CLI{}
+	if cli.rpcClient() == nil {
+		t.Fatal("running node not found")
+	}
+	cli.addBlock("over rpc")
+	cli.printChain()
+	cli.getTxOutSetInfo()
+
+	block, err := chain.GetBlock(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Height != 1 || string(block.Transactions[0].Vin[0].ScriptSig) != "over rpc at height 1" {
+		t.Fatalf("addblock did not reach the node: height %d", block.Height)
+	}
+
+	cli.setBan("10.0.0.0/8", "add", 60)
+	cli.listBanned()
+	cli.getPeerInfo()
+	if bans := server.ListBanned(); len(bans) != 1 || bans[0].Subnet != "10.0.0.0/8" {
+		t.Fatalf("setban did not reach the node: %+v", bans)
+	}
+	cli.clearBanned()
+	if bans := server.ListBanned(); len(bans) != 0 {
+		t.Fatalf("clearbanned did not reach the node: %+v", bans)
+	}
+
+	rpc.Stop()
+	if cli.rpcClient() != nil {
+		t.Fatal("expected offline mode once the node stopped")
+	}
+
+	// A node that crashed leaves its cookie behind, and nothing listens on
+	// its port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	t.Setenv("RPC_ADDR", ln.Addr().String())
+	cookie := fmt.Sprintf(rpcCookieFile, nodeID)
+	defer os.Remove(cookie)
+	if err := os.WriteFile(cookie, []byte("__cookie__:stale"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if client, err := cli.findNode(); client != nil || err != nil {
+		t.Fatalf("stale cookie: client %v, err %v", client, err)
+	}
+	if err := os.WriteFile(cookie, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.findNode(); err == nil {
+		t.Fatal("expected an error for a malformed cookie")
+	}
+}
+
+func TestRESTInterface(t *testing.T) {
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	genesis := NewGenesisBlock(NewCoinbaseTX("alice", genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	block := chain.AddBlock([]*Transaction{NewCoinbaseTX(testAddress("bob"), "")})
+	server := NewServer(chain, "127.0.0.1:0", nil, nil)
+
+	rpc := NewRPCServer(server, "test_rest", "127.0.0.1:0", "user", "password")
+	rpc.REST = true
+	if err := rpc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Stop()
+
+	if resp, err := http.Get("http://" + rpc.Addr() + "/rest/chaininfo.json"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("REST without credentials: %v %v", resp, err)
+	}
+	get := func(path string) (int, []byte) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+rpc.Addr()+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", "password")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body
+	}
+
+	hash := hex.EncodeToString(block.Header.Hash())
+	if status, body := get("/rest/block/" + hash + ".bin"); status != http.StatusOK || !bytes.Equal(body, block.Serialize()) {
+		t.Fatalf("block.bin: %d %q", status, body)
+	}
+	if status, body := get("/rest/block/" + hash + ".hex"); status != http.StatusOK || string(body) != hex.EncodeToString(block.Serialize())+"\n" {
+		t.Fatalf("block.hex: %d %q", status, body)
+	}
+	var blockJSON struct {
+		Height int
+		Tx     []struct{ TxID string }
+	}
+	if status, body := get("/rest/block/" + hash + ".json"); status != http.StatusOK || json.Unmarshal(body, &blockJSON) != nil ||
+		blockJSON.Height != 1 || len(blockJSON.Tx) != 1 || blockJSON.Tx[0].TxID != hex.EncodeToString(block.Transactions[0].ID()) {
+		t.Fatalf("block.json: %d %s", status, body)
+	}
+	if status, _ := get("/rest/block/" + strings.Repeat("00", 32) + ".json"); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown block, got %d", status)
+	}
+	if status, _ := get("/rest/block/nothex.json"); status != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad hash, got %d", status)
+	}
+
+	// Headers run forward from the given hash and stop at the tip.
+	status, body := get("/rest/headers/5/" + hex.EncodeToString(genesis.Header.Hash()) + ".bin")
+	if status != http.StatusOK || !bytes.Equal(body, append(genesis.Header.Serialize(), block.Header.Serialize()...)) {
+		t.Fatalf("headers.bin: %d, %d bytes", status, len(body))
+	}
+
+	// A mempool transaction spends bob's coin and creates one for carol.
+	coinbase := block.Transactions[0]
+	spend := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: coinbase.ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 9, ScriptPubKey: []byte("carol")}},
+	}, coinbase.Vout[0])
+	if _, err := server.Mempool().MaybeAcceptTransaction(spend); err != nil {
+		t.Fatal(err)
+	}
+
+	var txJSON struct {
+		BlockHash     string
+		Confirmations int
+	}
+	status, body = get("/rest/tx/" + hex.EncodeToString(coinbase.ID()) + ".json")
+	if status != http.StatusOK || json.Unmarshal(body, &txJSON) != nil || txJSON.BlockHash != hash || txJSON.Confirmations != 1 {
+		t.Fatalf("tx.json: %d %s", status, body)
+	}
+	if status, body := get("/rest/tx/" + hex.EncodeToString(spend.ID()) + ".bin"); status != http.StatusOK || !bytes.Equal(body, spend.Serialize()) {
+		t.Fatalf("mempool tx.bin: %d %q", status, body)
+	}
+
+	var info struct{ Blocks int }
+	if status, body := get("/rest/chaininfo.json"); status != http.StatusOK || json.Unmarshal(body, &info) != nil || info.Blocks != 1 {
+		t.Fatalf("chaininfo.json: %d %s", status, body)
+	}
+
+	var utxos struct {
+		ChainHeight int
+		Bitmap      string
+		UTXOs       []struct {
+			Height int
+			Value  int64
+		}
+	}
+	outpoints := hex.EncodeToString(coinbase.ID()) + "-0/" + hex.EncodeToString(spend.ID()) + "-0"
+	status, body = get("/rest/getutxos/" + outpoints + ".json")
+	if status != http.StatusOK || json.Unmarshal(body, &utxos) != nil || utxos.ChainHeight != 1 || utxos.Bitmap != "10" {
+		t.Fatalf("getutxos.json: %d %s", status, body)
+	}
+	status, body = get("/rest/getutxos/checkmempool/" + outpoints + ".json")
+	if status != http.StatusOK || json.Unmarshal(body, &utxos) != nil || utxos.Bitmap != "01" ||
+		len(utxos.UTXOs) != 1 || utxos.UTXOs[0].Value != 9 || utxos.UTXOs[0].Height != mempoolHeight {
+		t.Fatalf("getutxos/checkmempool.json: %d %s", status, body)
+	}
+	status, body = get("/rest/getutxos/" + outpoints + ".bin")
+	if status != http.StatusOK || len(body) < 38 || binary.LittleEndian.Uint32(body) != 1 || body[36] != 1 || body[37] != 0x01 {
+		t.Fatalf("getutxos.bin: %d %x", status, body)
+	}
+}
+
+func TestWebSocketNotifications(t *testing.T) {
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	address := testAddress("alice")
+	genesis := NewGenesisBlock(NewCoinbaseTX(address, genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(chain, "127.0.0.1:0", nil, nil)
+
+	rpc := NewRPCServer(server, "test_ws", "127.0.0.1:0", "user", "password")
+	if err := rpc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Stop()
+
+	dial := func(password string) (*websocket.Conn, error) {
+		config, err := websocket.NewConfig("ws://"+rpc.Addr()+wsPath, "http://"+rpc.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:"+password)))
+		return websocket.DialConfig(config)
+	}
+	if _, err := dial("wrong"); err == nil {
+		t.Fatal("expected a wrong password to be refused")
+	}
+	conn, err := dial("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	type message struct {
+		Method string
+		Params json.RawMessage
+		Result json.RawMessage
+		Error  *RPCError
+	}
+	receive := func() (msg message) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	call := func(request string) message {
+		t.Helper()
+		if err := websocket.Message.Send(conn, request); err != nil {
+			t.Fatal(err)
+		}
+		return receive()
+	}
+
+	if msg := call(`{"jsonrpc":"2.0","method":"subscribe","params":["bogus"],"id":1}`); msg.Error == nil || msg.Error.Code != rpcInvalidParameter {
+		t.Fatalf("expected an unknown topic to be refused, got %+v", msg)
+	}
+	msg := call(`{"jsonrpc":"2.0","method":"subscribe","params":["newblock","reorg","address:` + address + `"],"id":2}`)
+	if msg.Error != nil || string(msg.Result) != "true" {
+		t.Fatalf("subscribe: %+v", msg)
+	}
+
+	// A refused subscribe leaves the topics as they were, so the limit holds.
+	subscribe := func(from, to int) message {
+		t.Helper()
+		var topics []string
+		for i := from; i < to; i++ {
+			topics = append(topics, topicAddress+string(Wallet{PubKey: []byte(strconv.Itoa(i))}.GetAddress()))
+		}
+		params, _ := json.Marshal(topics)
+		return call(`{"jsonrpc":"2.0","method":"subscribe","params":` + string(params) + `,"id":4}`)
+	}
+	if msg := subscribe(0, maxWSTopics); msg.Error == nil || msg.Error.Code != rpcInvalidParameter {
+		t.Fatalf("expected too many topics to be refused, got %+v", msg)
+	}
+	if msg := subscribe(maxWSTopics, 2*maxWSTopics-3); msg.Error != nil {
+		t.Fatalf("subscribe up to the limit: %+v", msg)
+	}
+
+	if msg := call(`{"jsonrpc":"2.0","method":"getblockcount","id":3}`); string(msg.Result) != "0" {
+		t.Fatalf("getblockcount over websocket: %+v", msg)
+	}
+
+	// A new block is announced before the transactions in it.
+	block := chain.AddBlock([]*Transaction{NewCoinbaseTX(address, "ws")})
+	server.BroadcastBlock(block)
+	var blockJSON struct {
+		Hash   string
+		Height int
+	}
+	if msg := receive(); msg.Method != topicNewBlock || json.Unmarshal(msg.Params, &blockJSON) != nil ||
+		blockJSON.Hash != hex.EncodeToString(block.Header.Hash()) || blockJSON.Height != 1 {
+		t.Fatalf("expected newblock, got %+v", msg)
+	}
+	var txJSON struct {
+		TxID      string
+		BlockHash string
+	}
+	if msg := receive(); msg.Method != topicAddress+address || json.Unmarshal(msg.Params, &txJSON) != nil ||
+		txJSON.TxID != hex.EncodeToString(block.Transactions[0].ID()) || txJSON.BlockHash != hex.EncodeToString(block.Header.Hash()) {
+		t.Fatalf("expected the coinbase on the address topic, got %+v", msg)
+	}
+
+	// Transactions are announced as they enter the mempool too.
+	spend := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: block.Transactions[0].ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 9, ScriptPubKey: []byte(address)}},
+	}, block.Transactions[0].Vout[0])
+	if _, err := server.SubmitTransaction(spend); err != nil {
+		t.Fatal(err)
+	}
+	txJSON.BlockHash = ""
+	if msg := receive(); msg.Method != topicAddress+address || json.Unmarshal(msg.Params, &txJSON) != nil ||
+		txJSON.TxID != hex.EncodeToString(spend.ID()) || txJSON.BlockHash != "" {
+		t.Fatalf("expected the mempool tx on the address topic, got %+v", msg)
+	}
+
+	if err := chain.InvalidateBlock(block.Header.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	server.tipChanged()
+	var reorg reorgResult
+	if msg := receive(); msg.Method != topicReorg || json.Unmarshal(msg.Params, &reorg) != nil ||
+		reorg.ForkHash != hex.EncodeToString(genesis.Header.Hash()) || len(reorg.Disconnected) != 1 || len(reorg.Connected) != 0 {
+		t.Fatalf("expected a reorg, got %+v", msg)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	genesis := NewGenesisBlock(NewCoinbaseTX("alice", genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	describe := func(e Event) string {
+		switch e := e.(type) {
+		case BlockConnected:
+			return fmt.Sprintf("connected %d", e.Block.Height)
+		case BlockDisconnected:
+			return fmt.Sprintf("disconnected %d", e.Block.Height)
+		case TipChanged:
+			return fmt.Sprintf("tip %d", e.Height)
+		case TxAcceptedToMempool:
+			return "tx " + hex.EncodeToString(e.Desc.Tx.ID())[:8]
+		}
+		return "?"
+	}
+
+	// Both kinds of subscriber see the same events in the same order.
+	var syncEvents []string
+	chain.Events().Subscribe(func(e Event) { syncEvents = append(syncEvents, describe(e)) })
+	asyncEvents := make(chan string, 100)
+	chain.Events().SubscribeAsync(1, func(e Event) { asyncEvents <- describe(e) })
+	var connected int
+	chain.Events().Subscribe(Handle(func(BlockConnected) { connected++ }))
+
+	block1 := chain.AddBlock([]*Transaction{NewCoinbaseTX(testAddress("bob"), "1")})
+	block2 := chain.AddBlock([]*Transaction{NewCoinbaseTX(testAddress("bob"), "2")})
+	if err := chain.InvalidateBlock(block2.Header.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	spend := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: block1.Transactions[0].ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 9, ScriptPubKey: []byte("carol")}},
+	}, block1.Transactions[0].Vout[0])
+	if _, err := NewTxPool(chain).MaybeAcceptTransaction(spend); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"connected 1", "tip 1", "connected 2", "tip 2", "disconnected 2", "tip 1", "tx " + hex.EncodeToString(spend.ID())[:8]}
+	if strings.Join(syncEvents, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("synchronous subscriber got %v, want %v", syncEvents, want)
+	}
+	for _, w := range want {
+		select {
+		case got := <-asyncEvents:
+			if got != w {
+				t.Fatalf("asynchronous subscriber got %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("asynchronous subscriber never got %q", w)
+		}
+	}
+	if connected != 2 {
+		t.Fatalf("typed subscriber saw %d connected blocks, want 2", connected)
+	}
+
+	// A full buffer holds the publisher back until the subscriber catches up
+	// or goes away.
+	bus := NewEventBus()
+	release := make(chan struct{})
+	slow := bus.SubscribeAsync(1, func(Event) { <-release })
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			bus.Publish(TipChanged{Height: i})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("publisher did not wait for a full subscriber")
+	case <-time.After(100 * time.Millisecond):
+	}
+	slow.Unsubscribe()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher still blocked after unsubscribing")
+	}
+	close(release)
+
+	calls := 0
+	sub := bus.Subscribe(func(Event) { calls++ })
+	bus.Publish(TipChanged{})
+	sub.Unsubscribe()
+	bus.Publish(TipChanged{})
+	if calls != 1 {
+		t.Fatalf("expected 1 event before unsubscribing, got %d", calls)
+	}
+}
+
+func TestBlockExplorer(t *testing.T) {
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	alice, bob := testAddress("alice"), testAddress("bob")
+	genesis := NewGenesisBlock(NewCoinbaseTX("satoshi", genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	block1 := chain.AddBlock([]*Transaction{NewCoinbaseTX(alice, "1")})
+	spend := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: block1.Transactions[0].ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 9, ScriptPubKey: []byte(bob)}},
+	}, block1.Transactions[0].Vout[0])
+	block2 := chain.AddBlock([]*Transaction{NewCoinbaseTX(alice, "2"), spend})
+	server := NewServer(chain, "127.0.0.1:0", nil, nil)
+
+	rpc := NewRPCServer(server, "test_explorer", "127.0.0.1:0", "user", "password")
+	rpc.Explorer = true
+	if err := rpc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Stop()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	if resp, err := client.Get("http://" + rpc.Addr() + "/explorer/"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("explorer without credentials: %v %v", resp, err)
+	}
+	get := func(path string) (int, string, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+rpc.Addr()+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", "password")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body), resp.Header.Get("Location")
+	}
+	page := func(path string, want ...string) {
+		t.Helper()
+		status, body, _ := get(path)
+		if status != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", path, status, body)
+		}
+		for _, w := range want {
+			if !strings.Contains(body, w) {
+				t.Fatalf("%s does not contain %q:\n%s", path, w, body)
+			}
+		}
+	}
+
+	block2Hash := hex.EncodeToString(block2.Header.Hash())
+	coinbase1 := hex.EncodeToString(block1.Transactions[0].ID())
+	spendID := hex.EncodeToString(spend.ID())
+
+	page("/explorer/", "/explorer/block/"+block2Hash, "Difficulty", fmt.Sprintf("%08x", blockBits))
+	page("/explorer/block/2", block2Hash, spendID, "/explorer/block/"+hex.EncodeToString(block1.Header.Hash()))
+	// Inputs link to the outputs they spend, with the funding address and
+	// value from the undo data.
+	page("/explorer/tx/"+spendID, "/explorer/tx/"+coinbase1+"#out-0", "/explorer/address/"+alice, "/explorer/address/"+bob, "<td>1</td>")
+	page("/explorer/tx/"+coinbase1, `id="out-0"`, "spent")
+	page("/explorer/address/"+alice, "<td>10</td>", hex.EncodeToString(block2.Transactions[0].ID()))
+	page("/explorer/style.css", "body")
+
+	for q, want := range map[string]string{
+		"2":        "/explorer/block/2",
+		block2Hash: "/explorer/block/" + block2Hash,
+		spendID:    "/explorer/tx/" + spendID,
+		" " + bob:  "/explorer/address/" + bob,
+	} {
+		if status, _, location := get("/explorer/search?q=" + strings.ReplaceAll(q, " ", "+")); status != http.StatusFound || location != want {
+			t.Fatalf("search %q: %d %q, want %q", q, status, location, want)
+		}
+	}
+	if status, _, _ := get("/explorer/search?q=nothing"); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for a search with no match, got %d", status)
+	}
+	if status, _, _ := get("/explorer/block/99"); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing height, got %d", status)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	genesis := NewGenesisBlock(NewCoinbaseTX("alice", genesisCoinbaseData), blockBits)
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ProcessBlock(genesis); !errors.Is(err, ErrDuplicateBlock) {
+		t.Fatalf("expected a duplicate, got %v", err)
+	}
+	block := chain.AddBlock([]*Transaction{NewCoinbaseTX(testAddress("bob"), "")})
+	server := NewServer(chain, "127.0.0.1:0", nil, nil)
+	spend := signTestTx(t, &Transaction{
+		Version: 1,
+		Vin:     []TxIn{{PrevTxID: block.Transactions[0].ID(), Vout: 0, Sequence: 0xffffffff}},
+		Vout:    []TxOut{{Value: 9, ScriptPubKey: []byte("carol")}},
+	}, block.Transactions[0].Vout[0])
+	if _, err := server.Mempool().MaybeAcceptTransaction(spend); err != nil {
+		t.Fatal(err)
+	}
+
+	rpc := NewRPCServer(server, "test_metrics", "127.0.0.1:0", "user", "password")
+	rpc.Metrics = true
+	if err := rpc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Stop()
+
+	if resp, err := http.Get("http://" + rpc.Addr() + "/metrics"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("metrics without credentials: %v %v", resp, err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+rpc.Addr()+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("user", "password")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		v, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			t.Fatalf("malformed sample %q", line)
+		}
+		samples[name] = v
+	}
+
+	for name, want := range map[string]float64{
+		"blockchain_height":                      1,
+		"blockchain_mempool_transactions":        1,
+		"blockchain_mempool_bytes":               float64(len(spend.Serialize())),
+		`blockchain_peers{direction="inbound"}`:  0,
+		`blockchain_peers{direction="outbound"}`: 0,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	// The counters are shared with the other tests, so they can only be
+	// checked for having counted something.
+	for _, name := range []string{
+		`blockchain_blocks_validated_total{result="accepted"}`,
+		`blockchain_blocks_validated_total{result="duplicate"}`,
+		`blockchain_txs_validated_total{result="accepted"}`,
+		`blockchain_block_validation_seconds_bucket{le="+Inf"}`,
+		"blockchain_tx_validation_seconds_count",
+		"blockchain_miner_hashes_total",
+	} {
+		if samples[name] <= 0 {
+			t.Errorf("%s = %v, want > 0", name, samples[name])
+		}
+	}
+	for _, name := range []string{"blockchain_tip_age_seconds", "blockchain_difficulty", "blockchain_db_lsm_bytes", "blockchain_db_vlog_bytes"} {
+		if _, ok := samples[name]; !ok {
+			t.Errorf("%s missing", name)
+		}
+	}
+	if samples["blockchain_tx_validation_seconds_count"] != samples[`blockchain_tx_validation_seconds_bucket{le="+Inf"}`] {
+		t.Error("histogram count does not match its +Inf bucket")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := setupTracing(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := NewGenesisBlock(NewCoinbaseTX("alice", genesisCoinbaseData), blockBits)
+	miner := NewMemoryBlockchain()
+	defer miner.Close()
+	if err := miner.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	block := miner.AddBlock([]*Transaction{NewCoinbaseTX("bob", "")})
+
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	if err := chain.ProcessBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ProcessBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ProcessBlock(block); !errors.Is(err, ErrDuplicateBlock) {
+		t.Fatalf("expected a duplicate, got %v", err)
+	}
+
+	rpc := NewRPCServer(NewServer(chain, "127.0.0.1:0", nil, nil), "test_tracing", "127.0.0.1:0", "user", "password")
+	if _, err := rpc.Call("getblockcount", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	type spanContext struct{ TraceID, SpanID string }
+	type span struct {
+		Name        string
+		SpanContext spanContext
+		Parent      spanContext
+		Attributes  []struct {
+			Key   string
+			Value struct{ Value any }
+		}
+		Status struct{ Code string }
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var spans []span
+	for dec := json.NewDecoder(f); ; {
+		var s span
+		if err := dec.Decode(&s); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, s)
+	}
+
+	attr := func(s span, key string) any {
+		for _, a := range s.Attributes {
+			if a.Key == key {
+				return a.Value.Value
+			}
+		}
+		return nil
+	}
+	children := func(parent span) map[string]int {
+		names := make(map[string]int)
+		for _, s := range spans {
+			if s.Parent.SpanID == parent.SpanContext.SpanID && s.SpanContext.TraceID == parent.SpanContext.TraceID {
+				names[s.Name]++
+			}
+		}
+		return names
+	}
+	find := func(name string, match func(span) bool) span {
+		t.Helper()
+		for _, s := range spans {
+			if s.Name == name && match(s) {
+				return s
+			}
+		}
+		t.Fatalf("no %s span among %d", name, len(spans))
+		return span{}
+	}
+	hash := hex.EncodeToString(block.Header.Hash())
+
+	process := find("block.process", func(s span) bool {
+		return attr(s, "block.hash") == hash && attr(s, "block.result") == "accepted"
+	})
+	if got := children(process); got["block.check"] != 1 || got["block.store"] != 1 || got["chain.activate"] != 1 {
+		t.Fatalf("unexpected stages %v", got)
+	}
+	store := find("block.store", func(s span) bool { return s.Parent.SpanID == process.SpanContext.SpanID })
+	if got := children(store); got["db.commit"] != 1 {
+		t.Fatalf("unexpected store spans %v", got)
+	}
+	activate := find("chain.activate", func(s span) bool { return s.Parent.SpanID == process.SpanContext.SpanID })
+	if got := children(activate); got["chain.connect"] != 1 {
+		t.Fatalf("unexpected activation spans %v", got)
+	}
+	connect := find("chain.connect", func(s span) bool { return s.Parent.SpanID == activate.SpanContext.SpanID })
+	if got := children(connect); got["db.commit"] != 1 {
+		t.Fatalf("unexpected connect spans %v", got)
+	}
+
+	duplicate := find("block.process", func(s span) bool { return attr(s, "block.result") == "duplicate" })
+	if duplicate.Status.Code != "Error" {
+		t.Fatalf("duplicate block span has status %s", duplicate.Status.Code)
+	}
+
+	add := find("chain.addblock", func(s span) bool { return attr(s, "block.hash") == hash })
+	if got := children(add); got["chain.connect"] != 1 || got["db.commit"] != 1 {
+		t.Fatalf("unexpected addblock spans %v", got)
+	}
+	find("pow.mine", func(s span) bool { return attr(s, "pow.hashes") != nil })
+	find("rpc.getblockcount", func(s span) bool { return attr(s, "rpc.method") == "getblockcount" })
+}
+
+func TestWalletEncryption(t *testing.T) {
+	const nodeID = "test_walletcrypt"
+	path := fmt.Sprintf(walletFile, nodeID)
+	os.Remove(path)
+	defer os.Remove(path)
+
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	rpc := NewRPCServer(NewServer(chain, "127.0.0.1:0", nil, nil), nodeID, "127.0.0.1:0", "user", "password")
+	if err := rpc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Stop()
+	client := NewRPCClient(rpc.Addr(), "user", "password")
+
+	expectCode := func(err error, code int) {
+		t.Helper()
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != code {
+			t.Fatalf("expected error code %d, got %v", code, err)
+		}
+	}
+
+	expectCode(client.Call("walletlock", nil), rpcWalletWrongEncState)
+	var address string
+	if err := client.Call("getnewaddress", &address); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("wallet file not private: %v %v", info.Mode(), err)
+	}
+	wallets, err := NewWallets(nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey := wallets.GetWallet(address).PrivKey
+
+	expectCode(client.Call("encryptwallet", nil, ""), rpcInvalidParameter)
+	if err := client.Call("encryptwallet", nil, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(client.Call("encryptwallet", nil, "battery staple"), rpcWalletWrongEncState)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, privKey) {
+		t.Fatal("the private key is stored in the clear")
+	}
+
+	// Balances need no passphrase; new keys and payments do.
+	var balance int64
+	if err := client.Call("getbalance", &balance); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(client.Call("getnewaddress", nil), rpcWalletUnlockNeeded)
+	expectCode(client.Call("sendtoaddress", nil, address, 1), rpcWalletUnlockNeeded)
+	expectCode(client.Call("dumpmnemonic", nil), rpcWalletUnlockNeeded)
+	expectCode(client.Call("walletpassphrase", nil, "wrong", 60), rpcWalletPassphraseIncorrect)
+
+	if err := client.Call("walletpassphrase", nil, "correct horse", 60); err != nil {
+		t.Fatal(err)
+	}
+	var second string
+	if err := client.Call("getnewaddress", &second); err != nil {
+		t.Fatal(err)
+	}
+	var seed mnemonicResult
+	if err := client.Call("dumpmnemonic", &seed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MnemonicToEntropy(seed.Mnemonic); err != nil || seed.AccountPath != "m/44'/1'/0'" {
+		t.Fatalf("unexpected seed %+v: %v", seed, err)
+	}
+	if err := client.Call("walletlock", nil); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(client.Call("getnewaddress", nil), rpcWalletUnlockNeeded)
+
+	expectCode(client.Call("walletpassphrasechange", nil, "wrong", "battery staple"), rpcWalletPassphraseIncorrect)
+	if err := client.Call("walletpassphrasechange", nil, "correct horse", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	expectCode(client.Call("walletpassphrase", nil, "correct horse", 60), rpcWalletPassphraseIncorrect)
+
+	// Both keys, from before and after encrypting, open with the master
+	// key the new passphrase unlocks.
+	if wallets, err = NewWallets(nodeID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wallets.PrivateKey(address, nil); !errors.Is(err, ErrWalletLocked) {
+		t.Fatalf("expected a locked wallet, got %v", err)
+	}
+	masterKey, err := wallets.Unlock([]byte("battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := wallets.PrivateKey(address, masterKey); err != nil || !bytes.Equal(key, privKey) {
+		t.Fatalf("decrypted the wrong key: %v", err)
+	}
+	key, err := wallets.PrivateKey(second, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secp256k1.validScalar(key) {
+		t.Fatalf("decrypted %x, not a secp256k1 key", key)
+	}
+
+	// The wallet locks itself again once the timeout passes.
+	if err := client.Call("walletpassphrase", nil, "battery staple", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("getnewaddress", nil); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := client.Call("getnewaddress", nil)
+		if err != nil {
+			expectCode(err, rpcWalletUnlockNeeded)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the wallet did not lock after its timeout")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestMnemonic(t *testing.T) {
+	if sum := sha256.Sum256([]byte(bip39English)); hex.EncodeToString(sum[:]) != "2f5eed53a4727b4bf8880d8f3f199efc90e58503646d9ff8eff3a2ed3b24dbda" {
+		t.Fatalf("the embedded wordlist is not BIP39's: %x", sum)
+	}
+	if len(bip39Words) != 2048 {
+		t.Fatalf("%d words", len(bip39Words))
+	}
+
+	// From the BIP39 test vectors, whose seeds use the passphrase TREZOR.
+	for _, test := range []struct{ entropy, mnemonic, seed string }{
+		{
+			"00000000000000000000000000000000",
+			"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+			"c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04",
+		},
+		{
+			"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+			"legal winner thank year wave sausage worth useful legal winner thank yellow",
+			"2e8905819b8723fe2c1d161860e5ee1830318dbf49a83bd451cfb8440c28bd6fa457fe1296106559a3c80937a1c1069be3a3a5bd381ee6260e8d9739fce1f607",
+		},
+		{
+			"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+			"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo vote",
+			"dd48c104698c30cfe2b6142103248622fb7bb0ff692eebb00089b32d22484e1613912f0a5b694407be899ffd31ed3992c456cdf60f5d4564b8ba3f05a69890ad",
+		},
+	} {
+		entropy, _ := hex.DecodeString(test.entropy)
+		mnemonic, err := EntropyToMnemonic(entropy)
+		if err != nil || mnemonic != test.mnemonic {
+			t.Fatalf("mnemonic of %s: %q, %v", test.entropy, mnemonic, err)
+		}
+		if decoded, err := MnemonicToEntropy(mnemonic); err != nil || !bytes.Equal(decoded, entropy) {
+			t.Fatalf("entropy of %q: %x, %v", mnemonic, decoded, err)
+		}
+		seed, err := MnemonicToSeed(mnemonic, "TREZOR")
+		if err != nil || hex.EncodeToString(seed) != test.seed {
+			t.Fatalf("seed of %q: %x, %v", mnemonic, seed, err)
+		}
+	}
+
+	for _, bad := range []string{
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon bitcoin",
+	} {
+		if _, err := MnemonicToEntropy(bad); !errors.Is(err, ErrInvalidMnemonic) {
+			t.Fatalf("accepted %q: %v", bad, err)
+		}
+	}
+
+	mnemonic, err := NewMnemonic(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words := strings.Fields(mnemonic); len(words) != 24 {
+		t.Fatalf("%d words for 256 bits", len(words))
+	}
+	if _, err := MnemonicToEntropy(mnemonic); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHDWallet(t *testing.T) {
+	// Test vector 1 of BIP32 for secp256k1 and of SLIP-0010 for NIST P-256.
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	for _, test := range []struct {
+		curve                        *keyCurve
+		path, chainCode, key, public string
+	}{
+		{secp256k1, "m", "873dff81c02f525623fd1fe5167eac3a55a049de3d314bb42ee227ffed37d508",
+			"e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35",
+			"0339a36013301597daef41fbe593a02cc513d0b55527ec2df1050e2e8ff49c85c2"},
+		{secp256k1, "m/0'", "47fdacbd0f1097043b78c63c20c34ef4ed9a111d980047ad16282c7ae6236141",
+			"edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea",
+			"035a784662a4a20a65bf6aab9ae98a6c068a81c52e4b032c0fb5400c706cfccc56"},
+		{p256, "m", "beeb672fe4621673f722f38529c07392fecaa61015c80c34f29ce8b41b3cb6ea",
+			"612091aaa12e22dd2abef664f8a01a82cae99ad7441b7ef8110424915c268bc2",
+			"0266874dc6ade47b3ecd096745ca09bcd29638dd52c2c12117b11ed3e458cfa9e8"},
+		{p256, "m/0'", "3460cea53e6a6bb5fb391eeef3237ffd8724bf0a40e94943c98b83825342ee11",
+			"6939694369114c67917a182c59ddb8cafc3004e63ca5d3b84403ba8613debc0c",
+			"0384610f5ecffe8fda089363a41f56a5c7ffc1d81b59a612d0d649b2d22355590c"},
+		{p256, "m/0h/1/2h/2/1000000000", "b9b7b82d326bb9cb5b5b121066feea4eb93d5241103c9e7a18aad40f1dde8059",
+			"21c4f269ef0a5fd1badf47eeacebeeaa3de22eb8e5b0adcd0f27dd99d34d0119",
+			"02216cd26d31147f72427a453c443ed2cde8a1e53c9cc44e5ddf739725413fe3f4"},
+	} {
+		root, err := NewMasterKey(test.curve, seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := root.Derive(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public, err := key.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(key.ChainCode) != test.chainCode || hex.EncodeToString(key.Key) != test.key || hex.EncodeToString(public) != test.public {
+			t.Fatalf("%s %s: chain code %x, key %x, public key %x", test.curve.name, test.path, key.ChainCode, key.Key, public)
+		}
+	}
+	for _, bad := range []string{"", "n/0", "m/x", "m/2147483648", "m/0''"} {
+		if _, err := ParseDerivationPath(bad); !errors.Is(err, ErrInvalidPath) {
+			t.Fatalf("accepted path %q: %v", bad, err)
+		}
+	}
+
+	// A wallet hands out keys along its account's receiving chain.
+	wallets := &Wallets{Wallets: make(map[string]*Wallet)}
+	var addresses []string
+	for range 3 {
+		address, err := wallets.CreateWallet(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, address)
+	}
+	if got := wallets.Wallets[addresses[2]].Path; got != "m/44'/1'/0'/0/2" {
+		t.Fatalf("third key at %s", got)
+	}
+	mnemonic, _, err := wallets.Mnemonic(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring finds the keys up to the last used one, and goes on from
+	// there.
+	restored := &Wallets{Wallets: make(map[string]*Wallet)}
+	n, err := restored.Restore(mnemonic, "", secp256k1.name, func(address string) bool { return address == addresses[1] })
+	if err != nil || n != 2 {
+		t.Fatalf("restored %d keys: %v", n, err)
+	}
+	for _, address := range addresses[:2] {
+		if !bytes.Equal(restored.Wallets[address].PrivKey, wallets.Wallets[address].PrivKey) {
+			t.Fatalf("restored a different key for %s", address)
+		}
+	}
+	if address, err := restored.CreateWallet(nil); err != nil || address != addresses[2] {
+		t.Fatalf("next address after restoring: %s, %v", address, err)
+	}
+	if _, err := restored.Restore(mnemonic, "", secp256k1.name, func(string) bool { return false }); err == nil {
+		t.Fatal("restored over existing keys")
+	}
+
+	// A BIP39 passphrase makes another wallet of the same mnemonic.
+	other := &Wallets{Wallets: make(map[string]*Wallet)}
+	if n, err := other.Restore(mnemonic, "TREZOR", secp256k1.name, func(address string) bool { return address == addresses[0] }); err != nil || n != 0 {
+		t.Fatalf("restored %d keys with another passphrase: %v", n, err)
+	}
+
+	// Encrypting seals the mnemonic along with the keys.
+	if err := wallets.Encrypt([]byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	if wallets.HD.Mnemonic != "" {
+		t.Fatal("the mnemonic is stored in the clear")
+	}
+	if _, _, err := wallets.Mnemonic(nil); !errors.Is(err, ErrWalletLocked) {
+		t.Fatalf("expected a locked wallet, got %v", err)
+	}
+	masterKey, err := wallets.Unlock([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := wallets.Mnemonic(masterKey); err != nil || got != mnemonic {
+		t.Fatalf("unsealed mnemonic %q, %v", got, err)
+	}
+	address, err := wallets.CreateWallet(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := wallets.PrivateKey(address, masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := wallets.Wallets[address].Path; got != "m/44'/1'/0'/0/3" {
+		t.Fatalf("fourth key at %s", got)
+	}
+	if next, err := restored.CreateWallet(nil); err != nil || next != address || !bytes.Equal(restored.Wallets[next].PrivKey, key) {
+		t.Fatalf("the encrypted wallet derived a different fourth key: %v", err)
+	}
+}
+
+func TestSecp256k1Keys(t *testing.T) {
+	// Small multiples of the generator, and its SEC1 encodings.
+	for k, x := range map[byte]string{
+		1: "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		2: "c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5",
+		3: "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9",
+	} {
+		key := make([]byte, 32)
+		key[31] = k
+		px, _, err := secp256k1.publicPoint(key)
+		if err != nil || hex.EncodeToString(px.FillBytes(make([]byte, 32))) != x {
+			t.Fatalf("%dG has x %x: %v", k, px, err)
+		}
+	}
+	if got := hex.EncodeToString(secp256k1.marshalUncompressed(secp256k1Gx, secp256k1Gy)); got != "04"+
+		"79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"+
+		"483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8" {
+		t.Fatalf("uncompressed G is %s", got)
+	}
+	if got := hex.EncodeToString(secp256k1.marshalCompressed(secp256k1Gx, secp256k1Gy)); got != "02"+
+		"79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798" {
+		t.Fatalf("compressed G is %s", got)
+	}
+	for _, key := range [][]byte{make([]byte, 32), secp256k1.n.FillBytes(make([]byte, 32))} {
+		if _, _, err := secp256k1.publicPoint(key); err == nil {
+			t.Fatalf("accepted private key %x", key)
+		}
+	}
+
+	// Encodings keep their length even when x starts with zero bytes, and
+	// both decode to the same point.
+	var x, y *big.Int
+	var err error
+	for k := int64(2); x == nil || x.BitLen() > 248; k++ {
+		if x, y, err = secp256k1.publicPoint(big.NewInt(k).FillBytes(make([]byte, 32))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, encoded := range [][]byte{secp256k1.marshalCompressed(x, y), secp256k1.marshalUncompressed(x, y)} {
+		if len(encoded) != 33 && len(encoded) != 65 || encoded[1] != 0 {
+			t.Fatalf("encoded %x", encoded)
+		}
+		px, py, err := secp256k1.parsePublicKey(encoded)
+		if err != nil || px.Cmp(x) != 0 || py.Cmp(y) != 0 {
+			t.Fatalf("decoded %x as (%x, %x): %v", encoded, px, py, err)
+		}
+	}
+	offCurve := secp256k1.marshalUncompressed(x, new(big.Int).Add(y, big.NewInt(1)))
+	for _, bad := range [][]byte{offCurve, offCurve[:33], append([]byte{5}, offCurve[1:33]...)} {
+		if _, _, err := secp256k1.parsePublicKey(bad); !errors.Is(err, ErrInvalidPublicKey) {
+			t.Fatalf("decoded %x: %v", bad, err)
+		}
+	}
+
+	// New keys are on secp256k1, and addresses hash the compressed key.
+	wallet := NewWallet()
+	if wallet.Curve != "secp256k1" || len(wallet.PrivKey) != 32 || len(wallet.PubKey) != 33 {
+		t.Fatalf("new %q key of %d bytes, public key of %d", wallet.Curve, len(wallet.PrivKey), len(wallet.PubKey))
+	}
+	if _, _, err := secp256k1.parsePublicKey(wallet.PubKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seeds from before secp256k1 still derive the same addresses.
+	const mnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	legacy := &Wallets{Wallets: make(map[string]*Wallet)}
+	if err := legacy.SetMnemonic(mnemonic, "", legacyCurve, nil); err != nil {
+		t.Fatal(err)
+	}
+	if address, err := legacy.CreateWallet(nil); err != nil || address != "1K1CLVyiJbkaSFXEtmxZSDif3Y6V3VqsHC" {
+		t.Fatalf("legacy seed derived %s: %v", address, err)
+	}
+	for _, curve := range []string{"secp256k1", "P-256"} {
+		ws := &Wallets{Wallets: make(map[string]*Wallet)}
+		if err := ws.SetMnemonic(mnemonic, "", curve, nil); err != nil {
+			t.Fatal(err)
+		}
+		address, err := ws.CreateWallet(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address == "1K1CLVyiJbkaSFXEtmxZSDif3Y6V3VqsHC" || len(ws.Wallets[address].PubKey) != 33 {
+			t.Fatalf("%s seed derived %s with public key %x", curve, address, ws.Wallets[address].PubKey)
+		}
+	}
+}
+
+func TestWalletSend(t *testing.T) {
+	// RFC 6979 nonces make secp256k1 signatures deterministic; this is the
+	// signature of "Satoshi Nakamoto" by the private key 1, with low S.
+	one := make([]byte, 32)
+	one[31] = 1
+	hash := sha256.Sum256([]byte("Satoshi Nakamoto"))
+	sig, err := secp256k1.sign(one, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(sig); got != "3045022100934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d8"+
+		"02202442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5" {
+		t.Fatalf("signature %s", got)
+	}
+	if !secp256k1.verify(secp256k1Gx, secp256k1Gy, hash[:], sig) || secp256k1.verify(secp256k1Gx, secp256k1Gy, one, sig) {
+		t.Fatal("verified the wrong way")
+	}
+
+	// Branch and bound finds changeless selections, overshooting by no more
+	// than change would cost, and leaves the rest to the knapsack solver.
+	coins := func(values ...int64) []UnspentOutput {
+		var coins []UnspentOutput
+		for i, value := range values {
+			txid := sha256.Sum256([]byte{byte(i)})
+			coins = append(coins, UnspentOutput{TxID: txid[:], Coin: &Coin{Out: TxOut{Value: value}}})
+		}
+		return coins
+	}
+	sum := func(coins []UnspentOutput) (total int64) {
+		for _, coin := range coins {
+			total += coin.Coin.Out.Value
+		}
+		return total
+	}
+	pool := coins(1, 2, 5, 10, 20)
+	for _, test := range []struct{ target, costOfChange, want int64 }{
+		{7, 0, 7}, {16, 0, 16}, {38, 0, 38}, {4, 1, 5}, {4, 0, 0}, {24, 0, 0},
+	} {
+		got := selectCoinsBnB(pool, test.target, test.costOfChange)
+		if sum(got) != test.want {
+			t.Fatalf("branch and bound for %d picked %d, not %d", test.target, sum(got), test.want)
+		}
+	}
+	if got := sum(selectCoinsKnapsack(coins(3, 3, 3, 3), 7, 1)); got != 9 {
+		t.Fatalf("knapsack for 7 out of 3s picked %d", got)
+	}
+	if got := sum(selectCoinsKnapsack(coins(1, 2, 20, 30), 4, 1)); got != 20 {
+		t.Fatalf("knapsack picked %d rather than the smallest larger coin", got)
+	}
+	if selected, err := selectCoins(pool, 24, 0); err != nil || sum(selected) < 25 {
+		t.Fatalf("selected %d for 24 with change: %v", sum(selected), err)
+	}
+	if _, err := selectCoins(pool, 39, 0); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+
+	// Keys of every kind sign inputs that verify, and only those.
+	wallets := &Wallets{Wallets: make(map[string]*Wallet)}
+	if err := wallets.NewSeed(p256.name, nil); err != nil {
+		t.Fatal(err)
+	}
+	p256Address, err := wallets.CreateWallet(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyKey, err := p256.newPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyPriv, legacyPub, err := encodeKeyPair(legacyCurve, legacyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyAddress, _ := wallets.addWallet(&Wallet{PrivKey: legacyPriv, PubKey: legacyPub}, nil)
+	newWallet := NewWallet()
+	secpAddress, _ := wallets.addWallet(newWallet, nil)
+
+	spent := coins(4, 5, 6)
+	for i, address := range []string{p256Address, legacyAddress, secpAddress} {
+		spent[i].Coin.Out.ScriptPubKey = []byte(address)
+	}
+	tx, dropped, err := wallets.CreateTransaction(spent, p256Address, 14, 1, "", nil)
+	if err != nil || dropped != 0 {
+		t.Fatal(err)
+	}
+	if len(tx.Vin) != 3 || len(tx.Vout) != 1 {
+		t.Fatalf("paid 14 and a fee of 1 out of 15 with %d inputs and %d outputs", len(tx.Vin), len(tx.Vout))
+	}
+	prevOuts := make(map[string]TxOut)
+	for _, coin := range spent {
+		prevOuts[string(coin.TxID)] = coin.Coin.Out
+	}
+	for i, vin := range tx.Vin {
+		if err := VerifyInput(tx, i, prevOuts[string(vin.PrevTxID)]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Vout[0].Value--
+	if err := VerifyInput(tx, 0, prevOuts[string(tx.Vin[0].PrevTxID)]); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("verified a changed transaction: %v", err)
+	}
+
+	// Over RPC, payments come out of the coins the mempool leaves.
+	const nodeID = "test_send"
+	os.Remove(fmt.Sprintf(walletFile, nodeID))
+	defer os.Remove(fmt.Sprintf(walletFile, nodeID))
+
+	chain := NewMemoryBlockchain()
+	defer chain.Close()
+	rpc := NewRPCServer(NewServer(chain, "127.0.0.1:0", nil, nil), nodeID, "127.0.0.1:0", "user", "password")
+	if err := rpc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Stop()
+	client := NewRPCClient(rpc.Addr(), "user", "password")
+
+	var from, to string
+	if err := client.Call("getnewaddress", &from); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("getnewaddress", &to); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ProcessBlock(NewGenesisBlock(NewCoinbaseTX(from, genesisCoinbaseData), blockBits)); err != nil {
+		t.Fatal(err)
+	}
+	chain.AddBlock([]*Transaction{NewCoinbaseTX(from, "1")})
+	chain.AddBlock([]*Transaction{NewCoinbaseTX(from, "2")})
+
+	var unspent []unspentResult
+	if err := client.Call("listunspent", &unspent, from); err != nil || len(unspent) != 3 {
+		t.Fatalf("listunspent: %+v, %v", unspent, err)
+	}
+	confirmations := 0
+	for _, coin := range unspent {
+		confirmations += coin.Confirmations
+	}
+	if confirmations != 1+2+3 {
+		t.Fatalf("coins with %d confirmations in all", confirmations)
+	}
+
+	payment := func(txid string) Transaction {
+		t.Helper()
+		var raw string
+		if err := client.Call("getrawtransaction", &raw, txid); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := hex.DecodeString(raw)
+		tx, err := DeserializeTransaction(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, vin := range tx.Vin {
+			coin, err := chain.GetCoin(vin.PrevTxID, vin.Vout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyInput(&tx, i, coin.Out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tx
+	}
+
+	var res sendFromResult
+	if err := client.Call("sendfrom", &res, from, to, 20); err != nil {
+		t.Fatal(err)
+	}
+	if tx := payment(res.TxID); len(tx.Vin) != 2 || len(tx.Vout) != 1 || tx.Vout[0].Value != 20 {
+		t.Fatalf("paid 20 out of 10s with %+v", tx)
+	}
+	if err := client.Call("listunspent", &unspent); err != nil || len(unspent) != 1 {
+		t.Fatalf("listunspent after paying: %+v, %v", unspent, err)
+	}
+	var balance int64
+	if err := client.Call("getbalance", &balance); err != nil || balance != 10 {
+		t.Fatalf("expected a balance of the 10 the mempool leaves, got %d, %v", balance, err)
+	}
+
+	// Change is kept down to the dust threshold, whatever the fee.
+	if err := client.Call("sendfrom", &res, from, to, 5, 3); err != nil {
+		t.Fatal(err)
+	}
+	if tx := payment(res.TxID); len(tx.Vout) != 2 || tx.Vout[1].Value != 2 || string(tx.Vout[1].ScriptPubKey) != from || res.DroppedChange != 0 {
+		t.Fatalf("no change of 2 in %+v", tx)
+	}
+
+	// addblock mines the mempool, paying its fees to the coinbase.
+	if err := client.Call("addblock", nil, "mine"); err != nil {
+		t.Fatal(err)
+	}
+	tip, err := chain.GetBlock(chain.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tip.Transactions) != 3 || tip.Transactions[0].Vout[0].Value != blockSubsidy+3 || rpc.server.Mempool().Count() != 0 {
+		t.Fatalf("expected both payments mined with their fees, got %d transactions", len(tip.Transactions))
+	}
+	if err := client.Call("sendfrom", &res, to, from, 24); err != nil {
+		t.Fatal(err)
+	}
+	if tx := payment(res.TxID); len(tx.Vout) != 1 || res.DroppedChange != 1 {
+		t.Fatalf("expected change of 1 to be dropped, got %+v and %d", tx, res.DroppedChange)
+	}
+
+	var rpcErr *RPCError
+	if err := client.Call("sendfrom", nil, from, to, 3); !errors.As(err, &rpcErr) || rpcErr.Code != rpcWalletInsufficient {
+		t.Fatalf("expected insufficient funds, got %v", err)
+	}
+	if err := client.Call("sendfrom", nil, string(NewWallet().GetAddress()), to, 1); !errors.As(err, &rpcErr) || rpcErr.Code != rpcInvalidAddressOrKey {
+		t.Fatalf("paid from an address outside the wallet: %v", err)
+	}
+}
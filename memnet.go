@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const memNetDefaultPort = 8333
+
+var ErrUnreachable = errors.New("host unreachable")
+
+// MemoryNetwork connects servers in one process without sockets, so tests
+// can run many nodes and control the network between them. Every host gets
+// its own IP address; messages are delayed by the network's latency and
+// dropped at its loss rate, and partitions cut hosts in different groups off
+// from each other. Each write is delivered or dropped as a whole, which for
+// servers means whole messages.
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	hosts     int
+	nextPort  int
+	listeners map[string]*memListener
+	conns     map[*memConn]struct{}
+	latency   time.Duration
+	jitter    time.Duration
+	loss      float64
+	groups    map[string]int // host -> partition group; nil when not partitioned
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		nextPort:  49152,
+		listeners: make(map[string]*memListener),
+		conns:     make(map[*memConn]struct{}),
+	}
+}
+
+// Host returns the transport of a new host on the network.
+func (n *MemoryNetwork) Host() Transport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.hosts++
+	return &memHost{network: n, ip: fmt.Sprintf("10.0.%d.%d", n.hosts/256, n.hosts%256)}
+}
+
+// SetLatency delays every message by latency plus a random amount up to
+// jitter. Messages on one connection still arrive in order.
+func (n *MemoryNetwork) SetLatency(latency, jitter time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.latency, n.jitter = latency, jitter
+}
+
+// SetLoss drops each message with probability rate.
+func (n *MemoryNetwork) SetLoss(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.loss = rate
+}
+
+// Partition splits the network: hosts (given by any host:port address of
+// theirs) in different groups can't reach each other, and hosts in no group
+// form one more group. Connections across groups are closed.
+func (n *MemoryNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			n.groups[host] = i + 1
+		}
+	}
+
+	var cut []*memConn
+	for c := range n.conns {
+		if !n.reachable(c.local.ip, c.remote.ip) {
+			cut = append(cut, c)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, c := range cut {
+		c.Close()
+	}
+}
+
+// Heal ends a partition.
+func (n *MemoryNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.groups = nil
+}
+
+// reachable reports whether host a can reach host b. The caller must hold
+// n.mu.
+func (n *MemoryNetwork) reachable(a, b string) bool {
+	return n.groups == nil || n.groups[a] == n.groups[b]
+}
+
+// delay returns how long a message sent now takes, or false if it is lost.
+func (n *MemoryNetwork) delay() (time.Duration, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.loss > 0 && rand.Float64() < n.loss {
+		return 0, false
+	}
+	d := n.latency
+	if n.jitter > 0 {
+		d += rand.N(n.jitter)
+	}
+	return d, true
+}
+
+type memAddr struct {
+	ip   string
+	port int
+}
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return net.JoinHostPort(a.ip, strconv.Itoa(a.port)) }
+
+type memHost struct {
+	network *MemoryNetwork
+	ip      string
+}
+
+// Listen listens on the host's IP address at the port of addr, or port 8333
+// if it has none.
+func (h *memHost) Listen(addr string) (net.Listener, error) {
+	port := memNetDefaultPort
+	if _, p, err := net.SplitHostPort(addr); err == nil && p != "" && p != "0" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &memListener{
+		network: h.network,
+		addr:    memAddr{h.ip, port},
+		accept:  make(chan *memConn),
+		closed:  make(chan struct{}),
+	}
+
+	n := h.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := l.addr.String()
+	if _, ok := n.listeners[key]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", key)
+	}
+	n.listeners[key] = l
+	return l, nil
+}
+
+func (h *memHost) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	n := h.network
+
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	if !ok {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	if !n.reachable(h.ip, l.addr.ip) {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("dial %s: %w", addr, ErrUnreachable)
+	}
+	local := memAddr{h.ip, n.nextPort}
+	n.nextPort++
+	n.mu.Unlock()
+
+	toServer, toClient := newMemPipe(), newMemPipe()
+	client := newMemConn(n, local, l.addr, toClient, toServer)
+	server := newMemConn(n, l.addr, local, toServer, toClient)
+
+	n.mu.Lock()
+	n.conns[client] = struct{}{}
+	n.conns[server] = struct{}{}
+	n.mu.Unlock()
+
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.closed:
+	case <-time.After(timeout):
+	}
+
+	client.Close()
+	server.Close()
+	return nil, fmt.Errorf("dial %s: connection refused", addr)
+}
+
+type memListener struct {
+	network   *MemoryNetwork
+	addr      memAddr
+	accept    chan *memConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		l.network.mu.Lock()
+		delete(l.network.listeners, l.addr.String())
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return l.addr }
+
+type memChunk struct {
+	data []byte
+	at   time.Time // when it may be read
+}
+
+// memPipe carries the data of one direction of a connection.
+type memPipe struct {
+	mu     sync.Mutex
+	chunks []memChunk
+	last   time.Time
+	closed bool
+	notify chan struct{} // closed and replaced whenever the pipe changes
+}
+
+func newMemPipe() *memPipe {
+	return &memPipe{notify: make(chan struct{})}
+}
+
+// signal wakes readers. The caller must hold p.mu.
+func (p *memPipe) signal() {
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+func (p *memPipe) push(data []byte, delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	at := time.Now().Add(delay)
+	if at.Before(p.last) {
+		at = p.last
+	}
+	p.last = at
+	p.chunks = append(p.chunks, memChunk{data: data, at: at})
+	p.signal()
+}
+
+func (p *memPipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.signal()
+}
+
+type memConn struct {
+	network       *MemoryNetwork
+	local, remote memAddr
+	in, out       *memPipe
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func newMemConn(n *MemoryNetwork, local, remote memAddr, in, out *memPipe) *memConn {
+	return &memConn{
+		network: n,
+		local:   local,
+		remote:  remote,
+		in:      in,
+		out:     out,
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, net.ErrClosed
+		default:
+		}
+
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		now := time.Now()
+		if !deadline.IsZero() && !now.Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		p := c.in
+		p.mu.Lock()
+		if len(p.chunks) > 0 && !now.Before(p.chunks[0].at) {
+			n := copy(b, p.chunks[0].data)
+			if n == len(p.chunks[0].data) {
+				p.chunks = p.chunks[1:]
+			} else {
+				p.chunks[0].data = p.chunks[0].data[n:]
+			}
+			p.mu.Unlock()
+			return n, nil
+		}
+		if len(p.chunks) == 0 && p.closed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		wait := time.Duration(-1)
+		if len(p.chunks) > 0 {
+			wait = p.chunks[0].at.Sub(now)
+		}
+		if !deadline.IsZero() && (wait < 0 || deadline.Sub(now) < wait) {
+			wait = deadline.Sub(now)
+		}
+		notify := p.notify
+		p.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-notify:
+		case <-timeout:
+		case <-c.closed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	if delay, ok := c.network.delay(); ok {
+		c.out.push(append([]byte(nil), b...), delay)
+	}
+	return len(b), nil
+}
+
+// Close closes both directions. The other end reads what was already sent
+// and then io.EOF.
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.out.close()
+
+		c.network.mu.Lock()
+		delete(c.network.conns, c)
+		c.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	c.in.mu.Lock()
+	c.in.signal()
+	c.in.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing: writes never block.
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The pool holds at most maxMempoolSize bytes of transactions, as Core's
+// -maxmempool does, evicting those paying the lowest fee rate first, and
+// drops transactions still unconfirmed after mempoolExpiry.
+const (
+	maxStandardTxSize = 100_000
+	mempoolExpiry     = 14 * 24 * time.Hour
+)
+
+var maxMempoolSize = 300 << 20
+
+var (
+	ErrTxAlreadyKnown = errors.New("transaction already in mempool")
+	ErrTxConflict     = errors.New("transaction conflicts with one in the mempool")
+	ErrMempoolFull    = errors.New("mempool full")
+
+	// ErrPrematureSpend is not an ErrInvalidTx: a reorg can make a spend
+	// that was fine premature again without whoever relayed it being at
+	// fault.
+	ErrPrematureSpend = errors.New("transaction spends an immature coinbase")
+)
+
+// TxDesc is a transaction in the mempool together with what admission
+// worked out about it. Stem transactions are still being passed along a
+// Dandelion stem and must not be announced or served yet.
+type TxDesc struct {
+	Tx    *Transaction
+	Added time.Time
+	Fee   int64
+	Size  int
+	Stem  bool
+}
+
+// feeRate is the fee desc pays per byte.
+func (desc *TxDesc) feeRate() float64 {
+	return float64(desc.Fee) / float64(desc.Size)
+}
+
+// TxPool holds unconfirmed transactions that spend outputs of the active
+// UTXO set or of other pool transactions, without conflicts between them.
+type TxPool struct {
+	chain *Blockchain
+
+	mu     sync.RWMutex
+	txs    map[string]*TxDesc
+	spends map[string]*Transaction // outpoint (coinKey without prefix) -> spender
+	size   int                     // bytes of all transactions in txs
+}
+
+func NewTxPool(chain *Blockchain) *TxPool {
+	return &TxPool{
+		chain:  chain,
+		txs:    make(map[string]*TxDesc),
+		spends: make(map[string]*Transaction),
+	}
+}
+
+func outpointKey(txid []byte, vout uint32) string {
+	return string(coinKey("", txid, vout))
+}
+
+// MaybeAcceptTransaction validates tx against the UTXO set and the pool and
+// adds it. Inputs missing from both are reported with ErrMissingInput, since
+// the parent may simply not have arrived yet; every other rejection means
+// the transaction is invalid.
+func (mp *TxPool) MaybeAcceptTransaction(tx *Transaction) (*TxDesc, error) {
+	desc, err := mp.maybeAccept(tx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	mp.chain.Events().Publish(TxAcceptedToMempool{Desc: desc})
+	return desc, nil
+}
+
+// MaybeAcceptStemTransaction is MaybeAcceptTransaction for a transaction in
+// the Dandelion stem phase.
+func (mp *TxPool) MaybeAcceptStemTransaction(tx *Transaction) (*TxDesc, error) {
+	return mp.maybeAccept(tx, true)
+}
+
+func (mp *TxPool) maybeAccept(tx *Transaction, stem bool) (*TxDesc, error) {
+	start := time.Now()
+	desc, err := mp.addTransaction(tx, stem)
+	recordTxValidation(time.Since(start), err)
+	return desc, err
+}
+
+func (mp *TxPool) addTransaction(tx *Transaction, stem bool) (*TxDesc, error) {
+	if err := CheckTransaction(tx); err != nil {
+		return nil, err
+	}
+	if tx.IsCoinbase() {
+		return nil, fmt.Errorf("%w: coinbase outside a block", ErrInvalidTx)
+	}
+
+	size := len(tx.Serialize())
+	if size > maxStandardTxSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the size limit", ErrInvalidTx, size)
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	txid := tx.ID()
+	if _, ok := mp.txs[string(txid)]; ok {
+		return nil, ErrTxAlreadyKnown
+	}
+
+	fee, err := mp.checkInputs(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &TxDesc{Tx: tx, Added: time.Now(), Fee: fee, Size: size, Stem: stem}
+	mp.insert(desc)
+
+	mp.expire(desc.Added)
+	mp.trim()
+	if _, ok := mp.txs[string(txid)]; !ok {
+		return nil, fmt.Errorf("%w: fee rate too low to stay in the pool", ErrMempoolFull)
+	}
+
+	return desc, nil
+}
+
+// insert adds desc to the pool. The caller must hold mp.mu.
+func (mp *TxPool) insert(desc *TxDesc) {
+	mp.txs[string(desc.Tx.ID())] = desc
+	mp.size += desc.Size
+	for _, vin := range desc.Tx.Vin {
+		mp.spends[outpointKey(vin.PrevTxID, vin.Vout)] = desc.Tx
+	}
+}
+
+// expire drops the transactions added more than mempoolExpiry before now,
+// with their descendants. The caller must hold mp.mu.
+func (mp *TxPool) expire(now time.Time) {
+	for _, desc := range mp.txs {
+		if now.Sub(desc.Added) > mempoolExpiry {
+			mp.removeTree(desc.Tx)
+		}
+	}
+}
+
+// trim evicts the transactions paying the lowest fee rate, with their
+// descendants, until the pool fits in maxMempoolSize. The caller must hold
+// mp.mu.
+func (mp *TxPool) trim() {
+	for mp.size > maxMempoolSize {
+		var worst *TxDesc
+		for _, desc := range mp.txs {
+			if worst == nil || desc.feeRate() < worst.feeRate() {
+				worst = desc
+			}
+		}
+		mp.removeTree(worst.Tx)
+	}
+}
+
+// checkInputs returns the fee tx pays, looking its inputs up in the pool and
+// then the UTXO set. The caller must hold mp.mu.
+func (mp *TxPool) checkInputs(tx *Transaction) (int64, error) {
+	var in int64
+	for i, vin := range tx.Vin {
+		if spender, ok := mp.spends[outpointKey(vin.PrevTxID, vin.Vout)]; ok {
+			return 0, fmt.Errorf("%w: %x:%d is already spent by %x", ErrTxConflict, vin.PrevTxID, vin.Vout, spender.ID())
+		}
+
+		if parent, ok := mp.txs[string(vin.PrevTxID)]; ok {
+			if int(vin.Vout) >= len(parent.Tx.Vout) {
+				return 0, fmt.Errorf("%w: %x:%d does not exist", ErrInvalidTx, vin.PrevTxID, vin.Vout)
+			}
+			if err := VerifyInput(tx, i, parent.Tx.Vout[vin.Vout]); err != nil {
+				return 0, fmt.Errorf("%w: %v", ErrInvalidTx, err)
+			}
+			in += parent.Tx.Vout[vin.Vout].Value
+			continue
+		}
+
+		coin, err := mp.chain.GetCoin(vin.PrevTxID, vin.Vout)
+		if errors.Is(err, ErrCoinNotFound) {
+			return 0, fmt.Errorf("%x:%d: %w", vin.PrevTxID, vin.Vout, ErrMissingInput)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if height := mp.chain.Height() + 1; !coin.Mature(height) {
+			return 0, fmt.Errorf("%w: %x:%d cannot be spent before height %d", ErrPrematureSpend, vin.PrevTxID, vin.Vout, coin.Height+coinbaseMaturity)
+		}
+		if err := VerifyInput(tx, i, coin.Out); err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrInvalidTx, err)
+		}
+		in += coin.Out.Value
+	}
+
+	out := outputValue(tx)
+	if in < out {
+		return 0, fmt.Errorf("%w: outputs (%d) exceed inputs (%d)", ErrInvalidTx, out, in)
+	}
+
+	return in - out, nil
+}
+
+// removeTx drops tx from the pool. The caller must hold mp.mu.
+func (mp *TxPool) removeTx(tx *Transaction) {
+	txid := string(tx.ID())
+	desc, ok := mp.txs[txid]
+	if !ok {
+		return
+	}
+
+	delete(mp.txs, txid)
+	mp.size -= desc.Size
+	for _, vin := range tx.Vin {
+		key := outpointKey(vin.PrevTxID, vin.Vout)
+		if mp.spends[key] == tx {
+			delete(mp.spends, key)
+		}
+	}
+}
+
+// removeTree drops tx and every pool transaction that spends its outputs,
+// directly or through others. The caller must hold mp.mu.
+func (mp *TxPool) removeTree(tx *Transaction) {
+	mp.removeTx(tx)
+
+	txid := tx.ID()
+	for vout := range tx.Vout {
+		if spender, ok := mp.spends[outpointKey(txid, uint32(vout))]; ok {
+			mp.removeTree(spender)
+		}
+	}
+}
+
+// Revalidate runs every pool transaction through admission again against
+// the active chain, oldest first so parents come before their children, and
+// drops those it confirmed or made invalid (including spends of coinbases
+// that a reorg made immature), and those that expired. It must run after
+// every tip change.
+func (mp *TxPool) Revalidate() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	descs := make([]*TxDesc, 0, len(mp.txs))
+	for _, desc := range mp.txs {
+		descs = append(descs, desc)
+	}
+	sort.Slice(descs, func(i, j int) bool { return descs[i].Added.Before(descs[j].Added) })
+
+	mp.txs = make(map[string]*TxDesc)
+	mp.spends = make(map[string]*Transaction)
+	mp.size = 0
+
+	now := time.Now()
+	removed := 0
+	for _, desc := range descs {
+		if now.Sub(desc.Added) > mempoolExpiry {
+			removed++
+			continue
+		}
+		fee, err := mp.checkInputs(desc.Tx)
+		if err != nil {
+			removed++
+			continue
+		}
+		desc.Fee = fee
+		mp.insert(desc)
+	}
+	return removed
+}
+
+// BlockTransactions returns the pool's transactions in an order a block can
+// hold them, parents first, and the fees they pay. Stem transactions, and
+// whatever spends them, are left out until they are announced.
+func (mp *TxPool) BlockTransactions() ([]*Transaction, int64) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	descs := make([]*TxDesc, 0, len(mp.txs))
+	for _, desc := range mp.txs {
+		descs = append(descs, desc)
+	}
+	sort.Slice(descs, func(i, j int) bool { return descs[i].Added.Before(descs[j].Added) })
+
+	included := make(map[string]bool)
+	var txs []*Transaction
+	var fees int64
+	for _, desc := range descs {
+		ready := !desc.Stem
+		for _, vin := range desc.Tx.Vin {
+			if _, inPool := mp.txs[string(vin.PrevTxID)]; inPool && !included[string(vin.PrevTxID)] {
+				ready = false
+			}
+		}
+		if !ready {
+			continue
+		}
+
+		included[string(desc.Tx.ID())] = true
+		txs = append(txs, desc.Tx)
+		fees += desc.Fee
+	}
+	return txs, fees
+}
+
+// Have reports whether the transaction txid is in the pool.
+func (mp *TxPool) Have(txid []byte) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	_, ok := mp.txs[string(txid)]
+	return ok
+}
+
+// Get returns the pool transaction txid, or nil.
+func (mp *TxPool) Get(txid []byte) *Transaction {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	if desc, ok := mp.txs[string(txid)]; ok {
+		return desc.Tx
+	}
+	return nil
+}
+
+// IsStem reports whether txid is in the pool in the stem phase.
+func (mp *TxPool) IsStem(txid []byte) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	desc, ok := mp.txs[string(txid)]
+	return ok && desc.Stem
+}
+
+// Fluff ends the stem phase of txid. It reports whether the transaction was
+// in the stem phase.
+func (mp *TxPool) Fluff(txid []byte) bool {
+	mp.mu.Lock()
+	desc, ok := mp.txs[string(txid)]
+	stem := ok && desc.Stem
+	if stem {
+		desc.Stem = false
+	}
+	mp.mu.Unlock()
+
+	if stem {
+		mp.chain.Events().Publish(TxAcceptedToMempool{Desc: desc})
+	}
+	return stem
+}
+
+// IsSpent reports whether a pool transaction spends txid:vout.
+func (mp *TxPool) IsSpent(txid []byte, vout uint32) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	_, ok := mp.spends[outpointKey(txid, vout)]
+	return ok
+}
+
+// Count returns the number of transactions in the pool.
+func (mp *TxPool) Count() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return len(mp.txs)
+}
+
+// Descs returns the pool's transactions in no particular order.
+func (mp *TxPool) Descs() []*TxDesc {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	descs := make([]*TxDesc, 0, len(mp.txs))
+	for _, desc := range mp.txs {
+		descs = append(descs, desc)
+	}
+	return descs
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Every P2P message is framed Bitcoin-style:
+//
+//	magic (4) | command (12, NUL padded) | payload length (4) | checksum (4) | payload
+//
+// where checksum is the first four bytes of SHA256(SHA256(payload)).
+const (
+	networkMagic    = 0x0b110907
+	protocolVersion = 70015
+	userAgent       = "/blockchain-impl-study:0.1/"
+
+	messageHeaderSize = 24
+	commandSize       = 12
+	maxMessagePayload = 32 * 1024 * 1024
+	maxInvPerMessage  = 50000
+	maxAddrPerMessage = 1000
+	maxBlocksPerInv   = 500
+	maxHeadersPerMsg  = 2000
+
+	serviceNodeNetwork = 1
+	serviceDandelion   = 1 << 24 // relays dandeliontx stem transactions
+)
+
+// Inventory vector types.
+const (
+	InvTypeTx    uint32 = 1
+	InvTypeBlock uint32 = 2
+)
+
+var (
+	ErrBadChecksum      = errors.New("message checksum mismatch")
+	ErrOversizedMessage = errors.New("message exceeds the size limit")
+	ErrMalformedMessage = errors.New("malformed message")
+)
+
+type Message interface {
+	Command() string
+	Encode() []byte
+}
+
+func messageChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+func WriteMessage(w io.Writer, msg Message) error {
+	payload := msg.Encode()
+
+	header := make([]byte, messageHeaderSize)
+	binary.LittleEndian.PutUint32(header, networkMagic)
+	copy(header[4:4+commandSize], msg.Command())
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(payload)))
+	copy(header[20:], messageChecksum(payload))
+
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// ReadMessage reads one framed message. Unknown commands are returned as
+// *MsgUnknown so the caller can decide whether to ignore them. After
+// ErrBadChecksum or ErrMalformedMessage the stream is still in sync and the
+// next message can be read; after any other error it is not.
+func ReadMessage(r io.Reader) (Message, error) {
+	header := make([]byte, messageHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if magic := binary.LittleEndian.Uint32(header); magic != networkMagic {
+		return nil, fmt.Errorf("unexpected network magic %08x", magic)
+	}
+
+	command := string(bytes.TrimRight(header[4:4+commandSize], "\x00"))
+	length := binary.LittleEndian.Uint32(header[16:])
+	if length > maxMessagePayload {
+		return nil, fmt.Errorf("%w: %s message of %d bytes", ErrOversizedMessage, command, length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(messageChecksum(payload), header[20:24]) {
+		return nil, ErrBadChecksum
+	}
+
+	return decodeMessage(command, payload)
+}
+
+func decodeMessage(command string, payload []byte) (Message, error) {
+	r := bytes.NewReader(payload)
+
+	var msg Message
+	var err error
+	switch command {
+	case "version":
+		msg, err = decodeMsgVersion(r)
+	case "verack":
+		msg = &MsgVerAck{}
+	case "ping":
+		msg, err = decodeMsgPing(r)
+	case "pong":
+		msg, err = decodeMsgPong(r)
+	case "inv":
+		msg, err = decodeInvList(r, func(inv []InvVect) Message { return &MsgInv{inv} })
+	case "getdata":
+		msg, err = decodeInvList(r, func(inv []InvVect) Message { return &MsgGetData{inv} })
+	case "notfound":
+		msg, err = decodeInvList(r, func(inv []InvVect) Message { return &MsgNotFound{inv} })
+	case "getblocks":
+		msg, err = decodeMsgGetBlocks(r)
+	case "getheaders":
+		var m *MsgGetBlocks
+		if m, err = decodeMsgGetBlocks(r); err == nil {
+			msg = &MsgGetHeaders{*m}
+		}
+	case "headers":
+		msg, err = decodeMsgHeaders(r)
+	case "block":
+		var block *Block
+		if block, err = DeserializeBlock(payload); err == nil {
+			msg = &MsgBlock{block}
+		}
+	case "tx":
+		var tx Transaction
+		if tx, err = DeserializeTransaction(payload); err == nil {
+			msg = &MsgTx{&tx}
+		}
+	case "addr":
+		msg, err = decodeMsgAddr(r)
+	case "getaddr":
+		msg = &MsgGetAddr{}
+	case "dandeliontx":
+		var tx Transaction
+		if tx, err = DeserializeTransaction(payload); err == nil {
+			msg = &MsgDandelionTx{&tx}
+		}
+	case "sendcmpct":
+		msg, err = decodeMsgSendCmpct(r)
+	case "cmpctblock":
+		msg, err = decodeMsgCmpctBlock(r)
+	case "getblocktxn":
+		msg, err = decodeMsgGetBlockTxn(r)
+	case "blocktxn":
+		msg, err = decodeMsgBlockTxn(r)
+	default:
+		msg = &MsgUnknown{command, payload}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: decode %s: %v", ErrMalformedMessage, command, err)
+	}
+
+	return msg, nil
+}
+
+// NetAddress is a peer address as carried in version and addr messages. IP
+// is always stored as 16 bytes (IPv4-mapped for IPv4) and Port is big-endian
+// on the wire, as in Bitcoin.
+type NetAddress struct {
+	Timestamp uint32 // only serialized inside addr messages
+	Services  uint64
+	IP        net.IP
+	Port      uint16
+}
+
+func NewNetAddress(addr string, services uint64) (*NetAddress, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NetAddress{
+		Timestamp: uint32(time.Now().Unix()),
+		Services:  services,
+		IP:        tcpAddr.IP.To16(),
+		Port:      uint16(tcpAddr.Port),
+	}, nil
+}
+
+func (na *NetAddress) String() string {
+	return net.JoinHostPort(na.IP.String(), fmt.Sprint(na.Port))
+}
+
+func (na *NetAddress) serialize(buf []byte, withTimestamp bool) []byte {
+	if withTimestamp {
+		buf = binary.LittleEndian.AppendUint32(buf, na.Timestamp)
+	}
+	buf = binary.LittleEndian.AppendUint64(buf, na.Services)
+
+	ip := na.IP.To16()
+	if ip == nil {
+		ip = net.IPv6zero
+	}
+	buf = append(buf, ip...)
+
+	return binary.BigEndian.AppendUint16(buf, na.Port)
+}
+
+func readNetAddress(r io.Reader, withTimestamp bool) (*NetAddress, error) {
+	na := &NetAddress{IP: make(net.IP, 16)}
+
+	if withTimestamp {
+		if err := binary.Read(r, binary.LittleEndian, &na.Timestamp); err != nil {
+			return nil, err
+		}
+	}
+	if err := binary.Read(r, binary.LittleEndian, &na.Services); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, na.IP); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &na.Port); err != nil {
+		return nil, err
+	}
+
+	return na, nil
+}
+
+func readVarBytes(r io.Reader, max uint64) ([]byte, error) {
+	length, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > max {
+		return nil, fmt.Errorf("variable length field of %d bytes exceeds %d", length, max)
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+// readHash reads a 32-byte hash.
+func readHash(r io.Reader) ([]byte, error) {
+	hash := make([]byte, 32)
+	_, err := io.ReadFull(r, hash)
+	return hash, err
+}
+
+type MsgVersion struct {
+	Version     int32
+	Services    uint64
+	Timestamp   int64
+	AddrRecv    NetAddress
+	AddrFrom    NetAddress
+	Nonce       uint64
+	UserAgent   string
+	StartHeight int32
+}
+
+func (m *MsgVersion) Command() string { return "version" }
+
+func (m *MsgVersion) Encode() []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(m.Version))
+	buf = binary.LittleEndian.AppendUint64(buf, m.Services)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(m.Timestamp))
+	buf = m.AddrRecv.serialize(buf, false)
+	buf = m.AddrFrom.serialize(buf, false)
+	buf = binary.LittleEndian.AppendUint64(buf, m.Nonce)
+	buf = appendVarBytes(buf, []byte(m.UserAgent))
+	return binary.LittleEndian.AppendUint32(buf, uint32(m.StartHeight))
+}
+
+func decodeMsgVersion(r io.Reader) (*MsgVersion, error) {
+	m := &MsgVersion{}
+
+	if err := binary.Read(r, binary.LittleEndian, &m.Version); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &m.Services); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &m.Timestamp); err != nil {
+		return nil, err
+	}
+
+	addrRecv, err := readNetAddress(r, false)
+	if err != nil {
+		return nil, err
+	}
+	addrFrom, err := readNetAddress(r, false)
+	if err != nil {
+		return nil, err
+	}
+	m.AddrRecv, m.AddrFrom = *addrRecv, *addrFrom
+
+	if err := binary.Read(r, binary.LittleEndian, &m.Nonce); err != nil {
+		return nil, err
+	}
+	agent, err := readVarBytes(r, 256)
+	if err != nil {
+		return nil, err
+	}
+	m.UserAgent = string(agent)
+
+	if err := binary.Read(r, binary.LittleEndian, &m.StartHeight); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type MsgVerAck struct{}
+
+func (m *MsgVerAck) Command() string { return "verack" }
+func (m *MsgVerAck) Encode() []byte  { return nil }
+
+type MsgPing struct {
+	Nonce uint64
+}
+
+func (m *MsgPing) Command() string { return "ping" }
+func (m *MsgPing) Encode() []byte  { return binary.LittleEndian.AppendUint64(nil, m.Nonce) }
+
+func decodeMsgPing(r io.Reader) (*MsgPing, error) {
+	m := &MsgPing{}
+	return m, binary.Read(r, binary.LittleEndian, &m.Nonce)
+}
+
+type MsgPong struct {
+	Nonce uint64
+}
+
+func (m *MsgPong) Command() string { return "pong" }
+func (m *MsgPong) Encode() []byte  { return binary.LittleEndian.AppendUint64(nil, m.Nonce) }
+
+func decodeMsgPong(r io.Reader) (*MsgPong, error) {
+	m := &MsgPong{}
+	return m, binary.Read(r, binary.LittleEndian, &m.Nonce)
+}
+
+// InvVect identifies a transaction or block by type and hash.
+type InvVect struct {
+	Type uint32
+	Hash []byte
+}
+
+func encodeInvList(inv []InvVect) []byte {
+	buf := appendVarInt(nil, uint64(len(inv)))
+	for _, iv := range inv {
+		buf = binary.LittleEndian.AppendUint32(buf, iv.Type)
+		buf = append(buf, iv.Hash...)
+	}
+	return buf
+}
+
+func decodeInvList(r io.Reader, wrap func([]InvVect) Message) (Message, error) {
+	count, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxInvPerMessage {
+		return nil, fmt.Errorf("%d inventory entries exceed the limit", count)
+	}
+
+	inv := make([]InvVect, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var iv InvVect
+		if err := binary.Read(r, binary.LittleEndian, &iv.Type); err != nil {
+			return nil, err
+		}
+		if iv.Hash, err = readHash(r); err != nil {
+			return nil, err
+		}
+		inv = append(inv, iv)
+	}
+
+	return wrap(inv), nil
+}
+
+type MsgInv struct {
+	Inv []InvVect
+}
+
+func (m *MsgInv) Command() string { return "inv" }
+func (m *MsgInv) Encode() []byte  { return encodeInvList(m.Inv) }
+
+type MsgGetData struct {
+	Inv []InvVect
+}
+
+func (m *MsgGetData) Command() string { return "getdata" }
+func (m *MsgGetData) Encode() []byte  { return encodeInvList(m.Inv) }
+
+// MsgNotFound answers the part of a getdata the peer could not serve.
+type MsgNotFound struct {
+	Inv []InvVect
+}
+
+func (m *MsgNotFound) Command() string { return "notfound" }
+func (m *MsgNotFound) Encode() []byte  { return encodeInvList(m.Inv) }
+
+// MsgGetBlocks asks for the inventory of main chain blocks after the first
+// locator hash the peer recognizes, up to HashStop (all zeros for no limit).
+type MsgGetBlocks struct {
+	Version  uint32
+	Locator  [][]byte
+	HashStop []byte
+}
+
+func (m *MsgGetBlocks) Command() string { return "getblocks" }
+
+func (m *MsgGetBlocks) Encode() []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, m.Version)
+	buf = appendVarInt(buf, uint64(len(m.Locator)))
+	for _, hash := range m.Locator {
+		buf = append(buf, hash...)
+	}
+
+	if m.HashStop == nil {
+		return append(buf, make([]byte, 32)...)
+	}
+	return append(buf, m.HashStop...)
+}
+
+func decodeMsgGetBlocks(r io.Reader) (*MsgGetBlocks, error) {
+	m := &MsgGetBlocks{}
+
+	if err := binary.Read(r, binary.LittleEndian, &m.Version); err != nil {
+		return nil, err
+	}
+
+	count, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > 101 {
+		return nil, fmt.Errorf("%d locator hashes exceed the limit", count)
+	}
+
+	for i := uint64(0); i < count; i++ {
+		hash, err := readHash(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Locator = append(m.Locator, hash)
+	}
+
+	m.HashStop, err = readHash(r)
+	return m, err
+}
+
+// MsgGetHeaders has the layout of getblocks but asks for up to
+// maxHeadersPerMsg headers instead of block inventory.
+type MsgGetHeaders struct {
+	MsgGetBlocks
+}
+
+func (m *MsgGetHeaders) Command() string { return "getheaders" }
+
+// MsgHeaders carries block headers, each followed by a transaction count
+// that is always zero, as in Bitcoin.
+type MsgHeaders struct {
+	Headers []BlockHeader
+}
+
+func (m *MsgHeaders) Command() string { return "headers" }
+
+func (m *MsgHeaders) Encode() []byte {
+	buf := appendVarInt(nil, uint64(len(m.Headers)))
+	for i := range m.Headers {
+		buf = append(buf, m.Headers[i].Serialize()...)
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func decodeMsgHeaders(r io.Reader) (*MsgHeaders, error) {
+	count, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxHeadersPerMsg {
+		return nil, fmt.Errorf("%d headers exceed the limit", count)
+	}
+
+	m := &MsgHeaders{Headers: make([]BlockHeader, 0, count)}
+	for i := uint64(0); i < count; i++ {
+		header, err := DeserializeBlockHeaderFromReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		txCount, err := decodeVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		if txCount != 0 {
+			return nil, fmt.Errorf("header carries %d transactions", txCount)
+		}
+
+		m.Headers = append(m.Headers, *header)
+	}
+
+	return m, nil
+}
+
+type MsgBlock struct {
+	Block *Block
+}
+
+func (m *MsgBlock) Command() string { return "block" }
+func (m *MsgBlock) Encode() []byte  { return m.Block.Serialize() }
+
+type MsgTx struct {
+	Tx *Transaction
+}
+
+func (m *MsgTx) Command() string { return "tx" }
+func (m *MsgTx) Encode() []byte  { return m.Tx.Serialize() }
+
+// MsgDandelionTx passes a transaction along a Dandelion stem. It is sent
+// unannounced and only to peers advertising serviceDandelion.
+type MsgDandelionTx struct {
+	Tx *Transaction
+}
+
+func (m *MsgDandelionTx) Command() string { return "dandeliontx" }
+func (m *MsgDandelionTx) Encode() []byte  { return m.Tx.Serialize() }
+
+type MsgAddr struct {
+	Addrs []*NetAddress
+}
+
+func (m *MsgAddr) Command() string { return "addr" }
+
+func (m *MsgAddr) Encode() []byte {
+	buf := appendVarInt(nil, uint64(len(m.Addrs)))
+	for _, na := range m.Addrs {
+		buf = na.serialize(buf, true)
+	}
+	return buf
+}
+
+func decodeMsgAddr(r io.Reader) (*MsgAddr, error) {
+	count, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxAddrPerMessage {
+		return nil, fmt.Errorf("%d addresses exceed the limit", count)
+	}
+
+	m := &MsgAddr{}
+	for i := uint64(0); i < count; i++ {
+		na, err := readNetAddress(r, true)
+		if err != nil {
+			return nil, err
+		}
+		m.Addrs = append(m.Addrs, na)
+	}
+
+	return m, nil
+}
+
+// MsgGetAddr asks a peer for addresses from its address book.
+type MsgGetAddr struct{}
+
+func (m *MsgGetAddr) Command() string { return "getaddr" }
+func (m *MsgGetAddr) Encode() []byte  { return nil }
+
+// MsgSendCmpct tells the peer which compact block version we understand and
+// whether new blocks should be pushed to us as cmpctblock messages rather
+// than announced with inv.
+type MsgSendCmpct struct {
+	Announce bool
+	Version  uint64
+}
+
+func (m *MsgSendCmpct) Command() string { return "sendcmpct" }
+
+func (m *MsgSendCmpct) Encode() []byte {
+	var announce byte
+	if m.Announce {
+		announce = 1
+	}
+	return binary.LittleEndian.AppendUint64([]byte{announce}, m.Version)
+}
+
+func decodeMsgSendCmpct(r io.Reader) (*MsgSendCmpct, error) {
+	var announce byte
+	if err := binary.Read(r, binary.LittleEndian, &announce); err != nil {
+		return nil, err
+	}
+	if announce > 1 {
+		return nil, fmt.Errorf("announce flag %d is not a boolean", announce)
+	}
+
+	m := &MsgSendCmpct{Announce: announce == 1}
+	return m, binary.Read(r, binary.LittleEndian, &m.Version)
+}
+
+// PrefilledTx is a transaction sent in full inside a compact block.
+type PrefilledTx struct {
+	Index int
+	Tx    *Transaction
+}
+
+// MsgCmpctBlock is a block header with 6-byte short IDs in place of the
+// transactions the receiver probably has, and the ones it can't have (the
+// coinbase) prefilled. Prefilled indexes are encoded as the difference to
+// the previous one minus one, as in BIP152.
+type MsgCmpctBlock struct {
+	Header    BlockHeader
+	Nonce     uint64
+	ShortIDs  []uint64
+	Prefilled []PrefilledTx
+}
+
+func (m *MsgCmpctBlock) Command() string { return "cmpctblock" }
+
+func (m *MsgCmpctBlock) Encode() []byte {
+	buf := m.Header.Serialize()
+	buf = binary.LittleEndian.AppendUint64(buf, m.Nonce)
+
+	buf = appendVarInt(buf, uint64(len(m.ShortIDs)))
+	for _, id := range m.ShortIDs {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(id))
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(id>>32))
+	}
+
+	buf = appendVarInt(buf, uint64(len(m.Prefilled)))
+	last := -1
+	for _, ptx := range m.Prefilled {
+		buf = appendVarInt(buf, uint64(ptx.Index-last-1))
+		buf = append(buf, ptx.Tx.Serialize()...)
+		last = ptx.Index
+	}
+	return buf
+}
+
+func decodeMsgCmpctBlock(r *bytes.Reader) (*MsgCmpctBlock, error) {
+	header, err := DeserializeBlockHeaderFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MsgCmpctBlock{Header: *header}
+	if err := binary.Read(r, binary.LittleEndian, &m.Nonce); err != nil {
+		return nil, err
+	}
+
+	count, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()/6) {
+		return nil, fmt.Errorf("%d short IDs cannot fit in %d bytes", count, r.Len())
+	}
+	m.ShortIDs = make([]uint64, count)
+	for i := range m.ShortIDs {
+		var id [8]byte
+		if _, err := io.ReadFull(r, id[:6]); err != nil {
+			return nil, err
+		}
+		m.ShortIDs[i] = binary.LittleEndian.Uint64(id[:])
+	}
+
+	count, err = decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()/minTxSize) {
+		return nil, fmt.Errorf("%d prefilled transactions cannot fit in %d bytes", count, r.Len())
+	}
+	indexes, err := readDiffIndexes(r, count, func() error {
+		tx, err := DeserializeTransactionFromReader(r)
+		m.Prefilled = append(m.Prefilled, PrefilledTx{Tx: &tx})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, index := range indexes {
+		m.Prefilled[i].Index = index
+	}
+
+	return m, nil
+}
+
+// readDiffIndexes reads count differentially encoded indexes, calling each
+// (if not nil) after every index to read what follows it.
+func readDiffIndexes(r io.Reader, count uint64, each func() error) ([]int, error) {
+	indexes := make([]int, 0, count)
+	last := -1
+	for i := uint64(0); i < count; i++ {
+		diff, err := decodeVarInt(r)
+		if err != nil {
+			return nil, err
+		}
+		if diff > maxMessagePayload/minTxSize || last+1+int(diff) > maxMessagePayload/minTxSize {
+			return nil, fmt.Errorf("transaction index out of range")
+		}
+		last += int(diff) + 1
+		indexes = append(indexes, last)
+
+		if each != nil {
+			if err := each(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return indexes, nil
+}
+
+// MsgGetBlockTxn asks for the transactions of a block at the given indexes,
+// after a compact block could not be reconstructed without them. Indexes
+// are differentially encoded like those of prefilled transactions.
+type MsgGetBlockTxn struct {
+	BlockHash []byte
+	Indexes   []int
+}
+
+func (m *MsgGetBlockTxn) Command() string { return "getblocktxn" }
+
+func (m *MsgGetBlockTxn) Encode() []byte {
+	buf := append([]byte(nil), m.BlockHash...)
+	buf = appendVarInt(buf, uint64(len(m.Indexes)))
+	last := -1
+	for _, index := range m.Indexes {
+		buf = appendVarInt(buf, uint64(index-last-1))
+		last = index
+	}
+	return buf
+}
+
+func decodeMsgGetBlockTxn(r *bytes.Reader) (*MsgGetBlockTxn, error) {
+	hash, err := readHash(r)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("%d indexes cannot fit in %d bytes", count, r.Len())
+	}
+
+	indexes, err := readDiffIndexes(r, count, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &MsgGetBlockTxn{BlockHash: hash, Indexes: indexes}, nil
+}
+
+// MsgBlockTxn answers getblocktxn with the requested transactions, in the
+// order they were asked for.
+type MsgBlockTxn struct {
+	BlockHash []byte
+	Txs       []*Transaction
+}
+
+func (m *MsgBlockTxn) Command() string { return "blocktxn" }
+
+func (m *MsgBlockTxn) Encode() []byte {
+	buf := append([]byte(nil), m.BlockHash...)
+	buf = appendVarInt(buf, uint64(len(m.Txs)))
+	for _, tx := range m.Txs {
+		buf = append(buf, tx.Serialize()...)
+	}
+	return buf
+}
+
+func decodeMsgBlockTxn(r *bytes.Reader) (*MsgBlockTxn, error) {
+	hash, err := readHash(r)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()/minTxSize) {
+		return nil, fmt.Errorf("%d transactions cannot fit in %d bytes", count, r.Len())
+	}
+
+	m := &MsgBlockTxn{BlockHash: hash}
+	for i := uint64(0); i < count; i++ {
+		tx, err := DeserializeTransactionFromReader(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Txs = append(m.Txs, &tx)
+	}
+	return m, nil
+}
+
+// MsgUnknown carries a message whose command this node does not understand.
+type MsgUnknown struct {
+	command string
+	Payload []byte
+}
+
+func (m *MsgUnknown) Command() string { return m.command }
+func (m *MsgUnknown) Encode() []byte  { return m.Payload }
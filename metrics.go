@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The node reports its state at /metrics in the Prometheus text exposition
+// format. Gauges describing the chain, mempool, peers and database are read
+// when scraped; counters and histograms of validation and mining are kept in
+// package variables, so nodes sharing a process (as in tests) share them.
+const metricsPrefix = "blockchain_"
+
+var (
+	metricBlocksValidated = newCounter("blocks_validated_total", "Blocks processed, by result.", "result")
+	metricBlockValidation = newHistogram("block_validation_seconds", "Time to check, store and connect a block.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+	metricTxsValidated = newCounter("txs_validated_total", "Transactions offered to the mempool, by result.", "result")
+	metricTxValidation = newHistogram("tx_validation_seconds", "Time to check a transaction for the mempool.",
+		[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1})
+	metricMinerHashes   = newCounter("miner_hashes_total", "Block header hashes computed while mining.", "")
+	metricMinerHashRate = newGauge("miner_hashrate", "Hashes per second of the last block mined here.")
+)
+
+// validationResult labels the outcome of processing a block or transaction.
+func validationResult(err error) string {
+	switch {
+	case err == nil:
+		return "accepted"
+	case errors.Is(err, ErrDuplicateBlock), errors.Is(err, ErrTxAlreadyKnown):
+		return "duplicate"
+	case errors.Is(err, ErrOrphanBlock), errors.Is(err, ErrMissingInput):
+		return "orphan"
+	case errors.Is(err, ErrInvalidBlock), errors.Is(err, ErrKnownInvalid), errors.Is(err, ErrInvalidTx):
+		return "invalid"
+	default:
+		return "error"
+	}
+}
+
+func recordBlockValidation(elapsed time.Duration, err error) {
+	metricBlocksValidated.add(validationResult(err), 1)
+	metricBlockValidation.observe(elapsed.Seconds())
+}
+
+func recordTxValidation(elapsed time.Duration, err error) {
+	metricTxsValidated.add(validationResult(err), 1)
+	metricTxValidation.observe(elapsed.Seconds())
+}
+
+func recordMining(hashes uint64, elapsed time.Duration) {
+	metricMinerHashes.add("", float64(hashes))
+	if elapsed > 0 {
+		metricMinerHashRate.set(float64(hashes) / elapsed.Seconds())
+	}
+}
+
+// counter is a counter family with at most one label.
+type counter struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]float64 // by label value
+}
+
+func newCounter(name, help, label string) *counter {
+	return &counter{name: metricsPrefix + name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counter) add(labelValue string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[labelValue] += v
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	if c.label == "" {
+		writeSample(w, c.name, "", c.values[""])
+		return
+	}
+
+	labelValues := make([]string, 0, len(c.values))
+	for v := range c.values {
+		labelValues = append(labelValues, v)
+	}
+	sort.Strings(labelValues)
+	for _, v := range labelValues {
+		writeSample(w, c.name, labelPair(c.label, v), c.values[v])
+	}
+}
+
+// gauge is a gauge set by the code being measured.
+type gauge struct {
+	name, help string
+
+	mu    sync.Mutex
+	value float64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: metricsPrefix + name, help: help}
+}
+
+func (g *gauge) set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.value = v
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeGauge(w, g.name, g.help, g.value)
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	name, help string
+	buckets    []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: metricsPrefix + name, help: help, buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	var cumulative uint64
+	for i, count := range h.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = formatFloat(h.buckets[i])
+		}
+		writeSample(w, h.name+"_bucket", labelPair("le", le), float64(cumulative))
+	}
+	writeSample(w, h.name+"_sum", "", h.sum)
+	writeSample(w, h.name+"_count", "", float64(cumulative))
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(v))
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	writeHeader(w, name, help, "gauge")
+	writeSample(w, name, "", v)
+}
+
+func labelPair(label, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return label + `="` + value + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type metricsHandler struct {
+	server *Server
+	chain  *Blockchain
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "metrics are read with GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	height, headers := h.server.SyncProgress()
+	writeGauge(w, metricsPrefix+"height", "Height of the main chain tip.", float64(height))
+	writeGauge(w, metricsPrefix+"headers", "Height of the best known header.", float64(headers))
+	if tip := h.chain.Tip(); tip != nil {
+		if entry, err := h.chain.GetBlockIndex(tip); err == nil {
+			age := time.Since(time.Unix(int64(entry.Header.Timestamp), 0))
+			writeGauge(w, metricsPrefix+"tip_age_seconds", "Seconds since the timestamp of the tip.", age.Seconds())
+			writeGauge(w, metricsPrefix+"difficulty", "Difficulty of the tip.", Difficulty(entry.Header.Bits))
+		}
+	}
+
+	var mempoolBytes int
+	descs := h.server.Mempool().Descs()
+	for _, desc := range descs {
+		mempoolBytes += desc.Size
+	}
+	writeGauge(w, metricsPrefix+"mempool_transactions", "Transactions in the mempool.", float64(len(descs)))
+	writeGauge(w, metricsPrefix+"mempool_bytes", "Serialized size of the mempool transactions.", float64(mempoolBytes))
+
+	outbound, inbound := h.server.connectionCounts()
+	writeHeader(w, metricsPrefix+"peers", "Connected peers, by direction.", "gauge")
+	writeSample(w, metricsPrefix+"peers", labelPair("direction", "inbound"), float64(inbound))
+	writeSample(w, metricsPrefix+"peers", labelPair("direction", "outbound"), float64(outbound))
+
+	lsm, vlog := h.chain.Database.Size()
+	writeGauge(w, metricsPrefix+"db_lsm_bytes", "Size of the database's LSM tree files.", float64(lsm))
+	writeGauge(w, metricsPrefix+"db_vlog_bytes", "Size of the database's value log files.", float64(vlog))
+
+	metricBlocksValidated.write(w)
+	metricBlockValidation.write(w)
+	metricTxsValidated.write(w)
+	metricTxValidation.write(w)
+	metricMinerHashes.write(w)
+	metricMinerHashRate.write(w)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// A peer whose misbehavior score reaches banThreshold is disconnected and its
+// address banned. Scores follow Bitcoin Core: provably invalid data costs
+// the full threshold, while things an honest peer might occasionally do,
+// such as sending headers that don't connect, cost a little.
+const banThreshold = 100
+
+// Misbehaving adds howMuch to p's misbehavior score and bans it once the
+// score reaches banThreshold.
+func (s *Server) Misbehaving(p *Peer, howMuch int, reason string) {
+	p.mu.Lock()
+	p.banScore += howMuch
+	score := p.banScore
+	p.mu.Unlock()
+
+	log.Printf("peer %s misbehaving (%d -> %d): %s", p, score-howMuch, score, reason)
+
+	if score >= banThreshold {
+		s.banPeer(p, reason)
+	}
+}
+
+// banPeer bans p's address. Peers on loopback or whitelisted addresses are
+// only disconnected: on a single host every node shares 127.0.0.1, and one
+// misbehaving node must not cut the others off from each other.
+func (s *Server) banPeer(p *Peer, reason string) {
+	host, _, err := net.SplitHostPort(p.addr)
+	if err != nil {
+		p.Disconnect()
+		return
+	}
+
+	if ip := net.ParseIP(host); ip != nil && s.noBan(ip) {
+		log.Printf("not banning whitelisted peer %s, disconnecting", p)
+		p.Disconnect()
+		return
+	}
+
+	subnet, err := ParseSubnet(host)
+	if err != nil {
+		p.Disconnect()
+		return
+	}
+
+	if err := s.banSubnet(subnet, time.Now().Add(defaultBanDuration), reason); err != nil {
+		log.Printf("saving ban list: %v", err)
+	}
+}
+
+// noBan reports whether peers at ip are exempt from bans.
+func (s *Server) noBan(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, subnet := range s.Whitelist {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// banSubnet bans subnet and drops every peer in it.
+func (s *Server) banSubnet(subnet *net.IPNet, until time.Time, reason string) error {
+	err := s.banList.Ban(subnet, until, reason)
+
+	for _, p := range s.Peers() {
+		if host, _, splitErr := net.SplitHostPort(p.addr); splitErr == nil {
+			if ip := net.ParseIP(host); ip != nil && subnet.Contains(ip) {
+				log.Printf("disconnecting banned peer %s", p)
+				p.Disconnect()
+			}
+		}
+	}
+
+	return err
+}
+
+// SetBan bans subnet (an IP address or CIDR subnet) for duration, or the
+// default ban time if duration is zero.
+func (s *Server) SetBan(subnet string, duration time.Duration) error {
+	ipNet, err := ParseSubnet(subnet)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		duration = defaultBanDuration
+	}
+
+	return s.banSubnet(ipNet, time.Now().Add(duration), "manually added")
+}
+
+// Unban lifts the ban of subnet.
+func (s *Server) Unban(subnet string) error {
+	ipNet, err := ParseSubnet(subnet)
+	if err != nil {
+		return err
+	}
+
+	return s.banList.Unban(ipNet)
+}
+
+// ListBanned returns the active bans.
+func (s *Server) ListBanned() []BanEntry {
+	return s.banList.List()
+}
+
+// ClearBanned lifts every ban.
+func (s *Server) ClearBanned() error {
+	return s.banList.Clear()
+}
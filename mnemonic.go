@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Wallet seeds are backed up as BIP39 mnemonics: 128 to 256 bits of entropy
+// and a checksum of a bit per 32 of entropy, written as words of the English
+// wordlist, 11 bits each.
+//
+//go:embed bip39/english.txt
+var bip39English string
+
+var (
+	bip39Words   = strings.Fields(bip39English)
+	bip39Indexes = make(map[string]int, len(bip39Words))
+)
+
+func init() {
+	for i, word := range bip39Words {
+		bip39Indexes[word] = i
+	}
+}
+
+const (
+	defaultMnemonicBits = 128
+	seedIterations      = 2048
+	seedSize            = 64
+)
+
+var ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+// NewMnemonic returns a mnemonic for bits of fresh entropy.
+func NewMnemonic(bits int) (string, error) {
+	entropy := make([]byte, bits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return EntropyToMnemonic(entropy)
+}
+
+// EntropyToMnemonic encodes entropy of 16, 20, 24, 28 or 32 bytes.
+func EntropyToMnemonic(entropy []byte) (string, error) {
+	if len(entropy) < 16 || len(entropy) > 32 || len(entropy)%4 != 0 {
+		return "", fmt.Errorf("entropy of %d bytes is not 16 to 32 bytes in steps of 4", len(entropy))
+	}
+
+	checksumBits := uint(len(entropy) / 4)
+	hash := sha256.Sum256(entropy)
+	n := new(big.Int).SetBytes(entropy)
+	n.Lsh(n, checksumBits)
+	n.Or(n, big.NewInt(int64(hash[0]>>(8-checksumBits))))
+
+	words := make([]string, (len(entropy)*8+int(checksumBits))/11)
+	index := new(big.Int)
+	mask := big.NewInt(2047)
+	for i := len(words) - 1; i >= 0; i-- {
+		index.And(n, mask)
+		words[i] = bip39Words[index.Int64()]
+		n.Rsh(n, 11)
+	}
+	return strings.Join(words, " "), nil
+}
+
+// MnemonicToEntropy decodes mnemonic, checking its checksum.
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, fmt.Errorf("%w: %d words", ErrInvalidMnemonic, len(words))
+	}
+
+	n := new(big.Int)
+	for _, word := range words {
+		index, ok := bip39Indexes[word]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown word %q", ErrInvalidMnemonic, word)
+		}
+		n.Lsh(n, 11)
+		n.Or(n, big.NewInt(int64(index)))
+	}
+
+	checksumBits := uint(len(words) / 3)
+	checksum := new(big.Int).And(n, big.NewInt(1<<checksumBits-1)).Int64()
+	n.Rsh(n, checksumBits)
+	entropy := n.FillBytes(make([]byte, len(words)*4/3))
+
+	hash := sha256.Sum256(entropy)
+	if int64(hash[0]>>(8-checksumBits)) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidMnemonic)
+	}
+	return entropy, nil
+}
+
+// MnemonicToSeed derives the BIP32 seed of mnemonic and an optional
+// passphrase. BIP39 normalizes both to NFKD first, which leaves the English
+// words and ASCII passphrases as they are; other passphrases must be given
+// normalized.
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+	if _, err := MnemonicToEntropy(mnemonic); err != nil {
+		return nil, err
+	}
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key(sha512.New, mnemonic, []byte("mnemonic"+passphrase), seedIterations, seedSize)
+}
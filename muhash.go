@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log"
+	"math/big"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+const muhashBytes = 384
+
+// muhashPrime is the MuHash3072 modulus 2^3072 - 1103717 used by Bitcoin Core.
+var muhashPrime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1103717))
+
+// MuHash is an incremental multiset hash. Elements are mapped to numbers
+// modulo muhashPrime; inserting multiplies them into the numerator and
+// removing multiplies them into the denominator, so the digest only depends
+// on which elements are in the set, not on the order they were added.
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+func NewMuHash() *MuHash {
+	return &MuHash{big.NewInt(1), big.NewInt(1)}
+}
+
+// muhashElement expands SHA256(data) into a 3072-bit number with ChaCha20.
+func muhashElement(data []byte) *big.Int {
+	key := sha256.Sum256(data)
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		log.Panic(err)
+	}
+	stream := make([]byte, muhashBytes)
+	cipher.XORKeyStream(stream, stream)
+
+	return new(big.Int).SetBytes(reverseBytes(stream))
+}
+
+func (m *MuHash) Insert(data []byte) {
+	m.numerator.Mul(m.numerator, muhashElement(data))
+	m.numerator.Mod(m.numerator, muhashPrime)
+}
+
+func (m *MuHash) Remove(data []byte) {
+	m.denominator.Mul(m.denominator, muhashElement(data))
+	m.denominator.Mod(m.denominator, muhashPrime)
+}
+
+// Digest returns SHA256 of numerator/denominator serialized as 384
+// little-endian bytes.
+func (m *MuHash) Digest() []byte {
+	inverse := new(big.Int).ModInverse(m.denominator, muhashPrime)
+	value := inverse.Mul(inverse, m.numerator)
+	value.Mod(value, muhashPrime)
+
+	digest := sha256.Sum256(reverseBytes(value.FillBytes(make([]byte, muhashBytes))))
+	return digest[:]
+}
+
+func (m *MuHash) Serialize() []byte {
+	buf := m.numerator.FillBytes(make([]byte, muhashBytes))
+	return append(buf, m.denominator.FillBytes(make([]byte, muhashBytes))...)
+}
+
+func DeserializeMuHash(data []byte) (*MuHash, error) {
+	if len(data) != 2*muhashBytes {
+		return nil, errors.New("invalid muhash length")
+	}
+
+	return &MuHash{
+		numerator:   new(big.Int).SetBytes(data[:muhashBytes]),
+		denominator: new(big.Int).SetBytes(data[muhashBytes:]),
+	}, nil
+}
+
+func reverseBytes(data []byte) []byte {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	return data
+}
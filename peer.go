@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pingInterval     = 2 * time.Minute
+	handshakeTimeout = 30 * time.Second
+	sendQueueSize    = 100
+)
+
+// Peer is one connection to another node. Messages are read and handled on
+// the peer's own goroutine and written from a queue by another, so a slow
+// peer never blocks the rest of the node.
+type Peer struct {
+	server  *Server
+	conn    net.Conn
+	stream  net.Conn // conn, or the v2 transport on top of it; set by start
+	id      int
+	addr    string
+	inbound bool
+
+	sendQueue chan Message
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	mu          sync.Mutex
+	version     *MsgVersion
+	verAckRecv  bool
+	connectedAt time.Time
+	pingNonce   uint64
+	pingSent    time.Time
+	pingLatency time.Duration
+	banScore    int
+	sessionID   []byte // v2 transport session ID, nil for v1
+
+	knownInventory *inventorySet // blocks and txs the peer is known to have
+	txInvQueue     []InvVect     // tx announcements waiting for the next trickle
+
+	sendCompact  bool          // the peer wants new blocks pushed as cmpctblock
+	partialBlock *partialBlock // compact block waiting for blocktxn
+}
+
+func newPeer(server *Server, conn net.Conn, inbound bool) *Peer {
+	return &Peer{
+		server:      server,
+		conn:        conn,
+		stream:      conn,
+		addr:        conn.RemoteAddr().String(),
+		inbound:     inbound,
+		sendQueue:   make(chan Message, sendQueueSize),
+		quit:        make(chan struct{}),
+		connectedAt: time.Now(),
+
+		knownInventory: newInventorySet(maxKnownInventory),
+	}
+}
+
+func (p *Peer) String() string {
+	direction := "outbound"
+	if p.inbound {
+		direction = "inbound"
+	}
+	return p.addr + " (" + direction + ")"
+}
+
+func (p *Peer) start() {
+	go func() {
+		// Inbound peers pick the transport with their first bytes, so the
+		// peer can't be read from or written to before they arrive.
+		if p.inbound && p.server.V2Transport {
+			stream, err := v2Respond(p.conn)
+			if err != nil {
+				if p.Connected() {
+					log.Printf("peer %s: %v", p, err)
+				}
+				p.Disconnect()
+				return
+			}
+			p.stream = stream
+		}
+		if v2, ok := p.stream.(*v2Conn); ok {
+			p.mu.Lock()
+			p.sessionID = v2.sessionID
+			p.mu.Unlock()
+		}
+
+		go p.readLoop()
+		go p.writeLoop()
+		go p.pingLoop()
+		go p.trickleLoop()
+	}()
+
+	// Drop peers that never complete the version handshake.
+	time.AfterFunc(handshakeTimeout, func() {
+		if !p.HandshakeDone() {
+			p.Disconnect()
+		}
+	})
+}
+
+// QueueMessage schedules msg to be sent. It does nothing once the peer has
+// disconnected.
+func (p *Peer) QueueMessage(msg Message) {
+	select {
+	case p.sendQueue <- msg:
+	case <-p.quit:
+	}
+}
+
+func (p *Peer) Disconnect() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+		p.server.removePeer(p)
+	})
+}
+
+func (p *Peer) Connected() bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+		return true
+	}
+}
+
+func (p *Peer) HandshakeDone() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.version != nil && p.verAckRecv
+}
+
+// Services is the service bits the peer advertised in its version message.
+func (p *Peer) Services() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.version == nil {
+		return 0
+	}
+	return p.version.Services
+}
+
+// StartHeight is the chain height the peer reported in its version message.
+func (p *Peer) StartHeight() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.version == nil {
+		return -1
+	}
+	return int(p.version.StartHeight)
+}
+
+func (p *Peer) readLoop() {
+	defer p.Disconnect()
+
+	for {
+		msg, err := ReadMessage(p.stream)
+		switch {
+		case errors.Is(err, ErrBadChecksum):
+			// Could be corruption in transit rather than malice.
+			p.server.Misbehaving(p, 10, err.Error())
+			continue
+		case errors.Is(err, ErrMalformedMessage):
+			p.server.Misbehaving(p, 100, err.Error())
+			continue
+		case errors.Is(err, ErrOversizedMessage):
+			// The payload was not read, so the stream can't be resumed.
+			p.server.Misbehaving(p, 100, err.Error())
+			return
+		case err != nil:
+			if p.Connected() {
+				log.Printf("peer %s: %v", p, err)
+			}
+			return
+		}
+		if !p.Connected() {
+			return
+		}
+
+		p.server.handleMessage(p, msg)
+	}
+}
+
+func (p *Peer) writeLoop() {
+	for {
+		select {
+		case msg := <-p.sendQueue:
+			if err := WriteMessage(p.stream, msg); err != nil {
+				p.Disconnect()
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *Peer) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			p.pingNonce = rand.Uint64()
+			p.pingSent = time.Now()
+			nonce := p.pingNonce
+			p.mu.Unlock()
+
+			p.QueueMessage(&MsgPing{Nonce: nonce})
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *Peer) handlePong(msg *MsgPong) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pingNonce != 0 && msg.Nonce == p.pingNonce {
+		p.pingLatency = time.Since(p.pingSent)
+		p.pingNonce = 0
+	}
+}
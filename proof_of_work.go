@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"math"
 	"math/big"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ProofOfWork struct {
@@ -15,6 +20,11 @@ type ProofOfWork struct {
 func (pow *ProofOfWork) Run() (uint32, []byte) {
 	var hashInt big.Int
 	headerBytes := pow.header.Serialize()
+	start := time.Now()
+
+	_, span := tracer.Start(context.Background(), "pow.mine",
+		trace.WithAttributes(attribute.Int64("pow.bits", int64(pow.header.Bits))))
+	defer span.End()
 
 	for nonce := range uint32(math.MaxUint32) {
 		if len(headerBytes) != 80 {
@@ -28,6 +38,8 @@ func (pow *ProofOfWork) Run() (uint32, []byte) {
 		hashInt.SetBytes(second[:])
 
 		if hashInt.Cmp(pow.target) == -1 {
+			recordMining(uint64(nonce)+1, time.Since(start))
+			span.SetAttributes(attribute.Int64("pow.hashes", int64(nonce)+1))
 			return nonce, second[:]
 		}
 	}
@@ -65,3 +77,20 @@ func BitsToTarget(bits uint32) *big.Int {
 
 	return target
 }
+
+// Difficulty returns how many times harder a block at bits is to find than
+// one at the original Bitcoin limit, 0x1d00ffff.
+func Difficulty(bits uint32) float64 {
+	limit := new(big.Float).SetInt(BitsToTarget(0x1d00ffff))
+	target := new(big.Float).SetInt(BitsToTarget(bits))
+	difficulty, _ := new(big.Float).Quo(limit, target).Float64()
+	return difficulty
+}
+
+// CalcWork returns the expected number of hashes needed to find a block at
+// bits, 2^256 / (target + 1).
+func CalcWork(bits uint32) *big.Int {
+	target := BitsToTarget(bits)
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	pruneConfigKey = "prunecfg"
+	pruneHeightKey = "pruneheight"
+
+	// defaultPruneDepth mirrors Bitcoin Core's MIN_BLOCKS_TO_KEEP: the last
+	// 288 blocks always keep their bodies so a reorg can still be handled.
+	defaultPruneDepth = 288
+)
+
+// PruneConfig controls prune mode. Once the bodies stored on disk exceed
+// Target bytes, the oldest bodies buried deeper than Depth blocks are deleted
+// together with their undo data. The UTXO set only needs bodies and undo data
+// to disconnect blocks, which never happens below Depth. Headers and index
+// entries are kept so the chain can still be walked.
+type PruneConfig struct {
+	Target uint64 // 0 disables pruning
+	Depth  int
+}
+
+func (cfg PruneConfig) Serialize() []byte {
+	buf := make([]byte, 12)
+	binary.LittleEndian.PutUint64(buf, cfg.Target)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(cfg.Depth))
+	return buf
+}
+
+func DeserializePruneConfig(data []byte) (PruneConfig, error) {
+	if len(data) != 12 {
+		return PruneConfig{}, errors.New("invalid prune config length")
+	}
+
+	return PruneConfig{
+		Target: binary.LittleEndian.Uint64(data),
+		Depth:  int(binary.LittleEndian.Uint32(data[8:])),
+	}, nil
+}
+
+func (chain *Blockchain) loadPruneConfig() PruneConfig {
+	var cfg PruneConfig
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(pruneConfigKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			cfg, err = DeserializePruneConfig(val)
+			return err
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return cfg
+}
+
+// SetPruneConfig persists cfg and prunes right away if the chain is already
+// over the new target.
+func (chain *Blockchain) SetPruneConfig(cfg PruneConfig) {
+	if cfg.Depth < defaultPruneDepth {
+		cfg.Depth = defaultPruneDepth
+	}
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(pruneConfigKey), cfg.Serialize())
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	chain.prune = cfg
+	if cfg.Target > 0 {
+		chain.pruneBlocks()
+	}
+}
+
+func (chain *Blockchain) PruneConfig() PruneConfig {
+	return chain.prune
+}
+
+// PruneHeight returns the highest height whose body has been pruned, or -1
+// if no block has been pruned yet.
+func (chain *Blockchain) PruneHeight() int {
+	var height int
+
+	err := chain.Database.View(func(txn *badger.Txn) (err error) {
+		height, err = getPruneHeight(txn)
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return height
+}
+
+func getPruneHeight(txn *badger.Txn) (int, error) {
+	item, err := txn.Get([]byte(pruneHeightKey))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	height := -1
+	err = item.Value(func(val []byte) error {
+		height = int(binary.LittleEndian.Uint32(val))
+		return nil
+	})
+	return height, err
+}
+
+// Prune deletes the oldest main chain bodies until the bodies still on disk
+// fit in the configured target. Only blocks more than Depth below the tip
+// are candidates. It returns the number of bodies deleted.
+func (chain *Blockchain) Prune() int {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	return chain.pruneBlocks()
+}
+
+func (chain *Blockchain) pruneBlocks() int {
+	if chain.prune.Target == 0 {
+		return 0
+	}
+
+	pruned := 0
+	maxHeight := chain.Height() - chain.prune.Depth
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		total, err := storedBlockBytes(txn)
+		if err != nil {
+			return err
+		}
+
+		// Everything up to the stored height is gone already.
+		pruneHeight, err := getPruneHeight(txn)
+		if err != nil {
+			return err
+		}
+		for height := pruneHeight + 1; height <= maxHeight && total > chain.prune.Target; height++ {
+			hash, err := getMainChainHash(txn, height)
+			if err != nil {
+				return err
+			}
+
+			entry, err := getBlockIndex(txn, hash)
+			if err != nil {
+				return err
+			}
+			pruneHeight = height
+
+			if !entry.HaveData() {
+				continue
+			}
+
+			if err := txn.Delete(hash); err != nil {
+				return err
+			}
+			if err := txn.Delete(undoKey(hash)); err != nil {
+				return err
+			}
+
+			entry.Status &^= blockHaveData
+			entry.Status |= blockPruned
+			if err := putBlockIndex(txn, entry); err != nil {
+				return err
+			}
+
+			total -= uint64(entry.Size)
+			pruned++
+		}
+
+		if pruned == 0 {
+			return nil
+		}
+
+		tmp := make([]byte, 4)
+		binary.LittleEndian.PutUint32(tmp, uint32(pruneHeight))
+		return txn.Set([]byte(pruneHeightKey), tmp)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return pruned
+}
+
+// storedBlockBytes sums the body sizes of every block that still has data.
+func storedBlockBytes(txn *badger.Txn) (uint64, error) {
+	var total uint64
+
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(blockIndexPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if !isBlockIndexKey(item.Key()) {
+			continue
+		}
+
+		err := item.Value(func(val []byte) error {
+			entry, err := DeserializeBlockIndexEntry(val)
+			if err != nil {
+				return err
+			}
+			if entry.HaveData() {
+				total += uint64(entry.Size)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// invalidBlockError aborts a chain activation attempt when a block on the
+// candidate chain fails to connect.
+type invalidBlockError struct {
+	hash []byte
+	err  error
+}
+
+func (e *invalidBlockError) Error() string {
+	return fmt.Sprintf("block %x is invalid: %v", e.hash, e.err)
+}
+
+func (e *invalidBlockError) Unwrap() error {
+	return e.err
+}
+
+func getTip(txn *badger.Txn) (*BlockIndexEntry, error) {
+	item, err := txn.Get([]byte("l"))
+	if err != nil {
+		return nil, err
+	}
+
+	tipHash, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return getBlockIndex(txn, tipHash)
+}
+
+func isMainChain(txn *badger.Txn, entry *BlockIndexEntry) (bool, error) {
+	hash, err := getMainChainHash(txn, entry.Height)
+	if errors.Is(err, ErrBlockNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(hash, entry.Hash()), nil
+}
+
+// connectTip applies block, whose parent must be the current tip, to the
+// active UTXO set, stores its undo data and the updated UTXO set statistics,
+// and makes it the new tip.
+func connectTip(txn *badger.Txn, block *Block) error {
+	hash := block.Header.Hash()
+
+	stats, err := getUTXOStats(txn)
+	if err != nil {
+		return err
+	}
+
+	view := &statsCoinView{&badgerCoinView{txn, utxoPrefix}, stats}
+	spent, err := connectBlock(view, block)
+	if err != nil {
+		return err
+	}
+
+	if err := putUTXOStats(txn, stats); err != nil {
+		return err
+	}
+	if err := txn.Set(undoKey(hash), serializeUndo(spent)); err != nil {
+		return err
+	}
+	if err := txn.Set(heightKey(block.Height), hash); err != nil {
+		return err
+	}
+
+	return txn.Set([]byte("l"), hash)
+}
+
+// disconnectTip rolls the active UTXO set back past the current tip and makes
+// its parent the new tip. It returns the disconnected block's index entry.
+func disconnectTip(txn *badger.Txn) (*BlockIndexEntry, error) {
+	tip, err := getTip(txn)
+	if err != nil {
+		return nil, err
+	}
+	hash := tip.Hash()
+
+	if tip.Height == 0 {
+		return nil, errors.New("cannot disconnect the genesis block")
+	}
+
+	block, err := readBlock(txn, tip)
+	if err != nil {
+		return nil, fmt.Errorf("cannot disconnect block %x: %w", hash, err)
+	}
+	spent, err := getUndo(txn, hash)
+	if err != nil {
+		return nil, fmt.Errorf("cannot disconnect block %x: %w", hash, err)
+	}
+
+	stats, err := getUTXOStats(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	view := &statsCoinView{&badgerCoinView{txn, utxoPrefix}, stats}
+	if err := disconnectBlock(view, block, spent); err != nil {
+		return nil, err
+	}
+
+	if err := putUTXOStats(txn, stats); err != nil {
+		return nil, err
+	}
+	if err := txn.Delete(undoKey(hash)); err != nil {
+		return nil, err
+	}
+	if err := txn.Delete(heightKey(tip.Height)); err != nil {
+		return nil, err
+	}
+	if err := txn.Set([]byte("l"), tip.Header.PrevBlockHash); err != nil {
+		return nil, err
+	}
+
+	return tip, nil
+}
+
+// forEachBlockIndex calls fn for every entry in the block index.
+func forEachBlockIndex(txn *badger.Txn, fn func(entry *BlockIndexEntry) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(blockIndexPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if !isBlockIndexKey(item.Key()) {
+			continue
+		}
+
+		err := item.Value(func(val []byte) error {
+			entry, err := DeserializeBlockIndexEntry(val)
+			if err != nil {
+				return err
+			}
+			return fn(entry)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// descendants returns every indexed block that builds on hash.
+func descendants(txn *badger.Txn, hash []byte) ([]*BlockIndexEntry, error) {
+	children := make(map[string][]*BlockIndexEntry)
+
+	err := forEachBlockIndex(txn, func(entry *BlockIndexEntry) error {
+		parent := string(entry.Header.PrevBlockHash)
+		children[parent] = append(children[parent], entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*BlockIndexEntry
+	queue := children[string(hash)]
+	for len(queue) > 0 {
+		entry := queue[0]
+		queue = queue[1:]
+
+		result = append(result, entry)
+		queue = append(queue, children[string(entry.Hash())]...)
+	}
+
+	return result, nil
+}
+
+// connectable reports whether every block from entry back to the main chain
+// has its body and has not been marked invalid.
+func connectable(txn *badger.Txn, entry *BlockIndexEntry) (bool, error) {
+	for {
+		if !entry.HaveData() || entry.Failed() {
+			return false, nil
+		}
+
+		onMain, err := isMainChain(txn, entry)
+		if err != nil {
+			return false, err
+		}
+		if onMain {
+			return true, nil
+		}
+		if entry.Height == 0 {
+			return false, nil
+		}
+
+		entry, err = getBlockIndex(txn, entry.Header.PrevBlockHash)
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// loadCandidates fills the candidate set from the block index: every block
+// with its body that is valid so far and has more work than the tip. It scans
+// the whole index, so it only runs once at startup and after blocks were
+// marked valid or invalid by hand.
+func (chain *Blockchain) loadCandidates(txn *badger.Txn) error {
+	tip, err := getTip(txn)
+	if err != nil {
+		return err
+	}
+
+	candidates := make(map[string]*BlockIndexEntry)
+	err = forEachBlockIndex(txn, func(entry *BlockIndexEntry) error {
+		if entry.HaveData() && !entry.Failed() && entry.ChainWork.Cmp(tip.ChainWork) > 0 {
+			candidates[string(entry.Hash())] = entry
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.candidates = candidates
+	return nil
+}
+
+// addCandidate notes a newly stored block as a possible new tip.
+func (chain *Blockchain) addCandidate(entry *BlockIndexEntry) {
+	if chain.candidates != nil && entry.HaveData() && !entry.Failed() {
+		chain.candidates[string(entry.Hash())] = entry
+	}
+}
+
+// findBestChain returns the connectable candidate with the most work. The
+// current tip wins ties, so we never reorg onto an equal-work chain.
+// Candidates that have been marked invalid or fell behind the tip are
+// dropped on the way.
+func (chain *Blockchain) findBestChain(txn *badger.Txn) (*BlockIndexEntry, error) {
+	if chain.candidates == nil {
+		if err := chain.loadCandidates(txn); err != nil {
+			return nil, err
+		}
+	}
+
+	tip, err := getTip(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	best := tip
+	for key, entry := range chain.candidates {
+		if entry.ChainWork.Cmp(tip.ChainWork) <= 0 {
+			delete(chain.candidates, key)
+			continue
+		}
+		if entry.ChainWork.Cmp(best.ChainWork) <= 0 {
+			continue
+		}
+
+		// The cached entry does not see flags set since it was added.
+		entry, err := getBlockIndex(txn, entry.Hash())
+		if err != nil {
+			return nil, err
+		}
+		if entry.Failed() {
+			delete(chain.candidates, key)
+			continue
+		}
+
+		ok, err := connectable(txn, entry)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			best = entry
+		}
+	}
+
+	return best, nil
+}
+
+// activateBestChain disconnects back to the fork point with the best chain
+// and connects the best chain's blocks. Every block is connected or
+// disconnected in a transaction of its own, as Core commits per block: a
+// long catch-up or a deep reorg would not fit in one, and a block that fails
+// to connect leaves the chain at its parent.
+func (chain *Blockchain) activateBestChain(ctx context.Context) error {
+	var path []*BlockIndexEntry
+	var fork, tip *BlockIndexEntry
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		best, err := chain.findBestChain(txn)
+		if err != nil {
+			return err
+		}
+		if tip, err = getTip(txn); err != nil {
+			return err
+		}
+
+		fork = best
+		for {
+			onMain, err := isMainChain(txn, fork)
+			if err != nil {
+				return err
+			}
+			if onMain {
+				return nil
+			}
+
+			path = append(path, fork)
+			fork, err = getBlockIndex(txn, fork.Header.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for height := tip.Height; height > fork.Height; height-- {
+		var disconnected *BlockIndexEntry
+		spanCtx, span := startBlockSpan(ctx, "chain.disconnect", chain.Tip(), height)
+		err := chain.update(spanCtx, func(txn *badger.Txn) (err error) {
+			disconnected, err = disconnectTip(txn)
+			return err
+		})
+		endSpan(span, err)
+		if err != nil {
+			return err
+		}
+		chain.setTip(disconnected.Header.PrevBlockHash)
+
+		// Should the new chain fail, the old one is the way back.
+		chain.addCandidate(disconnected)
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		spanCtx, span := startBlockSpan(ctx, "chain.connect", path[i].Hash(), path[i].Height)
+		err := chain.update(spanCtx, func(txn *badger.Txn) error {
+			block, err := readBlock(txn, path[i])
+			if err != nil {
+				return err
+			}
+			return connectTip(txn, block)
+		})
+		endSpan(span, err)
+		if errors.Is(err, ErrMissingInput) || errors.Is(err, ErrInvalidBlock) {
+			return &invalidBlockError{path[i].Hash(), err}
+		}
+		if err != nil {
+			return err
+		}
+		chain.setTip(path[i].Hash())
+	}
+
+	return nil
+}
+
+// markFailed flags hash as invalid and all of its descendants as building on
+// an invalid block.
+func markFailed(txn *badger.Txn, hash []byte) error {
+	entry, err := getBlockIndex(txn, hash)
+	if err != nil {
+		return err
+	}
+
+	entry.Status |= blockFailedValid
+	if err := putBlockIndex(txn, entry); err != nil {
+		return err
+	}
+
+	children, err := descendants(txn, hash)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		child.Status |= blockFailedChild
+		if err := putBlockIndex(txn, child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ActivateBestChain makes the valid chain with the most work the main chain.
+// Blocks that fail to connect on the way are marked invalid and the search
+// starts over without them.
+func (chain *Blockchain) ActivateBestChain() error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	return chain.activate(context.Background())
+}
+
+func (chain *Blockchain) activate(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "chain.activate")
+	defer func() { endSpan(span, err) }()
+
+	for {
+		err = chain.activateBestChain(ctx)
+
+		var invalid *invalidBlockError
+		if errors.As(err, &invalid) {
+			log.Print(invalid)
+			err = chain.Database.Update(func(txn *badger.Txn) error {
+				return markFailed(txn, invalid.hash)
+			})
+			if err != nil {
+				return err
+			}
+			chain.resetBestHeader()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		break
+	}
+
+	chain.reloadTip()
+	chain.publishTipChanges()
+
+	if chain.prune.Target > 0 {
+		chain.pruneBlocks()
+	}
+
+	return nil
+}
+
+// InvalidateBlock marks hash and its descendants invalid, disconnecting them
+// if they are on the main chain, and reorganizes to the best remaining chain.
+func (chain *Blockchain) InvalidateBlock(hash []byte) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		entry, err := getBlockIndex(txn, hash)
+		if err != nil {
+			return err
+		}
+		if entry.Height == 0 {
+			return errors.New("cannot invalidate the genesis block")
+		}
+
+		onMain, err := isMainChain(txn, entry)
+		if err != nil {
+			return err
+		}
+		for onMain {
+			tip, err := disconnectTip(txn)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(tip.Hash(), hash) {
+				break
+			}
+		}
+
+		return markFailed(txn, hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.resetBestHeader()
+	chain.candidates = nil
+	return chain.activate(context.Background())
+}
+
+// ReconsiderBlock clears the invalid flags set on hash, its ancestors and its
+// descendants, and reorganizes to the best chain if that now has more work.
+func (chain *Blockchain) ReconsiderBlock(hash []byte) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		entry, err := getBlockIndex(txn, hash)
+		if err != nil {
+			return err
+		}
+
+		affected, err := descendants(txn, hash)
+		if err != nil {
+			return err
+		}
+		affected = append(affected, entry)
+
+		for entry.Height > 0 {
+			entry, err = getBlockIndex(txn, entry.Header.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+			affected = append(affected, entry)
+		}
+
+		for _, entry := range affected {
+			if !entry.Failed() {
+				continue
+			}
+			entry.Status &^= blockFailedMask
+			if err := putBlockIndex(txn, entry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.resetBestHeader()
+	chain.candidates = nil
+	return chain.activate(context.Background())
+}
+
+func (chain *Blockchain) reloadTip() {
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		tip, err := getTip(txn)
+		if err != nil {
+			return err
+		}
+		chain.setTip(tip.Hash())
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
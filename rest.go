@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The REST interface serves read-only chain data to plain HTTP GETs, after
+// Bitcoin Core's:
+//
+//	/rest/block/<hash>.<ext>              block, with decoded transactions in JSON
+//	/rest/block/notxdetails/<hash>.<ext>  block, with txids only in JSON
+//	/rest/headers/<count>/<hash>.<ext>    up to count main chain headers from hash on
+//	/rest/tx/<txid>.<ext>                 transaction from the mempool or main chain
+//	/rest/chaininfo.json                  like getblockchaininfo
+//	/rest/getutxos[/checkmempool]/<txid>-<n>/....<ext>
+//
+// The extension picks the format: json (the default), bin for the wire
+// serialization or hex for the same in hex. Nothing here changes the node or
+// touches the wallet, but it sits behind the RPC credentials all the same.
+const (
+	maxRESTHeaders   = 2000
+	maxRESTOutpoints = 15
+
+	// mempoolHeight is the height reported for coins created by mempool
+	// transactions.
+	mempoolHeight = 0x7fffffff
+)
+
+type restHandler struct {
+	server *Server
+	chain  *Blockchain
+	mux    *http.ServeMux
+}
+
+func newRESTHandler(server *Server) *restHandler {
+	h := &restHandler{server: server, chain: server.chain, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /rest/block/{file}", h.handleBlock)
+	h.mux.HandleFunc("GET /rest/block/notxdetails/{file}", h.handleBlock)
+	h.mux.HandleFunc("GET /rest/headers/{count}/{file}", h.handleHeaders)
+	h.mux.HandleFunc("GET /rest/tx/{file}", h.handleTx)
+	h.mux.HandleFunc("GET /rest/chaininfo", h.handleChainInfo)
+	h.mux.HandleFunc("GET /rest/chaininfo.json", h.handleChainInfo)
+	h.mux.HandleFunc("GET /rest/getutxos/{outpoints...}", h.handleGetUTXOs)
+	return h
+}
+
+func (h *restHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mux.ServeHTTP(w, req)
+}
+
+// splitFormat splits the extension off the last path element.
+func splitFormat(file string) (name, format string, err error) {
+	name, format, ok := strings.Cut(file, ".")
+	if !ok {
+		return name, "json", nil
+	}
+	switch format {
+	case "json", "bin", "hex":
+		return name, format, nil
+	}
+	return "", "", fmt.Errorf("output format %q not found (available: json, bin, hex)", format)
+}
+
+// writeREST answers in format with data, or its JSON encoding value.
+func writeREST(w http.ResponseWriter, format string, data []byte, value any) {
+	switch format {
+	case "bin":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	case "hex":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, hex.EncodeToString(data))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
+	}
+}
+
+func restHash(w http.ResponseWriter, s string) ([]byte, bool) {
+	hash, err := hex.DecodeString(s)
+	if err != nil || len(hash) != 32 {
+		http.Error(w, "invalid hash: "+s, http.StatusBadRequest)
+		return nil, false
+	}
+	return hash, true
+}
+
+func (h *restHandler) handleBlock(w http.ResponseWriter, req *http.Request) {
+	name, format, err := splitFormat(req.PathValue("file"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	hash, ok := restHash(w, name)
+	if !ok {
+		return
+	}
+
+	entry, err := h.chain.GetBlockIndex(hash)
+	if errors.Is(err, ErrBlockNotFound) {
+		http.Error(w, name+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	block, err := h.chain.GetBlock(hash)
+	if errors.Is(err, ErrBlockPruned) || errors.Is(err, ErrBlockNoData) {
+		http.Error(w, fmt.Sprintf("%s not available: %v", name, err), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	txDetails := !strings.Contains(req.URL.Path, "/notxdetails/")
+	writeREST(w, format, block.Serialize(), newBlockResult(h.chain, entry, block, txDetails))
+}
+
+func (h *restHandler) handleHeaders(w http.ResponseWriter, req *http.Request) {
+	count, err := strconv.Atoi(req.PathValue("count"))
+	if err != nil || count < 1 || count > maxRESTHeaders {
+		http.Error(w, fmt.Sprintf("header count must be between 1 and %d", maxRESTHeaders), http.StatusBadRequest)
+		return
+	}
+	name, format, err := splitFormat(req.PathValue("file"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	hash, ok := restHash(w, name)
+	if !ok {
+		return
+	}
+
+	entry, err := h.chain.GetBlockIndex(hash)
+	if errors.Is(err, ErrBlockNotFound) {
+		http.Error(w, name+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only the main chain goes on past hash.
+	entries := []*BlockIndexEntry{entry}
+	if confirmations(h.chain, entry) > 0 {
+		for height := entry.Height + 1; len(entries) < count; height++ {
+			next, err := h.chain.GetBlockHash(height)
+			if err != nil {
+				break
+			}
+			if entry, err = h.chain.GetBlockIndex(next); err != nil {
+				break
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	var data []byte
+	results := make([]blockHeaderResult, 0, len(entries))
+	for _, entry := range entries {
+		data = append(data, entry.Header.Serialize()...)
+		results = append(results, newBlockHeaderResult(h.chain, entry))
+	}
+	writeREST(w, format, data, results)
+}
+
+func (h *restHandler) handleTx(w http.ResponseWriter, req *http.Request) {
+	name, format, err := splitFormat(req.PathValue("file"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	txid, ok := restHash(w, name)
+	if !ok {
+		return
+	}
+
+	var block *Block
+	tx := h.server.Mempool().Get(txid)
+	if tx == nil {
+		tx, block, err = h.chain.FindTransaction(txid)
+	}
+	if errors.Is(err, ErrTxNotFound) {
+		http.Error(w, name+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeREST(w, format, tx.Serialize(), newBlockTxResult(h.chain, tx, block))
+}
+
+func (h *restHandler) handleChainInfo(w http.ResponseWriter, req *http.Request) {
+	info, err := newBlockchainInfoResult(h.chain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeREST(w, "json", nil, info)
+}
+
+type utxoResult struct {
+	Height       int    `json:"height"`
+	Value        int64  `json:"value"`
+	ScriptPubKey string `json:"scriptPubKey"`
+	Address      string `json:"address,omitempty"`
+}
+
+type getUTXOsResult struct {
+	ChainHeight  int          `json:"chainHeight"`
+	ChainTipHash string       `json:"chaintipHash"`
+	Bitmap       string       `json:"bitmap"`
+	UTXOs        []utxoResult `json:"utxos"`
+}
+
+// handleGetUTXOs reports which of the given outpoints are unspent. With
+// checkmempool, outputs spent by mempool transactions count as spent and
+// outputs of mempool transactions as unspent. In binary the answer is the
+// chain height (4 bytes, little endian), the tip hash, the bitmap of unspent
+// outpoints as var bytes (bit i for outpoint i, low bits first) and the
+// unspent coins in their UTXO set serialization, preceded by their count.
+func (h *restHandler) handleGetUTXOs(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(req.PathValue("outpoints"), "/")
+	last, format, err := splitFormat(parts[len(parts)-1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	parts[len(parts)-1] = last
+
+	checkMempool := parts[0] == "checkmempool"
+	if checkMempool {
+		parts = parts[1:]
+	}
+	if len(parts) == 0 || len(parts) > maxRESTOutpoints || parts[0] == "" {
+		http.Error(w, fmt.Sprintf("between 1 and %d outpoints required", maxRESTOutpoints), http.StatusBadRequest)
+		return
+	}
+
+	height, tip := h.chain.Height(), h.chain.Tip()
+	mempool := h.server.Mempool()
+
+	bitmap := make([]byte, (len(parts)+7)/8)
+	res := getUTXOsResult{ChainHeight: height, ChainTipHash: hex.EncodeToString(tip), UTXOs: []utxoResult{}}
+	var coins []*Coin
+	for i, part := range parts {
+		txidHex, voutStr, _ := strings.Cut(part, "-")
+		txid, err := hex.DecodeString(txidHex)
+		vout, voutErr := strconv.ParseUint(voutStr, 10, 32)
+		if err != nil || len(txid) != 32 || voutErr != nil {
+			http.Error(w, "invalid outpoint: "+part, http.StatusBadRequest)
+			return
+		}
+
+		coin, err := h.chain.GetCoin(txid, uint32(vout))
+		if err != nil && !errors.Is(err, ErrCoinNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if checkMempool {
+			if mempool.IsSpent(txid, uint32(vout)) {
+				coin = nil
+			} else if tx := mempool.Get(txid); tx != nil && int(vout) < len(tx.Vout) {
+				coin = &Coin{Height: mempoolHeight, Out: tx.Vout[vout]}
+			}
+		}
+
+		if coin == nil {
+			res.Bitmap += "0"
+			continue
+		}
+		res.Bitmap += "1"
+		bitmap[i/8] |= 1 << (i % 8)
+		coins = append(coins, coin)
+		res.UTXOs = append(res.UTXOs, utxoResult{
+			Height:       coin.Height,
+			Value:        coin.Out.Value,
+			ScriptPubKey: hex.EncodeToString(coin.Out.ScriptPubKey),
+			Address:      scriptAddress(coin.Out.ScriptPubKey),
+		})
+	}
+
+	data := binary.LittleEndian.AppendUint32(nil, uint32(height))
+	data = append(data, tip...)
+	data = appendVarBytes(data, bitmap)
+	data = appendVarInt(data, uint64(len(coins)))
+	for _, coin := range coins {
+		data = append(data, coin.Serialize()...)
+	}
+	writeREST(w, format, data, res)
+}
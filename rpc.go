@@ -0,0 +1,1356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The node answers JSON-RPC 2.0 requests POSTed over HTTP, singly or in
+// batches, with parameters given by position. Every request must carry
+// HTTP basic auth: either the user and password the node was started with
+// or, by default, user __cookie__ and the random password the node writes to
+// its cookie file at startup, which only users who can read the node's files
+// can use.
+const (
+	rpcPortOffset      = 5000
+	rpcCookieFile      = "./tmp/.cookie_%s"
+	rpcCookieUser      = "__cookie__"
+	maxRPCRequestSize  = 2*maxMessagePayload + 1<<16 // room for a hex encoded block
+	rpcReadTimeout     = 30 * time.Second
+	rpcShutdownTimeout = 5 * time.Second
+)
+
+// JSON-RPC 2.0 error codes, and the application codes used by Bitcoin Core
+// for the same failures.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+
+	rpcMiscError                 = -1
+	rpcWalletError               = -4
+	rpcInvalidAddressOrKey       = -5
+	rpcWalletInsufficient        = -6
+	rpcInvalidParameter          = -8
+	rpcWalletUnlockNeeded        = -13
+	rpcWalletPassphraseIncorrect = -14
+	rpcWalletWrongEncState       = -15
+	rpcDeserializationError      = -22
+	rpcVerifyError               = -25
+	rpcVerifyRejected            = -26
+	rpcClientNodeNotAdded        = -24
+	rpcClientNodeNotConnected    = -29
+)
+
+// RPCError is the error member of a JSON-RPC response.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+func rpcErrorf(code int, format string, args ...any) *RPCError {
+	return &RPCError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+	ID      json.RawMessage   `json:"id"` // nil for notifications
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// DefaultRPCPort is the port the RPC server of nodeID listens on unless told
+// otherwise, 5000 above its P2P port.
+func DefaultRPCPort(nodeID string) int {
+	return DefaultPort(nodeID) + rpcPortOffset
+}
+
+// ReadRPCCookie returns the user and password in the cookie file of a
+// running node.
+func ReadRPCCookie(nodeID string) (user, password string, err error) {
+	data, err := os.ReadFile(fmt.Sprintf(rpcCookieFile, nodeID))
+	if err != nil {
+		return "", "", err
+	}
+
+	user, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok {
+		return "", "", errors.New("malformed RPC cookie file")
+	}
+	return user, password, nil
+}
+
+// RPCServer serves the JSON-RPC interface of a running node.
+type RPCServer struct {
+	server     *Server
+	chain      *Blockchain
+	nodeID     string
+	listenAddr string
+	user       string
+	password   string
+	cookiePath string // empty unless a cookie was written
+
+	// REST, Explorer and Metrics also serve the read-only REST interface
+	// under /rest/, the block explorer under /explorer/ and Prometheus
+	// metrics at /metrics. Set them before Start.
+	REST     bool
+	Explorer bool
+	Metrics  bool
+
+	listener   net.Listener
+	httpServer *http.Server
+	notifier   *wsNotifier
+
+	walletMu sync.Mutex // serializes wallet file updates
+
+	// walletKey is the master key of the encrypted wallet while
+	// walletpassphrase has it unlocked. walletUnlocks counts unlocks, so a
+	// relock timer can tell it has been superseded. Both are guarded by
+	// walletMu.
+	walletKey     []byte
+	walletUnlocks int
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewRPCServer returns an RPC server for the node server runs, using the
+// wallet of nodeID. Clients must log in as user with password; an empty
+// password makes Start generate a cookie instead.
+func NewRPCServer(server *Server, nodeID, listenAddr, user, password string) *RPCServer {
+	return &RPCServer{
+		server:     server,
+		chain:      server.chain,
+		nodeID:     nodeID,
+		listenAddr: listenAddr,
+		user:       user,
+		password:   password,
+		shutdown:   make(chan struct{}),
+	}
+}
+
+// Start listens for RPC clients, writing the cookie file first if no
+// password was given.
+func (r *RPCServer) Start() error {
+	if r.password == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		r.user, r.password = rpcCookieUser, hex.EncodeToString(secret)
+
+		path := fmt.Sprintf(rpcCookieFile, r.nodeID)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(r.user+":"+r.password), 0600); err != nil {
+			return err
+		}
+		r.cookiePath = path
+	}
+
+	listener, err := net.Listen("tcp", r.listenAddr)
+	if err != nil {
+		return err
+	}
+	r.listener = listener
+	r.notifier = newWSNotifier(r)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", r)
+	mux.Handle(wsPath, r.notifier)
+	if r.REST {
+		mux.Handle("/rest/", r.requireAuth(newRESTHandler(r.server)))
+	}
+	if r.Explorer {
+		mux.Handle("/explorer/", r.requireAuth(newExplorerHandler(r.server)))
+	}
+	if r.Metrics {
+		mux.Handle("/metrics", r.requireAuth(&metricsHandler{server: r.server, chain: r.chain}))
+	}
+	r.httpServer = &http.Server{Handler: mux, ReadTimeout: rpcReadTimeout}
+
+	go func() {
+		if err := r.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("RPC server: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server is listening on.
+func (r *RPCServer) Addr() string {
+	return r.listener.Addr().String()
+}
+
+// Stop closes the listener and WebSocket connections, waits briefly for
+// requests in progress and removes the cookie file.
+func (r *RPCServer) Stop() {
+	if r.notifier != nil {
+		r.notifier.close()
+	}
+	if r.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), rpcShutdownTimeout)
+		defer cancel()
+		r.httpServer.Shutdown(ctx)
+	}
+	if r.cookiePath != "" {
+		os.Remove(r.cookiePath)
+	}
+}
+
+// ShutdownRequested is closed when a client calls stop.
+func (r *RPCServer) ShutdownRequested() <-chan struct{} {
+	return r.shutdown
+}
+
+func (r *RPCServer) authorized(req *http.Request) bool {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	// Comparing hashes keeps the comparison time independent of the
+	// lengths too.
+	got := sha256.Sum256([]byte(user + ":" + password))
+	want := sha256.Sum256([]byte(r.user + ":" + r.password))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// requireAuth wraps h so that it only answers clients with the RPC
+// credentials, for the handlers that share the RPC listener.
+func (r *RPCServer) requireAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.authorized(req) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func (r *RPCServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRPCRequestSize+1))
+	if err != nil {
+		return
+	}
+	if len(body) > maxRPCRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var reply any
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			reply = errorResponse(nil, rpcErrorf(rpcParseError, "parse error: %v", err))
+		} else if len(batch) == 0 {
+			reply = errorResponse(nil, rpcErrorf(rpcInvalidRequest, "empty batch"))
+		} else {
+			var responses []*rpcResponse
+			for _, raw := range batch {
+				if resp := r.handleRequest(raw); resp != nil {
+					responses = append(responses, resp)
+				}
+			}
+			if len(responses) > 0 {
+				reply = responses
+			}
+		}
+	} else if resp := r.handleRequest(body); resp != nil {
+		reply = resp
+	}
+
+	// A request made only of notifications gets no answer.
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func errorResponse(id json.RawMessage, err *RPCError) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", Error: err, ID: id}
+}
+
+// handleRequest runs one request and returns its response, or nil for a
+// notification.
+func (r *RPCServer) handleRequest(raw json.RawMessage) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return errorResponse(nil, rpcErrorf(rpcParseError, "parse error: %v", err))
+		}
+		return errorResponse(nil, rpcErrorf(rpcInvalidRequest, "invalid request: %v", err))
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return errorResponse(req.ID, rpcErrorf(rpcInvalidRequest, "invalid request"))
+	}
+
+	result, err := r.Call(req.Method, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = rpcErrorf(rpcInternalError, "%v", err)
+		}
+		return errorResponse(req.ID, rpcErr)
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(req.ID, rpcErrorf(rpcInternalError, "%v", err))
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: encoded, ID: req.ID}
+}
+
+// rpcHandler runs a method with its positional parameters.
+type rpcHandler func(r *RPCServer, params []json.RawMessage) (any, error)
+
+var rpcMethods = map[string]rpcHandler{
+	"getblockcount":          rpcGetBlockCount,
+	"getbestblockhash":       rpcGetBestBlockHash,
+	"getblockhash":           rpcGetBlockHash,
+	"getblock":               rpcGetBlock,
+	"getblockheader":         rpcGetBlockHeader,
+	"getblockchaininfo":      rpcGetBlockchainInfo,
+	"addblock":               rpcAddBlock,
+	"invalidateblock":        rpcInvalidateBlock,
+	"reconsiderblock":        rpcReconsiderBlock,
+	"setprune":               rpcSetPrune,
+	"gettxoutsetinfo":        rpcGetTxOutSetInfo,
+	"dumptxoutset":           rpcDumpTxOutSet,
+	"getrawtransaction":      rpcGetRawTransaction,
+	"sendrawtransaction":     rpcSendRawTransaction,
+	"getrawmempool":          rpcGetRawMempool,
+	"getmininginfo":          rpcGetMiningInfo,
+	"getbalance":             rpcGetBalance,
+	"getnewaddress":          rpcGetNewAddress,
+	"listunspent":            rpcListUnspent,
+	"sendtoaddress":          rpcSendToAddress,
+	"sendfrom":               rpcSendFrom,
+	"encryptwallet":          rpcEncryptWallet,
+	"walletpassphrase":       rpcWalletPassphrase,
+	"walletlock":             rpcWalletLock,
+	"walletpassphrasechange": rpcWalletPassphraseChange,
+	"dumpmnemonic":           rpcDumpMnemonic,
+	"getpeerinfo":            rpcGetPeerInfo,
+	"addnode":                rpcAddNode,
+	"disconnectnode":         rpcDisconnectNode,
+	"setban":                 rpcSetBan,
+	"listbanned":             rpcListBanned,
+	"clearbanned":            rpcClearBanned,
+	"stop":                   rpcStop,
+}
+
+// Call runs method with params and returns its result. Errors meant for the
+// client are *RPCError.
+func (r *RPCServer) Call(method string, params []json.RawMessage) (any, error) {
+	handler, ok := rpcMethods[method]
+	if !ok {
+		return nil, rpcErrorf(rpcMethodNotFound, "method not found: %s", method)
+	}
+
+	_, span := tracer.Start(context.Background(), "rpc."+method, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.system", "jsonrpc"), attribute.String("rpc.method", method)))
+	result, err := handler(r, params)
+	endSpan(span, err)
+	return result, err
+}
+
+// parseParams decodes params into dst, of which the first required must be
+// given.
+func parseParams(params []json.RawMessage, required int, dst ...any) error {
+	if len(params) < required || len(params) > len(dst) {
+		if required == len(dst) {
+			return rpcErrorf(rpcInvalidParams, "expected %d parameters, got %d", required, len(params))
+		}
+		return rpcErrorf(rpcInvalidParams, "expected %d to %d parameters, got %d", required, len(dst), len(params))
+	}
+
+	for i, param := range params {
+		if err := json.Unmarshal(param, dst[i]); err != nil {
+			return rpcErrorf(rpcInvalidParams, "parameter %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func parseHash(s string) ([]byte, error) {
+	hash, err := hex.DecodeString(s)
+	if err != nil || len(hash) != 32 {
+		return nil, rpcErrorf(rpcInvalidParameter, "%q is not a 32-byte hex hash", s)
+	}
+	return hash, nil
+}
+
+func rpcGetBlockCount(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return r.chain.Height(), nil
+}
+
+func rpcGetBestBlockHash(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(r.chain.Tip()), nil
+}
+
+func rpcGetBlockHash(r *RPCServer, params []json.RawMessage) (any, error) {
+	var height int
+	if err := parseParams(params, 1, &height); err != nil {
+		return nil, err
+	}
+
+	hash, err := r.chain.GetBlockHash(height)
+	if err != nil {
+		return nil, rpcErrorf(rpcInvalidParameter, "block height %d out of range", height)
+	}
+	return hex.EncodeToString(hash), nil
+}
+
+// getblock HASH [VERBOSITY]: 0 returns the serialized block in hex, 1 (the
+// default) the block with its txids, 2 with its transactions decoded.
+func rpcGetBlock(r *RPCServer, params []json.RawMessage) (any, error) {
+	var hashHex string
+	verbosity := 1
+	if err := parseParams(params, 1, &hashHex, &verbosity); err != nil {
+		return nil, err
+	}
+	hash, err := parseHash(hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := r.chain.GetBlockIndex(hash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, rpcErrorf(rpcInvalidAddressOrKey, "block not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := r.chain.GetBlock(hash)
+	if errors.Is(err, ErrBlockPruned) || errors.Is(err, ErrBlockNoData) {
+		return nil, rpcErrorf(rpcMiscError, "%v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if verbosity == 0 {
+		return hex.EncodeToString(block.Serialize()), nil
+	}
+	return newBlockResult(r.chain, entry, block, verbosity >= 2), nil
+}
+
+// getblockheader HASH [VERBOSE] returns the header in hex, or decoded with
+// VERBOSE. Headers are kept for pruned and not yet downloaded blocks too.
+func rpcGetBlockHeader(r *RPCServer, params []json.RawMessage) (any, error) {
+	var hashHex string
+	verbose := true
+	if err := parseParams(params, 1, &hashHex, &verbose); err != nil {
+		return nil, err
+	}
+	hash, err := parseHash(hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := r.chain.GetBlockIndex(hash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, rpcErrorf(rpcInvalidAddressOrKey, "block not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !verbose {
+		return hex.EncodeToString(entry.Header.Serialize()), nil
+	}
+	return newBlockHeaderResult(r.chain, entry), nil
+}
+
+func rpcGetBlockchainInfo(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	return newBlockchainInfoResult(r.chain)
+}
+
+// addblock DATA mines a block with a coinbase carrying DATA and the
+// mempool's transactions, whose fees the coinbase claims, and announces it.
+func rpcAddBlock(r *RPCServer, params []json.RawMessage) (any, error) {
+	var data string
+	if err := parseParams(params, 1, &data); err != nil {
+		return nil, err
+	}
+	if r.chain.Tip() == nil {
+		return nil, rpcErrorf(rpcMiscError, "the node has no chain yet")
+	}
+
+	block, err := r.chain.MineBlock(func(height int) []*Transaction {
+		txs, fees := r.server.Mempool().BlockTransactions()
+		coinbase := NewHeightCoinbaseTX("legacy_user", data, height)
+		coinbase.Vout[0].Value += fees
+		return append([]*Transaction{coinbase}, txs...)
+	})
+	if err != nil {
+		// The pool lags behind a block that just arrived.
+		return nil, rpcErrorf(rpcMiscError, "%v; try again", err)
+	}
+	r.server.BroadcastBlock(block)
+	return hex.EncodeToString(block.Header.Hash()), nil
+}
+
+func rpcInvalidateBlock(r *RPCServer, params []json.RawMessage) (any, error) {
+	return r.markBlock(params, r.chain.InvalidateBlock)
+}
+
+func rpcReconsiderBlock(r *RPCServer, params []json.RawMessage) (any, error) {
+	return r.markBlock(params, r.chain.ReconsiderBlock)
+}
+
+// markBlock runs invalidateblock or reconsiderblock and brings the mempool
+// in line with the resulting tip.
+func (r *RPCServer) markBlock(params []json.RawMessage, mark func(hash []byte) error) (any, error) {
+	var hashHex string
+	if err := parseParams(params, 1, &hashHex); err != nil {
+		return nil, err
+	}
+	hash, err := parseHash(hashHex)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mark(hash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, rpcErrorf(rpcInvalidAddressOrKey, "block not found")
+	}
+	if err != nil {
+		return nil, rpcErrorf(rpcMiscError, "%v", err)
+	}
+
+	r.server.tipChanged()
+	return nil, nil
+}
+
+// setprune TARGET [DEPTH] returns the prune settings in effect and the
+// prune height after pruning to them.
+func rpcSetPrune(r *RPCServer, params []json.RawMessage) (any, error) {
+	var target uint64
+	depth := defaultPruneDepth
+	if err := parseParams(params, 1, &target, &depth); err != nil {
+		return nil, err
+	}
+
+	r.chain.SetPruneConfig(PruneConfig{Target: target, Depth: depth})
+	cfg := r.chain.PruneConfig()
+	return struct {
+		Target      uint64 `json:"target"`
+		Depth       int    `json:"depth"`
+		PruneHeight int    `json:"pruneheight"`
+	}{cfg.Target, cfg.Depth, r.chain.PruneHeight()}, nil
+}
+
+type txOutSetInfoResult struct {
+	Height         int    `json:"height"`
+	BestBlock      string `json:"bestblock"`
+	TxOuts         uint64 `json:"txouts"`
+	TotalAmount    int64  `json:"total_amount"`
+	SerializedSize uint64 `json:"serialized_size"`
+	MuHash         string `json:"muhash"`
+}
+
+func rpcGetTxOutSetInfo(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	stats := r.chain.UTXOStats()
+	return txOutSetInfoResult{
+		Height:         r.chain.Height(),
+		BestBlock:      hex.EncodeToString(r.chain.Tip()),
+		TxOuts:         stats.Count,
+		TotalAmount:    stats.TotalAmount,
+		SerializedSize: stats.Size,
+		MuHash:         hex.EncodeToString(stats.Hash.Digest()),
+	}, nil
+}
+
+// dumptxoutset PATH [HASH] writes the UTXO set as of block HASH (default the
+// tip) to PATH, which is relative to the node's working directory.
+func rpcDumpTxOutSet(r *RPCServer, params []json.RawMessage) (any, error) {
+	var path, hashHex string
+	if err := parseParams(params, 1, &path, &hashHex); err != nil {
+		return nil, err
+	}
+
+	baseHash := r.chain.Tip()
+	if hashHex != "" {
+		var err error
+		if baseHash, err = parseHash(hashHex); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, rpcErrorf(rpcInvalidParameter, "%v", err)
+	}
+	defer f.Close()
+
+	contentHash, height, err := r.chain.DumpUTXOSet(f, baseHash)
+	if err != nil {
+		os.Remove(path)
+		return nil, rpcErrorf(rpcMiscError, "%v", err)
+	}
+
+	return struct {
+		Path        string `json:"path"`
+		Height      int    `json:"height"`
+		BaseHash    string `json:"base_hash"`
+		ContentHash string `json:"content_hash"`
+	}{path, height, hex.EncodeToString(baseHash), hex.EncodeToString(contentHash)}, nil
+}
+
+// getrawtransaction TXID [VERBOSE] [BLOCKHASH] looks in the mempool, then in
+// the given block or, without one, in the whole main chain.
+func rpcGetRawTransaction(r *RPCServer, params []json.RawMessage) (any, error) {
+	var txidHex, blockHashHex string
+	var verbose bool
+	if err := parseParams(params, 1, &txidHex, &verbose, &blockHashHex); err != nil {
+		return nil, err
+	}
+	txid, err := parseHash(txidHex)
+	if err != nil {
+		return nil, err
+	}
+
+	var tx *Transaction
+	var block *Block
+	if blockHashHex == "" {
+		tx = r.server.Mempool().Get(txid)
+	}
+	if tx == nil && blockHashHex != "" {
+		blockHash, err := parseHash(blockHashHex)
+		if err != nil {
+			return nil, err
+		}
+		if block, err = r.chain.GetBlock(blockHash); err != nil {
+			return nil, rpcErrorf(rpcInvalidAddressOrKey, "block not available: %v", err)
+		}
+		for _, candidate := range block.Transactions {
+			if bytes.Equal(candidate.ID(), txid) {
+				tx = candidate
+			}
+		}
+	} else if tx == nil {
+		tx, block, err = r.chain.FindTransaction(txid)
+		if err != nil && !errors.Is(err, ErrTxNotFound) {
+			return nil, err
+		}
+	}
+	if tx == nil {
+		return nil, rpcErrorf(rpcInvalidAddressOrKey, "no such mempool or blockchain transaction")
+	}
+
+	if !verbose {
+		return hex.EncodeToString(tx.Serialize()), nil
+	}
+	return newBlockTxResult(r.chain, tx, block), nil
+}
+
+func rpcSendRawTransaction(r *RPCServer, params []json.RawMessage) (any, error) {
+	var txHex string
+	if err := parseParams(params, 1, &txHex); err != nil {
+		return nil, err
+	}
+
+	data, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, rpcErrorf(rpcDeserializationError, "TX decode failed: %v", err)
+	}
+	tx, err := DeserializeTransaction(data)
+	if err != nil {
+		return nil, rpcErrorf(rpcDeserializationError, "TX decode failed: %v", err)
+	}
+
+	return r.submit(&tx)
+}
+
+// submit hands tx to the node and returns its txid. Resubmitting a
+// transaction the mempool already has is not an error.
+func (r *RPCServer) submit(tx *Transaction) (any, error) {
+	_, err := r.server.SubmitTransaction(tx)
+	switch {
+	case err == nil, errors.Is(err, ErrTxAlreadyKnown):
+		return hex.EncodeToString(tx.ID()), nil
+	case errors.Is(err, ErrMissingInput):
+		return nil, rpcErrorf(rpcVerifyError, "%v", err)
+	case errors.Is(err, ErrInvalidTx), errors.Is(err, ErrTxConflict), errors.Is(err, ErrPrematureSpend), errors.Is(err, ErrMempoolFull):
+		return nil, rpcErrorf(rpcVerifyRejected, "%v", err)
+	default:
+		return nil, err
+	}
+}
+
+func rpcGetRawMempool(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	descs := r.server.Mempool().Descs()
+	sort.Slice(descs, func(i, j int) bool { return descs[i].Added.Before(descs[j].Added) })
+
+	txids := make([]string, 0, len(descs))
+	for _, desc := range descs {
+		txids = append(txids, hex.EncodeToString(desc.Tx.ID()))
+	}
+	return txids, nil
+}
+
+func rpcGetMiningInfo(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	headers := -1
+	if best := r.chain.BestHeader(); best != nil {
+		headers = best.Height
+	}
+	return struct {
+		Blocks     int     `json:"blocks"`
+		Headers    int     `json:"headers"`
+		Bits       string  `json:"bits"`
+		Difficulty float64 `json:"difficulty"`
+		PooledTx   int     `json:"pooledtx"`
+	}{
+		Blocks:     r.chain.Height(),
+		Headers:    headers,
+		Bits:       fmt.Sprintf("%08x", blockBits),
+		Difficulty: Difficulty(blockBits),
+		PooledTx:   r.server.Mempool().Count(),
+	}, nil
+}
+
+// wallets loads the node's wallet file. The caller must hold walletMu.
+func (r *RPCServer) wallets() *Wallets {
+	// A missing file is an empty wallet.
+	wallets, _ := NewWallets(r.nodeID)
+	return wallets
+}
+
+// walletCoins returns the confirmed coins paying to the wallet's addresses.
+func (r *RPCServer) walletCoins(wallets *Wallets) ([]UnspentOutput, error) {
+	var scripts [][]byte
+	for address := range wallets.Wallets {
+		scripts = append(scripts, []byte(address))
+	}
+	return r.chain.FindCoins(scripts)
+}
+
+// getbalance [ADDRESS] returns the balance of ADDRESS, or of every address
+// in the wallet, that can be spent now: the coins listunspent lists.
+func rpcGetBalance(r *RPCServer, params []json.RawMessage) (any, error) {
+	var address string
+	if err := parseParams(params, 0, &address); err != nil {
+		return nil, err
+	}
+
+	var coins []UnspentOutput
+	var err error
+	if address != "" {
+		if !ValidateAddress(address) {
+			return nil, rpcErrorf(rpcInvalidAddressOrKey, "invalid address %q", address)
+		}
+		coins, err = r.chain.FindCoins([][]byte{[]byte(address)})
+	} else {
+		r.walletMu.Lock()
+		wallets := r.wallets()
+		r.walletMu.Unlock()
+		coins, err = r.walletCoins(wallets)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var balance int64
+	for _, coin := range r.spendable(coins) {
+		balance += coin.Coin.Out.Value
+	}
+	return balance, nil
+}
+
+func rpcGetNewAddress(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+
+	wallets := r.wallets()
+	address, err := wallets.CreateWallet(r.walletKey)
+	if err != nil {
+		return nil, walletError(err)
+	}
+	wallets.SaveToFile(r.nodeID)
+	return address, nil
+}
+
+// spendable leaves out immature coinbase coins and the coins mempool
+// transactions already spend.
+func (r *RPCServer) spendable(coins []UnspentOutput) []UnspentOutput {
+	height := r.chain.Height() + 1
+	var unspent []UnspentOutput
+	for _, coin := range coins {
+		if coin.Coin.Mature(height) && !r.server.Mempool().IsSpent(coin.TxID, coin.Vout) {
+			unspent = append(unspent, coin)
+		}
+	}
+	return unspent
+}
+
+type unspentResult struct {
+	TxID          string `json:"txid"`
+	Vout          uint32 `json:"vout"`
+	Address       string `json:"address"`
+	Amount        int64  `json:"amount"`
+	Confirmations int    `json:"confirmations"`
+}
+
+func newUnspentResult(coin UnspentOutput, height int) unspentResult {
+	return unspentResult{
+		TxID:          hex.EncodeToString(coin.TxID),
+		Vout:          coin.Vout,
+		Address:       string(coin.Coin.Out.ScriptPubKey),
+		Amount:        coin.Coin.Out.Value,
+		Confirmations: height - coin.Coin.Height + 1,
+	}
+}
+
+// listunspent [ADDRESS] lists the confirmed coins of ADDRESS, or of every
+// address in the wallet, that are mature and no mempool transaction spends
+// yet.
+func rpcListUnspent(r *RPCServer, params []json.RawMessage) (any, error) {
+	var address string
+	if err := parseParams(params, 0, &address); err != nil {
+		return nil, err
+	}
+
+	var coins []UnspentOutput
+	var err error
+	if address != "" {
+		if !ValidateAddress(address) {
+			return nil, rpcErrorf(rpcInvalidAddressOrKey, "invalid address %q", address)
+		}
+		coins, err = r.chain.FindCoins([][]byte{[]byte(address)})
+	} else {
+		r.walletMu.Lock()
+		wallets := r.wallets()
+		r.walletMu.Unlock()
+		coins, err = r.walletCoins(wallets)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	height := r.chain.Height()
+	unspent := make([]unspentResult, 0, len(coins))
+	for _, coin := range r.spendable(coins) {
+		unspent = append(unspent, newUnspentResult(coin, height))
+	}
+	return unspent, nil
+}
+
+// sendtoaddress ADDRESS AMOUNT pays AMOUNT from the wallet's coins that no
+// mempool transaction spends yet, sending the change back to the address of
+// the first coin spent.
+func rpcSendToAddress(r *RPCServer, params []json.RawMessage) (any, error) {
+	var address string
+	var amount int64
+	if err := parseParams(params, 2, &address, &amount); err != nil {
+		return nil, err
+	}
+
+	// Holding walletMu keeps two sends from picking the same coins.
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+
+	wallets := r.wallets()
+	coins, err := r.walletCoins(wallets)
+	if err != nil {
+		return nil, err
+	}
+	txid, _, err := r.send(wallets, coins, address, amount, 0, "")
+	return txid, err
+}
+
+type sendFromResult struct {
+	TxID          string `json:"txid"`
+	DroppedChange int64  `json:"droppedchange"`
+}
+
+// sendfrom FROM TO AMOUNT [FEE] pays AMOUNT and a fee of FEE from the coins
+// of the wallet's address FROM that no mempool transaction spends yet,
+// sending the change back to FROM. Change below the dust threshold goes to
+// the miner and is reported as droppedchange.
+func rpcSendFrom(r *RPCServer, params []json.RawMessage) (any, error) {
+	var from, to string
+	var amount, fee int64
+	if err := parseParams(params, 3, &from, &to, &amount, &fee); err != nil {
+		return nil, err
+	}
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+
+	wallets := r.wallets()
+	if _, ok := wallets.Wallets[from]; !ok {
+		return nil, rpcErrorf(rpcInvalidAddressOrKey, "%s: %v", from, ErrWalletNotFound)
+	}
+	coins, err := r.chain.FindCoins([][]byte{[]byte(from)})
+	if err != nil {
+		return nil, err
+	}
+	txid, dropped, err := r.send(wallets, coins, to, amount, fee, from)
+	if err != nil {
+		return nil, err
+	}
+	return sendFromResult{TxID: txid.(string), DroppedChange: dropped}, nil
+}
+
+// send pays amount to address out of coins and submits the transaction,
+// returning its txid and the change left to the miner. The caller must hold
+// walletMu.
+func (r *RPCServer) send(wallets *Wallets, coins []UnspentOutput, address string, amount, fee int64, changeAddress string) (any, int64, error) {
+	if !ValidateAddress(address) {
+		return nil, 0, rpcErrorf(rpcInvalidAddressOrKey, "invalid address %q", address)
+	}
+	if amount <= 0 || amount > maxMoney {
+		return nil, 0, rpcErrorf(rpcInvalidParameter, "amount %d out of range", amount)
+	}
+	if fee < 0 || fee > maxMoney {
+		return nil, 0, rpcErrorf(rpcInvalidParameter, "fee %d out of range", fee)
+	}
+
+	tx, dropped, err := wallets.CreateTransaction(r.spendable(coins), address, amount, fee, changeAddress, r.walletKey)
+	if err != nil {
+		return nil, 0, walletError(err)
+	}
+	txid, err := r.submit(tx)
+	return txid, dropped, err
+}
+
+// walletError maps the wallet's errors to Bitcoin Core's codes.
+func walletError(err error) error {
+	switch {
+	case errors.Is(err, ErrWalletLocked):
+		return rpcErrorf(rpcWalletUnlockNeeded, "please enter the wallet passphrase with walletpassphrase first")
+	case errors.Is(err, ErrWrongPassphrase):
+		return rpcErrorf(rpcWalletPassphraseIncorrect, "%v", err)
+	case errors.Is(err, ErrWalletEncrypted), errors.Is(err, ErrWalletNotEncrypted):
+		return rpcErrorf(rpcWalletWrongEncState, "%v", err)
+	case errors.Is(err, ErrEmptyPassphrase):
+		return rpcErrorf(rpcInvalidParameter, "%v", err)
+	case errors.Is(err, ErrInsufficientFunds):
+		return rpcErrorf(rpcWalletInsufficient, "%v", err)
+	default:
+		return rpcErrorf(rpcWalletError, "%v", err)
+	}
+}
+
+// lockWallet forgets the master key. The caller must hold walletMu.
+func (r *RPCServer) lockWallet() {
+	clear(r.walletKey)
+	r.walletKey = nil
+	r.walletUnlocks++
+}
+
+// encryptwallet PASSPHRASE encrypts the wallet's private keys. The wallet is
+// locked afterwards.
+func rpcEncryptWallet(r *RPCServer, params []json.RawMessage) (any, error) {
+	var passphrase string
+	if err := parseParams(params, 1, &passphrase); err != nil {
+		return nil, err
+	}
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+
+	wallets := r.wallets()
+	if err := wallets.Encrypt([]byte(passphrase)); err != nil {
+		return nil, walletError(err)
+	}
+	wallets.SaveToFile(r.nodeID)
+	r.lockWallet()
+	return "wallet encrypted; unlock it with walletpassphrase to make new addresses or send", nil
+}
+
+// walletpassphrase PASSPHRASE TIMEOUT keeps the master key for TIMEOUT
+// seconds, replacing any earlier timeout.
+func rpcWalletPassphrase(r *RPCServer, params []json.RawMessage) (any, error) {
+	var passphrase string
+	var timeout int64
+	if err := parseParams(params, 2, &passphrase, &timeout); err != nil {
+		return nil, err
+	}
+	if timeout < 0 {
+		return nil, rpcErrorf(rpcInvalidParameter, "timeout cannot be negative")
+	}
+	timeout = min(timeout, maxUnlockTimeout)
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+
+	masterKey, err := r.wallets().Unlock([]byte(passphrase))
+	if err != nil {
+		return nil, walletError(err)
+	}
+
+	r.lockWallet()
+	r.walletKey = masterKey
+	unlock := r.walletUnlocks
+	time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		r.walletMu.Lock()
+		defer r.walletMu.Unlock()
+
+		if r.walletUnlocks == unlock {
+			r.lockWallet()
+		}
+	})
+	return nil, nil
+}
+
+func rpcWalletLock(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+
+	if !r.wallets().IsEncrypted() {
+		return nil, walletError(ErrWalletNotEncrypted)
+	}
+	r.lockWallet()
+	return nil, nil
+}
+
+// walletpassphrasechange OLD NEW changes the passphrase. An unlocked wallet
+// stays unlocked, as the master key is unchanged.
+func rpcWalletPassphraseChange(r *RPCServer, params []json.RawMessage) (any, error) {
+	var oldPassphrase, newPassphrase string
+	if err := parseParams(params, 2, &oldPassphrase, &newPassphrase); err != nil {
+		return nil, err
+	}
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+
+	wallets := r.wallets()
+	if err := wallets.ChangePassphrase([]byte(oldPassphrase), []byte(newPassphrase)); err != nil {
+		return nil, walletError(err)
+	}
+	wallets.SaveToFile(r.nodeID)
+	return nil, nil
+}
+
+type mnemonicResult struct {
+	Mnemonic    string `json:"mnemonic"`
+	Passphrase  string `json:"passphrase,omitempty"`
+	AccountPath string `json:"accountpath"`
+}
+
+// dumpmnemonic returns the mnemonic that restores the wallet's keys.
+func rpcDumpMnemonic(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	r.walletMu.Lock()
+	defer r.walletMu.Unlock()
+
+	wallets := r.wallets()
+	if !wallets.IsHD() {
+		return nil, rpcErrorf(rpcWalletError, "wallet has no seed yet; getnewaddress creates one")
+	}
+	mnemonic, passphrase, err := wallets.Mnemonic(r.walletKey)
+	if err != nil {
+		return nil, walletError(err)
+	}
+	return &mnemonicResult{Mnemonic: mnemonic, Passphrase: passphrase, AccountPath: hdAccountPath(wallets.HD.Account)}, nil
+}
+
+type peerInfoResult struct {
+	ID             int     `json:"id"`
+	Addr           string  `json:"addr"`
+	Inbound        bool    `json:"inbound"`
+	Added          bool    `json:"added"`
+	Services       string  `json:"services"`
+	Version        int32   `json:"version"`
+	SubVer         string  `json:"subver"`
+	StartingHeight int     `json:"startingheight"`
+	ConnTime       int64   `json:"conntime"`
+	PingTime       float64 `json:"pingtime"`
+	BanScore       int     `json:"banscore"`
+	Transport      string  `json:"transport_protocol_type"`
+	SessionID      string  `json:"session_id,omitempty"`
+}
+
+func rpcGetPeerInfo(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	peers := []peerInfoResult{}
+	for _, p := range r.server.PeerInfo() {
+		info := peerInfoResult{
+			ID:             p.ID,
+			Addr:           p.Addr,
+			Inbound:        p.Inbound,
+			Added:          p.Added,
+			Services:       fmt.Sprintf("%016x", p.Services),
+			Version:        p.Version,
+			SubVer:         p.UserAgent,
+			StartingHeight: p.StartHeight,
+			ConnTime:       p.ConnTime.Unix(),
+			PingTime:       p.PingTime.Seconds(),
+			BanScore:       p.BanScore,
+			Transport:      "v1",
+		}
+		if p.SessionID != nil {
+			info.Transport = "v2"
+			info.SessionID = hex.EncodeToString(p.SessionID)
+		}
+		peers = append(peers, info)
+	}
+	return peers, nil
+}
+
+// addnode ADDR add|remove|onetry
+func rpcAddNode(r *RPCServer, params []json.RawMessage) (any, error) {
+	var addr, command string
+	if err := parseParams(params, 2, &addr, &command); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch command {
+	case "add":
+		err = r.server.AddNode(addr)
+	case "remove":
+		err = r.server.RemoveNode(addr)
+	case "onetry":
+		_, err = r.server.Connect(addr)
+	default:
+		return nil, rpcErrorf(rpcInvalidParameter, "command must be add, remove or onetry")
+	}
+	if errors.Is(err, ErrPeerNotFound) {
+		return nil, rpcErrorf(rpcClientNodeNotAdded, "%v", err)
+	}
+	if err != nil {
+		return nil, rpcErrorf(rpcMiscError, "%v", err)
+	}
+	return nil, nil
+}
+
+func rpcDisconnectNode(r *RPCServer, params []json.RawMessage) (any, error) {
+	var addr string
+	if err := parseParams(params, 1, &addr); err != nil {
+		return nil, err
+	}
+
+	err := r.server.DisconnectNode(addr)
+	if errors.Is(err, ErrPeerNotFound) {
+		return nil, rpcErrorf(rpcClientNodeNotConnected, "%v", err)
+	}
+	if err != nil {
+		return nil, rpcErrorf(rpcMiscError, "%v", err)
+	}
+	return nil, nil
+}
+
+// setban SUBNET add|remove [SECONDS]
+func rpcSetBan(r *RPCServer, params []json.RawMessage) (any, error) {
+	var subnet, command string
+	var seconds int64
+	if err := parseParams(params, 2, &subnet, &command, &seconds); err != nil {
+		return nil, err
+	}
+
+	var err error
+	switch command {
+	case "add":
+		err = r.server.SetBan(subnet, time.Duration(seconds)*time.Second)
+	case "remove":
+		err = r.server.Unban(subnet)
+	default:
+		return nil, rpcErrorf(rpcInvalidParameter, "command must be add or remove")
+	}
+	if err != nil {
+		return nil, rpcErrorf(rpcInvalidParameter, "%v", err)
+	}
+	return nil, nil
+}
+
+type banResult struct {
+	Address     string `json:"address"`
+	BanCreated  int64  `json:"ban_created"`
+	BannedUntil int64  `json:"banned_until"`
+	BanReason   string `json:"ban_reason"`
+}
+
+func rpcListBanned(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	bans := []banResult{}
+	for _, ban := range r.server.ListBanned() {
+		bans = append(bans, banResult{ban.Subnet, ban.Created.Unix(), ban.Until.Unix(), ban.Reason})
+	}
+	return bans, nil
+}
+
+func rpcClearBanned(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return nil, r.server.ClearBanned()
+}
+
+func rpcStop(r *RPCServer, params []json.RawMessage) (any, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+
+	r.shutdownOnce.Do(func() { close(r.shutdown) })
+	return "node stopping", nil
+}
+
+// ErrRPCUnauthorized is returned by RPCClient.Call when the node rejects its
+// credentials.
+var ErrRPCUnauthorized = errors.New("RPC credentials rejected")
+
+// RPCClient calls the JSON-RPC interface of a running node.
+type RPCClient struct {
+	url      string
+	user     string
+	password string
+	http     *http.Client
+	nextID   atomic.Uint64
+}
+
+// NewRPCClient returns a client for the RPC server at addr (host:port).
+func NewRPCClient(addr, user, password string) *RPCClient {
+	return &RPCClient{
+		url:      "http://" + addr + "/",
+		user:     user,
+		password: password,
+		http:     &http.Client{Timeout: rpcReadTimeout},
+	}
+}
+
+// Call runs method with params on the node and decodes its result into
+// result, which may be nil. Errors returned by the node are *RPCError.
+func (c *RPCClient) Call(method string, result any, params ...any) error {
+	if params == nil {
+		params = []any{}
+	}
+	id := c.nextID.Add(1)
+	body, err := json.Marshal(map[string]any{"jsonrpc": "2.0", "method": method, "params": params, "id": id})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.user, c.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%w: RPC %s: %s", ErrRPCUnauthorized, method, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("RPC %s: %s", method, resp.Status)
+	}
+
+	var reply rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("RPC %s: %w", method, err)
+	}
+	if reply.Error != nil {
+		return reply.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Result, result)
+}
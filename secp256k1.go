@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/big"
+
+	dcrsecp256k1 "github.com/decred/dcrd/dcrec/secp256k1/v4"
+	dcrecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// secp256k1 is y² = x³ + 7 over the field of secp256k1P. The standard library
+// only has NIST curves, so its arithmetic comes from dcrd's constant-time
+// implementation, the one btcd uses; this file converts between its types
+// and the big.Int coordinates and byte scalars of the wallet code.
+var (
+	secp256k1P  = dcrsecp256k1.S256().Params().P
+	secp256k1N  = dcrsecp256k1.S256().Params().N
+	secp256k1B  = dcrsecp256k1.S256().Params().B
+	secp256k1Gx = dcrsecp256k1.S256().Params().Gx
+	secp256k1Gy = dcrsecp256k1.S256().Params().Gy
+)
+
+func secp256k1ScalarBaseMult(k []byte) (*big.Int, *big.Int) {
+	private := dcrsecp256k1.PrivKeyFromBytes(k)
+	defer private.Zero()
+
+	public := private.PubKey()
+	return public.X(), public.Y()
+}
+
+// secp256k1Sign signs hash with the private key k, taking the nonce from
+// RFC 6979 so that no randomness is needed, as Bitcoin Core does.
+func secp256k1Sign(k, hash []byte) (*big.Int, *big.Int, error) {
+	private := dcrsecp256k1.PrivKeyFromBytes(k)
+	defer private.Zero()
+
+	sig := dcrecdsa.Sign(private, hash)
+	r, s := sig.R(), sig.S()
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	return new(big.Int).SetBytes(rBytes[:]), new(big.Int).SetBytes(sBytes[:]), nil
+}
+
+// secp256k1Verify reports whether (r, s) signs hash for the public key
+// (x, y).
+func secp256k1Verify(x, y *big.Int, hash []byte, r, s *big.Int) bool {
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(secp256k1N) >= 0 || s.Cmp(secp256k1N) >= 0 {
+		return false
+	}
+	if x.Sign() < 0 || y.Sign() < 0 || x.Cmp(secp256k1P) >= 0 || y.Cmp(secp256k1P) >= 0 {
+		return false
+	}
+
+	var fx, fy dcrsecp256k1.FieldVal
+	fx.SetByteSlice(x.Bytes())
+	fy.SetByteSlice(y.Bytes())
+	public := dcrsecp256k1.NewPublicKey(&fx, &fy)
+	if !public.IsOnCurve() {
+		return false
+	}
+
+	var sr, ss dcrsecp256k1.ModNScalar
+	sr.SetByteSlice(r.Bytes())
+	ss.SetByteSlice(s.Bytes())
+	return dcrecdsa.NewSignature(&sr, &ss).Verify(hash, public)
+}
@@ -0,0 +1,769 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultMaxOutbound = 8
+	defaultMaxInbound  = 117
+	dialTimeout        = 10 * time.Second
+)
+
+// Transport makes and accepts the server's connections. Servers use TCP
+// unless given another transport, such as a MemoryNetwork host in tests.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// Server is a running node: it owns the chain, accepts inbound connections,
+// dials outbound ones and handles the messages its peers send.
+type Server struct {
+	chain      *Blockchain
+	listenAddr string
+	nonce      uint64 // sent in our version message to detect self connections
+	addrBook   *AddrBook
+	banList    *BanList
+	sync       *syncManager
+	mempool    *TxPool
+
+	// MaxOutbound and MaxInbound limit the number of connections the server
+	// makes and accepts, over Transport. They must be set before Start.
+	MaxOutbound int
+	MaxInbound  int
+	Transport   Transport
+
+	// V2Transport enables the encrypted v2 transport, for inbound
+	// connections that offer it and for outbound ones unless the peer
+	// turned out not to support it.
+	V2Transport bool
+
+	// Dandelion sends our own transactions, and relays those received in
+	// the stem phase, along a Dandelion stem before announcing them.
+	Dandelion bool
+
+	// Whitelist lists subnets whose peers are disconnected rather than
+	// banned when they misbehave, as loopback peers always are.
+	Whitelist []*net.IPNet
+
+	listener net.Listener
+
+	mu         sync.Mutex
+	peers      map[*Peer]struct{}
+	nextPeerID int
+	added      map[string]*addedNode // addnode peers, kept connected
+	dialing    map[string]bool
+	v1Only     map[string]bool // addresses that did not answer a v2 handshake
+
+	recentRejects *inventorySet        // invalid txs, forgotten on every new tip
+	txRequests    map[string]time.Time // txs requested with getdata, by txid
+	stem          stemState
+
+	quit chan struct{}
+}
+
+// NewServer returns a server for chain listening on listenAddr. Addresses
+// learned from peers are kept in addrBook and banned subnets in banList; nil
+// for either uses one that is never saved.
+func NewServer(chain *Blockchain, listenAddr string, addrBook *AddrBook, banList *BanList) *Server {
+	if addrBook == nil {
+		addrBook = NewAddrBook("")
+	}
+	if banList == nil {
+		banList = NewBanList("")
+	}
+
+	s := &Server{
+		chain:       chain,
+		listenAddr:  listenAddr,
+		nonce:       rand.Uint64(),
+		addrBook:    addrBook,
+		banList:     banList,
+		mempool:     NewTxPool(chain),
+		MaxOutbound: defaultMaxOutbound,
+		MaxInbound:  defaultMaxInbound,
+		Transport:   tcpTransport{},
+		V2Transport: true,
+		Dandelion:   true,
+		peers:       make(map[*Peer]struct{}),
+		added:       make(map[string]*addedNode),
+		dialing:     make(map[string]bool),
+		v1Only:      make(map[string]bool),
+		quit:        make(chan struct{}),
+
+		recentRejects: newInventorySet(maxRecentRejects),
+		txRequests:    make(map[string]time.Time),
+		stem:          stemState{embargoes: make(map[string]time.Time)},
+	}
+	s.sync = newSyncManager(chain, s.Misbehaving)
+
+	return s
+}
+
+// Start listens for inbound peers on the server's listen address.
+func (s *Server) Start() error {
+	listener, err := s.Transport.Listen(s.listenAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	go s.acceptLoop()
+	go s.connectionLoop()
+	go s.sync.run(s.quit)
+	go s.dandelionLoop()
+	return nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Stop() {
+	close(s.quit)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	for _, p := range s.Peers() {
+		p.Disconnect()
+	}
+
+	if err := s.addrBook.Save(); err != nil {
+		log.Printf("saving address book: %v", err)
+	}
+}
+
+func (s *Server) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			log.Printf("accept: %v", err)
+			continue
+		}
+
+		if s.banList.IsBannedAddr(conn.RemoteAddr().String()) {
+			log.Printf("rejecting %s: %v", conn.RemoteAddr(), ErrBanned)
+			conn.Close()
+			continue
+		}
+		if _, inbound := s.connectionCounts(); inbound >= s.MaxInbound {
+			log.Printf("rejecting %s: inbound slots are full", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		p := newPeer(s, conn, true)
+		s.addPeer(p)
+		p.start()
+	}
+}
+
+// Connect dials addr and starts the version handshake.
+func (s *Server) Connect(addr string) (*Peer, error) {
+	if s.banList.IsBannedAddr(addr) {
+		return nil, ErrBanned
+	}
+
+	conn, err := s.dialTransport(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPeer(s, conn, false)
+	s.addPeer(p)
+	p.start()
+	p.QueueMessage(s.versionMessage(p))
+
+	return p, nil
+}
+
+// dialTransport connects to addr, over the v2 transport if possible. Peers that don't
+// answer the v2 handshake are redialed with the plain framing, and only
+// dialed that way from then on.
+func (s *Server) dialTransport(addr string) (net.Conn, error) {
+	conn, err := s.Transport.Dial(addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	v2 := s.V2Transport && !s.v1Only[addr]
+	s.mu.Unlock()
+	if !v2 {
+		return conn, nil
+	}
+
+	v2conn, err := v2Initiate(conn)
+	if err == nil {
+		return v2conn, nil
+	}
+	conn.Close()
+
+	log.Printf("%s does not support the v2 transport (%v), falling back to v1", addr, err)
+	s.mu.Lock()
+	s.v1Only[addr] = true
+	s.mu.Unlock()
+
+	return s.Transport.Dial(addr, dialTimeout)
+}
+
+func (s *Server) addPeer(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextPeerID++
+	p.id = s.nextPeerID
+	s.peers[p] = struct{}{}
+}
+
+func (s *Server) removePeer(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.peers, p)
+	s.sync.removePeer(p)
+
+	if node, ok := s.added[p.addr]; ok && node.peer == p {
+		node.peer = nil
+		node.retryAt = time.Now().Add(retryBackoff(node.attempts))
+		node.attempts++
+	}
+}
+
+func (s *Server) Peers() []*Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]*Peer, 0, len(s.peers))
+	for p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (s *Server) versionMessage(p *Peer) *MsgVersion {
+	addrRecv, _ := NewNetAddress(p.addr, 0)
+	addrFrom, _ := NewNetAddress(s.advertisedAddr(), serviceNodeNetwork)
+
+	services := uint64(serviceNodeNetwork)
+	if s.Dandelion {
+		services |= serviceDandelion
+	}
+
+	msg := &MsgVersion{
+		Version:     protocolVersion,
+		Services:    services,
+		Timestamp:   time.Now().Unix(),
+		Nonce:       s.nonce,
+		UserAgent:   userAgent,
+		StartHeight: int32(s.chain.Height()),
+	}
+	if addrRecv != nil {
+		msg.AddrRecv = *addrRecv
+	}
+	if addrFrom != nil {
+		msg.AddrFrom = *addrFrom
+	}
+
+	return msg
+}
+
+// advertisedAddr is the address other nodes can reach us on. Test networks
+// run on one host, so a node listening on all interfaces advertises its port
+// on the loopback address.
+func (s *Server) advertisedAddr() string {
+	listenAddr := s.listenAddr
+	if s.listener != nil {
+		listenAddr = s.listener.Addr().String()
+	}
+
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (s *Server) handleMessage(p *Peer, msg Message) {
+	if _, ok := msg.(*MsgVersion); !ok && !p.HandshakeDone() {
+		if _, ok := msg.(*MsgVerAck); !ok {
+			s.Misbehaving(p, 1, msg.Command()+" before the handshake")
+			return
+		}
+	}
+
+	switch m := msg.(type) {
+	case *MsgVersion:
+		s.handleVersion(p, m)
+	case *MsgVerAck:
+		s.handleVerAck(p)
+	case *MsgPing:
+		p.QueueMessage(&MsgPong{Nonce: m.Nonce})
+	case *MsgPong:
+		p.handlePong(m)
+	case *MsgInv:
+		s.handleInv(p, m)
+	case *MsgGetData:
+		s.handleGetData(p, m)
+	case *MsgNotFound:
+		s.handleNotFound(p, m)
+	case *MsgGetBlocks:
+		s.handleGetBlocks(p, m)
+	case *MsgGetHeaders:
+		s.handleGetHeaders(p, m)
+	case *MsgHeaders:
+		s.sync.handleHeaders(p, m)
+	case *MsgBlock:
+		s.handleBlock(p, m)
+	case *MsgTx:
+		s.handleTx(p, m)
+	case *MsgDandelionTx:
+		s.handleDandelionTx(p, m)
+	case *MsgAddr:
+		s.handleAddr(p, m)
+	case *MsgGetAddr:
+		s.handleGetAddr(p)
+	case *MsgSendCmpct:
+		s.handleSendCmpct(p, m)
+	case *MsgCmpctBlock:
+		s.handleCmpctBlock(p, m)
+	case *MsgGetBlockTxn:
+		s.handleGetBlockTxn(p, m)
+	case *MsgBlockTxn:
+		s.handleBlockTxn(p, m)
+	default:
+		log.Printf("peer %s sent unknown command %q", p, msg.Command())
+	}
+}
+
+func (s *Server) handleVersion(p *Peer, msg *MsgVersion) {
+	if msg.Nonce == s.nonce {
+		log.Printf("disconnecting %s: connected to ourselves", p)
+		p.Disconnect()
+		return
+	}
+
+	p.mu.Lock()
+	duplicate := p.version != nil
+	if !duplicate {
+		p.version = msg
+	}
+	p.mu.Unlock()
+
+	if duplicate {
+		s.Misbehaving(p, 1, "duplicate version message")
+		return
+	}
+
+	if p.inbound {
+		p.QueueMessage(s.versionMessage(p))
+	}
+	p.QueueMessage(&MsgVerAck{})
+
+	s.maybeHandshakeDone(p)
+}
+
+func (s *Server) handleVerAck(p *Peer) {
+	p.mu.Lock()
+	p.verAckRecv = true
+	p.mu.Unlock()
+
+	s.maybeHandshakeDone(p)
+}
+
+func (s *Server) maybeHandshakeDone(p *Peer) {
+	if !p.HandshakeDone() {
+		return
+	}
+
+	log.Printf("connected to %s, height %d", p, p.StartHeight())
+
+	if !p.inbound {
+		if addr, err := NewNetAddress(s.advertisedAddr(), serviceNodeNetwork); err == nil {
+			p.QueueMessage(&MsgAddr{Addrs: []*NetAddress{addr}})
+		}
+		p.QueueMessage(&MsgGetAddr{})
+
+		if addr, err := NewNetAddress(p.addr, p.Services()); err == nil {
+			s.addrBook.AddAddress(addr, p.addr)
+			s.addrBook.Good(p.addr)
+		}
+		s.markAddedConnected(p)
+	}
+
+	p.QueueMessage(&MsgSendCmpct{Announce: true, Version: compactBlockVersion})
+	s.sync.addPeer(p)
+}
+
+// handleInv answers announcements of unknown blocks with getheaders; the
+// headers that come back are what schedules the block download. Unknown
+// transactions are requested unless another peer was already asked for them.
+func (s *Server) handleInv(p *Peer, msg *MsgInv) {
+	var request []InvVect
+	sentGetHeaders := false
+
+	for _, iv := range msg.Inv {
+		p.AddKnownInventory(iv.Hash)
+
+		switch iv.Type {
+		case InvTypeBlock:
+			if sentGetHeaders {
+				continue
+			}
+			if _, err := s.chain.GetBlockIndex(iv.Hash); errors.Is(err, ErrBlockNotFound) {
+				s.sync.requestHeaders(p)
+				sentGetHeaders = true
+			}
+		case InvTypeTx:
+			if s.mempool.IsStem(iv.Hash) {
+				// Someone fluffed it, so there is no more reason to
+				// hold it back.
+				s.fluffTransaction(iv.Hash)
+				continue
+			}
+			if s.wantTx(iv.Hash) {
+				request = append(request, iv)
+			}
+		}
+	}
+
+	if len(request) > 0 {
+		p.QueueMessage(&MsgGetData{Inv: request})
+	}
+}
+
+// wantTx reports whether txid should be requested, and if so records the
+// request.
+func (s *Server) wantTx(txid []byte) bool {
+	if s.mempool.Have(txid) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.recentRejects.Has(txid) {
+		return false
+	}
+	if sent, ok := s.txRequests[string(txid)]; ok && time.Since(sent) < txRequestTimeout {
+		return false
+	}
+	s.txRequests[string(txid)] = time.Now()
+	return true
+}
+
+func (s *Server) handleGetData(p *Peer, msg *MsgGetData) {
+	var notFound []InvVect
+
+	for _, iv := range msg.Inv {
+		switch iv.Type {
+		case InvTypeBlock:
+			block, err := s.chain.GetBlock(iv.Hash)
+			if err != nil {
+				notFound = append(notFound, iv)
+				continue
+			}
+			p.QueueMessage(&MsgBlock{Block: block})
+		case InvTypeTx:
+			tx := s.mempool.Get(iv.Hash)
+			if tx == nil || s.mempool.IsStem(iv.Hash) {
+				notFound = append(notFound, iv)
+				continue
+			}
+			p.QueueMessage(&MsgTx{Tx: tx})
+		default:
+			notFound = append(notFound, iv)
+		}
+	}
+
+	if len(notFound) > 0 {
+		p.QueueMessage(&MsgNotFound{Inv: notFound})
+	}
+}
+
+// handleNotFound lets blocks and transactions the peer did not have be
+// requested from other peers right away.
+func (s *Server) handleNotFound(p *Peer, msg *MsgNotFound) {
+	s.mu.Lock()
+	for _, iv := range msg.Inv {
+		if iv.Type == InvTypeTx {
+			delete(s.txRequests, string(iv.Hash))
+		}
+	}
+	s.mu.Unlock()
+
+	for _, iv := range msg.Inv {
+		if iv.Type == InvTypeBlock {
+			s.sync.blockNotFound(p, iv.Hash)
+		}
+	}
+	s.sync.requestBlocks()
+}
+
+func (s *Server) handleTx(p *Peer, msg *MsgTx) {
+	tx := msg.Tx
+	txid := tx.ID()
+	p.AddKnownInventory(txid)
+
+	s.mu.Lock()
+	_, requested := s.txRequests[string(txid)]
+	delete(s.txRequests, string(txid))
+	rejected := s.recentRejects.Has(txid)
+	s.mu.Unlock()
+	if !requested {
+		s.Misbehaving(p, 10, "unsolicited transaction")
+		return
+	}
+	if rejected {
+		return
+	}
+
+	s.acceptTransaction(p, tx)
+}
+
+// acceptTransaction adds a transaction received from p to the mempool and
+// relays it.
+func (s *Server) acceptTransaction(p *Peer, tx *Transaction) {
+	txid := tx.ID()
+
+	_, err := s.mempool.MaybeAcceptTransaction(tx)
+	switch {
+	case errors.Is(err, ErrTxAlreadyKnown):
+		return
+	case errors.Is(err, ErrMissingInput):
+		// The parent may still be on its way; the tx can be announced again.
+		log.Printf("tx %x from %s has missing inputs", txid, p)
+		return
+	case err != nil:
+		s.mu.Lock()
+		s.recentRejects.Add(txid)
+		s.mu.Unlock()
+		log.Printf("rejected tx %x from %s: %v", txid, p, err)
+		if errors.Is(err, ErrInvalidTx) {
+			s.Misbehaving(p, 10, "invalid transaction")
+		}
+		return
+	}
+
+	s.relayTransaction(txid)
+}
+
+// SubmitTransaction adds a locally created transaction to the mempool and
+// sends it on its way to peers, along a Dandelion stem if enabled.
+func (s *Server) SubmitTransaction(tx *Transaction) (*TxDesc, error) {
+	if !s.Dandelion {
+		desc, err := s.mempool.MaybeAcceptTransaction(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		s.relayTransaction(tx.ID())
+		return desc, nil
+	}
+
+	desc, err := s.mempool.MaybeAcceptStemTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.stemTransaction(tx, nil)
+	return desc, nil
+}
+
+// Mempool returns the server's transaction pool.
+func (s *Server) Mempool() *TxPool {
+	return s.mempool
+}
+
+// relayTransaction queues an announcement of txid to every peer that does
+// not already know it.
+func (s *Server) relayTransaction(txid []byte) {
+	for _, p := range s.Peers() {
+		if p.HandshakeDone() {
+			p.QueueTxInventory(txid)
+		}
+	}
+}
+
+// tipChanged brings the mempool in line with a new tip. Transactions that
+// were invalid may be valid now, so the rejects are forgotten.
+func (s *Server) tipChanged() {
+	s.mempool.Revalidate()
+
+	s.mu.Lock()
+	s.recentRejects.Reset()
+	s.mu.Unlock()
+}
+
+func (s *Server) handleGetBlocks(p *Peer, msg *MsgGetBlocks) {
+	hashes := s.chain.LocateBlocks(msg.Locator, msg.HashStop, maxBlocksPerInv)
+	if len(hashes) == 0 {
+		return
+	}
+
+	inv := make([]InvVect, 0, len(hashes))
+	for _, hash := range hashes {
+		inv = append(inv, InvVect{Type: InvTypeBlock, Hash: hash})
+	}
+	p.QueueMessage(&MsgInv{Inv: inv})
+}
+
+func (s *Server) handleGetHeaders(p *Peer, msg *MsgGetHeaders) {
+	headers := s.chain.LocateHeaders(msg.Locator, msg.HashStop, maxHeadersPerMsg)
+	p.QueueMessage(&MsgHeaders{Headers: headers})
+}
+
+func (s *Server) handleBlock(p *Peer, msg *MsgBlock) {
+	hash := msg.Block.Header.Hash()
+	p.AddKnownInventory(hash)
+
+	// Full blocks are only ever fetched with getdata, so anything else is a
+	// peer pushing data at us.
+	if !s.sync.blockRequested(p, hash) {
+		s.Misbehaving(p, 20, "unsolicited block")
+		return
+	}
+
+	s.processBlock(p, msg.Block)
+}
+
+// processBlock adds a block received from p to the chain and announces the
+// new tip.
+func (s *Server) processBlock(p *Peer, block *Block) {
+	hash := block.Header.Hash()
+	oldTip := s.chain.Tip()
+
+	ctx, span := tracer.Start(context.Background(), "p2p.block", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("peer.address", p.String())))
+	defer span.End()
+
+	err := s.chain.ProcessBlockContext(ctx, block)
+	s.sync.blockReceived(hash)
+
+	switch {
+	case errors.Is(err, ErrOrphanBlock):
+		s.sync.requestHeaders(p)
+		return
+	case errors.Is(err, ErrDuplicateBlock):
+		return
+	case errors.Is(err, ErrKnownInvalid):
+		log.Printf("ignoring block %x from %s: %v", hash, p, err)
+		return
+	case errors.Is(err, ErrInvalidBlock):
+		s.Misbehaving(p, 100, err.Error())
+		return
+	case err != nil:
+		log.Printf("rejected block %x from %s: %v", hash, p, err)
+		return
+	}
+
+	tip := s.chain.Tip()
+	if !bytes.Equal(tip, oldTip) {
+		s.tipChanged()
+
+		// Only announce once caught up, not every block of the initial
+		// download.
+		if bytes.Equal(tip, s.chain.BestHeader().Hash()) {
+			log.Printf("new tip %x at height %d", tip, s.chain.Height())
+			s.announceBlock(tip, p)
+		}
+	}
+
+	s.sync.requestBlocks()
+}
+
+// SyncProgress returns the main chain height and the height of the best
+// known header, which is larger while blocks are being downloaded.
+func (s *Server) SyncProgress() (height, headers int) {
+	return s.sync.Progress()
+}
+
+// announceBlock tells every peer except from about the block hash: peers that
+// asked for compact blocks get one, the others an inv.
+func (s *Server) announceBlock(hash []byte, from *Peer) {
+	inv := &MsgInv{Inv: []InvVect{{Type: InvTypeBlock, Hash: hash}}}
+	var compact *MsgCmpctBlock
+
+	for _, p := range s.Peers() {
+		if p == from || !p.HandshakeDone() {
+			continue
+		}
+
+		p.mu.Lock()
+		known := p.knownInventory.Has(hash)
+		p.knownInventory.Add(hash)
+		sendCompact := p.sendCompact
+		p.mu.Unlock()
+
+		if known {
+			continue
+		}
+		if sendCompact && compact == nil {
+			if block, err := s.chain.GetBlock(hash); err == nil {
+				compact = NewCompactBlock(block)
+			}
+		}
+		if sendCompact && compact != nil {
+			p.QueueMessage(compact)
+		} else {
+			p.QueueMessage(inv)
+		}
+	}
+}
+
+// BroadcastBlock announces a block mined or otherwise added locally.
+func (s *Server) BroadcastBlock(block *Block) {
+	s.tipChanged()
+	s.announceBlock(block.Header.Hash(), nil)
+}
+
+func (s *Server) handleAddr(p *Peer, msg *MsgAddr) {
+	for _, na := range msg.Addrs {
+		s.addrBook.AddAddress(na, p.addr)
+	}
+}
+
+// handleGetAddr answers with a random sample of the address book.
+func (s *Server) handleGetAddr(p *Peer) {
+	if !p.inbound {
+		// Only answer inbound peers, so a node we connect to cannot learn
+		// which addresses our outbound connections were chosen from.
+		return
+	}
+
+	addrs := s.addrBook.Sample(maxAddrPerMessage)
+	if len(addrs) > 0 {
+		p.QueueMessage(&MsgAddr{Addrs: addrs})
+	}
+}
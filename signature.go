@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Inputs are signed as Bitcoin's P2PKH inputs are: the scriptSig pushes a
+// DER signature, followed by the sighash type, and then the public key whose
+// address the spent output pays. Signatures are normalized to low S.
+const (
+	sigHashAll  = 1
+	maxDataPush = 75 // longest push with a single-byte opcode
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// signatureHash returns the hash input i of tx signs for SIGHASH_ALL: the
+// double SHA-256 of tx with every scriptSig emptied but input i's, which is
+// replaced with the scriptPubKey it spends, followed by the sighash type.
+func signatureHash(tx *Transaction, i int, scriptPubKey []byte) []byte {
+	txCopy := *tx
+	txCopy.Vin = make([]TxIn, len(tx.Vin))
+	for j, vin := range tx.Vin {
+		vin.ScriptSig = nil
+		if j == i {
+			vin.ScriptSig = scriptPubKey
+		}
+		txCopy.Vin[j] = vin
+	}
+
+	data := binary.LittleEndian.AppendUint32(txCopy.Serialize(), sigHashAll)
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// sign returns the DER signature of hash by the private key k.
+func (c *keyCurve) sign(k, hash []byte) ([]byte, error) {
+	if !c.validScalar(k) {
+		return nil, errors.New("invalid private key")
+	}
+	r, s, err := c.signHash(k, hash)
+	if err != nil {
+		return nil, err
+	}
+	if s.Cmp(new(big.Int).Rsh(c.n, 1)) > 0 {
+		s.Sub(c.n, s)
+	}
+	return asn1.Marshal(ecdsaSignature{r, s})
+}
+
+// verify reports whether sig is a low-S DER signature of hash by the public
+// key (x, y).
+func (c *keyCurve) verify(x, y *big.Int, hash, sig []byte) bool {
+	var parsed ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &parsed)
+	if err != nil || len(rest) != 0 || parsed.R == nil || parsed.S == nil {
+		return false
+	}
+	if parsed.S.Cmp(new(big.Int).Rsh(c.n, 1)) > 0 {
+		return false
+	}
+	return c.verifyHash(x, y, hash, parsed.R, parsed.S)
+}
+
+func p256Sign(k, hash []byte) (*big.Int, *big.Int, error) {
+	private, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ecdsa.Sign(rand.Reader, private, hash)
+}
+
+func p256Verify(x, y *big.Int, hash []byte, r, s *big.Int) bool {
+	uncompressed := make([]byte, 65)
+	uncompressed[0] = 4
+	x.FillBytes(uncompressed[1:33])
+	y.FillBytes(uncompressed[33:])
+	public, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), uncompressed)
+	if err != nil {
+		return false
+	}
+	return ecdsa.Verify(public, hash, r, s)
+}
+
+// signingKey returns the private scalar of a wallet key on the named curve.
+func signingKey(curveName string, privKey []byte) ([]byte, error) {
+	if curveName != legacyCurve {
+		return privKey, nil
+	}
+	private, err := x509.ParseECPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	return private.Bytes()
+}
+
+// signInput sets the scriptSig of input i of tx, which spends prevOut, to a
+// signature by the wallet key privKey and pubKey on the named curve.
+func signInput(tx *Transaction, i int, prevOut TxOut, curveName string, privKey, pubKey []byte) error {
+	curve, err := lookupCurve(curveName)
+	if err != nil {
+		return err
+	}
+	k, err := signingKey(curveName, privKey)
+	if err != nil {
+		return err
+	}
+	sig, err := curve.sign(k, signatureHash(tx, i, prevOut.ScriptPubKey))
+	if err != nil {
+		return err
+	}
+
+	script := appendPush(nil, append(sig, sigHashAll))
+	tx.Vin[i].ScriptSig = appendPush(script, pubKey)
+	return nil
+}
+
+// VerifyInput checks the scriptSig of input i of tx, which spends prevOut:
+// its public key must have the address prevOut pays, and its signature must
+// sign the input with that key.
+func VerifyInput(tx *Transaction, i int, prevOut TxOut) error {
+	sig, pubKey, err := parseScriptSig(tx.Vin[i].ScriptSig)
+	if err != nil {
+		return err
+	}
+	if string(prevOut.ScriptPubKey) != string(Wallet{PubKey: pubKey}.GetAddress()) {
+		return fmt.Errorf("%w: public key does not match the address paid", ErrInvalidSignature)
+	}
+	if len(sig) == 0 || sig[len(sig)-1] != sigHashAll {
+		return fmt.Errorf("%w: unsupported sighash type", ErrInvalidSignature)
+	}
+	hash := signatureHash(tx, i, prevOut.ScriptPubKey)
+
+	for _, point := range publicKeyPoints(pubKey) {
+		if point.curve.verify(point.x, point.y, hash, sig[:len(sig)-1]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: input %d", ErrInvalidSignature, i)
+}
+
+type curvePoint struct {
+	curve *keyCurve
+	x, y  *big.Int
+}
+
+// publicKeyPoints returns what pubKey may be: a SEC1 key on either curve,
+// or else a legacy P-256 key, whose coordinates can only be told apart by
+// trying where one could end and the other begin.
+func publicKeyPoints(pubKey []byte) []curvePoint {
+	var points []curvePoint
+	if len(pubKey) == 33 || len(pubKey) == 65 {
+		for _, curve := range []*keyCurve{secp256k1, p256} {
+			if x, y, err := curve.parsePublicKey(pubKey); err == nil {
+				points = append(points, curvePoint{curve, x, y})
+			}
+		}
+		return points
+	}
+
+	for xLen := max(len(pubKey)-32, 1); xLen <= min(len(pubKey)-1, 32); xLen++ {
+		x, y := new(big.Int).SetBytes(pubKey[:xLen]), new(big.Int).SetBytes(pubKey[xLen:])
+		if _, _, err := p256.parsePublicKey(p256.marshalUncompressed(x, y)); err == nil {
+			points = append(points, curvePoint{p256, x, y})
+		}
+	}
+	return points
+}
+
+// appendPush appends a script operation pushing data, which must be short.
+func appendPush(script, data []byte) []byte {
+	return append(append(script, byte(len(data))), data...)
+}
+
+// parseScriptSig returns the signature and public key a scriptSig pushes.
+func parseScriptSig(script []byte) (sig, pubKey []byte, err error) {
+	r := bytes.NewReader(script)
+	var pushes [][]byte
+	for r.Len() > 0 {
+		n, _ := r.ReadByte()
+		if n == 0 || n > maxDataPush || int(n) > r.Len() {
+			return nil, nil, fmt.Errorf("%w: malformed scriptSig", ErrInvalidSignature)
+		}
+		data := make([]byte, n)
+		r.Read(data)
+		pushes = append(pushes, data)
+	}
+	if len(pushes) != 2 {
+		return nil, nil, fmt.Errorf("%w: scriptSig pushes %d items, not a signature and a public key", ErrInvalidSignature, len(pushes))
+	}
+	return pushes[0], pushes[1], nil
+}
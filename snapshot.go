@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// A UTXO snapshot file is laid out as
+//
+//	magic "utxo" | version | base hash | base height
+//	varint header count | 80-byte headers from genesis to base
+//	varint coin count | (txid | vout | coin) ...
+//	SHA256 over the (txid | vout | coin) entries
+//
+// The trailing hash is the snapshot's content hash. A node loaded from the
+// snapshot recomputes it over the UTXO set it builds while validating
+// history in the background.
+const (
+	snapshotMagic   = "utxo"
+	snapshotVersion = byte(1)
+
+	snapshotKey = "snapshot"
+
+	// The background chainstate replays history from genesis under its own
+	// prefixes so it never touches the active, snapshot-based UTXO set.
+	backgroundUTXOPrefix = "v"
+	backgroundTipKey     = "vl"
+)
+
+const (
+	snapshotPending byte = iota
+	snapshotValidated
+	snapshotInvalid
+)
+
+var ErrSnapshotMismatch = errors.New("background chainstate does not match snapshot")
+
+// SnapshotInfo records which snapshot a chainstate was bootstrapped from and
+// whether background validation has confirmed it yet.
+type SnapshotInfo struct {
+	BaseHash    []byte
+	Height      int
+	ContentHash []byte
+	Status      byte
+}
+
+func (s *SnapshotInfo) Serialize() []byte {
+	buf := append([]byte{}, s.BaseHash...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(s.Height))
+	buf = append(buf, s.ContentHash...)
+	return append(buf, s.Status)
+}
+
+func DeserializeSnapshotInfo(data []byte) (*SnapshotInfo, error) {
+	if len(data) != 69 {
+		return nil, errors.New("invalid snapshot info length")
+	}
+
+	return &SnapshotInfo{
+		BaseHash:    append([]byte{}, data[:32]...),
+		Height:      int(binary.LittleEndian.Uint32(data[32:])),
+		ContentHash: append([]byte{}, data[36:68]...),
+		Status:      data[68],
+	}, nil
+}
+
+// BlockSource supplies historical blocks for background validation. A
+// *Blockchain opened on another node's data directory satisfies it.
+type BlockSource interface {
+	GetBlockHash(height int) ([]byte, error)
+	GetBlock(hash []byte) (*Block, error)
+}
+
+// coinHasher computes the snapshot content hash over a stream of
+// (outpoint, coin) entries.
+type coinHasher struct {
+	h hash.Hash
+}
+
+func newCoinHasher() *coinHasher {
+	return &coinHasher{h: sha256.New()}
+}
+
+// add hashes one entry and returns its serialized form.
+func (c *coinHasher) add(outpoint []byte, coin *Coin) []byte {
+	entry := append(append([]byte{}, outpoint...), coin.Serialize()...)
+	c.h.Write(entry)
+	return entry
+}
+
+func (c *coinHasher) Sum() []byte {
+	return c.h.Sum(nil)
+}
+
+// DumpUTXOSet writes the UTXO set as of the main chain block baseHash to w
+// and returns its content hash. Blocks above the base are disconnected in
+// memory, so their bodies and undo data must not have been pruned.
+func (chain *Blockchain) DumpUTXOSet(w io.Writer, baseHash []byte) ([]byte, int, error) {
+	var contentHash []byte
+	var baseHeight int
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		base, err := getBlockIndex(txn, baseHash)
+		if err != nil {
+			return err
+		}
+		baseHeight = base.Height
+
+		mainHash, err := getMainChainHash(txn, base.Height)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(mainHash, baseHash) {
+			return fmt.Errorf("block %x is not on the main chain", baseHash)
+		}
+
+		view := memoryCoinView{}
+		err = forEachCoin(txn, utxoPrefix, func(key []byte, coin *Coin) error {
+			view[string(key)] = coin
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		tip, err := getBlockIndex(txn, chain.LastHash)
+		if err != nil {
+			return err
+		}
+
+		for height := tip.Height; height > base.Height; height-- {
+			hash, err := getMainChainHash(txn, height)
+			if err != nil {
+				return err
+			}
+			entry, err := getBlockIndex(txn, hash)
+			if err != nil {
+				return err
+			}
+			block, err := readBlock(txn, entry)
+			if err != nil {
+				return fmt.Errorf("cannot roll back block at height %d: %w", height, err)
+			}
+			spent, err := getUndo(txn, hash)
+			if err != nil {
+				return fmt.Errorf("cannot roll back block at height %d: %w", height, err)
+			}
+			if err := disconnectBlock(view, block, spent); err != nil {
+				return err
+			}
+		}
+
+		bw := bufio.NewWriter(w)
+
+		bw.WriteString(snapshotMagic)
+		bw.WriteByte(snapshotVersion)
+		bw.Write(baseHash)
+		binary.Write(bw, binary.LittleEndian, uint32(base.Height))
+
+		bw.Write(encodeVarInt(uint64(base.Height + 1)))
+		for height := 0; height <= base.Height; height++ {
+			hash, err := getMainChainHash(txn, height)
+			if err != nil {
+				return err
+			}
+			entry, err := getBlockIndex(txn, hash)
+			if err != nil {
+				return err
+			}
+			bw.Write(entry.Header.Serialize())
+		}
+
+		bw.Write(encodeVarInt(uint64(len(view))))
+		hasher := newCoinHasher()
+		for _, key := range view.sortedKeys() {
+			outpoint := []byte(key)[len(utxoPrefix):]
+			bw.Write(hasher.add(outpoint, view[key]))
+		}
+
+		contentHash = hasher.Sum()
+		bw.Write(contentHash)
+
+		return bw.Flush()
+	})
+
+	return contentHash, baseHeight, err
+}
+
+// utxoSnapshot is a parsed snapshot file.
+type utxoSnapshot struct {
+	baseHash    []byte
+	headers     []*BlockHeader
+	outpoints   [][]byte
+	coins       []*Coin
+	contentHash []byte
+}
+
+// readUTXOSnapshot parses a snapshot, checking that the headers link up from
+// genesis to the base with valid proof of work and that the coins match the
+// trailing content hash.
+func readUTXOSnapshot(r io.Reader) (*utxoSnapshot, error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic[:len(snapshotMagic)]) != snapshotMagic || magic[len(snapshotMagic)] != snapshotVersion {
+		return nil, errors.New("not a UTXO snapshot file")
+	}
+
+	snap := &utxoSnapshot{baseHash: make([]byte, 32)}
+	if _, err := io.ReadFull(br, snap.baseHash); err != nil {
+		return nil, err
+	}
+	var baseHeight uint32
+	if err := binary.Read(br, binary.LittleEndian, &baseHeight); err != nil {
+		return nil, err
+	}
+
+	headerCount, err := decodeVarInt(br)
+	if err != nil {
+		return nil, err
+	}
+	if headerCount != uint64(baseHeight)+1 {
+		return nil, errors.New("snapshot header count does not match base height")
+	}
+
+	prevHash := make([]byte, 32)
+	for i := uint64(0); i < headerCount; i++ {
+		header, err := DeserializeBlockHeaderFromReader(br)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(header.PrevBlockHash, prevHash) {
+			return nil, fmt.Errorf("snapshot header %d does not connect", i)
+		}
+		if !NewProofOfWork(header).Validate() {
+			return nil, fmt.Errorf("snapshot header %d has invalid proof of work", i)
+		}
+		prevHash = header.Hash()
+		snap.headers = append(snap.headers, header)
+	}
+	if !bytes.Equal(prevHash, snap.baseHash) {
+		return nil, errors.New("snapshot headers do not end at the base block")
+	}
+
+	coinCount, err := decodeVarInt(br)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := newCoinHasher()
+	for i := uint64(0); i < coinCount; i++ {
+		outpoint := make([]byte, 36)
+		if _, err := io.ReadFull(br, outpoint); err != nil {
+			return nil, err
+		}
+		coin, err := DeserializeCoinFromReader(br)
+		if err != nil {
+			return nil, err
+		}
+		hasher.add(outpoint, coin)
+
+		snap.outpoints = append(snap.outpoints, outpoint)
+		snap.coins = append(snap.coins, coin)
+	}
+
+	snap.contentHash = hasher.Sum()
+	trailer := make([]byte, 32)
+	if _, err := io.ReadFull(br, trailer); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer, snap.contentHash) {
+		return nil, errors.New("snapshot content hash does not match its coins")
+	}
+
+	return snap, nil
+}
+
+// LoadUTXOSnapshot creates a new chain for nodeID from a snapshot written by
+// DumpUTXOSet. If expectedHash is given the snapshot's content hash must
+// match it. The returned chain is usable right away with the snapshot base as
+// its tip; ValidateSnapshot later replays history to confirm it.
+func LoadUTXOSnapshot(nodeID string, r io.Reader, expectedHash []byte) (*Blockchain, error) {
+	path := fmt.Sprintf(dbPath, nodeID)
+	if DBExists(path) {
+		return nil, errors.New("blockchain already exists")
+	}
+
+	snap, err := readUTXOSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+	if expectedHash != nil && !bytes.Equal(expectedHash, snap.contentHash) {
+		return nil, fmt.Errorf("snapshot content hash %x does not match the expected %x", snap.contentHash, expectedHash)
+	}
+
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+
+	stats := NewUTXOStats()
+	for i, outpoint := range snap.outpoints {
+		stats.add(outpoint[:32], binary.BigEndian.Uint32(outpoint[32:]), snap.coins[i])
+		if err := wb.Set(append([]byte(utxoPrefix), outpoint...), snap.coins[i].Serialize()); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := wb.Set([]byte(utxoStatsKey), stats.Serialize()); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := wb.Set([]byte(dbVersionKey), binary.LittleEndian.AppendUint32(nil, dbVersion)); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	chainWork := new(big.Int)
+	for height, header := range snap.headers {
+		chainWork = new(big.Int).Add(chainWork, CalcWork(header.Bits))
+		entry := &BlockIndexEntry{Header: *header, Height: height, ChainWork: chainWork}
+		if err := wb.Set(blockIndexKey(entry.Hash()), entry.Serialize()); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := wb.Set(heightKey(height), entry.Hash()); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	info := &SnapshotInfo{
+		BaseHash:    snap.baseHash,
+		Height:      len(snap.headers) - 1,
+		ContentHash: snap.contentHash,
+	}
+	if err := wb.Set([]byte(snapshotKey), info.Serialize()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := wb.Set([]byte("l"), snap.baseHash); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := wb.Flush(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newBlockchain(db, snap.baseHash), nil
+}
+
+// SnapshotInfo returns the snapshot this chain was loaded from, or nil if it
+// was built from genesis.
+func (chain *Blockchain) SnapshotInfo() *SnapshotInfo {
+	var info *SnapshotInfo
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(snapshotKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			info, err = DeserializeSnapshotInfo(val)
+			return err
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return info
+}
+
+// ValidateSnapshot replays history from genesis up to the snapshot base into
+// a separate background UTXO set, fetching bodies from source. Progress is
+// persisted per block, so an interrupted run resumes where it stopped. Once
+// the background chain reaches the snapshot height its UTXO set is hashed and
+// compared with the snapshot; on a match the snapshot is marked validated and
+// the background chainstate is discarded.
+func (chain *Blockchain) ValidateSnapshot(source BlockSource, progress func(height, target int)) error {
+	info := chain.SnapshotInfo()
+	if info == nil {
+		return nil
+	}
+	if info.Status == snapshotValidated {
+		// Deleting may have been interrupted last time.
+		return chain.deleteBackgroundChainstate()
+	}
+	if info.Status == snapshotInvalid {
+		return ErrSnapshotMismatch
+	}
+
+	for height := chain.backgroundHeight() + 1; height <= info.Height; height++ {
+		if err := chain.connectBackgroundBlock(source, height); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(height, info.Height)
+		}
+	}
+
+	chain.mu.Lock()
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		hasher := newCoinHasher()
+		err := forEachCoin(txn, backgroundUTXOPrefix, func(key []byte, coin *Coin) error {
+			hasher.add(key[len(backgroundUTXOPrefix):], coin)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		info.Status = snapshotValidated
+		if !bytes.Equal(hasher.Sum(), info.ContentHash) {
+			info.Status = snapshotInvalid
+		}
+		if err := txn.Set([]byte(snapshotKey), info.Serialize()); err != nil {
+			return err
+		}
+		if info.Status == snapshotInvalid {
+			return ErrSnapshotMismatch
+		}
+		return nil
+	})
+	chain.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return chain.deleteBackgroundChainstate()
+}
+
+// StartSnapshotValidation runs ValidateSnapshot in the background. The
+// returned channel receives its result once the background chain has caught
+// up with the snapshot.
+func (chain *Blockchain) StartSnapshotValidation(source BlockSource, progress func(height, target int)) <-chan error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- chain.ValidateSnapshot(source, progress)
+	}()
+
+	return done
+}
+
+func (chain *Blockchain) backgroundHeight() int {
+	height := -1
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(backgroundTipKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			height = int(binary.LittleEndian.Uint32(val))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return height
+}
+
+// connectBackgroundBlock fetches the block at height from source, checks it
+// against the header we already have, stores its body and undo data and
+// applies it to the background UTXO set. It holds chain.mu while writing,
+// as the main chain writes the same block index entries.
+func (chain *Blockchain) connectBackgroundBlock(source BlockSource, height int) error {
+	hash, err := source.GetBlockHash(height)
+	if err != nil {
+		return err
+	}
+	block, err := source.GetBlock(hash)
+	if err != nil {
+		return fmt.Errorf("block at height %d: %w", height, err)
+	}
+
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		mainHash, err := getMainChainHash(txn, height)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(mainHash, block.Header.Hash()) {
+			return fmt.Errorf("block at height %d does not match the snapshot headers", height)
+		}
+		if !bytes.Equal(block.BuildMerkleRoot(), block.Header.MerkleRoot) {
+			return fmt.Errorf("block at height %d has an invalid merkle root", height)
+		}
+
+		entry, err := getBlockIndex(txn, mainHash)
+		if err != nil {
+			return err
+		}
+		block.Height = height
+
+		spent, err := connectBlock(&badgerCoinView{txn, backgroundUTXOPrefix}, block)
+		if err != nil {
+			return err
+		}
+
+		body := block.Serialize()
+		if err := txn.Set(mainHash, body); err != nil {
+			return err
+		}
+		if err := txn.Set(undoKey(mainHash), serializeUndo(spent)); err != nil {
+			return err
+		}
+
+		entry.Status |= blockHaveData
+		entry.Size = uint32(len(body))
+		if err := putBlockIndex(txn, entry); err != nil {
+			return err
+		}
+
+		tmp := make([]byte, 4)
+		binary.LittleEndian.PutUint32(tmp, uint32(height))
+		return txn.Set([]byte(backgroundTipKey), tmp)
+	})
+}
+
+// deleteBackgroundChainstate deletes the background UTXO set and tip. The set
+// can be as large as the main one, far too large for one transaction, so the
+// deletes go through a write batch.
+func (chain *Blockchain) deleteBackgroundChainstate() error {
+	wb := chain.Database.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		return forEachCoin(txn, backgroundUTXOPrefix, func(key []byte, coin *Coin) error {
+			return wb.Delete(key)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := wb.Delete([]byte(backgroundTipKey)); err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Headers-first initial block download: the header chain is fetched from
+// peers with getheaders and validated first, then the bodies of the blocks on
+// the best header chain are requested from every peer that has them. Only
+// blocks within blockDownloadWindow of the lowest missing block are requested,
+// so one slow peer cannot make us buffer an unbounded number of blocks that
+// can't be connected yet.
+const (
+	blockDownloadWindow      = 1024
+	maxBlocksInFlightPerPeer = 16
+	minBlockStallTimeout     = 2 * time.Second
+	maxBlockStallTimeout     = 64 * time.Second
+	blockDownloadTimeout     = time.Minute
+	syncInterval             = 500 * time.Millisecond
+	syncProgressInterval     = 10 * time.Second
+
+	// A peer is penalised for every maxUnconnectingHeaders headers messages
+	// in a row that don't connect to our header chain.
+	maxUnconnectingHeaders = 10
+)
+
+type blockRequest struct {
+	peer *Peer
+	sent time.Time
+}
+
+type peerSyncState struct {
+	bestHeight  int // highest block the peer is known to have
+	inFlight    int
+	unconnected int // headers messages in a row that didn't connect
+}
+
+type syncManager struct {
+	chain       *Blockchain
+	misbehaving func(p *Peer, howMuch int, reason string)
+
+	mu        sync.Mutex
+	peers     map[*Peer]*peerSyncState
+	requested map[string]*blockRequest
+
+	// queue is the best header chain above the fork with the main chain, as
+	// of the best header queueTip. next indexes the lowest block in it whose
+	// body has not arrived.
+	queue      []*BlockIndexEntry
+	queueIndex map[string]int
+	queueTip   []byte
+	next       int
+
+	stallTimeout time.Duration
+	lastProgress time.Time
+}
+
+func newSyncManager(chain *Blockchain, misbehaving func(*Peer, int, string)) *syncManager {
+	return &syncManager{
+		chain:        chain,
+		misbehaving:  misbehaving,
+		peers:        make(map[*Peer]*peerSyncState),
+		requested:    make(map[string]*blockRequest),
+		stallTimeout: minBlockStallTimeout,
+	}
+}
+
+func (sm *syncManager) run(quit <-chan struct{}) {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sm.checkStalls()
+			sm.requestBlocks()
+			sm.reportProgress()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// addPeer starts syncing headers from a peer that finished the handshake.
+func (sm *syncManager) addPeer(p *Peer) {
+	sm.mu.Lock()
+	sm.peers[p] = &peerSyncState{bestHeight: p.StartHeight()}
+	sm.mu.Unlock()
+
+	sm.requestHeaders(p)
+}
+
+// removePeer frees the blocks requested from p so they are fetched elsewhere.
+func (sm *syncManager) removePeer(p *Peer) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	delete(sm.peers, p)
+	for hash, req := range sm.requested {
+		if req.peer == p {
+			delete(sm.requested, hash)
+		}
+	}
+}
+
+func (sm *syncManager) requestHeaders(p *Peer) {
+	p.QueueMessage(&MsgGetHeaders{MsgGetBlocks{
+		Version: protocolVersion,
+		Locator: sm.chain.HeaderLocator(),
+	}})
+}
+
+func (sm *syncManager) handleHeaders(p *Peer, msg *MsgHeaders) {
+	if len(msg.Headers) == 0 {
+		return
+	}
+
+	last, err := sm.chain.ProcessHeaders(msg.Headers)
+	if errors.Is(err, ErrOrphanBlock) {
+		// The peer announced headers that don't connect to ours; ask for
+		// the chain from the last block we have in common. A peer that
+		// keeps doing so is wasting our time.
+		sm.mu.Lock()
+		unconnected := 0
+		if state, ok := sm.peers[p]; ok {
+			state.unconnected++
+			unconnected = state.unconnected
+		}
+		sm.mu.Unlock()
+
+		if unconnected > 0 && unconnected%maxUnconnectingHeaders == 0 {
+			sm.misbehaving(p, 20, "headers that don't connect")
+		}
+		sm.requestHeaders(p)
+		return
+	}
+	if errors.Is(err, ErrKnownInvalid) {
+		log.Printf("ignoring headers from %s: %v", p, err)
+		return
+	}
+	if errors.Is(err, ErrInvalidBlock) {
+		sm.misbehaving(p, 100, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("rejected headers from %s: %v", p, err)
+		return
+	}
+
+	sm.mu.Lock()
+	if state, ok := sm.peers[p]; ok {
+		state.unconnected = 0
+		if last.Height > state.bestHeight {
+			state.bestHeight = last.Height
+		}
+	}
+	sm.mu.Unlock()
+
+	if len(msg.Headers) == maxHeadersPerMsg {
+		sm.requestHeaders(p)
+	}
+
+	sm.requestBlocks()
+}
+
+// blockRequested reports whether the block hash was requested from p.
+func (sm *syncManager) blockRequested(p *Peer, hash []byte) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	req, ok := sm.requested[string(hash)]
+	return ok && req.peer == p
+}
+
+// blockReceived records that the body of hash arrived, whether or not it
+// turned out to be valid.
+func (sm *syncManager) blockReceived(hash []byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if req, ok := sm.requested[string(hash)]; ok {
+		delete(sm.requested, string(hash))
+		if state, ok := sm.peers[req.peer]; ok {
+			state.inFlight--
+		}
+	}
+
+	if i, ok := sm.queueIndex[string(hash)]; ok {
+		sm.queue[i].Status |= blockHaveData
+	}
+
+	// Blocks are flowing again: let the stall timeout recover from the
+	// increases caused by earlier stalls.
+	if sm.stallTimeout > minBlockStallTimeout {
+		sm.stallTimeout = max(sm.stallTimeout*85/100, minBlockStallTimeout)
+	}
+}
+
+// markRequested records that hash was requested from p outside the download
+// queue, so the block is not treated as unsolicited.
+func (sm *syncManager) markRequested(p *Peer, hash []byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if req, ok := sm.requested[string(hash)]; ok {
+		if state, ok := sm.peers[req.peer]; ok {
+			state.inFlight--
+		}
+	}
+	sm.requested[string(hash)] = &blockRequest{peer: p, sent: time.Now()}
+	if state, ok := sm.peers[p]; ok {
+		state.inFlight++
+	}
+}
+
+// blockNotFound frees the request for hash if p answered it with notfound.
+// The peer may have had only the header, so it is not asked for blocks at or
+// above that height again until it sends more headers.
+func (sm *syncManager) blockNotFound(p *Peer, hash []byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	req, ok := sm.requested[string(hash)]
+	if !ok || req.peer != p {
+		return
+	}
+	delete(sm.requested, string(hash))
+
+	if state, ok := sm.peers[p]; ok {
+		state.inFlight--
+		if i, ok := sm.queueIndex[string(hash)]; ok {
+			state.bestHeight = min(state.bestHeight, sm.queue[i].Height-1)
+		}
+	}
+}
+
+// refreshQueue rebuilds the download queue when the best header changed.
+// The caller must hold sm.mu.
+func (sm *syncManager) refreshQueue() {
+	best := sm.chain.BestHeader()
+	if best == nil || bytes.Equal(best.Hash(), sm.queueTip) {
+		return
+	}
+
+	sm.queue = sm.chain.HeaderPath()
+	sm.queueTip = best.Hash()
+	sm.queueIndex = make(map[string]int, len(sm.queue))
+	for i, entry := range sm.queue {
+		sm.queueIndex[string(entry.Hash())] = i
+	}
+	sm.next = 0
+}
+
+// requestBlocks hands out requests for missing blocks within the download
+// window to the least busy peers that have them.
+func (sm *syncManager) requestBlocks() {
+	sm.mu.Lock()
+	sm.refreshQueue()
+
+	for sm.next < len(sm.queue) && sm.queue[sm.next].HaveData() {
+		sm.next++
+	}
+
+	requests := make(map[*Peer][]InvVect)
+	if sm.next < len(sm.queue) {
+		limit := sm.queue[sm.next].Height + blockDownloadWindow
+		now := time.Now()
+
+		for _, entry := range sm.queue[sm.next:] {
+			if entry.Height >= limit {
+				break
+			}
+			hash := entry.Hash()
+			if entry.HaveData() || sm.requested[string(hash)] != nil {
+				continue
+			}
+
+			p := sm.pickPeer(entry.Height)
+			if p == nil {
+				continue
+			}
+
+			sm.requested[string(hash)] = &blockRequest{peer: p, sent: now}
+			sm.peers[p].inFlight++
+			requests[p] = append(requests[p], InvVect{Type: InvTypeBlock, Hash: hash})
+		}
+	}
+	sm.mu.Unlock()
+
+	for p, inv := range requests {
+		p.QueueMessage(&MsgGetData{Inv: inv})
+	}
+}
+
+// pickPeer returns the peer with the fewest blocks in flight that has a block
+// at height and a free download slot. The caller must hold sm.mu.
+func (sm *syncManager) pickPeer(height int) *Peer {
+	var best *Peer
+	for p, state := range sm.peers {
+		if state.bestHeight < height || state.inFlight >= maxBlocksInFlightPerPeer {
+			continue
+		}
+		if best == nil || state.inFlight < sm.peers[best].inFlight {
+			best = p
+		}
+	}
+	return best
+}
+
+// checkStalls disconnects peers holding up the download. A peer stalls the
+// download when the lowest missing block is waiting on it for longer than
+// the stall timeout while the window keeps other peers from being given
+// more work; the timeout doubles each time so a generally slow network does
+// not lose all its peers. Any request older than blockDownloadTimeout also
+// gets its peer disconnected.
+func (sm *syncManager) checkStalls() {
+	now := time.Now()
+	var drop []*Peer
+
+	sm.mu.Lock()
+	for _, req := range sm.requested {
+		if now.Sub(req.sent) > blockDownloadTimeout {
+			drop = append(drop, req.peer)
+		}
+	}
+
+	if sm.next < len(sm.queue) && len(sm.peers) > 1 {
+		lowest := sm.queue[sm.next]
+		req := sm.requested[string(lowest.Hash())]
+		if req != nil && now.Sub(req.sent) > sm.stallTimeout && sm.windowFull() {
+			log.Printf("peer %s is stalling block download at height %d", req.peer, lowest.Height)
+			drop = append(drop, req.peer)
+			sm.stallTimeout = min(sm.stallTimeout*2, maxBlockStallTimeout)
+		}
+	}
+	sm.mu.Unlock()
+
+	for _, p := range drop {
+		p.Disconnect()
+	}
+}
+
+// windowFull reports whether every missing block in the download window has
+// been requested while some peer could take more. The caller must hold sm.mu.
+func (sm *syncManager) windowFull() bool {
+	idle := false
+	for _, state := range sm.peers {
+		if state.inFlight < maxBlocksInFlightPerPeer {
+			idle = true
+		}
+	}
+	if !idle {
+		return false
+	}
+
+	limit := sm.queue[sm.next].Height + blockDownloadWindow
+	for _, entry := range sm.queue[sm.next:] {
+		if entry.Height >= limit {
+			return true
+		}
+		if !entry.HaveData() && sm.requested[string(entry.Hash())] == nil {
+			return false
+		}
+	}
+	return false
+}
+
+// Progress returns the main chain height and the height of the best header.
+func (sm *syncManager) Progress() (height, headers int) {
+	height = sm.chain.Height()
+	headers = height
+	if best := sm.chain.BestHeader(); best != nil {
+		headers = best.Height
+	}
+	return height, headers
+}
+
+func (sm *syncManager) reportProgress() {
+	height, headers := sm.Progress()
+	if height >= headers {
+		return
+	}
+
+	sm.mu.Lock()
+	if time.Since(sm.lastProgress) < syncProgressInterval {
+		sm.mu.Unlock()
+		return
+	}
+	sm.lastProgress = time.Now()
+	inFlight := len(sm.requested)
+	peers := len(sm.peers)
+	sm.mu.Unlock()
+
+	log.Printf("block download: height %d of %d (%.1f%%), %d blocks in flight from %d peers",
+		height, headers, 100*float64(height+1)/float64(headers+1), inFlight, peers)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/badger/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The node records OpenTelemetry spans for block receipt, each stage of
+// processing a block (checks, storing it, activating the chain, connecting
+// or disconnecting blocks from the UTXO set and committing to the database),
+// mining and RPC calls. Nothing is recorded until setupTracing installs an
+// exporter; until then the tracer is a no-op.
+var tracer = otel.Tracer("blockchain-impl-study")
+
+// setupTracing exports spans to dest: "stdout", or else a file that spans are
+// appended to, one JSON object per line. The returned function flushes and
+// stops the exporter.
+func setupTracing(dest string) (func(context.Context) error, error) {
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if dest != "stdout" {
+		var err error
+		file, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "blockchain-impl-study"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// startBlockSpan starts a span about the block hash at height.
+func startBlockSpan(ctx context.Context, name string, hash []byte, height int) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("block.hash", hex.EncodeToString(hash)),
+		attribute.Int("block.height", height),
+	))
+}
+
+// endSpan ends span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// update is Database.Update with the commit traced as a child of ctx's span.
+func (chain *Blockchain) update(ctx context.Context, fn func(txn *badger.Txn) error) error {
+	txn := chain.Database.NewTransaction(true)
+	defer txn.Discard()
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+
+	_, span := tracer.Start(ctx, "db.commit")
+	err := txn.Commit()
+	endSpan(span, err)
+	return err
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -66,6 +69,24 @@ func (tx *Transaction) Serialize() []byte {
 	return buf
 }
 
+// ID returns the Bitcoin-style txid, SHA256(SHA256(serialized tx)).
+func (tx *Transaction) ID() []byte {
+	first := sha256.Sum256(tx.Serialize())
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// IsCoinbase reports whether tx is a coinbase: a single input that spends
+// the null outpoint.
+func (tx *Transaction) IsCoinbase() bool {
+	if len(tx.Vin) != 1 || tx.Vin[0].Vout != 0xffffffff {
+		return false
+	}
+
+	prev := tx.Vin[0].PrevTxID
+	return len(prev) == 0 || bytes.Equal(prev, make([]byte, 32))
+}
+
 func (tx *Transaction) CalculateFee(prevTXs map[string]Transaction) int64 {
 	var inputSum int64
 	var outputSum int64
@@ -82,66 +103,153 @@ func (tx *Transaction) CalculateFee(prevTXs map[string]Transaction) int64 {
 	return inputSum - outputSum
 }
 
-func DeserializeTransaction(data []byte) Transaction {
+// Minimum serialized sizes, used to reject counts that could not possibly
+// fit in the remaining data before allocating for them.
+const (
+	minTxInSize  = 32 + 4 + 1 + 4
+	minTxOutSize = 8 + 1
+	minTxSize    = 4 + 1 + 1 + 4
+
+	maxScriptSize = 10_000
+)
+
+var ErrMalformedData = errors.New("malformed serialized data")
+
+// DeserializeTransaction decodes a transaction that must span all of data.
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	r := bytes.NewReader(data)
-	return DeserializeTransactionFromReader(r)
+
+	tx, err := DeserializeTransactionFromReader(r)
+	if err != nil {
+		return tx, err
+	}
+	if r.Len() != 0 {
+		return tx, fmt.Errorf("%w: %d trailing bytes after transaction", ErrMalformedData, r.Len())
+	}
+
+	return tx, nil
 }
 
-func DeserializeBlock(data []byte) *Block {
+// DeserializeBlock decodes a block that must span all of data.
+func DeserializeBlock(data []byte) (*Block, error) {
 	r := bytes.NewReader(data)
 
-	header, _ := DeserializeBlockHeaderFromReader(r)
+	header, err := DeserializeBlockHeaderFromReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: block header: %v", ErrMalformedData, err)
+	}
 
-	txCount, _ := decodeVarInt(r)
+	txCount, err := decodeVarInt(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: transaction count: %v", ErrMalformedData, err)
+	}
+	if txCount > uint64(r.Len()/minTxSize) {
+		return nil, fmt.Errorf("%w: %d transactions cannot fit in %d bytes", ErrMalformedData, txCount, r.Len())
+	}
 
-	var transactions []*Transaction
-	for i := 0; i < int(txCount); i++ {
-		tx := DeserializeTransactionFromReader(r)
+	transactions := make([]*Transaction, 0, txCount)
+	for i := uint64(0); i < txCount; i++ {
+		tx, err := DeserializeTransactionFromReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
 		transactions = append(transactions, &tx)
 	}
 
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes after block", ErrMalformedData, r.Len())
+	}
+
 	return &Block{
 		Header:       *header,
 		Transactions: transactions,
 		Height:       0,
+	}, nil
+}
+
+func readScript(r *bytes.Reader) ([]byte, error) {
+	length, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxScriptSize || length > uint64(r.Len()) {
+		return nil, fmt.Errorf("script length %d out of range", length)
+	}
+
+	script := make([]byte, length)
+	_, err = io.ReadFull(r, script)
+	return script, err
+}
+
+// DeserializeTransactionFromReader decodes one transaction from r. Every
+// error, including running out of data, is reported as ErrMalformedData.
+func DeserializeTransactionFromReader(r *bytes.Reader) (Transaction, error) {
+	tx, err := readTransaction(r)
+	if err != nil {
+		return tx, fmt.Errorf("%w: %v", ErrMalformedData, err)
 	}
+	return tx, nil
 }
 
-func DeserializeTransactionFromReader(r *bytes.Reader) Transaction {
+func readTransaction(r *bytes.Reader) (Transaction, error) {
 	var tx Transaction
 
-	binary.Read(r, binary.LittleEndian, &tx.Version)
+	if err := binary.Read(r, binary.LittleEndian, &tx.Version); err != nil {
+		return tx, err
+	}
 
-	vinCount, _ := decodeVarInt(r)
-	for i := 0; i < int(vinCount); i++ {
+	vinCount, err := decodeVarInt(r)
+	if err != nil {
+		return tx, err
+	}
+	if vinCount > uint64(r.Len()/minTxInSize) {
+		return tx, fmt.Errorf("%d inputs cannot fit in %d bytes", vinCount, r.Len())
+	}
+	for i := uint64(0); i < vinCount; i++ {
 		var vin TxIn
 		vin.PrevTxID = make([]byte, 32)
-		io.ReadFull(r, vin.PrevTxID)
+		if _, err := io.ReadFull(r, vin.PrevTxID); err != nil {
+			return tx, err
+		}
 
-		binary.Read(r, binary.LittleEndian, &vin.Vout)
+		if err := binary.Read(r, binary.LittleEndian, &vin.Vout); err != nil {
+			return tx, err
+		}
 
-		scriptLen, _ := decodeVarInt(r)
-		vin.ScriptSig = make([]byte, scriptLen)
-		io.ReadFull(r, vin.ScriptSig)
+		if vin.ScriptSig, err = readScript(r); err != nil {
+			return tx, err
+		}
 
-		binary.Read(r, binary.LittleEndian, &vin.Sequence)
+		if err := binary.Read(r, binary.LittleEndian, &vin.Sequence); err != nil {
+			return tx, err
+		}
 
 		tx.Vin = append(tx.Vin, vin)
 	}
 
-	voutCount, _ := decodeVarInt(r)
-	for i := 0; i < int(voutCount); i++ {
+	voutCount, err := decodeVarInt(r)
+	if err != nil {
+		return tx, err
+	}
+	if voutCount > uint64(r.Len()/minTxOutSize) {
+		return tx, fmt.Errorf("%d outputs cannot fit in %d bytes", voutCount, r.Len())
+	}
+	for i := uint64(0); i < voutCount; i++ {
 		var vout TxOut
-		binary.Read(r, binary.LittleEndian, &vout.Value)
+		if err := binary.Read(r, binary.LittleEndian, &vout.Value); err != nil {
+			return tx, err
+		}
 
-		scriptLen, _ := decodeVarInt(r)
-		vout.ScriptPubKey = make([]byte, scriptLen)
-		io.ReadFull(r, vout.ScriptPubKey)
+		if vout.ScriptPubKey, err = readScript(r); err != nil {
+			return tx, err
+		}
 
 		tx.Vout = append(tx.Vout, vout)
 	}
 
-	binary.Read(r, binary.LittleEndian, &tx.LockTime)
+	if err := binary.Read(r, binary.LittleEndian, &tx.LockTime); err != nil {
+		return tx, err
+	}
 
-	return tx
+	return tx, nil
 }
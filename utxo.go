@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// The UTXO set lives next to the blocks in Badger, one key per unspent
+// output: prefix + txid + big-endian vout. Undo data for a connected block is
+// stored under "u" + block hash and lists the coins its inputs spent, in
+// input order, so the block can be disconnected again.
+const (
+	utxoPrefix = "c"
+	undoPrefix = "u"
+)
+
+var (
+	ErrCoinNotFound = errors.New("coin not found")
+	ErrMissingInput = errors.New("input spends a missing or already spent output")
+)
+
+// A block's coinbase may claim blockSubsidy plus the fees of the block's
+// transactions. Its outputs can only be spent coinbaseMaturity blocks later,
+// as in Bitcoin, so a reorg cannot take away coins that were spent onward.
+const blockSubsidy = 10
+
+var coinbaseMaturity = 100
+
+// Coin is an unspent transaction output together with the metadata needed
+// to validate spends of it.
+type Coin struct {
+	Height   int
+	Coinbase bool
+	Out      TxOut
+}
+
+// Mature reports whether the coin may be spent in a block at height.
+func (c *Coin) Mature(height int) bool {
+	return !c.Coinbase || height-c.Height >= coinbaseMaturity
+}
+
+func (c *Coin) Serialize() []byte {
+	code := uint64(c.Height) << 1
+	if c.Coinbase {
+		code |= 1
+	}
+
+	buf := appendVarInt(nil, code)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(c.Out.Value))
+	return appendVarBytes(buf, c.Out.ScriptPubKey)
+}
+
+func DeserializeCoin(data []byte) (*Coin, error) {
+	return DeserializeCoinFromReader(bytes.NewReader(data))
+}
+
+func DeserializeCoinFromReader(r io.Reader) (*Coin, error) {
+	code, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	coin := &Coin{Height: int(code >> 1), Coinbase: code&1 == 1}
+	if err := binary.Read(r, binary.LittleEndian, &coin.Out.Value); err != nil {
+		return nil, err
+	}
+
+	scriptLen, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+	coin.Out.ScriptPubKey = make([]byte, scriptLen)
+	if _, err := io.ReadFull(r, coin.Out.ScriptPubKey); err != nil {
+		return nil, err
+	}
+
+	return coin, nil
+}
+
+func coinKey(prefix string, txid []byte, vout uint32) []byte {
+	key := append([]byte(prefix), txid...)
+	return binary.BigEndian.AppendUint32(key, vout)
+}
+
+func isCoinKey(prefix string, key []byte) bool {
+	return len(key) == 37 && bytes.HasPrefix(key, []byte(prefix))
+}
+
+func undoKey(hash []byte) []byte {
+	return append([]byte(undoPrefix), hash...)
+}
+
+func serializeUndo(spent []*Coin) []byte {
+	buf := appendVarInt(nil, uint64(len(spent)))
+	for _, coin := range spent {
+		buf = append(buf, coin.Serialize()...)
+	}
+	return buf
+}
+
+func deserializeUndo(data []byte) ([]*Coin, error) {
+	r := bytes.NewReader(data)
+
+	count, err := decodeVarInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	spent := make([]*Coin, 0, count)
+	for i := uint64(0); i < count; i++ {
+		coin, err := DeserializeCoinFromReader(r)
+		if err != nil {
+			return nil, err
+		}
+		spent = append(spent, coin)
+	}
+
+	return spent, nil
+}
+
+// CoinView is a UTXO set that blocks can be connected to and disconnected
+// from.
+type CoinView interface {
+	GetCoin(txid []byte, vout uint32) (*Coin, error)
+	AddCoin(txid []byte, vout uint32, coin *Coin) error
+	SpendCoin(txid []byte, vout uint32) error
+}
+
+// badgerCoinView is the UTXO set stored under prefix inside a Badger
+// transaction.
+type badgerCoinView struct {
+	txn    *badger.Txn
+	prefix string
+}
+
+func (v *badgerCoinView) GetCoin(txid []byte, vout uint32) (*Coin, error) {
+	item, err := v.txn.Get(coinKey(v.prefix, txid, vout))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrCoinNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var coin *Coin
+	err = item.Value(func(val []byte) error {
+		coin, err = DeserializeCoin(val)
+		return err
+	})
+
+	return coin, err
+}
+
+func (v *badgerCoinView) AddCoin(txid []byte, vout uint32, coin *Coin) error {
+	return v.txn.Set(coinKey(v.prefix, txid, vout), coin.Serialize())
+}
+
+func (v *badgerCoinView) SpendCoin(txid []byte, vout uint32) error {
+	return v.txn.Delete(coinKey(v.prefix, txid, vout))
+}
+
+// memoryCoinView is an in-memory UTXO set keyed by coinKey.
+type memoryCoinView map[string]*Coin
+
+func (v memoryCoinView) GetCoin(txid []byte, vout uint32) (*Coin, error) {
+	coin, ok := v[string(coinKey(utxoPrefix, txid, vout))]
+	if !ok {
+		return nil, ErrCoinNotFound
+	}
+	return coin, nil
+}
+
+func (v memoryCoinView) AddCoin(txid []byte, vout uint32, coin *Coin) error {
+	v[string(coinKey(utxoPrefix, txid, vout))] = coin
+	return nil
+}
+
+func (v memoryCoinView) SpendCoin(txid []byte, vout uint32) error {
+	delete(v, string(coinKey(utxoPrefix, txid, vout)))
+	return nil
+}
+
+// sortedKeys returns the view's keys in the same order Badger iterates them.
+func (v memoryCoinView) sortedKeys() []string {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// connectBlock spends the inputs and adds the outputs of every transaction
+// in block, checking that every input is signed and spends a mature coin,
+// that no output overwrites an unspent one, and that no transaction pays out
+// more than it spends, nor the coinbase more than the subsidy and fees. It
+// returns the spent coins, which form the block's undo data.
+func connectBlock(view CoinView, block *Block) ([]*Coin, error) {
+	var spent []*Coin
+	var fees int64
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			var in int64
+			for i, vin := range tx.Vin {
+				coin, err := view.GetCoin(vin.PrevTxID, vin.Vout)
+				if errors.Is(err, ErrCoinNotFound) {
+					return nil, fmt.Errorf("tx %x input %x:%d: %w", tx.ID(), vin.PrevTxID, vin.Vout, ErrMissingInput)
+				}
+				if err != nil {
+					return nil, err
+				}
+				if !coin.Mature(block.Height) {
+					return nil, fmt.Errorf("%w: tx %x spends coinbase %x:%d from height %d", ErrInvalidBlock, tx.ID(), vin.PrevTxID, vin.Vout, coin.Height)
+				}
+				if err := VerifyInput(tx, i, coin.Out); err != nil {
+					return nil, fmt.Errorf("%w: tx %x: %v", ErrInvalidBlock, tx.ID(), err)
+				}
+				in += coin.Out.Value
+
+				if err := view.SpendCoin(vin.PrevTxID, vin.Vout); err != nil {
+					return nil, err
+				}
+				spent = append(spent, coin)
+			}
+
+			if out := outputValue(tx); in < out {
+				return nil, fmt.Errorf("%w: tx %x outputs (%d) exceed inputs (%d)", ErrInvalidBlock, tx.ID(), out, in)
+			} else {
+				fees += in - out
+			}
+		}
+
+		txid := tx.ID()
+		for i, out := range tx.Vout {
+			// As in BIP30, a txid may only repeat once its outputs are spent;
+			// disconnecting would lose the earlier coin for good.
+			if _, err := view.GetCoin(txid, uint32(i)); err == nil {
+				return nil, fmt.Errorf("%w: tx %x overwrites an unspent output", ErrInvalidBlock, txid)
+			} else if !errors.Is(err, ErrCoinNotFound) {
+				return nil, err
+			}
+
+			coin := &Coin{Height: block.Height, Coinbase: tx.IsCoinbase(), Out: out}
+			if err := view.AddCoin(txid, uint32(i), coin); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if claimed := outputValue(block.Transactions[0]); claimed > blockSubsidy+fees {
+		return nil, fmt.Errorf("%w: coinbase pays %d, more than subsidy and fees (%d)", ErrInvalidBlock, claimed, blockSubsidy+fees)
+	}
+
+	return spent, nil
+}
+
+func outputValue(tx *Transaction) int64 {
+	var value int64
+	for _, out := range tx.Vout {
+		value += out.Value
+	}
+	return value
+}
+
+// disconnectBlock undoes connectBlock using the coins it returned.
+func disconnectBlock(view CoinView, block *Block, spent []*Coin) error {
+	next := len(spent)
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		txid := tx.ID()
+		for vout := range tx.Vout {
+			if err := view.SpendCoin(txid, uint32(vout)); err != nil {
+				return err
+			}
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for j := len(tx.Vin) - 1; j >= 0; j-- {
+			next--
+			if next < 0 {
+				return errors.New("undo data does not match block")
+			}
+
+			vin := tx.Vin[j]
+			if err := view.AddCoin(vin.PrevTxID, vin.Vout, spent[next]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if next != 0 {
+		return errors.New("undo data does not match block")
+	}
+
+	return nil
+}
+
+func getUndo(txn *badger.Txn, hash []byte) ([]*Coin, error) {
+	item, err := txn.Get(undoKey(hash))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrBlockPruned
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var spent []*Coin
+	err = item.Value(func(val []byte) error {
+		spent, err = deserializeUndo(val)
+		return err
+	})
+
+	return spent, err
+}
+
+// GetSpentCoins returns the coins the main chain block hash spent, in the
+// order of the inputs of its transactions, from the block's undo data.
+func (chain *Blockchain) GetSpentCoins(hash []byte) ([]*Coin, error) {
+	var spent []*Coin
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		spent, err = getUndo(txn, hash)
+		return err
+	})
+
+	return spent, err
+}
+
+// GetCoin returns the unspent output txid:vout from the active UTXO set.
+func (chain *Blockchain) GetCoin(txid []byte, vout uint32) (*Coin, error) {
+	var coin *Coin
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		coin, err = (&badgerCoinView{txn, utxoPrefix}).GetCoin(txid, vout)
+		return err
+	})
+
+	return coin, err
+}
+
+// forEachCoin calls fn for every coin stored under prefix, in key order.
+func forEachCoin(txn *badger.Txn, prefix string, fn func(key []byte, coin *Coin) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if !isCoinKey(prefix, item.Key()) {
+			continue
+		}
+
+		key := item.KeyCopy(nil)
+		err := item.Value(func(val []byte) error {
+			coin, err := DeserializeCoin(val)
+			if err != nil {
+				return err
+			}
+			return fn(key, coin)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UnspentOutput is a coin of the active UTXO set and the outpoint it is
+// stored under.
+type UnspentOutput struct {
+	TxID []byte
+	Vout uint32
+	Coin *Coin
+}
+
+// FindCoins returns the coins paying to any of scripts. There is no index by
+// script, so this reads the whole UTXO set.
+func (chain *Blockchain) FindCoins(scripts [][]byte) ([]UnspentOutput, error) {
+	wanted := make(map[string]bool, len(scripts))
+	for _, script := range scripts {
+		wanted[string(script)] = true
+	}
+
+	var coins []UnspentOutput
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		return forEachCoin(txn, utxoPrefix, func(key []byte, coin *Coin) error {
+			if wanted[string(coin.Out.ScriptPubKey)] {
+				coins = append(coins, UnspentOutput{
+					TxID: key[len(utxoPrefix) : len(utxoPrefix)+32],
+					Vout: binary.BigEndian.Uint32(key[len(utxoPrefix)+32:]),
+					Coin: coin,
+				})
+			}
+			return nil
+		})
+	})
+
+	return coins, err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const utxoStatsKey = "utxostats"
+
+// UTXOStats summarizes the active UTXO set. It is updated together with the
+// set on every block connect and disconnect, so two nodes at the same tip can
+// compare state by comparing Hash.Digest().
+type UTXOStats struct {
+	Count       uint64
+	TotalAmount int64
+	Size        uint64 // serialized size of the (outpoint | coin) entries
+	Hash        *MuHash
+}
+
+func NewUTXOStats() *UTXOStats {
+	return &UTXOStats{Hash: NewMuHash()}
+}
+
+func (s *UTXOStats) Serialize() []byte {
+	buf := binary.LittleEndian.AppendUint64(nil, s.Count)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(s.TotalAmount))
+	buf = binary.LittleEndian.AppendUint64(buf, s.Size)
+	return append(buf, s.Hash.Serialize()...)
+}
+
+func DeserializeUTXOStats(data []byte) (*UTXOStats, error) {
+	if len(data) != 24+2*muhashBytes {
+		return nil, errors.New("invalid utxo stats length")
+	}
+
+	hash, err := DeserializeMuHash(data[24:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &UTXOStats{
+		Count:       binary.LittleEndian.Uint64(data),
+		TotalAmount: int64(binary.LittleEndian.Uint64(data[8:])),
+		Size:        binary.LittleEndian.Uint64(data[16:]),
+		Hash:        hash,
+	}, nil
+}
+
+// utxoEntry is the serialized form of one coin, as hashed into the stats and
+// written to snapshot files.
+func utxoEntry(txid []byte, vout uint32, coin *Coin) []byte {
+	entry := binary.BigEndian.AppendUint32(append([]byte{}, txid...), vout)
+	return append(entry, coin.Serialize()...)
+}
+
+func (s *UTXOStats) add(txid []byte, vout uint32, coin *Coin) {
+	entry := utxoEntry(txid, vout, coin)
+	s.Count++
+	s.TotalAmount += coin.Out.Value
+	s.Size += uint64(len(entry))
+	s.Hash.Insert(entry)
+}
+
+func (s *UTXOStats) remove(txid []byte, vout uint32, coin *Coin) {
+	entry := utxoEntry(txid, vout, coin)
+	s.Count--
+	s.TotalAmount -= coin.Out.Value
+	s.Size -= uint64(len(entry))
+	s.Hash.Remove(entry)
+}
+
+// statsCoinView wraps a CoinView and keeps stats in step with it.
+type statsCoinView struct {
+	CoinView
+	stats *UTXOStats
+}
+
+func (v *statsCoinView) AddCoin(txid []byte, vout uint32, coin *Coin) error {
+	if old, err := v.CoinView.GetCoin(txid, vout); err == nil {
+		v.stats.remove(txid, vout, old)
+	} else if !errors.Is(err, ErrCoinNotFound) {
+		return err
+	}
+
+	v.stats.add(txid, vout, coin)
+	return v.CoinView.AddCoin(txid, vout, coin)
+}
+
+func (v *statsCoinView) SpendCoin(txid []byte, vout uint32) error {
+	coin, err := v.CoinView.GetCoin(txid, vout)
+	if err != nil {
+		return err
+	}
+
+	v.stats.remove(txid, vout, coin)
+	return v.CoinView.SpendCoin(txid, vout)
+}
+
+// getUTXOStats loads the stored stats, rebuilding them from the UTXO set if
+// the chain predates them.
+func getUTXOStats(txn *badger.Txn) (*UTXOStats, error) {
+	item, err := txn.Get([]byte(utxoStatsKey))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return computeUTXOStats(txn, utxoPrefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stats *UTXOStats
+	err = item.Value(func(val []byte) error {
+		stats, err = DeserializeUTXOStats(val)
+		return err
+	})
+
+	return stats, err
+}
+
+func putUTXOStats(txn *badger.Txn, stats *UTXOStats) error {
+	return txn.Set([]byte(utxoStatsKey), stats.Serialize())
+}
+
+// computeUTXOStats builds stats from scratch by scanning the set under prefix.
+func computeUTXOStats(txn *badger.Txn, prefix string) (*UTXOStats, error) {
+	stats := NewUTXOStats()
+
+	err := forEachCoin(txn, prefix, func(key []byte, coin *Coin) error {
+		txid := key[len(prefix) : len(prefix)+32]
+		stats.add(txid, binary.BigEndian.Uint32(key[len(prefix)+32:]), coin)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (chain *Blockchain) UTXOStats() *UTXOStats {
+	var stats *UTXOStats
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		stats, err = getUTXOStats(txn)
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return stats
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The v2 transport encrypts and authenticates everything after a key
+// exchange, loosely after BIP324. The initiator opens with an ephemeral
+// X25519 public key, the responder answers with its own, and both derive a
+// key per direction from the shared secret with HKDF. From then on every
+// write is one packet:
+//
+//	length (4, little endian) | ChaCha20-Poly1305 ciphertext of length bytes
+//
+// with the length as additional data and a per-direction packet counter as
+// the nonce. A responder tells a v1 peer from a v2 one by its first four
+// bytes, which for v1 are always the network magic (initiators never use a
+// key starting with it); an initiator whose v2 key goes unanswered
+// reconnects with the plain framing. The keys are ephemeral, so this stops
+// eavesdropping and tampering but not an active man in the middle; comparing
+// session IDs out of band detects one.
+const (
+	v2KeySize          = 32
+	v2HandshakeTimeout = 10 * time.Second
+	maxV2Packet        = messageHeaderSize + maxMessagePayload + chacha20poly1305.Overhead
+)
+
+var ErrV2Decrypt = errors.New("v2 packet failed authentication")
+
+// v1Prefix is how every plain connection starts.
+var v1Prefix = binary.LittleEndian.AppendUint32(nil, networkMagic)
+
+// v2Conn is a connection after a successful v2 handshake.
+type v2Conn struct {
+	net.Conn
+	r         io.Reader // reads from Conn, after anything peeked
+	sessionID []byte
+
+	readMu     sync.Mutex
+	recvCipher cipher.AEAD
+	recvCount  uint64
+	plaintext  []byte // decrypted but not yet read
+
+	writeMu    sync.Mutex
+	sendCipher cipher.AEAD
+	sendCount  uint64
+}
+
+func packetNonce(count uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], count)
+	return nonce
+}
+
+func (c *v2Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.plaintext) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return 0, err
+		}
+		length := binary.LittleEndian.Uint32(header)
+		if length < chacha20poly1305.Overhead || length > maxV2Packet {
+			return 0, fmt.Errorf("%w: packet of %d bytes", ErrV2Decrypt, length)
+		}
+
+		ciphertext := make([]byte, length)
+		if _, err := io.ReadFull(c.r, ciphertext); err != nil {
+			return 0, err
+		}
+		plaintext, err := c.recvCipher.Open(ciphertext[:0], packetNonce(c.recvCount), ciphertext, header)
+		if err != nil {
+			return 0, ErrV2Decrypt
+		}
+		c.recvCount++
+		c.plaintext = plaintext
+	}
+
+	n := copy(b, c.plaintext)
+	c.plaintext = c.plaintext[n:]
+	return n, nil
+}
+
+func (c *v2Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	packet := binary.LittleEndian.AppendUint32(nil, uint32(len(b)+chacha20poly1305.Overhead))
+	packet = c.sendCipher.Seal(packet, packetNonce(c.sendCount), b, packet[:4])
+	c.sendCount++
+
+	if _, err := c.Conn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// newV2Conn derives the session keys from our key pair and the peer's
+// public key.
+func newV2Conn(conn net.Conn, r io.Reader, priv *ecdh.PrivateKey, theirKey []byte, initiator bool) (*v2Conn, error) {
+	pub, err := ecdh.X25519().NewPublicKey(theirKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	ours := priv.PublicKey().Bytes()
+	salt := binary.LittleEndian.AppendUint32([]byte("blockchain-impl-study v2"), networkMagic)
+	if initiator {
+		salt = append(append(salt, ours...), theirKey...)
+	} else {
+		salt = append(append(salt, theirKey...), ours...)
+	}
+
+	derive := func(info string) []byte {
+		// Only lengths SHA-256 can't produce make this fail.
+		key, _ := hkdf.Key(sha256.New, secret, salt, info, chacha20poly1305.KeySize)
+		return key
+	}
+
+	initKey, err := chacha20poly1305.New(derive("initiator"))
+	if err != nil {
+		return nil, err
+	}
+	respKey, err := chacha20poly1305.New(derive("responder"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &v2Conn{Conn: conn, r: r, sessionID: derive("session_id")}
+	if initiator {
+		c.sendCipher, c.recvCipher = initKey, respKey
+	} else {
+		c.sendCipher, c.recvCipher = respKey, initKey
+	}
+	return c, nil
+}
+
+// v2Initiate runs the initiator's side of the handshake. An error means the
+// peer did not answer as a v2 peer and the connection is unusable.
+func v2Initiate(conn net.Conn) (*v2Conn, error) {
+	var priv *ecdh.PrivateKey
+	for {
+		var err error
+		if priv, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(priv.PublicKey().Bytes(), v1Prefix) {
+			break
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(v2HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if _, err := conn.Write(priv.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+	theirKey := make([]byte, v2KeySize)
+	if _, err := io.ReadFull(conn, theirKey); err != nil {
+		return nil, fmt.Errorf("v2 handshake: %w", err)
+	}
+
+	return newV2Conn(conn, conn, priv, theirKey, true)
+}
+
+// peekedConn replays bytes read while detecting the transport.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// v2Respond detects the transport of an inbound connection and, for a v2
+// peer, completes the handshake. v1 peers get back a connection that reads
+// from their first byte.
+func v2Respond(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(v2HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	prefix, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, v1Prefix) {
+		return &peekedConn{Conn: conn, r: r}, nil
+	}
+
+	theirKey := make([]byte, v2KeySize)
+	if _, err := io.ReadFull(r, theirKey); err != nil {
+		return nil, err
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(priv.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+
+	return newV2Conn(conn, r, priv, theirKey, false)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxMoney bounds every output value and their sum.
+const maxMoney = 21_000_000 * 100_000_000
+
+var (
+	ErrInvalidTx      = errors.New("invalid transaction")
+	ErrInvalidBlock   = errors.New("invalid block")
+	ErrOrphanBlock    = errors.New("block parent is unknown")
+	ErrDuplicateBlock = errors.New("block already known")
+
+	// ErrKnownInvalid is an ErrInvalidBlock for blocks already marked
+	// invalid, or building on one, which may be down to invalidateblock
+	// rather than to whoever sent them.
+	ErrKnownInvalid = fmt.Errorf("%w: marked invalid", ErrInvalidBlock)
+)
+
+// CheckBlock runs the checks that need nothing but the block itself.
+func CheckBlock(block *Block) error {
+	if err := CheckBlockHeader(&block.Header); err != nil {
+		return err
+	}
+
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("%w: no transactions", ErrInvalidBlock)
+	}
+	if !block.Transactions[0].IsCoinbase() {
+		return fmt.Errorf("%w: first transaction is not a coinbase", ErrInvalidBlock)
+	}
+
+	seen := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if i > 0 && tx.IsCoinbase() {
+			return fmt.Errorf("%w: more than one coinbase", ErrInvalidBlock)
+		}
+		if err := CheckTransaction(tx); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+		}
+
+		txid := string(tx.ID())
+		if seen[txid] {
+			return fmt.Errorf("%w: duplicate transaction %x", ErrInvalidBlock, tx.ID())
+		}
+		seen[txid] = true
+	}
+
+	if !bytes.Equal(block.BuildMerkleRoot(), block.Header.MerkleRoot) {
+		return fmt.Errorf("%w: merkle root mismatch", ErrInvalidBlock)
+	}
+
+	return nil
+}
+
+// CheckTransaction runs the checks that need nothing but the transaction
+// itself.
+func CheckTransaction(tx *Transaction) error {
+	if len(tx.Vin) == 0 {
+		return fmt.Errorf("%w: no inputs", ErrInvalidTx)
+	}
+	if len(tx.Vout) == 0 {
+		return fmt.Errorf("%w: no outputs", ErrInvalidTx)
+	}
+
+	var total int64
+	for _, out := range tx.Vout {
+		if out.Value < 0 || out.Value > maxMoney {
+			return fmt.Errorf("%w: output value %d out of range", ErrInvalidTx, out.Value)
+		}
+		total += out.Value
+		if total > maxMoney {
+			return fmt.Errorf("%w: total output value out of range", ErrInvalidTx)
+		}
+	}
+
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		outpoint := string(coinKey("", vin.PrevTxID, vin.Vout))
+		if seen[outpoint] {
+			return fmt.Errorf("%w: duplicate input %x:%d", ErrInvalidTx, vin.PrevTxID, vin.Vout)
+		}
+		seen[outpoint] = true
+
+		if len(vin.PrevTxID) != 32 || bytes.Equal(vin.PrevTxID, make([]byte, 32)) {
+			return fmt.Errorf("%w: input spends the null outpoint", ErrInvalidTx)
+		}
+	}
+
+	return nil
+}
+
+// ProcessBlock accepts a block received from elsewhere: it is checked, stored
+// in the block index and the best chain is activated, so a block extending a
+// side chain with more work triggers a reorg. Blocks whose header is already
+// indexed (headers-first sync) may arrive in any order; they are connected
+// once every block before them has arrived. A genesis block is only accepted
+// by a chain that has no blocks yet.
+func (chain *Blockchain) ProcessBlock(block *Block) error {
+	return chain.ProcessBlockContext(context.Background(), block)
+}
+
+// ProcessBlockContext is ProcessBlock with its spans traced as children of
+// ctx's.
+func (chain *Blockchain) ProcessBlockContext(ctx context.Context, block *Block) error {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "block.process",
+		trace.WithAttributes(attribute.String("block.hash", hex.EncodeToString(block.Header.Hash()))))
+	err := chain.processBlock(ctx, block)
+	span.SetAttributes(
+		attribute.Int("block.height", block.Height),
+		attribute.String("block.result", validationResult(err)),
+	)
+	endSpan(span, err)
+	recordBlockValidation(time.Since(start), err)
+	return err
+}
+
+func (chain *Blockchain) processBlock(ctx context.Context, block *Block) error {
+	_, span := tracer.Start(ctx, "block.check")
+	err := CheckBlock(block)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	hash := block.Header.Hash()
+	genesis := bytes.Equal(block.Header.PrevBlockHash, make([]byte, 32))
+
+	storeCtx, span := tracer.Start(ctx, "block.store")
+	var entry *BlockIndexEntry
+	var ready bool
+	err = chain.update(storeCtx, func(txn *badger.Txn) error {
+		if known, err := getBlockIndex(txn, hash); err == nil {
+			if known.Failed() {
+				return fmt.Errorf("%w: block %x", ErrKnownInvalid, hash)
+			}
+			if known.HaveData() {
+				return ErrDuplicateBlock
+			}
+		} else if !errors.Is(err, ErrBlockNotFound) {
+			return err
+		}
+
+		if genesis {
+			if chain.Tip() != nil {
+				return fmt.Errorf("%w: unexpected genesis block", ErrInvalidBlock)
+			}
+			block.Height = 0
+
+			var err error
+			if entry, err = storeBlock(txn, block); err != nil {
+				return err
+			}
+			ready = true
+			return connectTip(txn, block)
+		}
+
+		parent, err := getBlockIndex(txn, block.Header.PrevBlockHash)
+		if errors.Is(err, ErrBlockNotFound) {
+			return ErrOrphanBlock
+		}
+		if err != nil {
+			return err
+		}
+		if parent.Failed() {
+			return fmt.Errorf("%w: parent of %x", ErrKnownInvalid, hash)
+		}
+
+		block.Height = parent.Height + 1
+		if entry, err = storeBlock(txn, block); err != nil {
+			return err
+		}
+
+		// Without a tip or with missing blocks below this one there is
+		// nothing to connect yet.
+		if chain.Tip() == nil {
+			return nil
+		}
+		ready, err = connectable(txn, entry)
+		return err
+	})
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	chain.noteHeader(entry)
+	chain.addCandidate(entry)
+	if !ready {
+		return nil
+	}
+
+	if err := chain.activate(ctx); err != nil {
+		return err
+	}
+
+	// A block that failed to connect was marked invalid and left out of
+	// the chain; its sender still has to hear about it.
+	var failed bool
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		entry, err := getBlockIndex(txn, hash)
+		if err == nil {
+			failed = entry.Failed()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if failed {
+		return fmt.Errorf("%w: block %x failed to connect", ErrInvalidBlock, hash)
+	}
+	return nil
+}
@@ -2,11 +2,7 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
-	"crypto/x509"
 	"log"
 
 	"golang.org/x/crypto/ripemd160"
@@ -18,17 +14,30 @@ const addressChecksumLen = 4
 type Wallet struct {
 	PrivKey []byte
 	PubKey  []byte
+
+	// Curve is the name of the curve the key is on, or legacyCurve for a
+	// P-256 key from before secp256k1; see keyCurve.
+	Curve string
+
+	// EncryptedKey replaces PrivKey in an encrypted wallet.
+	EncryptedKey []byte
+
+	// Path is where the key was derived from the wallet's seed, or empty
+	// for a key generated on its own.
+	Path string
 }
 
 func NewWallet() *Wallet {
-	private, public := newKeyPair()
-
-	privateBytes, err := x509.MarshalECPrivateKey(&private)
+	key, err := defaultCurve.newPrivateKey()
+	if err != nil {
+		log.Panic(err)
+	}
+	private, public, err := encodeKeyPair(defaultCurve.name, key)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	return &Wallet{privateBytes, public}
+	return &Wallet{PrivKey: private, PubKey: public, Curve: defaultCurve.name}
 }
 
 func (w Wallet) GetAddress() []byte {
@@ -58,8 +67,19 @@ func HashPubKey(pubKey []byte) []byte {
 	return publicRIPEMD160
 }
 
+// ValidateAddress reports whether address is a well-formed address with a
+// valid checksum.
 func ValidateAddress(address string) bool {
+	for i := 0; i < len(address); i++ {
+		if b58Lookup[address[i]] == -1 {
+			return false
+		}
+	}
+
 	pubKeyHash := Base58Decode([]byte(address))
+	if len(pubKeyHash) != 1+ripemd160.Size+addressChecksumLen {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-addressChecksumLen]
@@ -74,15 +94,3 @@ func checksum(payload []byte) []byte {
 
 	return secondSHA[:addressChecksumLen]
 }
-
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
-	curve := elliptic.P256()
-	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	publicKey := append(privateKey.PublicKey.X.Bytes(), privateKey.PublicKey.Y.Bytes()...)
-
-	return *privateKey, publicKey
-}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted wallet keeps addresses and public keys in the clear, so
+// balances can be looked up while it is locked, but each private key only
+// sealed with AES-256-GCM under a random master key. The master key is in
+// turn sealed under a key derived from the passphrase with scrypt, so
+// changing the passphrase only reseals the master key.
+const (
+	walletKeySize    = 32
+	walletSaltSize   = 16
+	walletKDFR       = 8
+	walletKDFP       = 1
+	walletMasterAAD  = "wallet master key"
+	maxUnlockTimeout = 100_000_000 // seconds, as Bitcoin Core
+)
+
+// walletKDFCost is scrypt's N for newly set passphrases. Tests lower it.
+var walletKDFCost = 1 << 15
+
+var (
+	ErrWalletLocked        = errors.New("wallet is locked")
+	ErrWalletEncrypted     = errors.New("wallet is already encrypted")
+	ErrWalletNotEncrypted  = errors.New("wallet is not encrypted")
+	ErrWrongPassphrase     = errors.New("the wallet passphrase entered was incorrect")
+	ErrEmptyPassphrase     = errors.New("passphrase cannot be empty")
+	errWalletKeyCorruption = errors.New("wallet key does not decrypt")
+)
+
+// WalletEncryption is the sealed master key and how to derive the key that
+// opens it from the passphrase.
+type WalletEncryption struct {
+	Salt      []byte
+	N, R, P   int
+	MasterKey []byte // nonce and ciphertext
+}
+
+// newWalletEncryption seals masterKey under passphrase with a fresh salt.
+func newWalletEncryption(passphrase, masterKey []byte) (*WalletEncryption, error) {
+	enc := &WalletEncryption{Salt: make([]byte, walletSaltSize), N: walletKDFCost, R: walletKDFR, P: walletKDFP}
+	if _, err := rand.Read(enc.Salt); err != nil {
+		return nil, err
+	}
+
+	key, err := enc.passphraseKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if enc.MasterKey, err = seal(key, masterKey, []byte(walletMasterAAD)); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+func (enc *WalletEncryption) passphraseKey(passphrase []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, enc.Salt, enc.N, enc.R, enc.P, walletKeySize)
+}
+
+// open returns the master key if passphrase is right.
+func (enc *WalletEncryption) open(passphrase []byte) ([]byte, error) {
+	key, err := enc.passphraseKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := unseal(key, enc.MasterKey, []byte(walletMasterAAD))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return masterKey, nil
+}
+
+// seal encrypts plaintext with AES-256-GCM, authenticating aad too, and
+// returns the random nonce followed by the ciphertext.
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func unseal(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errWalletKeyCorruption
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncrypted reports whether the wallet's private keys are encrypted.
+func (ws *Wallets) IsEncrypted() bool {
+	return ws.Encryption != nil
+}
+
+// Encrypt seals every private key and the seed under a new master key,
+// itself sealed under passphrase, and forgets the plaintext.
+func (ws *Wallets) Encrypt(passphrase []byte) error {
+	if ws.IsEncrypted() {
+		return ErrWalletEncrypted
+	}
+	if len(passphrase) == 0 {
+		return ErrEmptyPassphrase
+	}
+
+	masterKey := make([]byte, walletKeySize)
+	if _, err := rand.Read(masterKey); err != nil {
+		return err
+	}
+	enc, err := newWalletEncryption(passphrase, masterKey)
+	if err != nil {
+		return err
+	}
+
+	sealed := make(map[string][]byte, len(ws.Wallets))
+	for address, wallet := range ws.Wallets {
+		if sealed[address], err = seal(masterKey, wallet.PrivKey, wallet.PubKey); err != nil {
+			return err
+		}
+	}
+	var sealedSecret []byte
+	if ws.IsHD() {
+		if sealedSecret, err = seal(masterKey, ws.HD.secret(), []byte(hdSecretAAD)); err != nil {
+			return err
+		}
+	}
+
+	for address, wallet := range ws.Wallets {
+		clear(wallet.PrivKey)
+		wallet.PrivKey = nil
+		wallet.EncryptedKey = sealed[address]
+	}
+	if ws.IsHD() {
+		ws.HD.Mnemonic, ws.HD.Passphrase = "", ""
+		ws.HD.EncryptedSecret = sealedSecret
+	}
+	ws.Encryption = enc
+	return nil
+}
+
+// Unlock returns the master key that passphrase opens.
+func (ws *Wallets) Unlock(passphrase []byte) ([]byte, error) {
+	if !ws.IsEncrypted() {
+		return nil, ErrWalletNotEncrypted
+	}
+	return ws.Encryption.open(passphrase)
+}
+
+// ChangePassphrase reseals the master key under newPassphrase.
+func (ws *Wallets) ChangePassphrase(oldPassphrase, newPassphrase []byte) error {
+	if len(newPassphrase) == 0 {
+		return ErrEmptyPassphrase
+	}
+	masterKey, err := ws.Unlock(oldPassphrase)
+	if err != nil {
+		return err
+	}
+	defer clear(masterKey)
+
+	enc, err := newWalletEncryption(newPassphrase, masterKey)
+	if err != nil {
+		return err
+	}
+	ws.Encryption = enc
+	return nil
+}
+
+// PrivateKey returns the private key of address, decrypting it with
+// masterKey if the wallet is encrypted.
+func (ws *Wallets) PrivateKey(address string, masterKey []byte) ([]byte, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+	if !ws.IsEncrypted() {
+		return wallet.PrivKey, nil
+	}
+	if masterKey == nil {
+		return nil, ErrWalletLocked
+	}
+
+	key, err := unseal(masterKey, wallet.EncryptedKey, wallet.PubKey)
+	if err != nil {
+		return nil, errWalletKeyCorruption
+	}
+	return key, nil
+}
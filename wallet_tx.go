@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// dustThreshold is the smallest change output the wallet makes. Less change
+// would cost about as much to spend as it is worth, so it is left to the
+// miner, and coin selection may overshoot by up to that much instead of
+// making change.
+const dustThreshold = 2
+
+// CreateTransaction pays amount to address out of coins, which must pay to
+// the wallet's addresses, leaving fee to the miner, and signs every input
+// with the wallet's keys. Change goes to changeAddress, or if that is empty
+// to the address of the first coin spent. It also returns the change below
+// dustThreshold that was left to the miner on top of fee.
+func (ws *Wallets) CreateTransaction(coins []UnspentOutput, address string, amount, fee int64, changeAddress string, masterKey []byte) (*Transaction, int64, error) {
+	if !ValidateAddress(address) {
+		return nil, 0, fmt.Errorf("invalid address %q", address)
+	}
+	if amount <= 0 || amount > maxMoney {
+		return nil, 0, fmt.Errorf("amount %d out of range", amount)
+	}
+	if fee < 0 || fee > maxMoney {
+		return nil, 0, fmt.Errorf("fee %d out of range", fee)
+	}
+	if ws.IsEncrypted() && masterKey == nil {
+		return nil, 0, ErrWalletLocked
+	}
+
+	selected, err := selectCoins(coins, amount+fee, dustThreshold-1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tx := &Transaction{Version: 1}
+	var prevOuts []TxOut
+	var total int64
+	for _, coin := range selected {
+		tx.Vin = append(tx.Vin, TxIn{PrevTxID: coin.TxID, Vout: coin.Vout, Sequence: 0xffffffff})
+		prevOuts = append(prevOuts, coin.Coin.Out)
+		total += coin.Coin.Out.Value
+	}
+
+	tx.Vout = append(tx.Vout, TxOut{Value: amount, ScriptPubKey: []byte(address)})
+	change := total - amount - fee
+	if change >= dustThreshold {
+		script := []byte(changeAddress)
+		if changeAddress == "" {
+			script = prevOuts[0].ScriptPubKey
+		}
+		tx.Vout = append(tx.Vout, TxOut{Value: change, ScriptPubKey: script})
+		change = 0
+	}
+
+	if err := ws.SignTransaction(tx, prevOuts, masterKey); err != nil {
+		return nil, 0, err
+	}
+	return tx, change, nil
+}
+
+// SignTransaction signs every input of tx, whose spent outputs are
+// prevOuts, with the key of the address it pays, and checks the result.
+func (ws *Wallets) SignTransaction(tx *Transaction, prevOuts []TxOut, masterKey []byte) error {
+	if len(prevOuts) != len(tx.Vin) {
+		return errors.New("an output must be given for every input")
+	}
+
+	for i, prevOut := range prevOuts {
+		address := string(prevOut.ScriptPubKey)
+		wallet, ok := ws.Wallets[address]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrWalletNotFound, address)
+		}
+		privKey, err := ws.PrivateKey(address, masterKey)
+		if err != nil {
+			return err
+		}
+		if err := signInput(tx, i, prevOut, wallet.Curve, privKey, wallet.PubKey); err != nil {
+			return err
+		}
+	}
+
+	for i, prevOut := range prevOuts {
+		if err := VerifyInput(tx, i, prevOut); err != nil {
+			return err
+		}
+	}
+	return nil
+}
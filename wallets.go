@@ -4,16 +4,24 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 )
 
 const walletFile = "wallet_%s.dat"
 
+var ErrWalletNotFound = errors.New("address is not in the wallet")
+
 type Wallets struct {
 	Wallets map[string]*Wallet
+
+	// HD is the seed keys are derived from, if the wallet has one.
+	HD *HDChain
+
+	// Encryption is set once the wallet is encrypted; see Encrypt.
+	Encryption *WalletEncryption
 }
 
 func NewWallets(nodeID string) (*Wallets, error) {
@@ -25,13 +33,42 @@ func NewWallets(nodeID string) (*Wallets, error) {
 	return &wallets, err
 }
 
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+// CreateWallet adds the next key of the wallet's seed and returns its
+// address, first giving the wallet a seed if it has none; keys from before
+// wallets had seeds stay as they are. An encrypted wallet needs its master
+// key to seal the private key with.
+func (ws *Wallets) CreateWallet(masterKey []byte) (string, error) {
+	if ws.IsEncrypted() && masterKey == nil {
+		return "", ErrWalletLocked
+	}
+
+	if !ws.IsHD() {
+		if err := ws.NewSeed(defaultCurve.name, masterKey); err != nil {
+			return "", err
+		}
+	}
+
+	return ws.deriveNext(hdExternal, masterKey)
+}
+
+// addWallet adds wallet, sealing its private key if the wallet is
+// encrypted, and returns its address.
+func (ws *Wallets) addWallet(wallet *Wallet, masterKey []byte) (string, error) {
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 
+	if ws.IsEncrypted() {
+		sealed, err := seal(masterKey, wallet.PrivKey, wallet.PubKey)
+		if err != nil {
+			return "", err
+		}
+		clear(wallet.PrivKey)
+		wallet.PrivKey = nil
+		wallet.EncryptedKey = sealed
+	}
+
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
 func (ws Wallets) GetWallet(address string) Wallet {
@@ -59,6 +96,8 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 	}
 
 	ws.Wallets = wallets.Wallets
+	ws.HD = wallets.HD
+	ws.Encryption = wallets.Encryption
 
 	return nil
 }
@@ -74,7 +113,14 @@ func (ws Wallets) SaveToFile(nodeID string) {
 		log.Panic(err)
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	// Only the owner may read the keys, even encrypted. Writing a new file
+	// and renaming it also fixes the mode of files from before that.
+	tmp := walletFile + ".new"
+	err = os.WriteFile(tmp, content.Bytes(), 0600)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = os.Rename(tmp, walletFile)
 	if err != nil {
 		log.Panic(err)
 	}
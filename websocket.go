@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// Clients of the RPC server can also connect a WebSocket at /ws, with the
+// same credentials, and speak JSON-RPC 2.0 over it. Besides the ordinary
+// methods it has subscribe and unsubscribe, taking topic names:
+//
+//	newblock         every block connected to the main chain, as getblock
+//	newtx            every transaction entering the mempool or the main chain
+//	address:<addr>   the same, for transactions paying addr
+//	reorg            blocks disconnected from the main chain and their replacements
+//
+// Notifications are JSON-RPC notifications whose method is the topic and
+// whose params are the data. A client that does not read them fast enough is
+// disconnected rather than held in memory.
+const (
+	wsPath        = "/ws"
+	wsSendQueue   = 256
+	wsEventQueue  = 1024
+	maxWSMessage  = 1 << 16
+	maxWSTopics   = 1000
+	topicNewBlock = "newblock"
+	topicNewTx    = "newtx"
+	topicReorg    = "reorg"
+	topicAddress  = "address:"
+)
+
+type wsNotification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type reorgResult struct {
+	ForkHash     string   `json:"forkhash"`
+	ForkHeight   int      `json:"forkheight"`
+	Disconnected []string `json:"disconnected"` // tip first
+	Connected    []string `json:"connected"`    // oldest first
+}
+
+// wsNotifier follows the chain and mempool for the WebSocket clients.
+type wsNotifier struct {
+	rpc   *RPCServer
+	chain *Blockchain
+
+	sub *Subscription
+
+	// mu orders notifications and guards the blocks of the tip change in
+	// progress.
+	mu           sync.Mutex
+	clients      map[*wsClient]struct{}
+	disconnected []*BlockIndexEntry
+	connected    []BlockConnected
+}
+
+type wsClient struct {
+	conn *websocket.Conn
+	send chan []byte
+	quit chan struct{}
+
+	mu     sync.Mutex
+	topics map[string]bool
+	closed bool
+}
+
+func newWSNotifier(rpc *RPCServer) *wsNotifier {
+	n := &wsNotifier{
+		rpc:     rpc,
+		chain:   rpc.chain,
+		clients: make(map[*wsClient]struct{}),
+	}
+	n.sub = rpc.chain.Events().SubscribeAsync(wsEventQueue, n.handleEvent)
+	return n
+}
+
+// ServeHTTP upgrades an authenticated request to a WebSocket. Browsers send
+// basic auth along to any site, so requests from pages of another origin are
+// refused.
+func (n *wsNotifier) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !n.rpc.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			var err error
+			if config.Origin, err = websocket.Origin(config, req); err != nil {
+				return err
+			}
+			if config.Origin != nil && config.Origin.Host != req.Host {
+				return fmt.Errorf("origin %s not allowed", config.Origin)
+			}
+			return nil
+		},
+		Handler: n.serveClient,
+	}
+	server.ServeHTTP(w, req)
+}
+
+func (n *wsNotifier) serveClient(conn *websocket.Conn) {
+	conn.MaxPayloadBytes = maxWSMessage
+	c := &wsClient{
+		conn:   conn,
+		send:   make(chan []byte, wsSendQueue),
+		quit:   make(chan struct{}),
+		topics: make(map[string]bool),
+	}
+
+	n.mu.Lock()
+	n.clients[c] = struct{}{}
+	n.mu.Unlock()
+	defer n.remove(c)
+
+	go c.writeLoop()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			return
+		}
+		if resp := n.handleRequest(c, data); resp != nil {
+			encoded, err := json.Marshal(resp)
+			if err != nil {
+				log.Printf("websocket: %v", err)
+				return
+			}
+			if !c.queue(encoded) {
+				return
+			}
+		}
+	}
+}
+
+// handleRequest runs subscribe and unsubscribe itself and passes anything
+// else on to the RPC server.
+func (n *wsNotifier) handleRequest(c *wsClient, raw []byte) *rpcResponse {
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || (req.Method != "subscribe" && req.Method != "unsubscribe") {
+		return n.rpc.handleRequest(raw)
+	}
+	if req.JSONRPC != "2.0" {
+		return errorResponse(req.ID, rpcErrorf(rpcInvalidRequest, "invalid request"))
+	}
+
+	var topics []string
+	for _, param := range req.Params {
+		var topic string
+		if err := json.Unmarshal(param, &topic); err != nil {
+			return errorResponse(req.ID, rpcErrorf(rpcInvalidParams, "topics must be strings"))
+		}
+		if err := validateTopic(topic); err != nil {
+			return errorResponse(req.ID, rpcErrorf(rpcInvalidParameter, "%v", err))
+		}
+		topics = append(topics, topic)
+	}
+
+	c.mu.Lock()
+	if req.Method == "subscribe" {
+		added := make(map[string]bool)
+		for _, topic := range topics {
+			if !c.topics[topic] {
+				added[topic] = true
+			}
+		}
+		if len(c.topics)+len(added) > maxWSTopics {
+			c.mu.Unlock()
+			return errorResponse(req.ID, rpcErrorf(rpcInvalidParameter, "more than %d topics", maxWSTopics))
+		}
+	}
+	for _, topic := range topics {
+		if req.Method == "subscribe" {
+			c.topics[topic] = true
+		} else {
+			delete(c.topics, topic)
+		}
+	}
+	c.mu.Unlock()
+
+	if req.ID == nil {
+		return nil
+	}
+	return &rpcResponse{JSONRPC: "2.0", Result: json.RawMessage("true"), ID: req.ID}
+}
+
+func validateTopic(topic string) error {
+	switch topic {
+	case topicNewBlock, topicNewTx, topicReorg:
+		return nil
+	}
+	if address, ok := strings.CutPrefix(topic, topicAddress); ok {
+		if !ValidateAddress(address) {
+			return fmt.Errorf("invalid address %q", address)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown topic %q", topic)
+}
+
+func (c *wsClient) subscribed(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.topics[topic]
+}
+
+// queue hands data to the write loop, closing the connection instead if the
+// client has fallen too far behind.
+func (c *wsClient) queue(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- data:
+		return true
+	default:
+		c.closeLocked()
+		return false
+	}
+}
+
+func (c *wsClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeLocked()
+}
+
+func (c *wsClient) closeLocked() {
+	if !c.closed {
+		c.closed = true
+		close(c.quit)
+		c.conn.Close()
+	}
+}
+
+func (c *wsClient) writeLoop() {
+	for {
+		select {
+		case data := <-c.send:
+			if err := websocket.Message.Send(c.conn, string(data)); err != nil {
+				c.close()
+				return
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (n *wsNotifier) remove(c *wsClient) {
+	n.mu.Lock()
+	delete(n.clients, c)
+	n.mu.Unlock()
+
+	c.close()
+}
+
+// close disconnects every client.
+func (n *wsNotifier) close() {
+	n.sub.Unsubscribe()
+
+	n.mu.Lock()
+	clients := n.clients
+	n.clients = make(map[*wsClient]struct{})
+	n.mu.Unlock()
+
+	for c := range clients {
+		c.close()
+	}
+}
+
+// notify sends a notification on topic to the clients subscribed to it.
+// Callers hold n.mu, so notifications arrive in order.
+func (n *wsNotifier) notify(topic string, params any) {
+	var encoded []byte
+	for c := range n.clients {
+		if !c.subscribed(topic) {
+			continue
+		}
+		if encoded == nil {
+			var err error
+			encoded, err = json.Marshal(&wsNotification{JSONRPC: "2.0", Method: topic, Params: params})
+			if err != nil {
+				log.Printf("websocket: %v", err)
+				return
+			}
+		}
+		c.queue(encoded)
+	}
+}
+
+// notifyTx sends tx, from block or else the mempool, to the newtx topic and
+// the topics of the addresses it pays.
+func (n *wsNotifier) notifyTx(tx *Transaction, block *Block) {
+	res := newBlockTxResult(n.chain, tx, block)
+	n.notify(topicNewTx, res)
+
+	seen := make(map[string]bool)
+	for _, out := range tx.Vout {
+		address := scriptAddress(out.ScriptPubKey)
+		if address != "" && !seen[address] {
+			seen[address] = true
+			n.notify(topicAddress+address, res)
+		}
+	}
+}
+
+// handleEvent turns the chain's events into notifications. The blocks of a
+// tip change are held back until its TipChanged, so a reorg is announced
+// before the blocks replacing the old ones.
+func (n *wsNotifier) handleEvent(e Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch e := e.(type) {
+	case TxAcceptedToMempool:
+		n.notifyTx(e.Desc.Tx, nil)
+	case BlockDisconnected:
+		n.disconnected = append(n.disconnected, e.Entry)
+	case BlockConnected:
+		n.connected = append(n.connected, e)
+	case TipChanged:
+		n.tipChanged()
+	}
+}
+
+// tipChanged sends the notifications for the blocks gathered since the last
+// tip change. The caller holds n.mu.
+func (n *wsNotifier) tipChanged() {
+	disconnected, connected := n.disconnected, n.connected
+	n.disconnected, n.connected = nil, nil
+
+	if len(disconnected) > 0 {
+		last := disconnected[len(disconnected)-1]
+		res := reorgResult{ForkHeight: last.Height - 1, Disconnected: []string{}, Connected: []string{}}
+		if last.Height > 0 {
+			res.ForkHash = hex.EncodeToString(last.Header.PrevBlockHash)
+		}
+		for _, entry := range disconnected {
+			res.Disconnected = append(res.Disconnected, hex.EncodeToString(entry.Hash()))
+		}
+		for _, e := range connected {
+			res.Connected = append(res.Connected, hex.EncodeToString(e.Entry.Hash()))
+		}
+		n.notify(topicReorg, res)
+	}
+
+	for _, e := range connected {
+		n.notify(topicNewBlock, newBlockResult(n.chain, e.Entry, e.Block, false))
+		for _, tx := range e.Block.Transactions {
+			n.notifyTx(tx, e.Block)
+		}
+	}
+}